@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"ows/ledger"
+)
+
+func handleShowChangeSet(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(1)(cmd, args); err != nil {
+		return err
+	}
+
+	l := state.ledger()
+
+	info, err := l.DescribeChangeSet(ledger.ChangeSetID(args[0]))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("ID: %s\n", info.ID)
+	fmt.Printf("Index: %d\n", info.Index)
+	fmt.Printf("Prev: %s\n", info.ChangeSet.Prev)
+	fmt.Printf("Version: %d\n", info.ChangeSet.Version)
+
+	if !info.ChangeSet.Timestamp.IsZero() {
+		fmt.Printf("Timestamp: %s\n", info.ChangeSet.Timestamp.Format(time.RFC3339))
+	}
+
+	if !info.ChangeSet.ValidUntil.IsZero() {
+		fmt.Printf("ValidUntil: %s\n", info.ChangeSet.ValidUntil.Format(time.RFC3339))
+	}
+
+	if info.ChangeSet.Message != "" {
+		fmt.Printf("Message: %s\n", info.ChangeSet.Message)
+	}
+
+	for _, id := range info.Signers {
+		fmt.Printf("Signer: %s\n", id)
+	}
+
+	for _, a := range info.ChangeSet.Actions {
+		fmt.Printf("Action: %s %s\n", actionName(a), formatValue(a))
+	}
+
+	for _, id := range info.Created {
+		fmt.Printf("Created: %s\n", id)
+	}
+
+	for _, id := range info.Removed {
+		fmt.Printf("Removed: %s\n", id)
+	}
+
+	return nil
+}
+
+func handleDiffLedger(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(2)(cmd, args); err != nil {
+		return err
+	}
+
+	l := state.ledger()
+
+	diffs, err := l.Diff(ledger.ChangeSetID(args[0]), ledger.ChangeSetID(args[1]))
+	if err != nil {
+		return err
+	}
+
+	for _, d := range diffs {
+		if d.Before == nil {
+			fmt.Printf("+ %s %s\n", d.ID, formatValue(d.After))
+		} else if d.After == nil {
+			fmt.Printf("- %s %s\n", d.ID, formatValue(d.Before))
+		} else {
+			fmt.Printf("~ %s %s -> %s\n", d.ID, formatValue(d.Before), formatValue(d.After))
+		}
+	}
+
+	return nil
+}
+
+func handleBlameResource(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(1)(cmd, args); err != nil {
+		return err
+	}
+
+	id := ledger.ResourceID(args[0])
+	l := state.ledger()
+
+	if l.Pruned {
+		fmt.Fprintf(os.Stderr, "warning: the ledger is pruned, change sets before %s aren't listed\n", l.Checkpoint.Head())
+	}
+
+	indices, err := l.Blame(id)
+	if err != nil {
+		return err
+	}
+
+	ids := l.IDChain().IDs
+
+	for _, i := range indices {
+		cs, _ := l.ChangeAt(i)
+
+		names := []string{}
+		for _, a := range cs.Actions {
+			names = append(names, actionName(a))
+		}
+
+		fmt.Printf("%d %s signers=%s actions=%s\n", i, ids[i], joinIDs(cs.Signers()), strings.Join(names, ","))
+	}
+
+	return nil
+}
+
+func handleShowLedgerState(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(0)(cmd, args); err != nil {
+		return err
+	}
+
+	l := state.ledger()
+	s := l.Snapshot
+
+	if atChangeSetID != "" {
+		var err error
+
+		s, err = l.SnapshotAt(ledger.ChangeSetID(atChangeSetID))
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Head: %s\n", s.Head)
+	fmt.Printf("Version: %d\n", s.Version)
+	fmt.Printf("Consensus: %t\n", s.Consensus)
+	fmt.Printf("Metrics: %s\n", formatValue(s.Metrics))
+
+	printResources("Function", s.Functions)
+	printResources("Gateway", s.Gateways)
+	printResources("Node", s.Nodes)
+	printResources("Policy", s.Policies)
+	printResources("User", s.Users)
+
+	return nil
+}
+
+// Prints one resource per line, sorted by id.
+func printResources[C any](kind string, resources map[ledger.ResourceID]C) {
+	ids := make([]ledger.ResourceID, 0, len(resources))
+
+	for id := range resources {
+		ids = append(ids, id)
+	}
+
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		fmt.Printf("%s: %s %s\n", kind, id, formatValue(resources[id]))
+	}
+}
+
+func handleRevertChangeSet(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(1)(cmd, args); err != nil {
+		return err
+	}
+
+	l := state.ledger()
+
+	actions, err := l.Revert(ledger.ChangeSetID(strings.TrimSpace(args[0])))
+	if err != nil {
+		return fmt.Errorf("unable to revert %s (%v)", args[0], err)
+	}
+
+	for _, a := range actions {
+		fmt.Printf("Action: %s %s\n", actionName(a), formatValue(a))
+	}
+
+	return state.appendActions(actions...)
+}
+
+func actionName(a ledger.Action) string {
+	return a.Category() + ":" + a.Name()
+}
+
+func joinIDs(ids []ledger.UserID) string {
+	strs := make([]string, len(ids))
+
+	for i, id := range ids {
+		strs[i] = string(id)
+	}
+
+	return strings.Join(strs, ",")
+}
+
+// Formats actions and resource configs on a single line. Unlike "%+v",
+// pointers are followed, zero fields are omitted and bytes are hex encoded.
+func formatValue(v any) string {
+	return formatReflectValue(reflect.ValueOf(v))
+}
+
+func formatReflectValue(v reflect.Value) string {
+	if !v.IsValid() {
+		return "<nil>"
+	}
+
+	if v.Kind() != reflect.Pointer && v.CanInterface() {
+		if s, ok := v.Interface().(fmt.Stringer); ok {
+			return s.String()
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return "<nil>"
+		}
+
+		return formatReflectValue(v.Elem())
+	case reflect.Struct:
+		fields := []string{}
+
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+
+			if !f.IsExported() || v.Field(i).IsZero() {
+				continue
+			}
+
+			fields = append(fields, f.Name+"="+formatReflectValue(v.Field(i)))
+		}
+
+		return "{" + strings.Join(fields, " ") + "}"
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			return hex.EncodeToString(v.Bytes())
+		}
+
+		items := make([]string, v.Len())
+
+		for i := range items {
+			items[i] = formatReflectValue(v.Index(i))
+		}
+
+		return "[" + strings.Join(items, " ") + "]"
+	case reflect.Map:
+		items := []string{}
+
+		for _, k := range v.MapKeys() {
+			items = append(items, formatReflectValue(k)+":"+formatReflectValue(v.MapIndex(k)))
+		}
+
+		slices.Sort(items)
+
+		return "map[" + strings.Join(items, " ") + "]"
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"os"
 	"path"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"ows/ledger"
+	"ows/network"
 	"ows/resources"
 )
 
@@ -26,6 +32,48 @@ var (
 	isOffline  bool
 	apiPort    uint16 // can't be of type ledger.Port, because cobra flags doesn't accept that
 	onlyIDs    bool   // only display IDs when listing resources (easier when parsing stdout with other tools)
+
+	// gateway endpoint authorizer flags
+	apiKeys        []string
+	authorizerFnID string
+	jwksURL        string
+	jwtAudience    string
+	jwtIssuer      string
+	jwtKeyPaths    []string
+
+	// gateway rate limit flags
+	isClusterWide   bool
+	rateLimitMethod string
+	rateLimitPath   string
+
+	// ledger history flags
+	atChangeSetID string
+
+	// change set metadata flags
+	changeSetMessage  string
+	changeSetValidFor time.Duration
+
+	// metrics flags
+	metricsAllowedNetworks []string
+
+	// signer flags
+	signerSpec string
+
+	// gateway CORS flags
+	corsOrigins       []string
+	corsMethods       []string
+	corsHeaders       []string
+	corsExposeHeaders []string
+	corsMaxAge        uint
+	corsCredentials   bool
+
+	// gateway endpoint transform flags
+	setRequestHeaders     []string
+	removeRequestHeaders  []string
+	setResponseHeaders    []string
+	removeResponseHeaders []string
+	requestTemplatePath   string
+	responseTemplatePath  string
 )
 
 func main() {
@@ -45,11 +93,14 @@ func makeCLI() *cobra.Command {
 	cli.AddCommand(makeGatewaysCLI())
 	cli.AddCommand(makeKeyCLI())
 	cli.AddCommand(makeLedgerCLI())
+	cli.AddCommand(makeMetricsCLI())
 	cli.AddCommand(makeNodesCLI())
 	cli.AddCommand(makeProjectsCLI())
 	cli.AddCommand(makeVersionCommand())
 
 	cli.PersistentFlags().StringVar(&(state.testDir), "test-dir", "", "test directory")
+	cli.PersistentFlags().StringVarP(&changeSetMessage, "message", "m", "", "message describing the submitted change set")
+	cli.PersistentFlags().DurationVar(&changeSetValidFor, "valid-for", 0, "nodes refuse the submitted change set after this duration (eg. 10m)")
 
 	return cli
 }
@@ -124,6 +175,55 @@ func makeGatewaysCLI() *cobra.Command {
 		RunE:  handleRemoveGateway,
 	})
 
+	gatewaysCLI.AddCommand(&cobra.Command{
+		Use:   "update <gateway-id> <port>",
+		Short: "Change the port of a gateway",
+		RunE:  handleUpdateGateway,
+	})
+
+	gatewaysCLI.AddCommand(&cobra.Command{
+		Use:   "stats <gateway-id>",
+		Short: "Show the request stats of each gateway endpoint, aggregated across all nodes",
+		RunE:  handleShowGatewayStats,
+	})
+
+	rateLimitCmd := &cobra.Command{
+		Use:   "rate-limit <gateway-id> <requests-per-second> <burst>",
+		Short: "Set the rate limit of a gateway or of one of its endpoints (0 requests per second removes it)",
+		RunE:  handleSetGatewayRateLimit,
+	}
+
+	rateLimitCmd.Flags().BoolVar(&isClusterWide, "cluster", false, "enforce the limit across all nodes")
+	rateLimitCmd.Flags().StringVar(&rateLimitMethod, "method", "", "endpoint method (gateway-wide if not set)")
+	rateLimitCmd.Flags().StringVar(&rateLimitPath, "path", "", "endpoint path (gateway-wide if not set)")
+
+	gatewaysCLI.AddCommand(rateLimitCmd)
+
+	quotaCmd := &cobra.Command{
+		Use:   "quota <gateway-id> <api-key> <limit> <period-seconds>",
+		Short: "Set the request quota of an API key (0 limit removes it)",
+		RunE:  handleSetGatewayAPIKeyQuota,
+	}
+
+	quotaCmd.Flags().BoolVar(&isClusterWide, "cluster", false, "enforce the quota across all nodes")
+
+	gatewaysCLI.AddCommand(quotaCmd)
+
+	corsCmd := &cobra.Command{
+		Use:   "cors <gateway-id>",
+		Short: "Set the CORS configuration of a gateway (no --origin removes it)",
+		RunE:  handleSetGatewayCORS,
+	}
+
+	corsCmd.Flags().StringArrayVar(&corsOrigins, "origin", []string{}, "allowed origin, or * for any origin")
+	corsCmd.Flags().StringArrayVar(&corsMethods, "method", []string{}, "allowed method (defaults to the methods of the requested path)")
+	corsCmd.Flags().StringArrayVar(&corsHeaders, "header", []string{}, "allowed request header")
+	corsCmd.Flags().StringArrayVar(&corsExposeHeaders, "expose-header", []string{}, "response header exposed to the browser")
+	corsCmd.Flags().UintVar(&corsMaxAge, "max-age", 0, "number of seconds preflight responses can be cached")
+	corsCmd.Flags().BoolVar(&corsCredentials, "credentials", false, "allow credentials")
+
+	gatewaysCLI.AddCommand(corsCmd)
+
 	endpointsCLI := &cobra.Command{
 		Use:   "endpoints",
 		Short: "Manage gateway endpoints",
@@ -147,6 +247,36 @@ func makeGatewaysCLI() *cobra.Command {
 		RunE:  handleRemoveGatewayEndpoint,
 	})
 
+	authorizeCmd := &cobra.Command{
+		Use:   "authorize <gateway-id> <method> <path> <api-key|jwt|ows-key|function|none>",
+		Short: "Set or remove the authorizer of a gateway endpoint",
+		RunE:  handleSetGatewayEndpointAuthorizer,
+	}
+
+	authorizeCmd.Flags().StringArrayVar(&apiKeys, "api-key", []string{}, "allowed API key (a random key is generated if none is given)")
+	authorizeCmd.Flags().StringVar(&authorizerFnID, "fn", "", "authorizer function id")
+	authorizeCmd.Flags().StringVar(&jwksURL, "jwks-url", "", "JWKS URL used to validate JWTs")
+	authorizeCmd.Flags().StringVar(&jwtAudience, "jwt-audience", "", "required JWT audience")
+	authorizeCmd.Flags().StringVar(&jwtIssuer, "jwt-issuer", "", "required JWT issuer")
+	authorizeCmd.Flags().StringArrayVar(&jwtKeyPaths, "jwt-key", []string{}, "path to PEM encoded public key used to validate JWTs")
+
+	endpointsCLI.AddCommand(authorizeCmd)
+
+	transformCmd := &cobra.Command{
+		Use:   "transform <gateway-id> <method> <path>",
+		Short: "Set the header policies and mapping templates of a gateway endpoint (no flags removes them)",
+		RunE:  handleSetGatewayEndpointTransform,
+	}
+
+	transformCmd.Flags().StringArrayVar(&setRequestHeaders, "set-request-header", []string{}, "request header to set, as <name>:<value>")
+	transformCmd.Flags().StringArrayVar(&removeRequestHeaders, "remove-request-header", []string{}, "request header to remove")
+	transformCmd.Flags().StringArrayVar(&setResponseHeaders, "set-response-header", []string{}, "response header to set, as <name>:<value>")
+	transformCmd.Flags().StringArrayVar(&removeResponseHeaders, "remove-response-header", []string{}, "response header to remove")
+	transformCmd.Flags().StringVar(&requestTemplatePath, "request-template", "", "path to template rendering the JSON function argument")
+	transformCmd.Flags().StringVar(&responseTemplatePath, "response-template", "", "path to template rendering the response body")
+
+	endpointsCLI.AddCommand(transformCmd)
+
 	gatewaysCLI.AddCommand(endpointsCLI)
 
 	return withProjectFlags(gatewaysCLI)
@@ -170,6 +300,12 @@ func makeKeyCLI() *cobra.Command {
 		RunE:  handleInitClientKey,
 	})
 
+	keyCLI.AddCommand(&cobra.Command{
+		Use:   "passwd",
+		Short: fmt.Sprintf("Change the passphrase used to encrypt %s", state.keyPairPath()),
+		RunE:  handleChangeKeyPassphrase,
+	})
+
 	keyCLI.AddCommand(&cobra.Command{
 		Use:   "phrase",
 		Short: "Show 24-word key phrase for backup",
@@ -182,6 +318,12 @@ func makeKeyCLI() *cobra.Command {
 		RunE:  handleRestoreKey,
 	})
 
+	keyCLI.AddCommand(withProjectFlags(&cobra.Command{
+		Use:   "rotate",
+		Short: "Replace the client key by a new random key, keeping the root status and policies of the user",
+		RunE:  handleRotateKey,
+	}))
+
 	keyCLI.AddCommand(&cobra.Command{
 		Use:   "set",
 		Short: "Set client key using hex or base64 encoded ed25519 private key",
@@ -194,6 +336,12 @@ func makeKeyCLI() *cobra.Command {
 		RunE:  handleShowKey,
 	})
 
+	keyCLI.AddCommand(withProjectFlags(&cobra.Command{
+		Use:   "signer [key|ssh-agent[:<public-key>]|pkcs11:<module-path>:<key-id-hex>[:<token-label>]]",
+		Short: "Show or set the signer used for the project",
+		RunE:  handleSigner,
+	}))
+
 	return keyCLI
 }
 
@@ -203,10 +351,60 @@ func makeLedgerCLI() *cobra.Command {
 		Short: "Query project ledger",
 	}
 
-	ledgerCLI.AddCommand(&cobra.Command{
+	listChangeSetsCmd := &cobra.Command{
 		Use:   "list",
-		Short: "List project ledger change set IDs",
+		Short: "List project ledger change sets, with their timestamp, signers and message",
 		RunE:  handleListLedgerChangeSets,
+	}
+
+	listChangeSetsCmd.Flags().BoolVar(&onlyIDs, "only-ids", false, "only show IDs")
+
+	ledgerCLI.AddCommand(listChangeSetsCmd)
+
+	ledgerCLI.AddCommand(&cobra.Command{
+		Use:   "show <change-set-id>",
+		Short: "Show the actions and signers of a change set, and the resources it created or removed",
+		RunE:  handleShowChangeSet,
+	})
+
+	ledgerCLI.AddCommand(&cobra.Command{
+		Use:   "diff <change-set-id> <change-set-id>",
+		Short: "Show the resources that changed between two change sets",
+		RunE:  handleDiffLedger,
+	})
+
+	ledgerCLI.AddCommand(&cobra.Command{
+		Use:   "blame <resource-id>",
+		Short: "List the change sets that created, changed or removed a resource (use * for project-wide settings)",
+		RunE:  handleBlameResource,
+	})
+
+	ledgerCLI.AddCommand(&cobra.Command{
+		Use:   "revert <change-set-id>",
+		Short: "Submit a new change set that undoes the given change set",
+		RunE:  handleRevertChangeSet,
+	})
+
+	ledgerCLI.AddCommand(&cobra.Command{
+		Use:   "upgrade [version]",
+		Short: fmt.Sprintf("Upgrade the ledger version (defaults to %d, requires a root user)", ledger.LatestLedgerVersion),
+		RunE:  handleUpgradeLedger,
+	})
+
+	stateCmd := &cobra.Command{
+		Use:   "state",
+		Short: "Show the functions, gateways, nodes, policies and users of the project",
+		RunE:  handleShowLedgerState,
+	}
+
+	stateCmd.Flags().StringVar(&atChangeSetID, "at", "", "show the state right after the given change set instead of the current state")
+
+	ledgerCLI.AddCommand(stateCmd)
+
+	ledgerCLI.AddCommand(&cobra.Command{
+		Use:   "orphans",
+		Short: "List change sets that were rolled back by the nodes when resolving forks",
+		RunE:  handleListOrphans,
 	})
 
 	ledgerCLI.AddCommand(&cobra.Command{
@@ -218,6 +416,25 @@ func makeLedgerCLI() *cobra.Command {
 	return withProjectFlags(ledgerCLI)
 }
 
+func makeMetricsCLI() *cobra.Command {
+	metricsCLI := &cobra.Command{
+		Use:   "metrics",
+		Short: "Configure node metrics",
+	}
+
+	configureCmd := &cobra.Command{
+		Use:   "configure <port>",
+		Short: "Serve the metrics of every node on the given port (0 disables metrics)",
+		RunE:  handleConfigureMetrics,
+	}
+
+	configureCmd.Flags().StringArrayVar(&metricsAllowedNetworks, "allow", []string{}, "network allowed to read metrics without a client certificate (CIDR notation)")
+
+	metricsCLI.AddCommand(configureCmd)
+
+	return withProjectFlags(metricsCLI)
+}
+
 func makeProjectsCLI() *cobra.Command {
 	projectsCLI := &cobra.Command{
 		Use:   "projects",
@@ -244,6 +461,7 @@ func makeProjectsCLI() *cobra.Command {
 
 	newProjectCmd.Flags().Uint16Var(&gossipPort, "gossip-port", 0, "0 results in a random port")
 	newProjectCmd.Flags().Uint16Var(&apiPort, "api-port", 0, "0 results in a random port")
+	newProjectCmd.Flags().StringVar(&signerSpec, "signer", "", "signer used for the project (see `ows key signer`)")
 
 	projectsCLI.AddCommand(newProjectCmd)
 
@@ -268,6 +486,18 @@ func makeNodesCLI() *cobra.Command {
 		RunE:  handleListNodes,
 	})
 
+	nodesCLI.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "Show which nodes are online, and whether their ledgers are in sync, lagging or forked",
+		RunE:  handleShowNodesStatus,
+	})
+
+	nodesCLI.AddCommand(&cobra.Command{
+		Use:   "consensus <enable|disable>",
+		Short: "Require change sets to be accepted by a majority of the nodes before they are committed",
+		RunE:  handleConfigureConsensus,
+	})
+
 	addNodeCmd := &cobra.Command{
 		Use:   "add <pubkey> <address>",
 		Short: "Add a node",
@@ -279,6 +509,29 @@ func makeNodesCLI() *cobra.Command {
 
 	nodesCLI.AddCommand(addNodeCmd)
 
+	nodesCLI.AddCommand(&cobra.Command{
+		Use:   "update-address <node-id> <address>",
+		Short: "Change the address of a node",
+		RunE:  handleUpdateNodeAddress,
+	})
+
+	updatePortsCmd := &cobra.Command{
+		Use:   "update-ports <node-id>",
+		Short: "Change the gossip and/or API port of a node",
+		RunE:  handleUpdateNodePorts,
+	}
+
+	updatePortsCmd.Flags().Uint16Var(&apiPort, "api-port", 0, "0 keeps the current port")
+	updatePortsCmd.Flags().Uint16Var(&gossipPort, "gossip-port", 0, "0 keeps the current port")
+
+	nodesCLI.AddCommand(updatePortsCmd)
+
+	nodesCLI.AddCommand(&cobra.Command{
+		Use:   "rotate-key <node-id> <old-private-key> <new-private-key>",
+		Short: "Replace the key of a node, the node keeps its id",
+		RunE:  handleRotateNodeKey,
+	})
+
 	return withProjectFlags(nodesCLI)
 }
 
@@ -421,8 +674,10 @@ func handleAddNode(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("invalid node public key %s (%v)", args[0], err)
 	}
 
-	// TODO: parse internet address
 	address := args[1]
+	if err := ledger.ValidateAddress(address); err != nil {
+		return err
+	}
 
 	if gossipPort != 0 && gossipPort == apiPort {
 		return fmt.Errorf("gossip port can't be equal to api port")
@@ -462,6 +717,61 @@ func handleAddNode(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func handleChangeKeyPassphrase(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(0)(cmd, args); err != nil {
+		return err
+	}
+
+	p := state.keyPairPath()
+
+	kp, err := ledger.ReadKeyPair(p, state.keyPassphrase)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("client key not found at %s", p)
+		} else {
+			return fmt.Errorf("unable to read key at %s (%v)", p, err)
+		}
+	}
+
+	// the keys of the projects that still use an older client key share its
+	// passphrase
+	keys := map[string]*ledger.KeyPair{p: kp}
+	d := path.Join(state.appConfigPath(), ProjectKeysDirName)
+
+	fs, err := os.ReadDir(d)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	for _, f := range fs {
+		fp := path.Join(d, f.Name())
+
+		keys[fp], err = ledger.ReadKeyPair(fp, state.keyPassphrase)
+		if err != nil {
+			return fmt.Errorf("unable to read project key at %s (%v)", fp, err)
+		}
+	}
+
+	pp, err := readNewPassphrase()
+	if err != nil {
+		return err
+	}
+
+	for keyPath, kp := range keys {
+		if err := kp.WriteEncrypted(keyPath, pp); err != nil {
+			return fmt.Errorf("failed to write key to %s (%v)", keyPath, err)
+		}
+	}
+
+	if len(pp) == 0 {
+		fmt.Fprintf(os.Stderr, "key at %s is no longer encrypted\n", p)
+	} else {
+		fmt.Fprintf(os.Stderr, "key at %s is now encrypted\n", p)
+	}
+
+	return nil
+}
+
 func handleCreateNewProject(cmd *cobra.Command, args []string) error {
 	if err := cobra.ExactArgs(3)(cmd, args); err != nil {
 		return err
@@ -489,7 +799,7 @@ func handleCreateNewProject(cmd *cobra.Command, args []string) error {
 	if _, err := os.Stat(mappingPath); err == nil {
 		return fmt.Errorf("project %s already exists (at %s)", projectName, mappingPath)
 	} else if !errors.Is(err, os.ErrNotExist) {
-		return fmt.Errorf("project %s already exists, but failed to read it (%v)", err)
+		return fmt.Errorf("project %s already exists, but failed to read it (%v)", projectName, err)
 	}
 
 	nodePubKey, err := ledger.ParsePublicKey(args[1])
@@ -497,8 +807,10 @@ func handleCreateNewProject(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("invalid node public key %s (%v)", args[1], err)
 	}
 
-	// TODO: parse internet address
 	address := args[2]
+	if err := ledger.ValidateAddress(address); err != nil {
+		return err
+	}
 
 	if gossipPort != 0 && gossipPort == apiPort {
 		return fmt.Errorf("gossip port can't be equal to api port")
@@ -531,14 +843,18 @@ func handleCreateNewProject(cmd *cobra.Command, args []string) error {
 		APIPort:    ledger.Port(apiPort),
 	}
 
-	kp := state.keyPair()
+	if signerSpec == "" {
+		signerSpec = state.signerSpec("")
+	}
 
-	cs := &ledger.ChangeSet{
-		Prev:    "",
-		Actions: []ledger.Action{action},
+	signer, err := newSigner(signerSpec, state.keyPair)
+	if err != nil {
+		return err
 	}
 
-	s, err := kp.SignChangeSet(cs)
+	cs := ledger.NewInitialChangeSet(initialVersion, action)
+
+	s, err := ledger.SignChangeSet(signer, cs)
 	if err != nil {
 		return fmt.Errorf("failed to sign initial config (%v)", err)
 	}
@@ -565,6 +881,12 @@ func handleCreateNewProject(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	if cmd.Flags().Changed("signer") {
+		if err := state.saveSignerSpec(projectID, signerSpec); err != nil {
+			return fmt.Errorf("failed to save signer for %s (%v)", projectName, err)
+		}
+	}
+
 	lp := path.Join(state.projectsDataPath(), string(projectID), LedgerFileName)
 
 	// write ledger
@@ -691,8 +1013,59 @@ func handleListLedgerChangeSets(cmd *cobra.Command, args []string) error {
 	l := state.ledger()
 	chain := l.IDChain()
 
-	for _, id := range chain.IDs {
-		fmt.Println(id)
+	for i, id := range chain.IDs {
+		cs, ok := l.ChangeAt(i)
+
+		if onlyIDs || !ok {
+			fmt.Println(id)
+			continue
+		}
+
+		timestamp := "-"
+		if !cs.Timestamp.IsZero() {
+			timestamp = cs.Timestamp.Format(time.RFC3339)
+		}
+
+		fmt.Printf("%s %s signers=%s", id, timestamp, joinIDs(cs.Signers()))
+
+		if !cs.ValidUntil.IsZero() {
+			fmt.Printf(" valid-until=%s", cs.ValidUntil.Format(time.RFC3339))
+		}
+
+		if cs.Message != "" {
+			fmt.Printf(" %q", cs.Message)
+		}
+
+		fmt.Println()
+	}
+
+	return nil
+}
+
+func handleListOrphans(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(0)(cmd, args); err != nil {
+		return err
+	}
+
+	orphans, errs := state.newAPIClient().Orphans()
+
+	for nodeID, err := range errs {
+		fmt.Fprintf(os.Stderr, "warning: orphans of node %s unavailable (%v)\n", nodeID, err)
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].Time.Before(orphans[j].Time)
+	})
+
+	userID := state.signer().PublicKey().UserID()
+
+	for _, o := range orphans {
+		mine := ""
+		if o.SignedBy(userID) {
+			mine = " (yours)"
+		}
+
+		fmt.Printf("%s %s index=%d node=%s%s\n", o.Time.Format(time.RFC3339), o.ID, o.Index, o.NodeID, mine)
 	}
 
 	return nil
@@ -713,113 +1086,515 @@ func handleListNodes(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func handleShowVersion(cmd *cobra.Command, args []string) error {
-	if err := cobra.ExactArgs(0)(cmd, args); err != nil {
+func handleUpdateNodeAddress(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(2)(cmd, args); err != nil {
 		return err
 	}
 
-	fmt.Println(Version)
+	id := ledger.NodeID(strings.TrimSpace(args[0]))
+	if _, ok := state.ledger().Snapshot.Nodes[id]; !ok {
+		return fmt.Errorf("node %s not found", id)
+	}
 
-	return nil
-}
+	if err := ledger.ValidateAddress(args[1]); err != nil {
+		return err
+	}
 
-type projectsTable struct {
-	rows []projectsTableRow
+	return state.appendActions(ledger.UpdateNodeAddress{ID: id, Address: args[1]})
 }
 
-type projectsTableRow struct {
-	name      string
-	projectID string
-	isDefault bool
-}
+func handleUpdateNodePorts(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(1)(cmd, args); err != nil {
+		return err
+	}
 
-func (t *projectsTable) Len() int {
-	return len(t.rows)
-}
+	id := ledger.NodeID(strings.TrimSpace(args[0]))
 
-func (t *projectsTable) Less(i, j int) bool {
-	a := t.rows[i]
-	b := t.rows[j]
+	conf, ok := state.ledger().Snapshot.Nodes[id]
+	if !ok {
+		return fmt.Errorf("node %s not found", id)
+	}
 
-	return a.name < b.name
-}
+	action := ledger.UpdateNodePorts{
+		ID:         id,
+		GossipPort: conf.GossipPort,
+		APIPort:    conf.APIPort,
+	}
 
-func (t *projectsTable) Swap(i, j int) {
-	a := t.rows[i]
-	b := t.rows[j]
+	if gossipPort != 0 {
+		action.GossipPort = ledger.Port(gossipPort)
+	}
 
-	t.rows[i] = b
-	t.rows[j] = a
+	if apiPort != 0 {
+		action.APIPort = ledger.Port(apiPort)
+	}
+
+	if action.GossipPort == action.APIPort {
+		return fmt.Errorf("gossip port can't be equal to api port")
+	}
+
+	return state.appendActions(action)
 }
 
-func handleListProjects(cmd *cobra.Command, args []string) error {
-	if err := cobra.ExactArgs(0)(cmd, args); err != nil {
+func handleRotateNodeKey(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(3)(cmd, args); err != nil {
 		return err
 	}
 
-	d := state.projectsConfigPath()
+	id := ledger.NodeID(strings.TrimSpace(args[0]))
 
-	if _, err := os.Stat(d); err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return nil
-		} else {
-			return err
-		}
+	conf, ok := state.ledger().Snapshot.Nodes[id]
+	if !ok {
+		return fmt.Errorf("node %s not found", id)
 	}
 
-	projects, err := os.ReadDir(d)
+	oldKey, err := ledger.ParsePrivateKey(args[1])
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid old node key (%v)", err)
 	}
 
-	var defaultProjectID string
-
-	for _, f := range projects {
-		name := f.Name()
-		if name == DefaultProjectName {
-			p := path.Join(d, name)
+	newKey, err := ledger.ParsePrivateKey(args[2])
+	if err != nil {
+		return fmt.Errorf("invalid new node key (%v)", err)
+	}
 
-			bs, err := os.ReadFile(p)
-			if err != nil {
-				return err
-			}
+	oldKP := oldKey.KeyPair()
+	newKP := newKey.KeyPair()
 
-			defaultProjectID = string(bs)
-			if err := ledger.ValidateID(defaultProjectID, ledger.ProjectIDPrefix); err != nil {
-				return fmt.Errorf("invalid project id in %s (%v)", p, err)
-			}
-		}
+	if !bytes.Equal(oldKP.Public, conf.Key) {
+		return fmt.Errorf("old key isn't the current key of node %s", id)
 	}
 
-	defaultFound := false
-	rows := make([]projectsTableRow, 0)
+	action := ledger.RotateNodeKey{ID: id, Key: newKP.Public}
 
-	for _, f := range projects {
-		name := f.Name()
+	return state.appendActionsSignedBy([]ledger.Signer{oldKP, newKP}, action)
+}
 
-		if name != DefaultProjectName {
-			p := path.Join(d, name)
+func handleShowNodesStatus(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(0)(cmd, args); err != nil {
+		return err
+	}
 
-			bs, err := os.ReadFile(p)
-			if err != nil {
-				return err
-			}
+	status, err := state.newAPIClient().NodesStatus()
+	if err != nil {
+		return err
+	}
 
-			projectID := string(bs)
-			if err := ledger.ValidateID(projectID, ledger.ProjectIDPrefix); err != nil {
-				return fmt.Errorf("invalid project id in %s (%v)", p, err)
-			}
+	chain := state.ledger().IDChain()
 
-			if projectID == defaultProjectID {
-				defaultFound = true
+	for _, s := range status {
+		sync := "unknown"
+
+		if s.Head != "" {
+			i := slices.Index(chain.IDs, s.Head)
+
+			switch {
+			case i == len(chain.IDs)-1:
+				sync = "in-sync"
+			case i >= 0:
+				sync = fmt.Sprintf("lagging(%d)", len(chain.IDs)-1-i)
+			case int(s.Height) > len(chain.IDs):
+				// the local ledger might be outdated
+				sync = "ahead"
+			default:
+				sync = "forked"
 			}
+		}
 
-			rows = append(rows, projectsTableRow{name, projectID, projectID == defaultProjectID})
+		fmt.Printf(
+			"%s %s %s height=%d version=%s uptime=%s load=%.2f",
+			s.NodeID,
+			s.State,
+			sync,
+			s.Height,
+			s.Version,
+			time.Duration(s.Uptime)*time.Second,
+			s.Load,
+		)
+
+		if s.LastError != "" {
+			fmt.Printf(" last-error=%q (%s)", s.LastError, s.LastErrorTime.Format(time.RFC3339))
 		}
-	}
 
-	if defaultProjectID != "" && !defaultFound {
-		rows = append(rows, projectsTableRow{DefaultProjectName, defaultProjectID, true})
+		fmt.Printf("\n")
+	}
+
+	return nil
+}
+
+func handleSetGatewayEndpointAuthorizer(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(4)(cmd, args); err != nil {
+		return err
+	}
+
+	gatewayID := strings.TrimSpace(args[0])
+	if err := ledger.ValidateID(gatewayID, ledger.GatewayIDPrefix); err != nil {
+		return err
+	}
+
+	method := strings.TrimSpace(args[1])
+	if method != "GET" && method != "POST" && method != "PUT" && method != "PATCH" && method != "DELETE" {
+		return fmt.Errorf("invalid method %s", method)
+	}
+
+	path := strings.TrimSpace(args[2])
+	if path == "" {
+		return fmt.Errorf("invalid empty path")
+	}
+
+	action := ledger.SetGatewayEndpointAuthorizer{
+		GatewayID: ledger.GatewayID(gatewayID),
+		Method:    method,
+		Path:      path,
+	}
+
+	// API keys that were generated here are printed after the change set has
+	// been accepted
+	generatedKeys := []string{}
+
+	switch authorizerType := strings.TrimSpace(args[3]); authorizerType {
+	case "none":
+	case ledger.APIKeyAuthorizerType:
+		if len(apiKeys) == 0 {
+			bs := make([]byte, 32)
+			if _, err := rand.Read(bs); err != nil {
+				return fmt.Errorf("failed to generate random API key (%v)", err)
+			}
+
+			key := base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(bs)
+			apiKeys = []string{key}
+			generatedKeys = append(generatedKeys, key)
+		}
+
+		action.Type = authorizerType
+
+		for _, key := range apiKeys {
+			action.APIKeyDigests = append(action.APIKeyDigests, ledger.DigestShort([]byte(key)))
+		}
+	case ledger.FunctionAuthorizerType:
+		if err := ledger.ValidateID(authorizerFnID, ledger.FunctionIDPrefix); err != nil {
+			return fmt.Errorf("invalid --fn (%v)", err)
+		}
+
+		action.Type = authorizerType
+		action.FunctionID = ledger.FunctionID(authorizerFnID)
+	case ledger.JWTAuthorizerType:
+		action.Type = authorizerType
+		action.JWKSURL = jwksURL
+		action.JWTIssuer = jwtIssuer
+		action.JWTAudience = jwtAudience
+
+		for _, p := range jwtKeyPaths {
+			bs, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+
+			if _, err := ledger.ParsePEMPublicKey(string(bs)); err != nil {
+				return fmt.Errorf("invalid JWT key at %s (%v)", p, err)
+			}
+
+			action.JWTKeys = append(action.JWTKeys, string(bs))
+		}
+	case ledger.OWSKeyAuthorizerType:
+		action.Type = authorizerType
+	default:
+		return fmt.Errorf("invalid authorizer type %s", authorizerType)
+	}
+
+	if err := state.appendActions(action); err != nil {
+		return err
+	}
+
+	for _, key := range generatedKeys {
+		fmt.Println(key)
+	}
+
+	return nil
+}
+
+func handleSetGatewayAPIKeyQuota(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(4)(cmd, args); err != nil {
+		return err
+	}
+
+	gatewayID := strings.TrimSpace(args[0])
+	if err := ledger.ValidateID(gatewayID, ledger.GatewayIDPrefix); err != nil {
+		return err
+	}
+
+	apiKey := strings.TrimSpace(args[1])
+	if apiKey == "" {
+		return fmt.Errorf("invalid empty API key")
+	}
+
+	limit, err := strconv.ParseUint(args[2], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid limit %s (%v)", args[2], err)
+	}
+
+	period, err := strconv.ParseUint(args[3], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid period %s (%v)", args[3], err)
+	}
+
+	action := ledger.SetGatewayAPIKeyQuota{
+		GatewayID:    ledger.GatewayID(gatewayID),
+		APIKeyDigest: ledger.DigestShort([]byte(apiKey)),
+		Limit:        uint(limit),
+		Period:       uint(period),
+		Cluster:      isClusterWide,
+	}
+
+	return state.appendActions(action)
+}
+
+func handleSetGatewayCORS(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(1)(cmd, args); err != nil {
+		return err
+	}
+
+	gatewayID := strings.TrimSpace(args[0])
+	if err := ledger.ValidateID(gatewayID, ledger.GatewayIDPrefix); err != nil {
+		return err
+	}
+
+	action := ledger.SetGatewayCORS{
+		GatewayID:        ledger.GatewayID(gatewayID),
+		AllowOrigins:     corsOrigins,
+		AllowMethods:     corsMethods,
+		AllowHeaders:     corsHeaders,
+		ExposeHeaders:    corsExposeHeaders,
+		MaxAge:           corsMaxAge,
+		AllowCredentials: corsCredentials,
+	}
+
+	return state.appendActions(action)
+}
+
+func handleSetGatewayEndpointTransform(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(3)(cmd, args); err != nil {
+		return err
+	}
+
+	gatewayID := strings.TrimSpace(args[0])
+	if err := ledger.ValidateID(gatewayID, ledger.GatewayIDPrefix); err != nil {
+		return err
+	}
+
+	method := strings.TrimSpace(args[1])
+	if method != "GET" && method != "POST" && method != "PUT" && method != "PATCH" && method != "DELETE" {
+		return fmt.Errorf("invalid method %s", method)
+	}
+
+	path := strings.TrimSpace(args[2])
+	if path == "" {
+		return fmt.Errorf("invalid empty path")
+	}
+
+	setRequest, err := parseHeaderValues(setRequestHeaders)
+	if err != nil {
+		return err
+	}
+
+	setResponse, err := parseHeaderValues(setResponseHeaders)
+	if err != nil {
+		return err
+	}
+
+	action := ledger.SetGatewayEndpointTransform{
+		GatewayID:             ledger.GatewayID(gatewayID),
+		Method:                method,
+		Path:                  path,
+		SetRequestHeaders:     setRequest,
+		RemoveRequestHeaders:  removeRequestHeaders,
+		SetResponseHeaders:    setResponse,
+		RemoveResponseHeaders: removeResponseHeaders,
+	}
+
+	if requestTemplatePath != "" {
+		bs, err := os.ReadFile(requestTemplatePath)
+		if err != nil {
+			return fmt.Errorf("unable to read request template %s (%v)", requestTemplatePath, err)
+		}
+
+		action.RequestTemplate = string(bs)
+	}
+
+	if responseTemplatePath != "" {
+		bs, err := os.ReadFile(responseTemplatePath)
+		if err != nil {
+			return fmt.Errorf("unable to read response template %s (%v)", responseTemplatePath, err)
+		}
+
+		action.ResponseTemplate = string(bs)
+	}
+
+	return state.appendActions(action)
+}
+
+// Each header is formatted as <name>:<value>
+func parseHeaderValues(headers []string) ([]ledger.HeaderValue, error) {
+	values := make([]ledger.HeaderValue, 0, len(headers))
+
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid header %q, expected <name>:<value>", h)
+		}
+
+		values = append(values, ledger.HeaderValue{
+			Name:  strings.TrimSpace(name),
+			Value: strings.TrimSpace(value),
+		})
+	}
+
+	return values, nil
+}
+
+func handleSetGatewayRateLimit(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(3)(cmd, args); err != nil {
+		return err
+	}
+
+	gatewayID := strings.TrimSpace(args[0])
+	if err := ledger.ValidateID(gatewayID, ledger.GatewayIDPrefix); err != nil {
+		return err
+	}
+
+	rate, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || rate < 0 {
+		return fmt.Errorf("invalid rate %s", args[1])
+	}
+
+	burst, err := strconv.ParseUint(args[2], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid burst %s (%v)", args[2], err)
+	}
+
+	if (rateLimitMethod == "") != (rateLimitPath == "") {
+		return fmt.Errorf("--method and --path must be specified together")
+	}
+
+	action := ledger.SetGatewayRateLimit{
+		GatewayID: ledger.GatewayID(gatewayID),
+		Method:    rateLimitMethod,
+		Path:      rateLimitPath,
+		Rate:      rate,
+		Burst:     uint(burst),
+		Cluster:   isClusterWide,
+	}
+
+	return state.appendActions(action)
+}
+
+func handleShowVersion(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(0)(cmd, args); err != nil {
+		return err
+	}
+
+	fmt.Println(Version)
+
+	return nil
+}
+
+type projectsTable struct {
+	rows []projectsTableRow
+}
+
+type projectsTableRow struct {
+	name      string
+	projectID string
+	isDefault bool
+}
+
+func (t *projectsTable) Len() int {
+	return len(t.rows)
+}
+
+func (t *projectsTable) Less(i, j int) bool {
+	a := t.rows[i]
+	b := t.rows[j]
+
+	return a.name < b.name
+}
+
+func (t *projectsTable) Swap(i, j int) {
+	a := t.rows[i]
+	b := t.rows[j]
+
+	t.rows[i] = b
+	t.rows[j] = a
+}
+
+func handleListProjects(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(0)(cmd, args); err != nil {
+		return err
+	}
+
+	d := state.projectsConfigPath()
+
+	if _, err := os.Stat(d); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else {
+			return err
+		}
+	}
+
+	projects, err := os.ReadDir(d)
+	if err != nil {
+		return err
+	}
+
+	var defaultProjectID string
+
+	for _, f := range projects {
+		name := f.Name()
+		if name == DefaultProjectName {
+			p := path.Join(d, name)
+
+			bs, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+
+			defaultProjectID = string(bs)
+			if err := ledger.ValidateID(defaultProjectID, ledger.ProjectIDPrefix); err != nil {
+				return fmt.Errorf("invalid project id in %s (%v)", p, err)
+			}
+		}
+	}
+
+	defaultFound := false
+	rows := make([]projectsTableRow, 0)
+
+	for _, f := range projects {
+		name := f.Name()
+
+		if name != DefaultProjectName {
+			p := path.Join(d, name)
+
+			bs, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+
+			projectID := string(bs)
+			if err := ledger.ValidateID(projectID, ledger.ProjectIDPrefix); err != nil {
+				return fmt.Errorf("invalid project id in %s (%v)", p, err)
+			}
+
+			if projectID == defaultProjectID {
+				defaultFound = true
+			}
+
+			rows = append(rows, projectsTableRow{name, projectID, projectID == defaultProjectID})
+		}
+	}
+
+	if defaultProjectID != "" && !defaultFound {
+		rows = append(rows, projectsTableRow{DefaultProjectName, defaultProjectID, true})
 	}
 
 	table := &projectsTable{rows}
@@ -856,6 +1631,148 @@ func handleRemoveGateway(cmd *cobra.Command, args []string) error {
 	return state.appendActions(action)
 }
 
+func handleConfigureMetrics(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(1)(cmd, args); err != nil {
+		return err
+	}
+
+	port, err := strconv.ParseUint(args[0], 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %s (%v)", args[0], err)
+	}
+
+	action := ledger.ConfigureMetrics{
+		Port:            ledger.Port(port),
+		AllowedNetworks: metricsAllowedNetworks,
+	}
+
+	return state.appendActions(action)
+}
+
+func handleConfigureConsensus(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(1)(cmd, args); err != nil {
+		return err
+	}
+
+	var enabled bool
+
+	switch args[0] {
+	case "enable":
+		enabled = true
+	case "disable":
+		enabled = false
+	default:
+		return fmt.Errorf("invalid consensus mode %s (expected enable or disable)", args[0])
+	}
+
+	return state.appendActions(ledger.ConfigureConsensus{Enabled: enabled})
+}
+
+func handleUpgradeLedger(cmd *cobra.Command, args []string) error {
+	if err := cobra.MaximumNArgs(1)(cmd, args); err != nil {
+		return err
+	}
+
+	v := ledger.LatestLedgerVersion
+
+	if len(args) == 1 {
+		n, err := strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid ledger version %s (%v)", args[0], err)
+		}
+
+		v = ledger.LedgerVersion(n)
+	}
+
+	return state.appendActions(ledger.UpgradeLedgerVersion{Version: v})
+}
+
+func handleShowGatewayStats(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(1)(cmd, args); err != nil {
+		return err
+	}
+
+	gatewayID := strings.TrimSpace(args[0])
+	if err := ledger.ValidateID(gatewayID, ledger.GatewayIDPrefix); err != nil {
+		return err
+	}
+
+	if _, ok := state.ledger().Snapshot.Gateways[ledger.GatewayID(gatewayID)]; !ok {
+		return fmt.Errorf("gateway %s not found", gatewayID)
+	}
+
+	stats, errs := state.newAPIClient().GatewayStats(ledger.GatewayID(gatewayID))
+
+	for nodeID, err := range errs {
+		fmt.Fprintf(os.Stderr, "warning: stats of node %s unavailable (%v)\n", nodeID, err)
+	}
+
+	sort.Slice(stats.Endpoints, func(i, j int) bool {
+		a, b := stats.Endpoints[i], stats.Endpoints[j]
+
+		return a.Path+" "+a.Method < b.Path+" "+b.Method
+	})
+
+	formatPercentile := func(e network.EndpointStats, p float64) string {
+		if ms := e.LatencyPercentile(p); ms >= 0 {
+			return fmt.Sprintf("<=%gms", ms)
+		} else {
+			return fmt.Sprintf(">%gms", network.LatencyBucketBounds[len(network.LatencyBucketBounds)-1])
+		}
+	}
+
+	for _, e := range stats.Endpoints {
+		if e.Requests == 0 {
+			continue
+		}
+
+		name := e.Method + " " + e.Path
+		if e.Method == "" {
+			name = "(unmatched)"
+		}
+
+		fmt.Printf(
+			"%s requests=%d 2xx=%d 3xx=%d 4xx=%d 5xx=%d bytes=%d avg=%.1fms p50%s p95%s p99%s\n",
+			name,
+			e.Requests,
+			e.Statuses["2xx"],
+			e.Statuses["3xx"],
+			e.Statuses["4xx"],
+			e.Statuses["5xx"],
+			e.Bytes,
+			e.LatencySum/float64(e.Requests),
+			formatPercentile(e, 0.5),
+			formatPercentile(e, 0.95),
+			formatPercentile(e, 0.99),
+		)
+	}
+
+	return nil
+}
+
+func handleUpdateGateway(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(2)(cmd, args); err != nil {
+		return err
+	}
+
+	gatewayID := strings.TrimSpace(args[0])
+	if err := ledger.ValidateID(gatewayID, ledger.GatewayIDPrefix); err != nil {
+		return err
+	}
+
+	port, err := strconv.ParseUint(args[1], 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %s (%v)", args[1], err)
+	}
+
+	action := ledger.UpdateGateway{
+		ID:   ledger.GatewayID(gatewayID),
+		Port: ledger.Port(port),
+	}
+
+	return state.appendActions(action)
+}
+
 func handleRemoveGatewayEndpoint(cmd *cobra.Command, args []string) error {
 	if err := cobra.ExactArgs(3)(cmd, args); err != nil {
 		return err
@@ -931,6 +1848,10 @@ func handleRemoveProject(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	if err := os.Remove(state.signerSpecPath(ledger.ProjectID(projectID))); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
 	if err := os.Remove(mappingPath); err != nil {
 		return err
 	}
@@ -992,6 +1913,149 @@ func handleSetDefaultProject(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func handleRotateKey(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(0)(cmd, args); err != nil {
+		return err
+	}
+
+	projectID := state.currentProjectID()
+
+	if spec := state.signerSpec(projectID); !isKeySigner(spec) {
+		return fmt.Errorf("key rotation requires the %s signer, the project uses signer %s", KeySignerName, spec)
+	}
+
+	oldKP := state.projectKeyPair()
+
+	if _, existsInEnv := ledger.EnvKeyPair(); existsInEnv {
+		newKP, err := ledger.RandomKeyPair()
+		if err != nil {
+			return fmt.Errorf("unable to generate random key (%v)", err)
+		}
+
+		if err := state.appendActionsSignedBy([]ledger.Signer{newKP}, ledger.RotateUserKey{OldKey: oldKP.Public, NewKey: newKP.Public}); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "warning: the client key is set by %s, replace it by the new key\n", ledger.PrivateKeyEnvName)
+		fmt.Println("PrivateKey: ", newKP.Private.String())
+		printRotatedKey(newKP)
+
+		return nil
+	}
+
+	// the project still uses an older client key, it is rotated to the
+	// current client key
+	if newKP := state.keyPair(); oldKP.Public.UserID() != newKP.Public.UserID() {
+		pp := state.projectKeyPairPath(projectID)
+
+		if err := state.appendActionsSignedBy([]ledger.Signer{newKP}, ledger.RotateUserKey{OldKey: oldKP.Public, NewKey: newKP.Public}); err != nil {
+			return err
+		}
+
+		if err := os.Remove(pp); err != nil {
+			return fmt.Errorf("failed to remove old project key %s (%v)", pp, err)
+		}
+
+		fmt.Fprintf(os.Stderr, "project now uses the client key\n")
+		printRotatedKey(newKP)
+
+		return nil
+	}
+
+	newKP, err := ledger.RandomKeyPair()
+	if err != nil {
+		return fmt.Errorf("unable to generate random key (%v)", err)
+	}
+
+	// The new key only replaces the client key once the rotation has been
+	// submitted. Both keys keep the passphrase of the old key.
+	p := state.keyPairPath()
+	newPath := p + ".new"
+
+	if err := newKP.WriteEncrypted(newPath, state.cachedPassphrase); err != nil {
+		return fmt.Errorf("failed to write new key to %s (%v)", newPath, err)
+	}
+
+	// the new key is kept in case the change set was applied nonetheless
+	if err := state.appendActionsSignedBy([]ledger.Signer{newKP}, ledger.RotateUserKey{OldKey: oldKP.Public, NewKey: newKP.Public}); err != nil {
+		return fmt.Errorf("%v (the new key was written to %s)", err, newPath)
+	}
+
+	kept, err := state.keepProjectKeys(projectID, oldKP)
+	if err != nil {
+		return fmt.Errorf("failed to keep old key for the other projects (%v), the new key was written to %s", err, newPath)
+	}
+
+	if err := os.Rename(newPath, p); err != nil {
+		return fmt.Errorf("failed to move new key from %s to %s (%v)", newPath, p, err)
+	}
+
+	for _, name := range kept {
+		fmt.Fprintf(os.Stderr, "project %s still uses the old key (hint: rotate it with `ows key rotate --project-name %s`)\n", name, name)
+	}
+
+	printRotatedKey(newKP)
+
+	return nil
+}
+
+func printRotatedKey(kp *ledger.KeyPair) {
+	fmt.Println("PublicKey: ", kp.Public.String())
+	fmt.Println("UserID: ", kp.Public.UserID())
+}
+
+// Saves the old client key as the project key of the other projects that use
+// the key signer, so that they can still be used after the client key is
+// rotated. Returns the names of these projects.
+func (s *clientState) keepProjectKeys(current ledger.ProjectID, old *ledger.KeyPair) ([]string, error) {
+	d := s.projectsConfigPath()
+
+	fs, err := os.ReadDir(d)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	names := []string{}
+
+	for _, f := range fs {
+		if f.Name() == DefaultProjectName {
+			continue
+		}
+
+		bs, err := os.ReadFile(path.Join(d, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		projectID := ledger.ProjectID(bs)
+
+		if projectID == current || !isKeySigner(s.signerSpec(projectID)) {
+			continue
+		}
+
+		p := s.projectKeyPairPath(projectID)
+
+		if _, err := os.Stat(p); err == nil {
+			// already uses an older key
+			continue
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		if err := old.WriteEncrypted(p, s.cachedPassphrase); err != nil {
+			return nil, err
+		}
+
+		names = append(names, f.Name())
+	}
+
+	return names, nil
+}
+
 func handleSetKey(cmd *cobra.Command, args []string) error {
 	if err := cobra.ExactArgs(1)(cmd, args); err != nil {
 		return err
@@ -1009,6 +2073,42 @@ func handleSetKey(cmd *cobra.Command, args []string) error {
 	return saveKeyPair(kp)
 }
 
+func handleSigner(cmd *cobra.Command, args []string) error {
+	if err := cobra.MaximumNArgs(1)(cmd, args); err != nil {
+		return err
+	}
+
+	projectID := state.currentProjectID()
+
+	spec := state.signerSpec(projectID)
+
+	if len(args) == 1 {
+		if _, exists := os.LookupEnv(SignerEnvName); exists {
+			return fmt.Errorf("%s is set, unset it to change the signer of the project", SignerEnvName)
+		}
+
+		spec = args[0]
+	}
+
+	// make sure the signer is usable before saving it
+	signer, err := newSigner(spec, state.keyPair)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 1 {
+		if err := state.saveSignerSpec(projectID, spec); err != nil {
+			return fmt.Errorf("failed to save signer (%v)", err)
+		}
+	}
+
+	fmt.Println("Signer: ", spec)
+	fmt.Println("PublicKey: ", signer.PublicKey().String())
+	fmt.Println("UserID: ", signer.PublicKey().UserID())
+
+	return nil
+}
+
 func handleShowInitialLedgerConfig(cmd *cobra.Command, args []string) error {
 	if err := cobra.ExactArgs(0)(cmd, args); err != nil {
 		return err
@@ -1016,7 +2116,12 @@ func handleShowInitialLedgerConfig(cmd *cobra.Command, args []string) error {
 
 	l := state.ledger()
 
-	l0, err := ledger.NewLedger(l.InitialVersion, &(l.Changes[0]))
+	initialConfig, ok := l.ChangeAt(0)
+	if !ok {
+		return fmt.Errorf("initial config was pruned from the local ledger")
+	}
+
+	l0, err := ledger.NewLedger(l.InitialVersion, initialConfig)
 	if err != nil {
 		return err
 	}
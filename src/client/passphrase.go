@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+
+	"ows/ledger"
+)
+
+// Prompts for a passphrase without echoing it.
+func readPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("%s not set and stdin isn't a terminal", ledger.KeyPassphraseEnvName)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+
+	pp, err := term.ReadPassword(fd)
+
+	fmt.Fprintln(os.Stderr)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to read passphrase (%v)", err)
+	}
+
+	return pp, nil
+}
+
+// Prompts twice for the passphrase of a new key file. An empty passphrase
+// means the key file isn't encrypted.
+func readNewPassphrase() ([]byte, error) {
+	pp, err := readPassphrase("New passphrase (empty for no encryption): ")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pp) == 0 {
+		return nil, nil
+	}
+
+	confirmation, err := readPassphrase("Repeat new passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(pp, confirmation) {
+		return nil, errors.New("passphrases don't match")
+	}
+
+	return pp, nil
+}
+
+// Passphrase used to encrypt newly created key files. OWS_KEY_PASSPHRASE is
+// used if it is set, otherwise the user is prompted if stdin is a terminal.
+// Without terminal the key file isn't encrypted.
+func newKeyPassphrase() ([]byte, error) {
+	if pp, exists := ledger.EnvKeyPassphrase(); exists {
+		return pp, nil
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, nil
+	}
+
+	return readNewPassphrase()
+}
+
+// Passphrase of the client key file, which is only requested once.
+func (s *clientState) keyPassphrase() ([]byte, error) {
+	if s.cachedPassphrase != nil {
+		return s.cachedPassphrase, nil
+	}
+
+	pp, exists := ledger.EnvKeyPassphrase()
+	if !exists {
+		var err error
+		pp, err = readPassphrase(fmt.Sprintf("Passphrase for %s: ", s.keyPairPath()))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.cachedPassphrase = pp
+
+	return pp, nil
+}
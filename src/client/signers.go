@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"ows/ledger"
+)
+
+const (
+	PKCS11PinEnvName   = "OWS_PKCS11_PIN"
+	SignerEnvName      = "OWS_SIGNER"
+	SSHAuthSockEnvName = "SSH_AUTH_SOCK"
+
+	SignersDirName = "signers"
+
+	// signer specifications have the format <backend>[:<options>]
+	KeySignerName      = "key"       // key
+	PKCS11SignerName   = "pkcs11"    // pkcs11:<module-path>:<key-id-hex>[:<token-label>]
+	SSHAgentSignerName = "ssh-agent" // ssh-agent[:<public-key>]
+)
+
+// Creates the signer described by `spec`. The key signer uses the key
+// returned by `keyPair`, which is only called if needed.
+func newSigner(spec string, keyPair func() *ledger.KeyPair) (ledger.Signer, error) {
+	name, options, _ := strings.Cut(spec, ":")
+
+	switch name {
+	case "", KeySignerName:
+		if options != "" {
+			return nil, fmt.Errorf("signer %s doesn't have options", KeySignerName)
+		}
+
+		return keyPair(), nil
+	case PKCS11SignerName:
+		fields := strings.Split(options, ":")
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("invalid signer %q (expected %s:<module-path>:<key-id-hex>[:<token-label>])", spec, PKCS11SignerName)
+		}
+
+		tokenLabel := ""
+		if len(fields) == 3 {
+			tokenLabel = fields[2]
+		}
+
+		return newPKCS11Signer(fields[0], fields[1], tokenLabel)
+	case SSHAgentSignerName:
+		var key ledger.PublicKey
+
+		if options != "" {
+			var err error
+			key, err = ledger.ParsePublicKey(options)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ssh-agent public key %s (%v)", options, err)
+			}
+		}
+
+		socketPath, exists := os.LookupEnv(SSHAuthSockEnvName)
+		if !exists {
+			return nil, fmt.Errorf("%s not set (is ssh-agent running?)", SSHAuthSockEnvName)
+		}
+
+		return newSSHAgentSigner(socketPath, key)
+	default:
+		return nil, fmt.Errorf("unknown signer %q (expected %s, %s or %s)", name, KeySignerName, PKCS11SignerName, SSHAgentSignerName)
+	}
+}
+
+func isKeySigner(spec string) bool {
+	return spec == "" || spec == KeySignerName
+}
+
+// Signs with an Ed25519 key held by ssh-agent. A new connection to the agent
+// is used for each signature, and closed afterwards.
+type sshAgentSigner struct {
+	socketPath string
+	key        *agent.Key
+	public     ledger.PublicKey
+}
+
+// Uses the agent key matching `key`, or the first Ed25519 key of the agent if
+// `key` is nil.
+func newSSHAgentSigner(socketPath string, key ledger.PublicKey) (*sshAgentSigner, error) {
+	var keys []*agent.Key
+
+	if err := withSSHAgent(socketPath, func(a agent.Agent) error {
+		var err error
+		keys, err = a.List()
+		if err != nil {
+			return fmt.Errorf("unable to list ssh-agent keys (%v)", err)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		if k.Type() != ssh.KeyAlgoED25519 {
+			continue
+		}
+
+		public, err := sshEd25519PublicKey(k)
+		if err != nil {
+			return nil, err
+		}
+
+		if key == nil || bytes.Equal(key, public) {
+			return &sshAgentSigner{socketPath, k, public}, nil
+		}
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("ssh-agent doesn't hold an ed25519 key (hint: use `ssh-add` to add one)")
+	} else {
+		return nil, fmt.Errorf("ssh-agent doesn't hold key %s", key)
+	}
+}
+
+func withSSHAgent(socketPath string, fn func(a agent.Agent) error) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("unable to connect to ssh-agent at %s (%v)", socketPath, err)
+	}
+
+	defer conn.Close()
+
+	return fn(agent.NewClient(conn))
+}
+
+func (s *sshAgentSigner) PublicKey() ledger.PublicKey {
+	return s.public
+}
+
+func (s *sshAgentSigner) Sign(message []byte) (ledger.Signature, error) {
+	var sig *ssh.Signature
+
+	if err := withSSHAgent(s.socketPath, func(a agent.Agent) error {
+		var err error
+		sig, err = a.Sign(s.key, message)
+		if err != nil {
+			return fmt.Errorf("ssh-agent failed to sign (%v)", err)
+		}
+
+		return nil
+	}); err != nil {
+		return ledger.Signature{}, err
+	}
+
+	if sig.Format != ssh.KeyAlgoED25519 {
+		return ledger.Signature{}, fmt.Errorf("unexpected ssh-agent signature format %s", sig.Format)
+	}
+
+	return ledger.NewSignature(s.public, sig.Blob)
+}
+
+func sshEd25519PublicKey(k ssh.PublicKey) (ledger.PublicKey, error) {
+	parsed, err := ssh.ParsePublicKey(k.Marshal())
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh-agent key (%v)", err)
+	}
+
+	cryptoKey, ok := parsed.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported ssh-agent key type %s", k.Type())
+	}
+
+	public, ok := cryptoKey.CryptoPublicKey().(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("ssh-agent key of type %s isn't an ed25519 key", k.Type())
+	}
+
+	return ledger.PublicKey(public), nil
+}
+
+// Signs with an Ed25519 key stored in a PKCS#11 token (eg. a YubiHSM, or
+// SoftHSM for testing), using the pkcs11-tool command of OpenSC. The PIN of
+// the token is read from the OWS_PKCS11_PIN env variable, which is passed on
+// to pkcs11-tool (so that the PIN doesn't show up in its command line).
+type pkcs11Signer struct {
+	module     string
+	keyID      string
+	tokenLabel string
+	public     ledger.PublicKey
+}
+
+func newPKCS11Signer(module string, keyID string, tokenLabel string) (*pkcs11Signer, error) {
+	if _, err := hex.DecodeString(keyID); err != nil || keyID == "" {
+		return nil, fmt.Errorf("invalid pkcs11 key id %q (expected hex string)", keyID)
+	}
+
+	s := &pkcs11Signer{module: module, keyID: keyID, tokenLabel: tokenLabel}
+
+	der, err := s.run("--read-object", "--type", "pubkey")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pkcs11 public key %s (%v)", keyID, err)
+	}
+
+	s.public, err = parsePKCS11PublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkcs11 public key %s (%v)", keyID, err)
+	}
+
+	return s, nil
+}
+
+func (s *pkcs11Signer) PublicKey() ledger.PublicKey {
+	return s.public
+}
+
+func (s *pkcs11Signer) Sign(message []byte) (ledger.Signature, error) {
+	if _, exists := os.LookupEnv(PKCS11PinEnvName); !exists {
+		return ledger.Signature{}, fmt.Errorf("%s not set", PKCS11PinEnvName)
+	}
+
+	d, err := os.MkdirTemp("", "ows-pkcs11-")
+	if err != nil {
+		return ledger.Signature{}, err
+	}
+
+	defer os.RemoveAll(d)
+
+	inputPath := path.Join(d, "message")
+
+	if err := os.WriteFile(inputPath, message, 0600); err != nil {
+		return ledger.Signature{}, err
+	}
+
+	// pkcs11-tool reads the PIN from the env variable itself
+	raw, err := s.run("--login", "--pin", "env:"+PKCS11PinEnvName, "--sign", "--mechanism", "EDDSA", "--input-file", inputPath)
+	if err != nil {
+		return ledger.Signature{}, fmt.Errorf("pkcs11 token failed to sign (%v)", err)
+	}
+
+	return ledger.NewSignature(s.public, raw)
+}
+
+// Runs pkcs11-tool for the configured key, and returns the content of its
+// output file.
+func (s *pkcs11Signer) run(args ...string) ([]byte, error) {
+	d, err := os.MkdirTemp("", "ows-pkcs11-")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.RemoveAll(d)
+
+	outputPath := path.Join(d, "output")
+
+	args = append([]string{"--module", s.module, "--id", s.keyID, "--output-file", outputPath}, args...)
+
+	if s.tokenLabel != "" {
+		args = append(args, "--token-label", s.tokenLabel)
+	}
+
+	cmd := exec.Command("pkcs11-tool", args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("pkcs11-tool not found (hint: install OpenSC)")
+		}
+
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return os.ReadFile(outputPath)
+}
+
+// Depending on the OpenSC version, public keys are exported as
+// SubjectPublicKeyInfo, or as the raw (possibly DER wrapped) EC point.
+func parsePKCS11PublicKey(der []byte) (ledger.PublicKey, error) {
+	if key, err := x509.ParsePKIXPublicKey(der); err == nil {
+		public, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("not an ed25519 key")
+		}
+
+		return ledger.PublicKey(public), nil
+	}
+
+	switch {
+	case len(der) == ed25519.PublicKeySize:
+		return ledger.PublicKey(der), nil
+	case len(der) == ed25519.PublicKeySize+2 && der[0] == 0x04 && der[1] == ed25519.PublicKeySize:
+		return ledger.PublicKey(der[2:]), nil
+	}
+
+	// SubjectPublicKeyInfo with curve parameters unknown to crypto/x509 (ends
+	// with a BIT STRING containing the key)
+	suffix := []byte{0x03, ed25519.PublicKeySize + 1, 0x00}
+	if n := len(der) - ed25519.PublicKeySize - len(suffix); n >= 0 && bytes.Equal(der[n:n+len(suffix)], suffix) {
+		return ledger.PublicKey(der[n+len(suffix):]), nil
+	}
+
+	return nil, fmt.Errorf("unsupported public key encoding")
+}
+
+// The signer of a project is configured by `ows key signer`, and can be
+// overridden with the OWS_SIGNER env variable.
+func (s *clientState) signerSpec(projectID ledger.ProjectID) string {
+	if spec, exists := os.LookupEnv(SignerEnvName); exists {
+		return spec
+	}
+
+	if projectID == "" {
+		return KeySignerName
+	}
+
+	bs, err := os.ReadFile(s.signerSpecPath(projectID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return KeySignerName
+		} else {
+			panic(err)
+		}
+	}
+
+	return strings.TrimSpace(string(bs))
+}
+
+func (s *clientState) signerSpecPath(projectID ledger.ProjectID) string {
+	return path.Join(s.appConfigPath(), SignersDirName, string(projectID))
+}
+
+func (s *clientState) saveSignerSpec(projectID ledger.ProjectID, spec string) error {
+	return ledger.OverwriteSafe(s.signerSpecPath(projectID), []byte(spec))
+}
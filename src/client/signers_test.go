@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+
+	"ows/ledger"
+)
+
+func testChangeSet(t *testing.T) *ledger.ChangeSet {
+	t.Helper()
+
+	return ledger.NewInitialChangeSet(ledger.LatestLedgerVersion, ledger.AddGateway{Port: 8080})
+}
+
+// Serves an in-memory ssh-agent holding the given keys, and returns the
+// socket path and the number of open connections.
+func startTestAgent(t *testing.T, keys ...any) (string, *atomic.Int32) {
+	t.Helper()
+
+	keyring := agent.NewKeyring()
+
+	for _, k := range keys {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: k}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	open := &atomic.Int32{}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			open.Add(1)
+
+			go func() {
+				defer open.Add(-1)
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	return socketPath, open
+}
+
+func TestSSHAgentSigner(t *testing.T) {
+	public1, private1, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public2, private2, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socketPath, open := startTestAgent(t, private1, private2)
+
+	// defaults to the first ed25519 key
+	s, err := newSSHAgentSigner(socketPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(s.PublicKey(), public1) {
+		t.Fatalf("expected first agent key %x, got %x", public1, s.PublicKey())
+	}
+
+	s, err = newSSHAgentSigner(socketPath, ledger.PublicKey(public2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs := testChangeSet(t)
+
+	sig, err := ledger.SignChangeSet(s, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sig.Verify(cs.Encode()) {
+		t.Fatalf("invalid ssh-agent signature")
+	}
+
+	if !bytes.Equal(sig.Key, public2) {
+		t.Fatalf("expected signature by %x, got %x", public2, sig.Key)
+	}
+
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newSSHAgentSigner(socketPath, ledger.PublicKey(other)); err == nil {
+		t.Fatalf("expected signer of key missing from the agent to fail")
+	}
+
+	// the connections to the agent are closed
+	for i := 0; open.Load() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("expected connections to ssh-agent to be closed, %d are still open", open.Load())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSSHAgentSignerWithoutEd25519Key(t *testing.T) {
+	socketPath, _ := startTestAgent(t)
+
+	if _, err := newSSHAgentSigner(socketPath, nil); err == nil {
+		t.Fatalf("expected signer of empty agent to fail")
+	}
+}
+
+func TestNewSigner(t *testing.T) {
+	kp, err := ledger.RandomKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPair := func() *ledger.KeyPair { return kp }
+
+	for _, spec := range []string{"", "key"} {
+		s, err := newSigner(spec, keyPair)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(s.PublicKey(), kp.Public) {
+			t.Fatalf("expected signer %q to use the key pair", spec)
+		}
+	}
+
+	for _, spec := range []string{"key:x", "gpg", "pkcs11:/usr/lib/softhsm/libsofthsm2.so", "pkcs11:/usr/lib/softhsm/libsofthsm2.so:zz", "ssh-agent:x"} {
+		if _, err := newSigner(spec, keyPair); err == nil {
+			t.Fatalf("expected invalid signer %q to be refused", spec)
+		}
+	}
+}
+
+func TestParsePKCS11PublicKey(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spki, err := hex.DecodeString("302a300506032b6570032100" + hex.EncodeToString(public))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SubjectPublicKeyInfo with the curve name as parameters
+	namedSPKI, err := hex.DecodeString("3039301406072a8648ce3d020106092b06010401da470f01032100" + hex.EncodeToString(public))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, der := range [][]byte{spki, namedSPKI, public, append([]byte{0x04, 0x20}, public...)} {
+		key, err := parsePKCS11PublicKey(der)
+		if err != nil {
+			t.Fatalf("unable to parse %x (%v)", der, err)
+		}
+
+		if !bytes.Equal(key, public) {
+			t.Fatalf("expected %x, got %x", public, key)
+		}
+	}
+
+	if _, err := parsePKCS11PublicKey([]byte{0x04, 0x20}); err == nil {
+		t.Fatalf("expected truncated key to be refused")
+	}
+}
+
+// Requires SoftHSM and OpenSC, eg. `apt install softhsm2 opensc`.
+func TestPKCS11Signer(t *testing.T) {
+	for _, name := range []string{"softhsm2-util", "pkcs11-tool"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s not installed", name)
+		}
+	}
+
+	module := ""
+	for _, p := range []string{
+		"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/lib64/softhsm/libsofthsm.so",
+		"/usr/local/lib/softhsm/libsofthsm2.so",
+	} {
+		if _, err := os.Stat(p); err == nil {
+			module = p
+			break
+		}
+	}
+
+	if module == "" {
+		t.Skip("libsofthsm2.so not found")
+	}
+
+	d := t.TempDir()
+	tokensPath := filepath.Join(d, "tokens")
+	confPath := filepath.Join(d, "softhsm2.conf")
+
+	if err := os.Mkdir(tokensPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(confPath, []byte("directories.tokendir = "+tokensPath+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SOFTHSM2_CONF", confPath)
+	t.Setenv(PKCS11PinEnvName, "1234")
+
+	run := func(name string, args ...string) {
+		t.Helper()
+
+		if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+			t.Fatalf("%s %s failed (%v): %s", name, strings.Join(args, " "), err, out)
+		}
+	}
+
+	run("softhsm2-util", "--init-token", "--free", "--label", "ows", "--pin", "1234", "--so-pin", "5678")
+	run("pkcs11-tool", "--module", module, "--token-label", "ows", "--login", "--pin", "1234", "--keypairgen", "--key-type", "EC:edwards25519", "--id", "01", "--label", "ows")
+
+	s, err := newSigner("pkcs11:"+module+":01:ows", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs := testChangeSet(t)
+
+	sig, err := ledger.SignChangeSet(s, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sig.Verify(cs.Encode()) {
+		t.Fatalf("invalid pkcs11 signature")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"time"
 
 	"ows/ledger"
 	"ows/network"
@@ -25,6 +26,7 @@ const (
 	KeyPairFileName      = "key"
 	LedgerFileName       = "ledger"
 	LogsDirName          = "logs"
+	ProjectKeysDirName   = "keys"
 	ProjectsDirName      = "projects"
 )
 
@@ -36,8 +38,10 @@ type clientState struct {
 	projectName string
 	testDir     string
 
-	cachedKeyPair *ledger.KeyPair
-	cachedLedger  *ledger.Ledger
+	cachedKeyPair    *ledger.KeyPair
+	cachedLedger     *ledger.Ledger
+	cachedPassphrase []byte
+	cachedSigner     ledger.Signer
 }
 
 func (s *clientState) AddAsset(bs []byte, _ bool) (ledger.AssetID, error) {
@@ -70,14 +74,43 @@ func (s *clientState) ListAssets() []ledger.AssetID {
 	return resources.ListAssets(s.assetsPath())
 }
 
-func (s *clientState) OwnKeyPair() *ledger.KeyPair {
-	return s.keyPair()
+func (s *clientState) OwnSigner() ledger.Signer {
+	return s.signer()
 }
 
+// Replaces the local ledger by a pruned ledger starting from the checkpoint.
+func (s *clientState) RestoreCheckpoint(cp *ledger.Checkpoint) error {
+	l := ledger.NewLedgerFromCheckpoint(s.ledger().InitialVersion, cp)
+	p := s.ledgerPath()
+
+	if err := cp.Write(ledger.CheckpointPath(p)); err != nil {
+		return err
+	}
+
+	if err := l.Write(p); err != nil {
+		return err
+	}
+
+	s.cachedLedger = l
+
+	return nil
+}
+
+// Warns if change sets submitted by the current user are rolled back, because
+// the nodes adopted another fork.
 func (s *clientState) Rollback(p int) error {
 	l := s.ledger()
+	userID := s.signer().PublicKey().UserID()
 
-	l.Keep(p)
+	for _, o := range network.NewOrphanedChangeSets(l, p, "", time.Now()) {
+		if o.SignedBy(userID) {
+			fmt.Fprintf(os.Stderr, "warning: your change set %s was rolled back, its actions must be resubmitted\n", o.ID)
+		}
+	}
+
+	if err := l.Keep(p); err != nil {
+		return err
+	}
 
 	return l.Write(s.ledgerPath())
 }
@@ -116,6 +149,12 @@ func (s *clientState) keyPairPath() string {
 	return path.Join(s.appConfigPath(), KeyPairFileName)
 }
 
+// The key of a project that still uses an older client key (see `ows key
+// rotate`).
+func (s *clientState) projectKeyPairPath(projectID ledger.ProjectID) string {
+	return path.Join(s.appConfigPath(), ProjectKeysDirName, string(projectID))
+}
+
 func (s *clientState) ledgerPath() string {
 	return path.Join(s.currentProjectPath(), LedgerFileName)
 }
@@ -133,16 +172,44 @@ func (s *clientState) projectsDataPath() string {
 }
 
 func (s *clientState) appendActions(actions ...ledger.Action) error {
+	return s.appendActionsSignedBy(nil, actions...)
+}
+
+// Like `appendActions()`, but the change set is also signed by the given
+// signers (eg. the node keys needed to rotate a node key).
+func (s *clientState) appendActionsSignedBy(signers []ledger.Signer, actions ...ledger.Action) error {
 	cs := s.ledger().NewChangeSet(actions...)
-	kp := s.keyPair()
 
-	sig, err := kp.SignChangeSet(cs)
+	if changeSetMessage != "" || changeSetValidFor != 0 {
+		if cs.Version < 2 {
+			return fmt.Errorf("change set messages and expiry require ledger version 2 (see ows ledger upgrade)")
+		}
+
+		cs.Message = changeSetMessage
+
+		if changeSetValidFor > 0 {
+			cs.ValidUntil = cs.Timestamp.Add(changeSetValidFor).Truncate(time.Second)
+		} else if changeSetValidFor < 0 {
+			return fmt.Errorf("invalid --valid-for %s", changeSetValidFor)
+		}
+	}
+
+	sig, err := ledger.SignChangeSet(s.signer(), cs)
 	if err != nil {
 		return err
 	}
 
 	cs.Signatures = []ledger.Signature{sig}
 
+	for _, other := range signers {
+		sig, err := ledger.SignChangeSet(other, cs)
+		if err != nil {
+			return err
+		}
+
+		cs.Signatures = append(cs.Signatures, sig)
+	}
+
 	// Pick node before appending change set locally, because the change set might add a node that isn't yet online
 	nc := s.newAPIClient().PickNode()
 
@@ -152,7 +219,28 @@ func (s *clientState) appendActions(actions ...ledger.Action) error {
 	}
 
 	// Append remotely
-	return nc.AppendChangeSet(cs)
+	ack, err := nc.AppendChangeSet(cs)
+	if err != nil {
+		// the change set isn't part of the nodes' ledger, so it mustn't
+		// remain in the local copy either
+		l := s.ledger()
+
+		if keepErr := l.Keep(l.Height() - 2); keepErr != nil {
+			return fmt.Errorf("%v (unable to discard local change set: %v)", err, keepErr)
+		}
+
+		if writeErr := l.Write(s.ledgerPath()); writeErr != nil {
+			return fmt.Errorf("%v (unable to discard local change set: %v)", err, writeErr)
+		}
+
+		return err
+	}
+
+	if ack == network.ChangeSetCommitted {
+		fmt.Fprintf(os.Stderr, "change set %s committed by a majority of the nodes\n", cs.ID())
+	}
+
+	return nil
 }
 
 func (s *clientState) currentProjectID() ledger.ProjectID {
@@ -240,12 +328,12 @@ func (s *clientState) keyPair() *ledger.KeyPair {
 		p := s.keyPairPath()
 
 		var err error
-		kp, err = ledger.ReadKeyPair(p)
+		kp, err = ledger.ReadKeyPair(p, s.keyPassphrase)
 		if err != nil {
 			if errors.Is(err, os.ErrNotExist) {
 				panic(fmt.Sprintf("client key not found at %s (hint: use `ows key init` to create a new random key)", p))
 			} else {
-				panic(err)
+				panic(fmt.Sprintf("unable to read client key at %s (%v)", p, err))
 			}
 		}
 	}
@@ -255,6 +343,49 @@ func (s *clientState) keyPair() *ledger.KeyPair {
 	return kp
 }
 
+// The key of the current project, which is the client key unless the client
+// key was rotated in another project.
+func (s *clientState) projectKeyPair() *ledger.KeyPair {
+	if _, existsInEnv := ledger.EnvKeyPair(); existsInEnv || s.testDir != "" {
+		return s.keyPair()
+	}
+
+	p := s.projectKeyPairPath(s.currentProjectID())
+
+	kp, err := ledger.ReadKeyPair(p, s.keyPassphrase)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s.keyPair()
+		} else {
+			panic(fmt.Sprintf("unable to read project key at %s (%v)", p, err))
+		}
+	}
+
+	return kp
+}
+
+// The key pair is used in test mode, the signer of the current project is
+// used otherwise.
+func (s *clientState) signer() ledger.Signer {
+	if s.cachedSigner != nil {
+		return s.cachedSigner
+	}
+
+	spec := KeySignerName
+	if s.testDir == "" {
+		spec = s.signerSpec(s.currentProjectID())
+	}
+
+	signer, err := newSigner(spec, s.projectKeyPair)
+	if err != nil {
+		panic(err)
+	}
+
+	s.cachedSigner = signer
+
+	return signer
+}
+
 func (s *clientState) ledger() *ledger.Ledger {
 	if s.cachedLedger != nil {
 		return s.cachedLedger
@@ -289,11 +420,12 @@ func (s *clientState) ledger() *ledger.Ledger {
 		}
 	}
 
-	return l
+	// syncing might have replaced the ledger (see `clientState.RestoreCheckpoint()`)
+	return s.cachedLedger
 }
 
 func (s *clientState) newAPIClient() *network.APIClient {
-	return network.NewAPIClient(s.keyPair(), s)
+	return network.NewAPIClient(s.signer(), s)
 }
 
 func envHomePath(failMessage string) string {
@@ -315,7 +447,12 @@ func saveKeyPair(kp *ledger.KeyPair) error {
 		return fmt.Errorf("an error occured while reading existing key at %s (%v)", p, err)
 	}
 
-	if err := kp.Write(p); err != nil {
+	pp, err := newKeyPassphrase()
+	if err != nil {
+		return err
+	}
+
+	if err := kp.WriteEncrypted(p, pp); err != nil {
 		return fmt.Errorf("failure while writing key to %s (%v)", p, err)
 	}
 
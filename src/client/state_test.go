@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"ows/ledger"
+)
+
+// Unsets the env variable for the duration of the test.
+func unsetenv(t *testing.T, name string) {
+	t.Helper()
+
+	t.Setenv(name, "")
+	os.Unsetenv(name)
+}
+
+// After rotating the client key in one project, the other projects that use
+// the key signer keep using the old key.
+func TestKeepProjectKeys(t *testing.T) {
+	unsetenv(t, ledger.PrivateKeyEnvName)
+	unsetenv(t, SignerEnvName)
+	t.Setenv(XDGConfigPathEnvName, t.TempDir())
+
+	oldKP, err := ledger.RandomKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKP, err := ledger.RandomKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &clientState{projectName: "a"}
+
+	if err := oldKP.Write(s.keyPairPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	projects := map[string]ledger.ProjectID{"a": "project1a", "b": "project1b", "c": "project1c", DefaultProjectName: "project1a"}
+
+	for name, id := range projects {
+		if err := ledger.OverwriteSafe(path.Join(s.projectsConfigPath(), name), []byte(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.saveSignerSpec("project1c", SSHAgentSignerName); err != nil {
+		t.Fatal(err)
+	}
+
+	kept, err := s.keepProjectKeys("project1a", oldKP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(kept, []string{"b"}) {
+		t.Fatalf("expected the old key to be kept for project b, got %v", kept)
+	}
+
+	if err := newKP.Write(s.keyPairPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]*ledger.KeyPair{"a": newKP, "b": oldKP} {
+		other := &clientState{projectName: name}
+
+		if kp := other.projectKeyPair(); kp.Public.UserID() != expected.Public.UserID() {
+			t.Errorf("unexpected key for project %s", name)
+		}
+	}
+
+	// a project keeps its oldest key
+	kept, err = s.keepProjectKeys("project1a", newKP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kept) != 0 {
+		t.Fatalf("expected no project to keep the new key, got %v", kept)
+	}
+}
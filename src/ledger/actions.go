@@ -1,6 +1,9 @@
 package ledger
 
-import ()
+import (
+	"bytes"
+	"fmt"
+)
 
 const (
 	FunctionsCategory  = "functions"
@@ -35,6 +38,10 @@ func (a AddFunction) Apply(s *Snapshot, genID ResourceIDGenerator) error {
 	})
 }
 
+func (a AddFunction) Inverse(_ *Snapshot, genID ResourceIDGenerator) ([]Action, error) {
+	return []Action{RemoveFunction{ID: genID(FunctionIDPrefix)}}, nil
+}
+
 type RemoveFunction struct {
 	ID ResourceID `cbor:"0,keyasint"`
 }
@@ -55,12 +62,29 @@ func (a RemoveFunction) Apply(s *Snapshot, _ ResourceIDGenerator) error {
 	return s.RemoveFunction(a.ID)
 }
 
+// A removed function can't be restored, because adding it again would
+// generate a different function id.
+func (a RemoveFunction) Inverse(_ *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	return nil, fmt.Errorf("removed function %s can't be restored with the same id", a.ID)
+}
+
 const (
-	GatewaysCategory          = "gateways"
-	AddGatewayName            = "Add"
-	AddGatewayEndpointName    = "AddEndpoint"
-	RemoveGatewayName         = "Remove"
-	RemoveGatewayEndpointName = "RemoveEndpoint"
+	GatewaysCategory                 = "gateways"
+	AddGatewayName                   = "Add"
+	AddGatewayEndpointName           = "AddEndpoint"
+	RemoveGatewayName                = "Remove"
+	RemoveGatewayEndpointName        = "RemoveEndpoint"
+	SetGatewayAPIKeyQuotaName        = "SetAPIKeyQuota"
+	SetGatewayCORSName               = "SetCORS"
+	SetGatewayEndpointAuthorizerName = "SetEndpointAuthorizer"
+	SetGatewayEndpointTransformName  = "SetEndpointTransform"
+	SetGatewayRateLimitName          = "SetRateLimit"
+	UpdateGatewayName                = "Update"
+
+	// Not a ledger action. Policies allowing this action on a gateway id
+	// allow the user to invoke endpoints protected by an "ows-key"
+	// authorizer.
+	InvokeGatewayName = "Invoke"
 )
 
 type AddGateway struct {
@@ -88,6 +112,10 @@ func (a AddGateway) Apply(s *Snapshot, genID ResourceIDGenerator) error {
 	})
 }
 
+func (a AddGateway) Inverse(_ *Snapshot, genID ResourceIDGenerator) ([]Action, error) {
+	return []Action{RemoveGateway{ID: genID(GatewayIDPrefix)}}, nil
+}
+
 // Valid methods are "GET", "POST", "PUT", "PATCH", or "DELETE".
 // FunctionID refers to the handler that will be invoked when the endpoint is
 // requested.
@@ -124,6 +152,14 @@ func (a AddGatewayEndpoint) Apply(s *Snapshot, _ ResourceIDGenerator) error {
 	})
 }
 
+func (a AddGatewayEndpoint) Inverse(_ *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	return []Action{RemoveGatewayEndpoint{
+		GatewayID: a.GatewayID,
+		Method:    a.Method,
+		Path:      a.Path,
+	}}, nil
+}
+
 type RemoveGateway struct {
 	ID GatewayID `cbor:"0,keyasint"`
 }
@@ -144,6 +180,12 @@ func (a RemoveGateway) Apply(s *Snapshot, _ ResourceIDGenerator) error {
 	return s.RemoveGateway(a.ID)
 }
 
+// A removed gateway can't be restored, because adding it again would generate
+// a different gateway id.
+func (a RemoveGateway) Inverse(_ *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	return nil, fmt.Errorf("removed gateway %s can't be restored with the same id", a.ID)
+}
+
 type RemoveGatewayEndpoint struct {
 	GatewayID GatewayID `cbor:"0,keyasint"`
 	Method    string    `cbor:"1,keyasint"`
@@ -166,10 +208,407 @@ func (a RemoveGatewayEndpoint) Apply(s *Snapshot, _ ResourceIDGenerator) error {
 	return s.RemoveGatewayEndpoint(a.GatewayID, a.Method, a.Path)
 }
 
+// The endpoint is added again, along with its authorizer, rate limit and
+// transform.
+func (a RemoveGatewayEndpoint) Inverse(s *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	ep, err := s.gatewayEndpoint(a.GatewayID, a.Method, a.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	inverse := []Action{AddGatewayEndpoint{
+		GatewayID:  a.GatewayID,
+		Method:     a.Method,
+		Path:       a.Path,
+		FunctionID: ep.FunctionID,
+	}}
+
+	if ep.Authorizer != nil {
+		inverse = append(inverse, newSetGatewayEndpointAuthorizer(a.GatewayID, a.Method, a.Path, ep.Authorizer))
+	}
+
+	if ep.RateLimit != nil {
+		inverse = append(inverse, newSetGatewayRateLimit(a.GatewayID, a.Method, a.Path, ep.RateLimit))
+	}
+
+	if ep.Transform != nil {
+		inverse = append(inverse, newSetGatewayEndpointTransform(a.GatewayID, a.Method, a.Path, ep.Transform))
+	}
+
+	return inverse, nil
+}
+
+// Changes the port of a gateway. The endpoints and other settings of the
+// gateway are kept.
+type UpdateGateway struct {
+	ID   GatewayID `cbor:"0,keyasint"`
+	Port Port      `cbor:"1,keyasint"`
+}
+
+func (a UpdateGateway) Category() string {
+	return GatewaysCategory
+}
+
+func (a UpdateGateway) Name() string {
+	return UpdateGatewayName
+}
+
+func (a UpdateGateway) Resources() []ResourceID {
+	return []ResourceID{a.ID}
+}
+
+func (a UpdateGateway) Apply(s *Snapshot, _ ResourceIDGenerator) error {
+	return s.UpdateGateway(a.ID, a.Port)
+}
+
+func (a UpdateGateway) Inverse(s *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	conf, ok := s.Gateways[a.ID]
+	if !ok {
+		return nil, fmt.Errorf("gateway %s doesn't exist", a.ID)
+	}
+
+	return []Action{UpdateGateway{ID: a.ID, Port: conf.Port}}, nil
+}
+
+// An empty Type removes the authorizer, making the endpoint public again.
+//
+// See `GatewayAuthorizerConfig` for the meaning of the other fields.
+type SetGatewayEndpointAuthorizer struct {
+	GatewayID     GatewayID  `cbor:"0,keyasint"`
+	Method        string     `cbor:"1,keyasint"`
+	Path          string     `cbor:"2,keyasint"`
+	Type          string     `cbor:"3,keyasint"`
+	APIKeyDigests [][]byte   `cbor:"4,keyasint,omitempty"`
+	JWKSURL       string     `cbor:"5,keyasint,omitempty"`
+	JWTKeys       []string   `cbor:"6,keyasint,omitempty"`
+	JWTIssuer     string     `cbor:"7,keyasint,omitempty"`
+	JWTAudience   string     `cbor:"8,keyasint,omitempty"`
+	FunctionID    FunctionID `cbor:"9,keyasint,omitempty"`
+}
+
+func (a SetGatewayEndpointAuthorizer) Category() string {
+	return GatewaysCategory
+}
+
+func (a SetGatewayEndpointAuthorizer) Name() string {
+	return SetGatewayEndpointAuthorizerName
+}
+
+func (a SetGatewayEndpointAuthorizer) Resources() []ResourceID {
+	return []ResourceID{a.GatewayID}
+}
+
+func (a SetGatewayEndpointAuthorizer) Apply(s *Snapshot, _ ResourceIDGenerator) error {
+	if a.Type == "" {
+		return s.SetGatewayEndpointAuthorizer(a.GatewayID, a.Method, a.Path, nil)
+	}
+
+	return s.SetGatewayEndpointAuthorizer(a.GatewayID, a.Method, a.Path, &GatewayAuthorizerConfig{
+		Type:          a.Type,
+		APIKeyDigests: a.APIKeyDigests,
+		JWKSURL:       a.JWKSURL,
+		JWTKeys:       a.JWTKeys,
+		JWTIssuer:     a.JWTIssuer,
+		JWTAudience:   a.JWTAudience,
+		FunctionID:    a.FunctionID,
+	})
+}
+
+func (a SetGatewayEndpointAuthorizer) Inverse(s *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	ep, err := s.gatewayEndpoint(a.GatewayID, a.Method, a.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return []Action{newSetGatewayEndpointAuthorizer(a.GatewayID, a.Method, a.Path, ep.Authorizer)}, nil
+}
+
+// Rate limits the whole gateway if Method and Path are empty, otherwise only
+// rate limits the given endpoint. A zero Rate removes the rate limit.
+type SetGatewayRateLimit struct {
+	GatewayID GatewayID `cbor:"0,keyasint"`
+	Method    string    `cbor:"1,keyasint,omitempty"`
+	Path      string    `cbor:"2,keyasint,omitempty"`
+	Rate      float64   `cbor:"3,keyasint"`
+	Burst     uint      `cbor:"4,keyasint"`
+	Cluster   bool      `cbor:"5,keyasint,omitempty"`
+}
+
+func (a SetGatewayRateLimit) Category() string {
+	return GatewaysCategory
+}
+
+func (a SetGatewayRateLimit) Name() string {
+	return SetGatewayRateLimitName
+}
+
+func (a SetGatewayRateLimit) Resources() []ResourceID {
+	return []ResourceID{a.GatewayID}
+}
+
+func (a SetGatewayRateLimit) Apply(s *Snapshot, _ ResourceIDGenerator) error {
+	var config *RateLimitConfig
+
+	if a.Rate != 0 {
+		config = &RateLimitConfig{
+			Rate:    a.Rate,
+			Burst:   a.Burst,
+			Cluster: a.Cluster,
+		}
+	}
+
+	return s.SetGatewayRateLimit(a.GatewayID, a.Method, a.Path, config)
+}
+
+func (a SetGatewayRateLimit) Inverse(s *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	if a.Method == "" && a.Path == "" {
+		conf, ok := s.Gateways[a.GatewayID]
+		if !ok {
+			return nil, fmt.Errorf("gateway %s doesn't exist", a.GatewayID)
+		}
+
+		return []Action{newSetGatewayRateLimit(a.GatewayID, "", "", conf.RateLimit)}, nil
+	}
+
+	ep, err := s.gatewayEndpoint(a.GatewayID, a.Method, a.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return []Action{newSetGatewayRateLimit(a.GatewayID, a.Method, a.Path, ep.RateLimit)}, nil
+}
+
+// A zero Limit removes the quota of the API key.
+type SetGatewayAPIKeyQuota struct {
+	GatewayID    GatewayID `cbor:"0,keyasint"`
+	APIKeyDigest []byte    `cbor:"1,keyasint"`
+	Limit        uint      `cbor:"2,keyasint"`
+	Period       uint      `cbor:"3,keyasint"`
+	Cluster      bool      `cbor:"4,keyasint,omitempty"`
+}
+
+func (a SetGatewayAPIKeyQuota) Category() string {
+	return GatewaysCategory
+}
+
+func (a SetGatewayAPIKeyQuota) Name() string {
+	return SetGatewayAPIKeyQuotaName
+}
+
+func (a SetGatewayAPIKeyQuota) Resources() []ResourceID {
+	return []ResourceID{a.GatewayID}
+}
+
+func (a SetGatewayAPIKeyQuota) Apply(s *Snapshot, _ ResourceIDGenerator) error {
+	return s.SetGatewayAPIKeyQuota(a.GatewayID, APIKeyQuotaConfig{
+		APIKeyDigest: a.APIKeyDigest,
+		Limit:        a.Limit,
+		Period:       a.Period,
+		Cluster:      a.Cluster,
+	})
+}
+
+func (a SetGatewayAPIKeyQuota) Inverse(s *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	conf, ok := s.Gateways[a.GatewayID]
+	if !ok {
+		return nil, fmt.Errorf("gateway %s doesn't exist", a.GatewayID)
+	}
+
+	for _, q := range conf.APIKeyQuotas {
+		if bytes.Equal(q.APIKeyDigest, a.APIKeyDigest) {
+			return []Action{SetGatewayAPIKeyQuota{
+				GatewayID:    a.GatewayID,
+				APIKeyDigest: q.APIKeyDigest,
+				Limit:        q.Limit,
+				Period:       q.Period,
+				Cluster:      q.Cluster,
+			}}, nil
+		}
+	}
+
+	// the API key didn't have a quota before
+	return []Action{SetGatewayAPIKeyQuota{
+		GatewayID:    a.GatewayID,
+		APIKeyDigest: a.APIKeyDigest,
+	}}, nil
+}
+
+// Empty AllowOrigins removes the CORS configuration of the gateway.
+//
+// See `CORSConfig` for the meaning of the other fields.
+type SetGatewayCORS struct {
+	GatewayID        GatewayID `cbor:"0,keyasint"`
+	AllowOrigins     []string  `cbor:"1,keyasint,omitempty"`
+	AllowMethods     []string  `cbor:"2,keyasint,omitempty"`
+	AllowHeaders     []string  `cbor:"3,keyasint,omitempty"`
+	ExposeHeaders    []string  `cbor:"4,keyasint,omitempty"`
+	MaxAge           uint      `cbor:"5,keyasint,omitempty"`
+	AllowCredentials bool      `cbor:"6,keyasint,omitempty"`
+}
+
+func (a SetGatewayCORS) Category() string {
+	return GatewaysCategory
+}
+
+func (a SetGatewayCORS) Name() string {
+	return SetGatewayCORSName
+}
+
+func (a SetGatewayCORS) Resources() []ResourceID {
+	return []ResourceID{a.GatewayID}
+}
+
+func (a SetGatewayCORS) Apply(s *Snapshot, _ ResourceIDGenerator) error {
+	if len(a.AllowOrigins) == 0 {
+		return s.SetGatewayCORS(a.GatewayID, nil)
+	}
+
+	return s.SetGatewayCORS(a.GatewayID, &CORSConfig{
+		AllowOrigins:     a.AllowOrigins,
+		AllowMethods:     a.AllowMethods,
+		AllowHeaders:     a.AllowHeaders,
+		ExposeHeaders:    a.ExposeHeaders,
+		MaxAge:           a.MaxAge,
+		AllowCredentials: a.AllowCredentials,
+	})
+}
+
+func (a SetGatewayCORS) Inverse(s *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	conf, ok := s.Gateways[a.GatewayID]
+	if !ok {
+		return nil, fmt.Errorf("gateway %s doesn't exist", a.GatewayID)
+	}
+
+	inverse := SetGatewayCORS{GatewayID: a.GatewayID}
+
+	if c := conf.CORS; c != nil {
+		inverse.AllowOrigins = c.AllowOrigins
+		inverse.AllowMethods = c.AllowMethods
+		inverse.AllowHeaders = c.AllowHeaders
+		inverse.ExposeHeaders = c.ExposeHeaders
+		inverse.MaxAge = c.MaxAge
+		inverse.AllowCredentials = c.AllowCredentials
+	}
+
+	return []Action{inverse}, nil
+}
+
+// Replaces the transform of an endpoint. If all the transform fields are empty,
+// the transform is removed.
+//
+// See `TransformConfig` for the meaning of the other fields.
+type SetGatewayEndpointTransform struct {
+	GatewayID             GatewayID     `cbor:"0,keyasint"`
+	Method                string        `cbor:"1,keyasint"`
+	Path                  string        `cbor:"2,keyasint"`
+	SetRequestHeaders     []HeaderValue `cbor:"3,keyasint,omitempty"`
+	RemoveRequestHeaders  []string      `cbor:"4,keyasint,omitempty"`
+	SetResponseHeaders    []HeaderValue `cbor:"5,keyasint,omitempty"`
+	RemoveResponseHeaders []string      `cbor:"6,keyasint,omitempty"`
+	RequestTemplate       string        `cbor:"7,keyasint,omitempty"`
+	ResponseTemplate      string        `cbor:"8,keyasint,omitempty"`
+}
+
+func (a SetGatewayEndpointTransform) Category() string {
+	return GatewaysCategory
+}
+
+func (a SetGatewayEndpointTransform) Name() string {
+	return SetGatewayEndpointTransformName
+}
+
+func (a SetGatewayEndpointTransform) Resources() []ResourceID {
+	return []ResourceID{a.GatewayID}
+}
+
+func (a SetGatewayEndpointTransform) Apply(s *Snapshot, _ ResourceIDGenerator) error {
+	config := &TransformConfig{
+		SetRequestHeaders:     a.SetRequestHeaders,
+		RemoveRequestHeaders:  a.RemoveRequestHeaders,
+		SetResponseHeaders:    a.SetResponseHeaders,
+		RemoveResponseHeaders: a.RemoveResponseHeaders,
+		RequestTemplate:       a.RequestTemplate,
+		ResponseTemplate:      a.ResponseTemplate,
+	}
+
+	if len(config.SetRequestHeaders) == 0 && len(config.RemoveRequestHeaders) == 0 &&
+		len(config.SetResponseHeaders) == 0 && len(config.RemoveResponseHeaders) == 0 &&
+		config.RequestTemplate == "" && config.ResponseTemplate == "" {
+		config = nil
+	}
+
+	return s.SetGatewayEndpointTransform(a.GatewayID, a.Method, a.Path, config)
+}
+
+func (a SetGatewayEndpointTransform) Inverse(s *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	ep, err := s.gatewayEndpoint(a.GatewayID, a.Method, a.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return []Action{newSetGatewayEndpointTransform(a.GatewayID, a.Method, a.Path, ep.Transform)}, nil
+}
+
 const (
-	NodesCategory  = "nodes"
-	AddNodeName    = "Add"
-	RemoveNodeName = "Remove"
+	MetricsCategory      = "metrics"
+	ConfigureMetricsName = "Configure"
+
+	// Not a ledger action. Policies allowing this action on a node id allow
+	// the user to read the metrics of that node.
+	ReadMetricsName = "Read"
+)
+
+// Enables the metrics endpoint of all nodes on Port. A zero Port disables the
+// metrics endpoint.
+//
+// See `MetricsConfig` for the meaning of AllowedNetworks.
+type ConfigureMetrics struct {
+	Port            Port     `cbor:"0,keyasint"`
+	AllowedNetworks []string `cbor:"1,keyasint,omitempty"`
+}
+
+func (a ConfigureMetrics) Category() string {
+	return MetricsCategory
+}
+
+func (a ConfigureMetrics) Name() string {
+	return ConfigureMetricsName
+}
+
+func (a ConfigureMetrics) Resources() []ResourceID {
+	return []ResourceID{GlobalResourceID}
+}
+
+func (a ConfigureMetrics) Apply(s *Snapshot, _ ResourceIDGenerator) error {
+	if a.Port == 0 {
+		return s.ConfigureMetrics(nil)
+	}
+
+	return s.ConfigureMetrics(&MetricsConfig{
+		Port:            a.Port,
+		AllowedNetworks: a.AllowedNetworks,
+	})
+}
+
+func (a ConfigureMetrics) Inverse(s *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	if s.Metrics == nil {
+		return []Action{ConfigureMetrics{}}, nil
+	}
+
+	return []Action{ConfigureMetrics{
+		Port:            s.Metrics.Port,
+		AllowedNetworks: s.Metrics.AllowedNetworks,
+	}}, nil
+}
+
+const (
+	NodesCategory          = "nodes"
+	AddNodeName            = "Add"
+	ConfigureConsensusName = "ConfigureConsensus"
+	RemoveNodeName         = "Remove"
+	RotateNodeKeyName      = "RotateKey"
+	UpdateNodeAddressName  = "UpdateAddress"
+	UpdateNodePortsName    = "UpdatePorts"
 )
 
 // When applied, creates a node with all the properties in NodeConfig.
@@ -207,6 +646,39 @@ func (a AddNode) Apply(s *Snapshot, _ ResourceIDGenerator) error {
 	})
 }
 
+func (a AddNode) Inverse(_ *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	return []Action{RemoveNode{ID: a.Key.NodeID()}}, nil
+}
+
+// Enables or disables consensus-based ordering of change sets. When enabled, a
+// change set submitted to a node is only committed once a majority of the
+// nodes has accepted it.
+type ConfigureConsensus struct {
+	Enabled bool `cbor:"0,keyasint"`
+}
+
+func (a ConfigureConsensus) Category() string {
+	return NodesCategory
+}
+
+func (a ConfigureConsensus) Name() string {
+	return ConfigureConsensusName
+}
+
+func (a ConfigureConsensus) Resources() []ResourceID {
+	return []ResourceID{GlobalResourceID}
+}
+
+func (a ConfigureConsensus) Apply(s *Snapshot, _ ResourceIDGenerator) error {
+	s.Consensus = a.Enabled
+
+	return nil
+}
+
+func (a ConfigureConsensus) Inverse(s *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	return []Action{ConfigureConsensus{Enabled: s.Consensus}}, nil
+}
+
 type RemoveNode struct {
 	ID ResourceID `cbor:"0,keyasint"`
 }
@@ -227,9 +699,149 @@ func (a RemoveNode) Apply(s *Snapshot, _ ResourceIDGenerator) error {
 	return s.RemoveNode(a.ID)
 }
 
+// Node ids are derived from the node keys, so a removed node can be added
+// again, unless its key was rotated.
+func (a RemoveNode) Inverse(s *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	conf, ok := s.Nodes[a.ID]
+	if !ok {
+		return nil, fmt.Errorf("node %s doesn't exist", a.ID)
+	}
+
+	if conf.Key.NodeID() != a.ID {
+		return nil, fmt.Errorf("node %s can't be added again, because its key was rotated", a.ID)
+	}
+
+	return []Action{AddNode{
+		Key:        conf.Key,
+		Address:    conf.Address,
+		GossipPort: conf.GossipPort,
+		APIPort:    conf.APIPort,
+	}}, nil
+}
+
+// Replaces the key of a node. The node id is still derived from the original
+// key, so the node keeps its identity (eg. for asset placement).
+//
+// Besides the signatures required by the policies, the change set must be
+// signed by both the old and the new key (see `Snapshot.CheckChangeSet()`).
+type RotateNodeKey struct {
+	ID  NodeID    `cbor:"0,keyasint"`
+	Key PublicKey `cbor:"1,keyasint"`
+}
+
+func (a RotateNodeKey) Category() string {
+	return NodesCategory
+}
+
+func (a RotateNodeKey) Name() string {
+	return RotateNodeKeyName
+}
+
+func (a RotateNodeKey) Resources() []ResourceID {
+	return []ResourceID{a.ID}
+}
+
+func (a RotateNodeKey) Apply(s *Snapshot, _ ResourceIDGenerator) error {
+	return s.UpdateNode(a.ID, func(conf *NodeConfig) error {
+		if other, ok := s.FindNode(a.Key); ok {
+			return fmt.Errorf("key already used by node %s", other)
+		}
+
+		conf.Key = a.Key
+
+		return nil
+	})
+}
+
+// Rotating back requires the signature of the old key again, which is
+// possible as long as it isn't compromised.
+func (a RotateNodeKey) Inverse(s *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	conf, ok := s.Nodes[a.ID]
+	if !ok {
+		return nil, fmt.Errorf("node %s doesn't exist", a.ID)
+	}
+
+	return []Action{RotateNodeKey{ID: a.ID, Key: conf.Key}}, nil
+}
+
+type UpdateNodeAddress struct {
+	ID      NodeID `cbor:"0,keyasint"`
+	Address string `cbor:"1,keyasint"`
+}
+
+func (a UpdateNodeAddress) Category() string {
+	return NodesCategory
+}
+
+func (a UpdateNodeAddress) Name() string {
+	return UpdateNodeAddressName
+}
+
+func (a UpdateNodeAddress) Resources() []ResourceID {
+	return []ResourceID{a.ID}
+}
+
+func (a UpdateNodeAddress) Apply(s *Snapshot, _ ResourceIDGenerator) error {
+	return s.UpdateNode(a.ID, func(conf *NodeConfig) error {
+		conf.Address = a.Address
+
+		return nil
+	})
+}
+
+func (a UpdateNodeAddress) Inverse(s *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	conf, ok := s.Nodes[a.ID]
+	if !ok {
+		return nil, fmt.Errorf("node %s doesn't exist", a.ID)
+	}
+
+	return []Action{UpdateNodeAddress{ID: a.ID, Address: conf.Address}}, nil
+}
+
+type UpdateNodePorts struct {
+	ID         NodeID `cbor:"0,keyasint"`
+	GossipPort Port   `cbor:"1,keyasint"`
+	APIPort    Port   `cbor:"2,keyasint"`
+}
+
+func (a UpdateNodePorts) Category() string {
+	return NodesCategory
+}
+
+func (a UpdateNodePorts) Name() string {
+	return UpdateNodePortsName
+}
+
+func (a UpdateNodePorts) Resources() []ResourceID {
+	return []ResourceID{a.ID}
+}
+
+func (a UpdateNodePorts) Apply(s *Snapshot, _ ResourceIDGenerator) error {
+	return s.UpdateNode(a.ID, func(conf *NodeConfig) error {
+		conf.GossipPort = a.GossipPort
+		conf.APIPort = a.APIPort
+
+		return nil
+	})
+}
+
+func (a UpdateNodePorts) Inverse(s *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	conf, ok := s.Nodes[a.ID]
+	if !ok {
+		return nil, fmt.Errorf("node %s doesn't exist", a.ID)
+	}
+
+	return []Action{UpdateNodePorts{
+		ID:         a.ID,
+		GossipPort: conf.GossipPort,
+		APIPort:    conf.APIPort,
+	}}, nil
+}
+
 const (
 	PermissionsCategory = "permissions"
 	AddUserName         = "AddUser"
+	RotateUserKeyName   = "RotateUserKey"
 )
 
 type AddUser struct {
@@ -256,3 +868,85 @@ func (a AddUser) Apply(s *Snapshot, _ ResourceIDGenerator) error {
 		Policies: []ResourceID{},
 	})
 }
+
+// There is no action to remove users yet.
+func (a AddUser) Inverse(_ *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	return nil, fmt.Errorf("user %s can't be removed", a.Key.UserID())
+}
+
+// Replaces the user with the old key by a user with the new key. User ids are
+// derived from the keys, so the id changes, but root status and attached
+// policies are carried over.
+//
+// Besides the signatures required by the policies, the change set must be
+// signed by both the old and the new key (see `Snapshot.CheckChangeSet()`).
+type RotateUserKey struct {
+	OldKey PublicKey `cbor:"0,keyasint"`
+	NewKey PublicKey `cbor:"1,keyasint"`
+}
+
+func (a RotateUserKey) Category() string {
+	return PermissionsCategory
+}
+
+func (a RotateUserKey) Name() string {
+	return RotateUserKeyName
+}
+
+func (a RotateUserKey) Resources() []ResourceID {
+	return []ResourceID{a.OldKey.UserID()}
+}
+
+func (a RotateUserKey) Apply(s *Snapshot, _ ResourceIDGenerator) error {
+	return s.RotateUserKey(a.OldKey, a.NewKey)
+}
+
+func (a RotateUserKey) Inverse(_ *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	return []Action{RotateUserKey{OldKey: a.NewKey, NewKey: a.OldKey}}, nil
+}
+
+const (
+	LedgerCategory           = "ledger"
+	UpgradeLedgerVersionName = "UpgradeVersion"
+)
+
+// Switches the ledger to a newer version. The change set containing this
+// action is still encoded using the previous version, the following change
+// sets are encoded using the new version.
+//
+// Only root users can upgrade the ledger (see `Snapshot.CheckChangeSet()`).
+type UpgradeLedgerVersion struct {
+	Version LedgerVersion `cbor:"0,keyasint"`
+}
+
+func (a UpgradeLedgerVersion) Category() string {
+	return LedgerCategory
+}
+
+func (a UpgradeLedgerVersion) Name() string {
+	return UpgradeLedgerVersionName
+}
+
+func (a UpgradeLedgerVersion) Resources() []ResourceID {
+	return []ResourceID{GlobalResourceID}
+}
+
+func (a UpgradeLedgerVersion) Apply(s *Snapshot, _ ResourceIDGenerator) error {
+	if a.Version <= s.Version {
+		return fmt.Errorf("can't upgrade ledger from version %d to version %d", s.Version, a.Version)
+	}
+
+	if a.Version > LatestLedgerVersion {
+		return fmt.Errorf("unsupported ledger version %d (latest is %d)", a.Version, LatestLedgerVersion)
+	}
+
+	s.Version = a.Version
+
+	return nil
+}
+
+// Ledger versions can't be downgraded, because older versions can't encode
+// everything newer versions can.
+func (a UpgradeLedgerVersion) Inverse(s *Snapshot, _ ResourceIDGenerator) ([]Action, error) {
+	return nil, fmt.Errorf("ledger version %d can't be downgraded", a.Version)
+}
@@ -0,0 +1,140 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Node addresses are IPv4 addresses, IPv6 addresses (without brackets or
+// zone), or DNS names. Ports are configured separately.
+func ValidateAddress(address string) error {
+	if address == "" {
+		return errors.New("empty address")
+	}
+
+	if ip := net.ParseIP(address); ip != nil {
+		if ip.IsUnspecified() || ip.IsMulticast() {
+			return fmt.Errorf("address %s can't be used to reach a node", address)
+		}
+
+		return nil
+	}
+
+	if strings.ContainsAny(address, "[]:%") {
+		return fmt.Errorf("invalid IP address %s (IPv6 addresses must be given without brackets, port or zone)", address)
+	}
+
+	if err := validateDNSName(address); err != nil {
+		return fmt.Errorf("invalid address %s (%v)", address, err)
+	}
+
+	return nil
+}
+
+func validateDNSName(name string) error {
+	name = strings.TrimSuffix(name, ".")
+
+	if len(name) > 253 {
+		return errors.New("DNS name longer than 253 characters")
+	}
+
+	labels := strings.Split(name, ".")
+
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return errors.New("DNS labels must be 1 to 63 characters long")
+		}
+
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("DNS label %s starts or ends with a hyphen", label)
+		}
+
+		for _, c := range label {
+			if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-') {
+				return fmt.Errorf("invalid character %q in DNS label %s", c, label)
+			}
+		}
+	}
+
+	// otherwise invalid IPv4 addresses (eg. 1.2.3.256) would be accepted
+	if tld := labels[len(labels)-1]; strings.Trim(tld, "0123456789") == "" {
+		return errors.New("all-numeric top-level domain")
+	}
+
+	return nil
+}
+
+// Addresses of the same host map to the same key. Hosts using different DNS
+// names, or a DNS name and an IP address, can't be recognized as the same host.
+func hostKey(address string) string {
+	if ip := net.ParseIP(address); ip != nil {
+		if ip.IsLoopback() {
+			return "localhost"
+		}
+
+		return ip.String()
+	}
+
+	return strings.ToLower(strings.TrimSuffix(address, "."))
+}
+
+// Gateways and the metrics endpoint are served by every node, so their ports
+// can't be used by any node. Node ports only conflict with the ports of other
+// nodes on the same host.
+//
+// Only checked from ledger version 3 onwards, so that older ledgers containing
+// such node configs can still be replayed.
+func (s *Snapshot) checkNodeConfig(id NodeID, config NodeConfig) error {
+	if s.Version < 3 {
+		return nil
+	}
+
+	if err := ValidateAddress(config.Address); err != nil {
+		return err
+	}
+
+	if config.GossipPort == 0 || config.APIPort == 0 {
+		return fmt.Errorf("ports of node %s can't be 0", id)
+	}
+
+	if config.GossipPort == config.APIPort {
+		return fmt.Errorf("gossip port and api port of node %s are both %d", id, config.APIPort)
+	}
+
+	for _, port := range []Port{config.GossipPort, config.APIPort} {
+		for gatewayID, gateway := range s.Gateways {
+			if gateway.Port == port {
+				return fmt.Errorf("port %d already used by %s", port, gatewayID)
+			}
+		}
+
+		if s.Metrics != nil && s.Metrics.Port == port {
+			return fmt.Errorf("port %d already used by metrics endpoint", port)
+		}
+	}
+
+	host := hostKey(config.Address)
+
+	for otherID, other := range s.Nodes {
+		if otherID == id || hostKey(other.Address) != host {
+			continue
+		}
+
+		for _, port := range []Port{config.GossipPort, config.APIPort} {
+			if port == other.GossipPort || port == other.APIPort {
+				return fmt.Errorf("port %d already used by %s on %s", port, otherID, other.Address)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Joins an address and a port, with brackets around IPv6 addresses (eg. for
+// URLs).
+func JoinHostPort(address string, port Port) string {
+	return net.JoinHostPort(address, strconv.Itoa(int(port)))
+}
@@ -0,0 +1,177 @@
+package ledger
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		valid   bool
+	}{
+		{"127.0.0.1", true},
+		{"192.168.1.20", true},
+		{"::1", true},
+		{"2001:db8::8a2e:370:7334", true},
+		{"::ffff:10.0.0.1", true},
+		{"localhost", true},
+		{"node-1.example.com", true},
+		{"node-1.example.com.", true},
+		{"xn--bcher-kva.example", true},
+		{"", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"1.2.3.256", false},
+		{"1.2.3", false},
+		{"[::1]", false},
+		{"fe80::1%eth0", false},
+		{"127.0.0.1:9000", false},
+		{"example.com:443", false},
+		{"-node.example.com", false},
+		{"node-.example.com", false},
+		{"node..example.com", false},
+		{"node_1.example.com", false},
+		{"https://example.com", false},
+		{strings.Repeat("a", 64) + ".example.com", false},
+		{strings.Repeat("a.", 127) + "com", false},
+	}
+
+	for _, test := range tests {
+		err := ValidateAddress(test.address)
+
+		if test.valid && err != nil {
+			t.Errorf("expected %q to be valid, got %v", test.address, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("expected %q to be invalid", test.address)
+		}
+	}
+}
+
+func TestNodePortConflicts(t *testing.T) {
+	node1 := goldenKeyPair(t, 1).Public
+	node2 := goldenKeyPair(t, 2).Public
+	node3 := goldenKeyPair(t, 3).Public
+
+	// node1 and node2 run on the same host, the gateway and the metrics
+	// endpoint run on every node
+	newTestSnapshot := func() *Snapshot {
+		s := newSnapshot(LatestLedgerVersion)
+
+		s.Nodes[node1.NodeID()] = NodeConfig{Key: node1, Address: "10.0.0.1", GossipPort: 9000, APIPort: 9001}
+		s.Nodes[node2.NodeID()] = NodeConfig{Key: node2, Address: "10.0.0.1", GossipPort: 9002, APIPort: 9003}
+		s.Gateways["gateway1"] = GatewayConfig{Port: 8080}
+		s.Metrics = &MetricsConfig{Port: 9100}
+
+		return s
+	}
+
+	tests := []struct {
+		name   string
+		action Action
+		err    string // empty if the action must succeed
+	}{
+		{"other ports on same host", AddNode{Key: node3, Address: "10.0.0.1", GossipPort: 9004, APIPort: 9005}, ""},
+		{"same ports on other host", AddNode{Key: node3, Address: "10.0.0.2", GossipPort: 9000, APIPort: 9001}, ""},
+		{"same ports on IPv6 host", AddNode{Key: node3, Address: "2001:db8::1", GossipPort: 9000, APIPort: 9001}, ""},
+		{"gossip port used on same host", AddNode{Key: node3, Address: "10.0.0.1", GossipPort: 9003, APIPort: 9005}, "port 9003 already used"},
+		{"api port used on same host", AddNode{Key: node3, Address: "10.0.0.1", GossipPort: 9004, APIPort: 9000}, "port 9000 already used"},
+		{"same IPv4 host in IPv6 notation", AddNode{Key: node3, Address: "::ffff:10.0.0.1", GossipPort: 9000, APIPort: 9005}, "port 9000 already used"},
+		{"gateway port on other host", AddNode{Key: node3, Address: "10.0.0.2", GossipPort: 8080, APIPort: 9005}, "port 8080 already used by gateway1"},
+		{"metrics port on other host", AddNode{Key: node3, Address: "10.0.0.2", GossipPort: 9004, APIPort: 9100}, "port 9100 already used by metrics"},
+		{"gossip port equal to api port", AddNode{Key: node3, Address: "10.0.0.2", GossipPort: 9004, APIPort: 9004}, "are both 9004"},
+		{"zero port", AddNode{Key: node3, Address: "10.0.0.2", GossipPort: 0, APIPort: 9004}, "can't be 0"},
+		{"invalid address", AddNode{Key: node3, Address: "10.0.0.2:9000", GossipPort: 9004, APIPort: 9005}, "invalid IP address"},
+		{"swap own ports", UpdateNodePorts{ID: node1.NodeID(), GossipPort: 9001, APIPort: 9000}, ""},
+		{"ports of other node on same host", UpdateNodePorts{ID: node1.NodeID(), GossipPort: 9002, APIPort: 9001}, "port 9002 already used"},
+		{"ports of gateway", UpdateNodePorts{ID: node1.NodeID(), GossipPort: 9000, APIPort: 8080}, "port 8080 already used by gateway1"},
+		{"move to other host", UpdateNodeAddress{ID: node1.NodeID(), Address: "node1.example.com"}, ""},
+		{"move to invalid address", UpdateNodeAddress{ID: node1.NodeID(), Address: "[::1]"}, "invalid IP address"},
+		{"gateway on node port", AddGateway{Port: 9003}, "port 9003 already used"},
+		{"gateway on free port", AddGateway{Port: 8081}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.action.Apply(newTestSnapshot(), func(string) ResourceID { return "gateway2" })
+
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("expected success, got %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	// loopback addresses all refer to the same host
+	s := newTestSnapshot()
+
+	if err := s.AddNode(node3.NodeID(), NodeConfig{Key: node3, Address: "127.0.0.1", GossipPort: 9004, APIPort: 9005}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, address := range []string{"localhost", "::1", "127.0.0.2"} {
+		err := s.UpdateNode(node2.NodeID(), func(conf *NodeConfig) error {
+			conf.Address = address
+			conf.GossipPort = 9005
+
+			return nil
+		})
+
+		if err == nil {
+			t.Fatalf("expected port conflict between 127.0.0.1 and %s", address)
+		}
+	}
+}
+
+// Node configs are only checked from ledger version 3 onwards, so older
+// ledgers containing conflicting nodes can still be replayed.
+func TestNodeConfigVersion(t *testing.T) {
+	root := goldenKeyPair(t, 1)
+
+	initial := NewInitialChangeSet(2, AddNode{Key: root.Public, Address: "10.0.0.1", GossipPort: 9000, APIPort: 9001})
+
+	sig, err := root.SignChangeSet(initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initial.Signatures = []Signature{sig}
+
+	l, err := NewLedger(2, initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appendSigned(t, l, root, l.NewChangeSet(
+		AddNode{Key: goldenKeyPair(t, 2).Public, Address: "10.0.0.1", GossipPort: 9000, APIPort: 9001},
+		AddNode{Key: goldenKeyPair(t, 3).Public, Address: "10.0.0.3:9000", GossipPort: 9000, APIPort: 9000},
+	))
+
+	decoded, err := DecodeLedger(l.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Head() != l.Head() || len(decoded.Snapshot.Nodes) != 3 {
+		t.Fatalf("version 2 ledger with conflicting nodes wasn't replayed")
+	}
+
+	appendSigned(t, l, root, l.NewChangeSet(UpgradeLedgerVersion{Version: 3}))
+
+	cs := l.NewChangeSet(AddNode{Key: goldenKeyPair(t, 4).Public, Address: "10.0.0.1", GossipPort: 9000, APIPort: 9001})
+
+	sig, err = root.SignChangeSet(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs.Signatures = []Signature{sig}
+
+	if err := l.Append(cs); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Fatalf("expected port conflict in version 3 ledger, got %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Nodes create a checkpoint every time the ledger height reaches a multiple of
+// CheckpointInterval.
+const CheckpointInterval = 1000
+
+// Checkpoints are stored beside the ledger file, using this name.
+const CheckpointFileName = "checkpoint"
+
+// A Checkpoint is the state of the ledger after a given change set. It allows
+// loading a ledger without replaying the change sets it covers, and
+// bootstrapping new nodes without downloading the whole history.
+//
+// The ids of all covered change sets are kept, so that ledgers starting from
+// a checkpoint can still be compared with other ledgers.
+//
+// Nodes attest a checkpoint by signing its encoding without signatures (see
+// `Checkpoint.Attested()`).
+type Checkpoint struct {
+	IDs        []ChangeSetID // the last id is the head of the checkpoint
+	Signatures []Signature
+
+	snapshot []byte // deterministically encoded, so that nodes sign the same bytes
+}
+
+type encodeableCheckpoint struct {
+	IDs        [][]byte    `cbor:"0,keyasint"`
+	Snapshot   []byte      `cbor:"1,keyasint"`
+	Signatures []Signature `cbor:"2,keyasint,omitempty"`
+}
+
+var snapshotEncMode cbor.EncMode
+
+func init() {
+	var err error
+
+	snapshotEncMode, err = cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		panic(fmt.Sprintf("unable to create snapshot encoding mode (%v)", err))
+	}
+}
+
+// Creates an unsigned checkpoint of the current state of the ledger.
+func (l *Ledger) NewCheckpoint() *Checkpoint {
+	bs, err := snapshotEncMode.Marshal(l.Snapshot)
+	if err != nil {
+		panic(fmt.Sprintf("unable to encode snapshot (%v)", err))
+	}
+
+	return &Checkpoint{
+		IDs:        l.IDChain().IDs,
+		Signatures: []Signature{},
+		snapshot:   bs,
+	}
+}
+
+func (cp *Checkpoint) Head() ChangeSetID {
+	return cp.IDs[len(cp.IDs)-1]
+}
+
+// Number of change sets covered by the checkpoint.
+func (cp *Checkpoint) Height() int {
+	return len(cp.IDs)
+}
+
+// Returns a copy of the snapshot, which can be modified freely.
+func (cp *Checkpoint) Snapshot() *Snapshot {
+	s := newSnapshot(0)
+
+	if err := cbor.Unmarshal(cp.snapshot, s); err != nil {
+		panic(fmt.Sprintf("invalid checkpoint snapshot (%v)", err))
+	}
+
+	return s
+}
+
+// Adds the signature if it is valid, and if the key hasn't signed yet. Returns
+// false otherwise.
+func (cp *Checkpoint) AddSignature(sig Signature) bool {
+	if !sig.Verify(cp.withoutSignatures().Encode()) {
+		return false
+	}
+
+	for _, other := range cp.Signatures {
+		if other.Key.NodeID() == sig.Key.NodeID() {
+			return false
+		}
+	}
+
+	cp.Signatures = append(cp.Signatures, sig)
+
+	return true
+}
+
+// Returns the given nodes that have validly signed the checkpoint.
+func (cp *Checkpoint) Attesters(nodes map[NodeID]NodeConfig) []NodeID {
+	message := cp.withoutSignatures().Encode()
+
+	attesters := []NodeID{}
+
+	for _, sig := range cp.Signatures {
+		id, ok := FindNode(nodes, sig.Key)
+
+		if !ok || !sig.Verify(message) {
+			continue
+		}
+
+		if !slices.Contains(attesters, id) {
+			attesters = append(attesters, id)
+		}
+	}
+
+	return attesters
+}
+
+// Returns nil if a majority of the given nodes have signed the checkpoint.
+//
+// The nodes must come from a trusted ledger: anyone can create a checkpoint
+// whose snapshot only contains their own nodes.
+func (cp *Checkpoint) Attested(nodes map[NodeID]NodeConfig) error {
+	n := len(cp.Attesters(nodes))
+	nNodes := len(nodes)
+
+	if 2*n <= nNodes {
+		return fmt.Errorf("checkpoint attested by %d of %d nodes, a majority is required", n, nNodes)
+	}
+
+	return nil
+}
+
+// Returns nil if the checkpoint extends the ledger, and if it was attested by
+// a majority of the nodes of the ledger.
+func (l *Ledger) CheckCheckpoint(cp *Checkpoint) error {
+	ids := l.IDChain().IDs
+
+	if len(ids) > cp.Height() || !slices.Equal(ids, cp.IDs[0:len(ids)]) {
+		return fmt.Errorf("checkpoint %s doesn't extend the ledger", cp.Head())
+	}
+
+	return cp.Attested(l.Snapshot.Nodes)
+}
+
+func (cp *Checkpoint) withoutSignatures() *Checkpoint {
+	return &Checkpoint{
+		IDs:        cp.IDs,
+		Signatures: []Signature{},
+		snapshot:   cp.snapshot,
+	}
+}
+
+func (cp *Checkpoint) Encode() []byte {
+	ids := make([][]byte, len(cp.IDs))
+
+	for i, id := range cp.IDs {
+		bs, err := id.encode()
+		if err != nil {
+			panic(fmt.Sprintf("invalid checkpoint change set id (%v)", err))
+		}
+
+		ids[i] = bs
+	}
+
+	bs, err := cbor.Marshal(encodeableCheckpoint{
+		IDs:        ids,
+		Snapshot:   cp.snapshot,
+		Signatures: cp.Signatures,
+	})
+	if err != nil {
+		panic(fmt.Sprintf("unable to encode checkpoint (%v)", err))
+	}
+
+	return bs
+}
+
+func DecodeCheckpoint(bs []byte) (*Checkpoint, error) {
+	ecp := encodeableCheckpoint{}
+
+	if err := cbor.Unmarshal(bs, &ecp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint format (%v)", err)
+	}
+
+	if len(ecp.IDs) == 0 {
+		return nil, errors.New("checkpoint doesn't cover any change sets")
+	}
+
+	ids := make([]ChangeSetID, len(ecp.IDs))
+
+	for i, bs := range ecp.IDs {
+		id, err := DecodeShortID(ChangeSetIDPrefix, bs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checkpoint change set id %d (%v)", i, err)
+		}
+
+		ids[i] = ChangeSetID(id)
+	}
+
+	if err := cbor.Unmarshal(ecp.Snapshot, newSnapshot(0)); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint snapshot (%v)", err)
+	}
+
+	if ecp.Signatures == nil {
+		ecp.Signatures = []Signature{}
+	}
+
+	return &Checkpoint{
+		IDs:        ids,
+		Signatures: ecp.Signatures,
+		snapshot:   ecp.Snapshot,
+	}, nil
+}
+
+// Returns an os.ErrNotExist error if there is no checkpoint at the path.
+func ReadCheckpoint(path string) (*Checkpoint, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeCheckpoint(bs)
+}
+
+func (cp *Checkpoint) Write(path string) error {
+	return OverwriteSafe(path, cp.Encode())
+}
@@ -0,0 +1,92 @@
+package ledger
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckCheckpoint(t *testing.T) {
+	nodes := []*KeyPair{goldenKeyPair(t, 1), goldenKeyPair(t, 2), goldenKeyPair(t, 3)}
+	attackers := []*KeyPair{goldenKeyPair(t, 21), goldenKeyPair(t, 22), goldenKeyPair(t, 23), goldenKeyPair(t, 24)}
+
+	initial := NewInitialChangeSet(LatestLedgerVersion,
+		AddNode{Key: nodes[0].Public, Address: "10.0.0.1", GossipPort: 9000, APIPort: 9001},
+		AddNode{Key: nodes[1].Public, Address: "10.0.0.2", GossipPort: 9000, APIPort: 9001},
+		AddNode{Key: nodes[2].Public, Address: "10.0.0.3", GossipPort: 9000, APIPort: 9001},
+	)
+
+	sig, err := nodes[0].SignChangeSet(initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initial.Signatures = []Signature{sig}
+
+	trusted, err := NewLedger(LatestLedgerVersion, initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// returns a checkpoint of the trusted ledger followed by the actions
+	checkpoint := func(signers []*KeyPair, actions ...Action) *Checkpoint {
+		l := trusted.Copy()
+		appendSigned(t, l, nodes[0], l.NewChangeSet(actions...))
+
+		cp := l.NewCheckpoint()
+
+		for _, kp := range signers {
+			sig, err := kp.SignCheckpoint(cp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cp.AddSignature(sig)
+		}
+
+		return cp
+	}
+
+	valid := checkpoint(nodes[0:2], AddUser{Key: goldenKeyPair(t, 10).Public})
+
+	if err := trusted.CheckCheckpoint(valid); err != nil {
+		t.Fatalf("valid checkpoint refused (%v)", err)
+	}
+
+	// the attackers form a majority of the nodes of the checkpoint snapshot,
+	// but aren't nodes of the trusted ledger
+	forgedActions := []Action{}
+
+	for i, kp := range attackers {
+		forgedActions = append(forgedActions, AddNode{Key: kp.Public, Address: "10.0.1.1", GossipPort: Port(9000 + 2*i), APIPort: Port(9001 + 2*i)})
+	}
+
+	forged := checkpoint(attackers, forgedActions...)
+
+	if err := forged.Attested(forged.Snapshot().Nodes); err != nil {
+		t.Fatalf("expected forged checkpoint to be attested by its own nodes (%v)", err)
+	}
+
+	tests := []struct {
+		name   string
+		ledger *Ledger
+		cp     *Checkpoint
+		err    string
+	}{
+		{"forged", trusted, forged, "attested by 0 of 3 nodes"},
+		{"under-attested", trusted, checkpoint(nodes[0:1], AddUser{Key: goldenKeyPair(t, 10).Public}), "attested by 1 of 3 nodes"},
+		{"signed by the same node twice", trusted, checkpoint([]*KeyPair{nodes[0], nodes[0]}, AddUser{Key: goldenKeyPair(t, 10).Public}), "attested by 1 of 3 nodes"},
+		{"non-extending", trusted.Copy(), checkpoint(nodes, AddUser{Key: goldenKeyPair(t, 11).Public}), "doesn't extend"},
+	}
+
+	// the ledger of the non-extending test has forked from the checkpoint
+	appendSigned(t, tests[3].ledger, nodes[0], tests[3].ledger.NewChangeSet(AddUser{Key: goldenKeyPair(t, 12).Public}))
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.ledger.CheckCheckpoint(test.cp)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/btcsuite/btcutil/bech32"
 	"github.com/fxamacker/cbor/v2"
@@ -17,18 +18,24 @@ import (
 //
 // Empty signatures are omitted to create the change set body that is used for
 // signing.
+//
+// Fields added by later ledger versions must be omitted when empty, so change
+// sets of older versions keep their original encoding (and thus their ids).
 type EncodeableChangeSet struct {
 	Prev       []byte             `cbor:"0,keyasint"`
 	Actions    []encodeableAction `cbor:"1,keyasint"`
 	Signatures []Signature        `cbor:"2,keyasint,omitempty"`
+	Timestamp  int64              `cbor:"3,keyasint,omitempty"` // unix seconds, since v2
+	Message    string             `cbor:"4,keyasint,omitempty"` // since v2
+	ValidUntil int64              `cbor:"5,keyasint,omitempty"` // unix seconds, since v2
 }
 
 // `encodeableAction` is an intermediate representation of Action, with
 // encoding of the attributes already applied.
 //
 // If this format changes from one ledger version to another, change name to
-// `encodeableActionV1`, and add `encodeableActionV2` etc, and add appropriate
-// switch logic to `decodeAction()` and `actionEncoder.encodeable()`.
+// `encodeableActionV1`, add `encodeableActionV2` etc, and convert between
+// them in the corresponding `changeSetCodec`.
 type encodeableAction struct {
 	Category   string `cbor:"0,keyasint"`
 	Name       string `cbor:"1,keyasint"`
@@ -43,13 +50,19 @@ type actionDecoder = func(attrBytes []byte) (Action, error)
 // Validation must be done at the same time because decoding depends on the ledger version,
 // which can change from one change set to another.
 func DecodeLedger(bs []byte) (*Ledger, error) {
-	var entries [][]byte
-
-	err := cbor.Unmarshal(bs, &entries)
+	entries, err := decodeLedgerEntries(bs)
 	if err != nil {
-		return nil, fmt.Errorf("invalid top-level ledger format, expected list of bytestrings (%v)", err)
+		return nil, err
 	}
 
+	return decodeLedgerFromEntries(entries)
+}
+
+// Decodes a ledger that has already been split into its entries (ie. the
+// encoded ledger version followed by the encoded change sets).
+func decodeLedgerFromEntries(entries [][]byte) (*Ledger, error) {
+	var err error
+
 	if len(entries) < 2 {
 		return nil, fmt.Errorf("invalid top-level ledger format, bytestring list contains less than two entries (expected ledger version and initial configuration, got %d entry) (%v)", len(entries), err)
 	}
@@ -104,6 +117,119 @@ func DecodeLedger(bs []byte) (*Ledger, error) {
 	}, nil
 }
 
+// Decodes a ledger, trusting the state of the checkpoint instead of replaying
+// the change sets it covers. The encoded ledger can either contain all change
+// sets, in which case the ids of the covered change sets must correspond to
+// those of the checkpoint, or it can be pruned (ie. start with the first
+// change set after the checkpoint).
+func DecodeLedgerFrom(bs []byte, cp *Checkpoint) (*Ledger, error) {
+	entries, err := decodeLedgerEntries(bs)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeLedgerFromEntriesAndCheckpoint(entries, cp)
+}
+
+func decodeLedgerFromEntriesAndCheckpoint(entries [][]byte, cp *Checkpoint) (*Ledger, error) {
+	if len(entries) < 1 {
+		return nil, fmt.Errorf("invalid top-level ledger format, expected at least the ledger version")
+	}
+
+	initialVersion, err := decodeLedgerVersion(entries[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode initial ledger version (%v)", err)
+	}
+
+	l := &Ledger{
+		InitialVersion: initialVersion,
+		Checkpoint:     cp,
+		Changes:        make([]ChangeSet, 0, len(entries)-1),
+	}
+
+	// a pruned ledger continues with the version of the checkpoint
+	v := initialVersion
+
+	if len(entries) > 1 {
+		ecs := new(EncodeableChangeSet)
+
+		if err := cbor.Unmarshal(entries[1], ecs); err != nil {
+			return nil, fmt.Errorf("unable to decode change set 0 (%v)", err)
+		}
+
+		if len(ecs.Prev) > 0 {
+			v = cp.Snapshot().Version
+		}
+	}
+
+	for i, entry := range entries[1:] {
+		cs, err := DecodeChangeSet(entry, v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode change set %d (%v)", i, err)
+		}
+
+		l.Changes = append(l.Changes, *cs)
+
+		v = cs.nextVersion()
+	}
+
+	l.Pruned = len(l.Changes) == 0 || l.Changes[0].Prev != ""
+
+	if l.Pruned {
+		if len(l.Changes) > 0 && l.Changes[0].Prev != cp.Head() {
+			return nil, fmt.Errorf("pruned ledger doesn't start after checkpoint %s", cp.Head())
+		}
+	} else {
+		if len(l.Changes) < cp.Height() {
+			return nil, fmt.Errorf("ledger is shorter than checkpoint")
+		}
+
+		// the ids are derived from the Prev fields (like in `Ledger.IDChain()`),
+		// which avoids hashing every change set
+		n := cp.Height()
+
+		for i := 0; i+1 < n; i++ {
+			if l.Changes[i+1].Prev != cp.IDs[i] {
+				return nil, fmt.Errorf("ledger doesn't correspond to checkpoint %s (change set %d differs)", cp.Head(), i)
+			}
+		}
+
+		if l.Changes[n-1].ID() != cp.Head() {
+			return nil, fmt.Errorf("ledger doesn't correspond to checkpoint %s", cp.Head())
+		}
+	}
+
+	if err := l.Validate(); err != nil {
+		return nil, err
+	}
+
+	// invalid change sets after the checkpoint are ignored, like in `DecodeLedger()`
+	l.Changes = l.Changes[0 : l.IndexOf(l.Head())+1-l.offset()]
+
+	return l, nil
+}
+
+func decodeLedgerEntries(bs []byte) ([][]byte, error) {
+	var entries [][]byte
+
+	if err := cbor.Unmarshal(bs, &entries); err != nil {
+		return nil, fmt.Errorf("invalid top-level ledger format, expected list of bytestrings (%v)", err)
+	}
+
+	return entries, nil
+}
+
+// Creates a pruned ledger which only contains the state of the checkpoint.
+func NewLedgerFromCheckpoint(v LedgerVersion, cp *Checkpoint) *Ledger {
+	return &Ledger{
+		InitialVersion: v,
+		Checkpoint:     cp,
+		Pruned:         true,
+		Changes:        []ChangeSet{},
+		Snapshot:       cp.Snapshot(),
+	}
+}
+
 // The Initial config is the Ledger with only the version entry and the first
 // change set, encoded using base64.
 func ParseLedger(s string) (*Ledger, error) {
@@ -116,7 +242,20 @@ func ParseLedger(s string) (*Ledger, error) {
 }
 
 // Encodes the ledger into its binary CBOR representation.
+//
+// The change sets covered by the checkpoint of a pruned ledger are missing, so
+// a pruned ledger can only be decoded using `DecodeLedgerFrom()`.
 func (l *Ledger) Encode() []byte {
+	bs, err := cbor.Marshal(l.entries())
+	if err != nil {
+		panic(fmt.Sprintf("unable to encode Ledger (%v)", err))
+	}
+
+	return bs
+}
+
+// Returns the encoded initial version, followed by the encoded change sets.
+func (l *Ledger) entries() [][]byte {
 	entries := make([][]byte, len(l.Changes)+1)
 
 	// encode the initial version bytes
@@ -126,12 +265,7 @@ func (l *Ledger) Encode() []byte {
 		entries[i+1] = c.Encode()
 	}
 
-	bs, err := cbor.Marshal(entries)
-	if err != nil {
-		panic(fmt.Sprintf("unable to encode Ledger (%v)", err))
-	}
-
-	return bs
+	return entries
 }
 
 func (l *Ledger) String() string {
@@ -174,10 +308,69 @@ func (cs *ChangeSet) Encode() []byte {
 	return NewEncodeableChangeSet(cs).encode()
 }
 
+// Converts a ChangeSet into its encodeable form, using the codec of the
+// change set version.
 func NewEncodeableChangeSet(cs *ChangeSet) EncodeableChangeSet {
+	ecs, err := changeSetCodecFor(cs.Version).encodeable(cs)
+	if err != nil {
+		panic(fmt.Sprintf("unable to make change set with prev=%s encodeable (%v)", cs.Prev, err))
+	}
+
+	return ecs
+}
+
+// Converts an EncodeableChangeSet back into a regular ChangeSet.
+func (ecs EncodeableChangeSet) ChangeSet(v LedgerVersion) (*ChangeSet, error) {
+	cs, err := changeSetCodecFor(v).changeSet(ecs, v)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.Version = v
+
+	return cs, nil
+}
+
+// Converts between ChangeSet and EncodeableChangeSet for a given range of
+// ledger versions.
+type changeSetCodec struct {
+	encodeable func(cs *ChangeSet) (EncodeableChangeSet, error)
+	changeSet  func(ecs EncodeableChangeSet, v LedgerVersion) (*ChangeSet, error)
+}
+
+// A collection of all change set codecs. Like for `actionDecoders`, if a codec
+// for a ledger version isn't available, the previous available version is
+// used.
+var changeSetCodecs = map[LedgerVersion]changeSetCodec{
+	1: {
+		encodeable: encodeableChangeSetV1,
+		changeSet:  changeSetV1,
+	},
+	2: {
+		encodeable: encodeableChangeSetV2,
+		changeSet:  changeSetV2,
+	},
+}
+
+func changeSetCodecFor(v LedgerVersion) changeSetCodec {
+	for i := v; i >= 1; i-- {
+		if codec, ok := changeSetCodecs[i]; ok {
+			return codec
+		}
+	}
+
+	panic(fmt.Sprintf("no change set codec defined for ledger version %d", v))
+}
+
+// Version 1 change sets don't have any metadata.
+func encodeableChangeSetV1(cs *ChangeSet) (EncodeableChangeSet, error) {
+	if !cs.Timestamp.IsZero() || cs.Message != "" || !cs.ValidUntil.IsZero() {
+		return EncodeableChangeSet{}, fmt.Errorf("ledger version 1 change sets can't have a timestamp, message or expiry")
+	}
+
 	prev, err := cs.Prev.encode()
 	if err != nil {
-		panic(fmt.Sprintf("invalid Prev ChangeSetID %s (%v)", cs.Prev, err))
+		return EncodeableChangeSet{}, fmt.Errorf("invalid Prev ChangeSetID %s (%v)", cs.Prev, err)
 	}
 
 	actions := make([]encodeableAction, len(cs.Actions))
@@ -190,12 +383,22 @@ func NewEncodeableChangeSet(cs *ChangeSet) EncodeableChangeSet {
 		Prev:       prev,
 		Actions:    actions,
 		Signatures: cs.Signatures,
-	}
+	}, nil
 }
 
-// Converts an EncodeableChangeSet back into a regular ChangeSet.
-func (ecs EncodeableChangeSet) ChangeSet(v LedgerVersion) (*ChangeSet, error) {
+func changeSetV1(ecs EncodeableChangeSet, v LedgerVersion) (*ChangeSet, error) {
+	if len(ecs.Prev) != 0 {
+		if _, err := DecodeShortID(ChangeSetIDPrefix, ecs.Prev); err != nil {
+			return nil, fmt.Errorf("invalid prev in ledger version %d change set (%v)", v, err)
+		}
+	}
+
 	prev := decodeChangeSetID(ecs.Prev)
+
+	if ecs.Timestamp != 0 || ecs.Message != "" || ecs.ValidUntil != 0 {
+		return nil, fmt.Errorf("unexpected metadata in ledger version %d change set with prev=%s", v, prev)
+	}
+
 	actions := make([]Action, len(ecs.Actions))
 
 	for i, ea := range ecs.Actions {
@@ -214,6 +417,58 @@ func (ecs EncodeableChangeSet) ChangeSet(v LedgerVersion) (*ChangeSet, error) {
 	}, nil
 }
 
+// Version 2 change sets must have a timestamp, and can have a message and an
+// expiry. Times are encoded as unix seconds.
+func encodeableChangeSetV2(cs *ChangeSet) (EncodeableChangeSet, error) {
+	if cs.Timestamp.IsZero() {
+		return EncodeableChangeSet{}, fmt.Errorf("missing timestamp")
+	}
+
+	v1 := *cs
+	v1.Timestamp = time.Time{}
+	v1.Message = ""
+	v1.ValidUntil = time.Time{}
+
+	ecs, err := encodeableChangeSetV1(&v1)
+	if err != nil {
+		return ecs, err
+	}
+
+	ecs.Timestamp = cs.Timestamp.Unix()
+	ecs.Message = cs.Message
+
+	if !cs.ValidUntil.IsZero() {
+		ecs.ValidUntil = cs.ValidUntil.Unix()
+	}
+
+	return ecs, nil
+}
+
+func changeSetV2(ecs EncodeableChangeSet, v LedgerVersion) (*ChangeSet, error) {
+	if ecs.Timestamp == 0 {
+		return nil, fmt.Errorf("missing timestamp in ledger version %d change set", v)
+	}
+
+	v1 := ecs
+	v1.Timestamp = 0
+	v1.Message = ""
+	v1.ValidUntil = 0
+
+	cs, err := changeSetV1(v1, v)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.Timestamp = time.Unix(ecs.Timestamp, 0).UTC()
+	cs.Message = ecs.Message
+
+	if ecs.ValidUntil != 0 {
+		cs.ValidUntil = time.Unix(ecs.ValidUntil, 0).UTC()
+	}
+
+	return cs, nil
+}
+
 func (ecs EncodeableChangeSet) encode() []byte {
 	bs, err := cbor.Marshal(ecs)
 	if err != nil {
@@ -327,26 +582,69 @@ var actionDecoders = map[string]map[string]map[LedgerVersion]actionDecoder{
 		RemoveGatewayEndpointName: {
 			1: newActionDecoder[RemoveGatewayEndpoint](),
 		},
+		SetGatewayAPIKeyQuotaName: {
+			1: newActionDecoder[SetGatewayAPIKeyQuota](),
+		},
+		SetGatewayCORSName: {
+			1: newActionDecoder[SetGatewayCORS](),
+		},
+		SetGatewayEndpointAuthorizerName: {
+			1: newActionDecoder[SetGatewayEndpointAuthorizer](),
+		},
+		SetGatewayEndpointTransformName: {
+			1: newActionDecoder[SetGatewayEndpointTransform](),
+		},
+		SetGatewayRateLimitName: {
+			1: newActionDecoder[SetGatewayRateLimit](),
+		},
+		UpdateGatewayName: {
+			1: newActionDecoder[UpdateGateway](),
+		},
+	},
+	LedgerCategory: {
+		UpgradeLedgerVersionName: {
+			1: newActionDecoder[UpgradeLedgerVersion](),
+		},
+	},
+	MetricsCategory: {
+		ConfigureMetricsName: {
+			1: newActionDecoder[ConfigureMetrics](),
+		},
 	},
 	NodesCategory: {
 		AddNodeName: {
 			1: newActionDecoder[AddNode](),
 		},
+		ConfigureConsensusName: {
+			1: newActionDecoder[ConfigureConsensus](),
+		},
 		RemoveNodeName: {
 			1: newActionDecoder[RemoveNode](),
 		},
+		RotateNodeKeyName: {
+			1: newActionDecoder[RotateNodeKey](),
+		},
+		UpdateNodeAddressName: {
+			1: newActionDecoder[UpdateNodeAddress](),
+		},
+		UpdateNodePortsName: {
+			1: newActionDecoder[UpdateNodePorts](),
+		},
 	},
 	PermissionsCategory: {
 		AddUserName: {
 			1: newActionDecoder[AddUser](),
 		},
+		RotateUserKeyName: {
+			1: newActionDecoder[RotateUserKey](),
+		},
 	},
 }
 
 func decodeAction(bs []byte, v LedgerVersion) (Action, error) {
 	// If the encodeableAction CBOR changes from one ledger version to another,
-	// then switch statement must be placed here to select encodeableActionV1,
-	// encodeableActionV2 etc.
+	// then a switch statement must be placed here to select
+	// encodeableActionV1, encodeableActionV2 etc.
 	ea := new(encodeableAction)
 
 	err := cbor.Unmarshal(bs, ea)
@@ -0,0 +1,433 @@
+package ledger
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// Regenerates the golden files of the latest ledger version. The golden files
+// of older versions are never regenerated, they were created by older
+// releases.
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// Head of testdata/v1.ledger, which was created by the first release (that
+// only supported ledger version 1), so it only contains the actions of that
+// release.
+const goldenV1Head = ChangeSetID("changes10g5jylgvsp8m6e3970ygvk5rcq7x9ve0")
+
+// Timestamp of the change sets in the generated golden files.
+var goldenTimestamp = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func goldenKeyPair(t *testing.T, b byte) *KeyPair {
+	t.Helper()
+
+	k, err := ParsePrivateKey(strings.Repeat(fmt.Sprintf("%02x", b), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return k.KeyPair()
+}
+
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+
+	bs, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bs
+}
+
+// Compares the encoded ledger to the golden file, or overwrites the golden
+// file if -update is set.
+func checkGolden(t *testing.T, name string, bs []byte) {
+	t.Helper()
+
+	p := filepath.Join("testdata", name)
+
+	if *update {
+		if err := os.WriteFile(p, bs, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !bytes.Equal(readGolden(t, name), bs) {
+		t.Fatalf("encoding differs from %s (run with -update if the change is intended)", p)
+	}
+}
+
+func appendSigned(t *testing.T, l *Ledger, kp *KeyPair, cs *ChangeSet) {
+	t.Helper()
+
+	sig, err := kp.SignChangeSet(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs.Signatures = []Signature{sig}
+
+	if err := l.Append(cs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeV1Ledger(t *testing.T) {
+	bs := readGolden(t, "v1.ledger")
+
+	l, err := DecodeLedger(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l.Head() != goldenV1Head {
+		t.Fatalf("expected head %s, got %s", goldenV1Head, l.Head())
+	}
+
+	if l.Height() != 5 {
+		t.Fatalf("expected 5 change sets, got %d", l.Height())
+	}
+
+	if l.InitialVersion != 1 || l.Snapshot.Version != 1 {
+		t.Fatalf("expected version 1, got initial version %d and version %d", l.InitialVersion, l.Snapshot.Version)
+	}
+
+	for i, cs := range l.Changes {
+		if cs.Version != 1 || !cs.Timestamp.IsZero() {
+			t.Fatalf("change set %d has version %d and timestamp %s", i, cs.Version, cs.Timestamp)
+		}
+	}
+
+	if len(l.Snapshot.Gateways) != 1 || len(l.Snapshot.Functions) != 1 || len(l.Snapshot.Nodes) != 2 || len(l.Snapshot.Users) != 2 {
+		t.Fatalf("unexpected state %+v", l.Snapshot)
+	}
+
+	if !bytes.Equal(l.Encode(), bs) {
+		t.Fatalf("reencoded v1 ledger differs")
+	}
+}
+
+func TestUpgradeV1Ledger(t *testing.T) {
+	l, err := DecodeLedger(readGolden(t, "v1.ledger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := goldenKeyPair(t, 1)
+
+	// change sets of the new version can't be submitted before upgrading
+	early := l.NewChangeSet(ConfigureConsensus{Enabled: true})
+	early.Version = 2
+	early.Timestamp = goldenTimestamp
+
+	if err := l.Snapshot.CheckChangeSet(early); err == nil {
+		t.Fatalf("expected version 2 change set to be refused by version 1 ledger")
+	}
+
+	appendSigned(t, l, root, l.NewChangeSet(UpgradeLedgerVersion{Version: 2}))
+
+	if l.Snapshot.Version != 2 {
+		t.Fatalf("expected version 2 after upgrade, got %d", l.Snapshot.Version)
+	}
+
+	cs := l.NewChangeSet(ConfigureConsensus{Enabled: true})
+	cs.Timestamp = goldenTimestamp
+	appendSigned(t, l, root, cs)
+
+	bs := l.Encode()
+	checkGolden(t, "v1-upgraded.ledger", bs)
+
+	decoded, err := DecodeLedger(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Head() != l.Head() || decoded.Height() != 7 {
+		t.Fatalf("decoded upgraded ledger differs (head %s, height %d)", decoded.Head(), decoded.Height())
+	}
+
+	for i, expected := range []LedgerVersion{1, 1, 1, 1, 1, 1, 2} {
+		if v := decoded.VersionAt(i); v != expected {
+			t.Fatalf("expected version %d for change set %d, got %d", expected, i, v)
+		}
+	}
+
+	if last, _ := decoded.ChangeAt(6); !last.Timestamp.Equal(goldenTimestamp) {
+		t.Fatalf("expected timestamp %s, got %s", goldenTimestamp, last.Timestamp)
+	}
+
+	if decoded.Snapshot.Version != 2 || !decoded.Snapshot.Consensus {
+		t.Fatalf("unexpected state %+v", decoded.Snapshot)
+	}
+
+	if _, err := decoded.Revert(decoded.Changes[5].ID()); err == nil {
+		t.Fatalf("expected upgrade to be irreversible")
+	}
+}
+
+func TestV2Ledger(t *testing.T) {
+	root := goldenKeyPair(t, 1)
+	node := goldenKeyPair(t, 2)
+
+	initialConfig := NewInitialChangeSet(2, AddNode{Key: node.Public, Address: "127.0.0.1", GossipPort: 9000, APIPort: 9001})
+	initialConfig.Timestamp = goldenTimestamp
+
+	sig, err := root.SignChangeSet(initialConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initialConfig.Signatures = []Signature{sig}
+
+	l, err := NewLedger(2, initialConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs := l.NewChangeSet(AddGateway{Port: 8080})
+	cs.Timestamp = goldenTimestamp.Add(time.Hour)
+	appendSigned(t, l, root, cs)
+
+	// version 2 change sets must have a timestamp
+	untimed := l.NewChangeSet(ConfigureConsensus{Enabled: true})
+	untimed.Timestamp = time.Time{}
+
+	if err := l.Snapshot.CheckChangeSet(untimed); err == nil {
+		t.Fatalf("expected change set without timestamp to be refused")
+	}
+
+	bs := l.Encode()
+	checkGolden(t, "v2.ledger", bs)
+
+	decoded, err := DecodeLedger(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Head() != l.Head() || decoded.Snapshot.Version != 2 {
+		t.Fatalf("decoded v2 ledger differs (head %s, version %d)", decoded.Head(), decoded.Snapshot.Version)
+	}
+
+	for i, cs := range decoded.Changes {
+		if cs.Version != 2 || !cs.Timestamp.Equal(l.Changes[i].Timestamp) {
+			t.Fatalf("change set %d has version %d and timestamp %s", i, cs.Version, cs.Timestamp)
+		}
+	}
+
+	// the timestamp is part of the encoding, so v1 decoding must fail
+	if _, err := DecodeChangeSet(decoded.Changes[1].Encode(), 1); err == nil {
+		t.Fatalf("expected v2 change set to be refused by v1 codec")
+	}
+}
+
+func TestUpgradeRequiresRootUser(t *testing.T) {
+	l, err := DecodeLedger(readGolden(t, "v1.ledger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := goldenKeyPair(t, 1)
+	user := goldenKeyPair(t, 3)
+
+	appendSigned(t, l, root, l.NewChangeSet(AddUser{Key: user.Public}))
+
+	cs := l.NewChangeSet(UpgradeLedgerVersion{Version: 2})
+
+	sig, err := user.SignChangeSet(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs.Signatures = []Signature{sig}
+
+	err = l.Snapshot.CheckChangeSet(cs)
+	if err == nil || !strings.Contains(err.Error(), "root user") {
+		t.Fatalf("expected upgrade signed by non-root user to be refused, got %v", err)
+	}
+}
+
+// One example of every action, encoded in testdata/actions.golden.
+func goldenActions(t *testing.T) []Action {
+	node := goldenKeyPair(t, 2).Public
+	user := goldenKeyPair(t, 3).Public
+	gateway := GatewayID("gateway1dwpwqd0dddnx7awx8q7qs9jwscxc3ulx")
+	function := FunctionID("fn1yw08uc6jxw06meauffem49fdwq28k7hc3")
+
+	return []Action{
+		AddFunction{Runtime: "nodejs", HandlerID: "asset1qqqsyqcyq5rqwzqfpg9scrgwpugpzysn6hc9qv"},
+		RemoveFunction{ID: function},
+		AddGateway{Port: 8080},
+		AddGatewayEndpoint{GatewayID: gateway, Method: "GET", Path: "/hello", FunctionID: function},
+		RemoveGateway{ID: gateway},
+		RemoveGatewayEndpoint{GatewayID: gateway, Method: "GET", Path: "/hello"},
+		SetGatewayAPIKeyQuota{GatewayID: gateway, APIKeyDigest: []byte{1, 2, 3}, Limit: 1000, Period: 3600, Cluster: true},
+		SetGatewayCORS{GatewayID: gateway, AllowOrigins: []string{"https://example.com"}, AllowMethods: []string{"GET"}, MaxAge: 600},
+		SetGatewayEndpointAuthorizer{GatewayID: gateway, Method: "GET", Path: "/hello", Type: JWTAuthorizerType, JWKSURL: "https://example.com/jwks.json", JWTIssuer: "issuer"},
+		SetGatewayEndpointTransform{GatewayID: gateway, Method: "GET", Path: "/hello", SetRequestHeaders: []HeaderValue{{"X-Api", "1"}}, RemoveResponseHeaders: []string{"Server"}},
+		SetGatewayRateLimit{GatewayID: gateway, Rate: 2.5, Burst: 10},
+		UpdateGateway{ID: gateway, Port: 8081},
+		UpgradeLedgerVersion{Version: 2},
+		ConfigureMetrics{Port: 9100, AllowedNetworks: []string{"10.0.0.0/8"}},
+		AddNode{Key: node, Address: "127.0.0.1", GossipPort: 9000, APIPort: 9001},
+		ConfigureConsensus{Enabled: true},
+		RemoveNode{ID: node.NodeID()},
+		RotateNodeKey{ID: node.NodeID(), Key: user},
+		UpdateNodeAddress{ID: node.NodeID(), Address: "node1.example.com"},
+		UpdateNodePorts{ID: node.NodeID(), GossipPort: 9002, APIPort: 9003},
+		AddUser{Key: user},
+		RotateUserKey{OldKey: user, NewKey: node},
+	}
+}
+
+// Returns the zero value of every registered action (using the latest
+// decoder of each action).
+func registeredActions(t *testing.T) []Action {
+	t.Helper()
+
+	actions := []Action{}
+
+	for category, names := range actionDecoders {
+		for name, decoders := range names {
+			ea := encodeableAction{Category: category, Name: name, Attributes: []byte{0xa0}}
+
+			a, err := ea.action(LatestLedgerVersion)
+			if err != nil {
+				t.Fatalf("unable to decode empty %s:%s (%v)", category, name, err)
+			}
+
+			if a.Category() != category || a.Name() != name {
+				t.Fatalf("%s:%s registered as %s:%s", a.Category(), a.Name(), category, name)
+			}
+
+			if len(decoders) == 0 {
+				t.Fatalf("no decoders registered for %s:%s", category, name)
+			}
+
+			actions = append(actions, a)
+		}
+	}
+
+	sort.Slice(actions, func(i, j int) bool {
+		return actionKey(actions[i]) < actionKey(actions[j])
+	})
+
+	return actions
+}
+
+func actionKey(a Action) string {
+	return a.Category() + ":" + a.Name()
+}
+
+func TestActionsGolden(t *testing.T) {
+	examples := map[string]Action{}
+
+	var b strings.Builder
+
+	for _, a := range goldenActions(t) {
+		examples[actionKey(a)] = a
+
+		fmt.Fprintf(&b, "%s %x\n", actionKey(a), encodeAction(a))
+	}
+
+	for _, a := range registeredActions(t) {
+		if _, ok := examples[actionKey(a)]; !ok {
+			t.Fatalf("no golden example for %s", actionKey(a))
+		}
+	}
+
+	checkGolden(t, "actions.golden", []byte(b.String()))
+
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		key, encoded, _ := strings.Cut(line, " ")
+
+		bs, err := hex.DecodeString(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a, err := decodeAction(bs, LatestLedgerVersion)
+		if err != nil {
+			t.Fatalf("unable to decode %s (%v)", key, err)
+		}
+
+		if !reflect.DeepEqual(a, examples[key]) {
+			t.Fatalf("decoded %s differs: %+v", key, a)
+		}
+	}
+}
+
+// Encoding random attributes of every registered action, and decoding them
+// again, must result in the same encoding (the ids of change sets are hashes
+// of their encoding).
+func TestActionsRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	for _, zero := range registeredActions(t) {
+		t.Run(actionKey(zero), func(t *testing.T) {
+			typ := reflect.TypeOf(zero)
+
+			for i := 0; i < 200; i++ {
+				v, ok := quick.Value(typ, r)
+				if !ok {
+					t.Fatalf("unable to generate random %s", typ)
+				}
+
+				a := v.Interface().(Action)
+				bs := encodeAction(a)
+
+				decoded, err := decodeAction(bs, LatestLedgerVersion)
+				if err != nil {
+					t.Fatalf("unable to decode %+v (%v)", a, err)
+				}
+
+				if reflect.TypeOf(decoded) != typ {
+					t.Fatalf("expected %s, decoded %s", typ, reflect.TypeOf(decoded))
+				}
+
+				if reencoded := encodeAction(decoded); !bytes.Equal(reencoded, bs) {
+					t.Fatalf("round trip of %+v changed encoding\n%x\n%x", a, bs, reencoded)
+				}
+			}
+		})
+	}
+}
+
+func FuzzDecodeLedger(f *testing.F) {
+	for _, name := range []string{"v1.ledger", "v1-upgraded.ledger", "v2.ledger"} {
+		bs, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		f.Add(bs)
+	}
+
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		l, err := DecodeLedger(bs)
+		if err != nil {
+			return
+		}
+
+		// a decodable ledger is valid, so it must survive a round trip
+		decoded, err := DecodeLedger(l.Encode())
+		if err != nil {
+			t.Fatalf("unable to decode reencoded ledger (%v)", err)
+		}
+
+		if decoded.Head() != l.Head() || decoded.Height() != l.Height() {
+			t.Fatalf("reencoded ledger differs")
+		}
+	})
+}
@@ -0,0 +1,390 @@
+package ledger
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Project-wide settings, which are treated as the configuration of the
+// GlobalResourceID when inspecting the history of the ledger.
+type GlobalConfig struct {
+	Version   LedgerVersion
+	Consensus bool
+	Metrics   *MetricsConfig
+}
+
+// Decoded information about a change set, for auditing purposes.
+type ChangeSetInfo struct {
+	Index     int
+	ID        ChangeSetID
+	ChangeSet *ChangeSet
+	Signers   []UserID
+	Created   []ResourceID // resources that didn't exist before the change set
+	Removed   []ResourceID // resources that no longer exist after the change set
+}
+
+// The configuration of a resource before and after a sequence of change sets.
+// Before is nil if the resource was created, After is nil if the resource was
+// removed.
+type ResourceDiff struct {
+	ID     ResourceID
+	Before any
+	After  any
+}
+
+// Returns a deep copy of the snapshot.
+func (s *Snapshot) Copy() *Snapshot {
+	bs, err := snapshotEncMode.Marshal(s)
+	if err != nil {
+		panic(fmt.Sprintf("unable to encode snapshot (%v)", err))
+	}
+
+	c := newSnapshot(0)
+
+	if err := cbor.Unmarshal(bs, c); err != nil {
+		panic(fmt.Sprintf("unable to decode snapshot (%v)", err))
+	}
+
+	return c
+}
+
+// Returns the configuration of any kind of resource.
+func (s *Snapshot) Resource(id ResourceID) (any, bool) {
+	if id == GlobalResourceID {
+		return GlobalConfig{
+			Version:   s.Version,
+			Consensus: s.Consensus,
+			Metrics:   s.Metrics,
+		}, true
+	}
+
+	if conf, ok := s.Functions[id]; ok {
+		return conf, true
+	} else if conf, ok := s.Gateways[id]; ok {
+		return conf, true
+	} else if conf, ok := s.Nodes[id]; ok {
+		return conf, true
+	} else if conf, ok := s.Policies[id]; ok {
+		return conf, true
+	} else if conf, ok := s.Users[id]; ok {
+		return conf, true
+	}
+
+	return nil, false
+}
+
+// Returns the sorted ids of all the resources, including the GlobalResourceID.
+func (s *Snapshot) ResourceIDs() []ResourceID {
+	ids := []ResourceID{GlobalResourceID}
+
+	for id := range s.Functions {
+		ids = append(ids, id)
+	}
+
+	for id := range s.Gateways {
+		ids = append(ids, id)
+	}
+
+	for id := range s.Nodes {
+		ids = append(ids, id)
+	}
+
+	for id := range s.Policies {
+		ids = append(ids, id)
+	}
+
+	for id := range s.Users {
+		ids = append(ids, id)
+	}
+
+	slices.Sort(ids)
+
+	return ids
+}
+
+// Lists the resources that were created, removed or changed between a and b.
+func DiffSnapshots(a *Snapshot, b *Snapshot) []ResourceDiff {
+	ids := append(a.ResourceIDs(), b.ResourceIDs()...)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+
+	diffs := []ResourceDiff{}
+
+	for _, id := range ids {
+		before, _ := a.Resource(id)
+		after, _ := b.Resource(id)
+
+		if !equalResources(before, after) {
+			diffs = append(diffs, ResourceDiff{id, before, after})
+		}
+	}
+
+	return diffs
+}
+
+// Unique signers of the change set. The signatures aren't validated.
+func (cs *ChangeSet) Signers() []UserID {
+	signers := []UserID{}
+
+	for _, sig := range cs.Signatures {
+		id := sig.Key.UserID()
+
+		if !slices.Contains(signers, id) {
+			signers = append(signers, id)
+		}
+	}
+
+	return signers
+}
+
+// Decodes the change set with the given id, and determines which resources it
+// created and removed by replaying the ledger until that change set.
+func (l *Ledger) DescribeChangeSet(id ChangeSetID) (*ChangeSetInfo, error) {
+	i := l.IndexOf(id)
+	if i < 0 {
+		return nil, fmt.Errorf("change set %s not found", id)
+	}
+
+	cs, ok := l.ChangeAt(i)
+	if !ok {
+		return nil, fmt.Errorf("change set %s was pruned", id)
+	}
+
+	var before, after *Snapshot
+
+	if i == 0 {
+		snapshots, err := l.snapshotsAt(0)
+		if err != nil {
+			return nil, err
+		}
+
+		before, after = newSnapshot(l.InitialVersion), snapshots[0]
+	} else {
+		snapshots, err := l.snapshotsAt(i-1, i)
+		if err != nil {
+			return nil, err
+		}
+
+		before, after = snapshots[0], snapshots[1]
+	}
+
+	info := &ChangeSetInfo{
+		Index:     i,
+		ID:        id,
+		ChangeSet: cs,
+		Signers:   cs.Signers(),
+		Created:   []ResourceID{},
+		Removed:   []ResourceID{},
+	}
+
+	for _, d := range DiffSnapshots(before, after) {
+		if d.Before == nil {
+			info.Created = append(info.Created, d.ID)
+		} else if d.After == nil {
+			info.Removed = append(info.Removed, d.ID)
+		}
+	}
+
+	return info, nil
+}
+
+// Returns the state of the ledger right after the change set with the given
+// id. The ledger is replayed up to that change set in a separate snapshot, so
+// the ledger itself isn't modified.
+func (l *Ledger) SnapshotAt(id ChangeSetID) (*Snapshot, error) {
+	i := l.IndexOf(id)
+	if i < 0 {
+		return nil, fmt.Errorf("change set %s not found", id)
+	}
+
+	if i == l.Height()-1 {
+		return l.Snapshot.Copy(), nil
+	}
+
+	snapshots, err := l.snapshotsAt(i)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshots[0], nil
+}
+
+// Lists the resources that changed between change sets a and b.
+func (l *Ledger) Diff(a ChangeSetID, b ChangeSetID) ([]ResourceDiff, error) {
+	i := l.IndexOf(a)
+	if i < 0 {
+		return nil, fmt.Errorf("change set %s not found", a)
+	}
+
+	j := l.IndexOf(b)
+	if j < 0 {
+		return nil, fmt.Errorf("change set %s not found", b)
+	}
+
+	snapshots, err := l.snapshotsAt(i, j)
+	if err != nil {
+		return nil, err
+	}
+
+	return DiffSnapshots(snapshots[0], snapshots[1]), nil
+}
+
+// Returns the indices of the change sets that created, changed or removed the
+// resource, or that contain an action operating on the resource.
+func (l *Ledger) Blame(id ResourceID) ([]int, error) {
+	indices := []int{}
+
+	var prev any
+
+	err := l.replay(func(i int, s *Snapshot) bool {
+		conf, _ := s.Resource(id)
+
+		cs, ok := l.ChangeAt(i)
+
+		if ok && (!equalResources(prev, conf) || cs.touches(id)) {
+			indices = append(indices, i)
+		}
+
+		prev = conf
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return indices, nil
+}
+
+func (cs *ChangeSet) touches(id ResourceID) bool {
+	for _, a := range cs.Actions {
+		if slices.Contains(a.Resources(), id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns copies of the snapshots after the change sets with the given
+// indices.
+func (l *Ledger) snapshotsAt(indices ...int) ([]*Snapshot, error) {
+	snapshots := make([]*Snapshot, len(indices))
+
+	for _, i := range indices {
+		if i < 0 || i >= l.Height() {
+			return nil, fmt.Errorf("change set %d out of range", i)
+		}
+
+		if i < l.offset()-1 {
+			return nil, fmt.Errorf("state after change set %d unavailable, the ledger is pruned until change set %d", i, l.offset()-1)
+		}
+	}
+
+	last := slices.Max(indices)
+
+	err := l.replay(func(i int, s *Snapshot) bool {
+		for k, j := range indices {
+			if i == j {
+				snapshots[k] = s.Copy()
+			}
+		}
+
+		return i < last
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for k, s := range snapshots {
+		if s == nil {
+			return nil, fmt.Errorf("state after change set %d unavailable, replaying didn't reach it", indices[k])
+		}
+	}
+
+	return snapshots, nil
+}
+
+// Replays the ledger from the initial config (or from the checkpoint of a
+// pruned ledger), calling fn with the snapshot after each change set. The
+// snapshot is modified by the following change sets, so fn must copy it if it
+// is needed later. Replaying stops when fn returns false.
+func (l *Ledger) replay(fn func(i int, s *Snapshot) bool) error {
+	if l.Pruned {
+		snapshot := l.Checkpoint.Snapshot()
+		offset := l.offset()
+
+		if !fn(offset-1, snapshot) {
+			return nil
+		}
+
+		for j := range l.Changes {
+			if err := validateChangeSet(&(l.Changes[j]), snapshot); err != nil {
+				return fmt.Errorf("failed to replay change set %d (%v)", offset+j, err)
+			}
+
+			if !fn(offset+j, snapshot) {
+				return nil
+			}
+		}
+
+		return nil
+	}
+
+	snapshot := newSnapshot(l.InitialVersion)
+	stopped := false
+
+	// the generator resumes after each change set has been validated and
+	// applied by `validateAllChangeSets()`
+	genChanges := func(yield func(cs *ChangeSet, err error) bool) {
+		if !fn(0, snapshot) {
+			stopped = true
+			return
+		}
+
+		for i := 1; i < len(l.Changes); i++ {
+			if !yield(&(l.Changes[i]), nil) {
+				return
+			}
+
+			if !fn(i, snapshot) {
+				stopped = true
+				return
+			}
+		}
+	}
+
+	changes, err := validateAllChangeSets(&(l.Changes[0]), genChanges, snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to replay ledger (%v)", err)
+	}
+
+	// invalid change sets are skipped by `validateAllChangeSets()`, so fn
+	// would never be called for the following change sets
+	if n := len(changes); !stopped && n < len(l.Changes) {
+		return fmt.Errorf("failed to replay ledger, change set %d is invalid", n)
+	}
+
+	return nil
+}
+
+func equalResources(a any, b any) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	aBytes, err := snapshotEncMode.Marshal(a)
+	if err != nil {
+		panic(fmt.Sprintf("unable to encode resource (%v)", err))
+	}
+
+	bBytes, err := snapshotEncMode.Marshal(b)
+	if err != nil {
+		panic(fmt.Sprintf("unable to encode resource (%v)", err))
+	}
+
+	return bytes.Equal(aBytes, bBytes)
+}
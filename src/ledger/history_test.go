@@ -0,0 +1,193 @@
+package ledger
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Returns a ledger in which a gateway is added, updated and removed, along
+// with the id of the gateway.
+func newHistoryTestLedger(t *testing.T) (*Ledger, GatewayID) {
+	t.Helper()
+
+	l, kp := newStoreTestLedger(t, 0)
+
+	appendSigned(t, l, kp, l.NewChangeSet(AddGateway{Port: 8080}))
+
+	id := slices.Collect(maps.Keys(l.Snapshot.Gateways))[0]
+
+	appendSigned(t, l, kp, l.NewChangeSet(UpdateGateway{ID: id, Port: 8081}))
+	appendSigned(t, l, kp, l.NewChangeSet(ConfigureConsensus{Enabled: true}))
+	appendSigned(t, l, kp, l.NewChangeSet(RemoveGateway{ID: id}))
+
+	return l, id
+}
+
+// Returns a copy of the ledger in which change set i fails to replay. The ids
+// of the ledger are unchanged, since they are derived from the Prev fields.
+func withInvalidChangeSet(t *testing.T, l *Ledger, i int) *Ledger {
+	t.Helper()
+
+	invalid := l.Copy()
+	cs, _ := invalid.ChangeAt(i)
+
+	sig, err := goldenKeyPair(t, 30).SignChangeSet(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs.Signatures = []Signature{sig}
+
+	return invalid
+}
+
+func TestSnapshotAt(t *testing.T) {
+	l, gatewayID := newHistoryTestLedger(t)
+	ids := l.IDChain().IDs
+
+	s, err := l.SnapshotAt(ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf, ok := s.Gateways[gatewayID]; !ok || conf.Port != 8081 || s.Consensus {
+		t.Fatalf("unexpected state after change set 2 %+v", s)
+	}
+
+	if _, ok := l.Snapshot.Gateways[gatewayID]; ok {
+		t.Fatalf("ledger was modified")
+	}
+
+	if _, err := l.SnapshotAt("changes1unknown"); err == nil {
+		t.Fatalf("expected error for unknown change set")
+	}
+
+	invalid := withInvalidChangeSet(t, l, 3)
+
+	if _, err := invalid.SnapshotAt(ids[3]); err == nil || !strings.Contains(err.Error(), "change set 3 is invalid") {
+		t.Fatalf("expected replay error, got %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	l, gatewayID := newHistoryTestLedger(t)
+	ids := l.IDChain().IDs
+
+	diffs, err := l.Diff(ids[1], ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diffs) != 1 || diffs[0].ID != gatewayID || diffs[0].Before.(GatewayConfig).Port != 8080 || diffs[0].After.(GatewayConfig).Port != 8081 {
+		t.Fatalf("unexpected diff %+v", diffs)
+	}
+
+	// the gateway was created and removed in between
+	diffs, err = l.Diff(ids[0], ids[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diffs) != 1 || diffs[0].ID != GlobalResourceID {
+		t.Fatalf("unexpected diff %+v", diffs)
+	}
+
+	invalid := withInvalidChangeSet(t, l, 3)
+
+	if _, err := invalid.Diff(ids[0], ids[3]); err == nil {
+		t.Fatalf("expected replay error")
+	}
+}
+
+func TestBlame(t *testing.T) {
+	l, gatewayID := newHistoryTestLedger(t)
+
+	indices, err := l.Blame(gatewayID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(indices, []int{1, 2, 4}) {
+		t.Fatalf("expected change sets [1 2 4], got %v", indices)
+	}
+
+	indices, err = l.Blame(GlobalResourceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// adding a gateway also requires permissions on the global resource
+	if !slices.Equal(indices, []int{0, 1, 3}) {
+		t.Fatalf("expected change sets [0 1 3], got %v", indices)
+	}
+
+	invalid := withInvalidChangeSet(t, l, 3)
+
+	if _, err := invalid.Blame(gatewayID); err == nil {
+		t.Fatalf("expected replay error")
+	}
+}
+
+func TestHistoryOfPrunedLedger(t *testing.T) {
+	full, gatewayID := newHistoryTestLedger(t)
+	ids := full.IDChain().IDs
+
+	// pruned after change set 2
+	c := full.Copy()
+
+	if err := c.Keep(2); err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewLedgerFromCheckpoint(LatestLedgerVersion, c.NewCheckpoint())
+
+	for _, cs := range full.Changes[3:] {
+		if err := l.Append(&cs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := l.SnapshotAt(ids[1]); err == nil || !strings.Contains(err.Error(), "pruned") {
+		t.Fatalf("expected pruned error, got %v", err)
+	}
+
+	s, err := l.SnapshotAt(ids[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf, ok := s.Gateways[gatewayID]; !ok || conf.Port != 8081 || !s.Consensus {
+		t.Fatalf("unexpected state after change set 3 %+v", s)
+	}
+
+	diffs, err := l.Diff(ids[2], ids[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diffs) != 2 {
+		t.Fatalf("expected 2 diffs, got %+v", diffs)
+	}
+
+	if _, err := l.Diff(ids[0], ids[4]); err == nil {
+		t.Fatalf("expected pruned error")
+	}
+
+	// change sets covered by the checkpoint can't be blamed
+	indices, err := l.Blame(gatewayID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(indices, []int{4}) {
+		t.Fatalf("expected change sets [4], got %v", indices)
+	}
+
+	invalid := withInvalidChangeSet(t, l, 3)
+
+	if _, err := invalid.SnapshotAt(ids[3]); err == nil {
+		t.Fatalf("expected replay error")
+	}
+}
@@ -10,7 +10,14 @@ import (
 // Takes the ChangeSetID of the first change set, and changes to bech32 prefix
 // to "project".
 func (l *Ledger) ProjectID() ProjectID {
-	bs, err := l.Changes[0].ID().encode()
+	var first ChangeSetID
+	if l.Pruned {
+		first = l.Checkpoint.IDs[0]
+	} else {
+		first = l.Changes[0].ID()
+	}
+
+	bs, err := first.encode()
 	if err != nil {
 		panic(fmt.Sprintf("invalid change set id (%v)", err))
 	}
@@ -61,21 +68,19 @@ func ValidateID(id string, expectedPrefix string) error {
 	return nil
 }
 
+// The prefixes are ignored, so that resources (eg. assets) can be assigned to
+// the closest nodes.
 func HammingDistance(aID string, bID string) int {
-	aPrefix, aBytes, err := DecodeBech32(aID)
+	_, aBytes, err := DecodeBech32(aID)
 	if err != nil {
 		panic(err)
 	}
 
-	bPrefix, bBytes, err := DecodeBech32(bID)
+	_, bBytes, err := DecodeBech32(bID)
 	if err != nil {
 		panic(err)
 	}
 
-	if aPrefix != bPrefix {
-		panic("prefixes aren't the same")
-	}
-
 	if len(aBytes) != len(bBytes) {
 		panic("number of bytes aren't the same")
 	}
@@ -154,3 +159,14 @@ func DigestShort(bs []byte) []byte {
 
 	return hash
 }
+
+// Converts the bytes of a node, change set or resource id, received from
+// another node, into a bech32 id. Unlike `EncodeBech32()` it doesn't panic if
+// the bytes have an invalid length.
+func DecodeShortID(prefix string, bs []byte) (string, error) {
+	if len(bs) != shortDigestSize {
+		return "", fmt.Errorf("invalid %s id length %d (expected %d bytes)", prefix, len(bs), shortDigestSize)
+	}
+
+	return EncodeBech32(prefix, bs), nil
+}
@@ -0,0 +1,151 @@
+package ledger
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChangeSetID(t *testing.T) {
+	l, err := DecodeLedger(readGolden(t, "v1.ledger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the ids are hashes of the encoded change sets, so they must be stable
+	// across releases
+	if id := l.Changes[len(l.Changes)-1].ID(); id != goldenV1Head {
+		t.Fatalf("expected id %s, got %s", goldenV1Head, id)
+	}
+
+	for i := 1; i < len(l.Changes); i++ {
+		if id := l.Changes[i-1].ID(); id != l.Changes[i].Prev {
+			t.Fatalf("id %s of change set %d differs from prev %s of change set %d", id, i-1, l.Changes[i].Prev, i)
+		}
+	}
+
+	// signatures are part of the id
+	cs := l.Changes[1]
+	cs.Signatures = nil
+
+	if cs.ID() == l.Changes[1].ID() {
+		t.Fatalf("expected id to depend on signatures")
+	}
+
+	if err := ValidateID(string(goldenV1Head), ChangeSetIDPrefix); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenerateResourceID(t *testing.T) {
+	tests := []struct {
+		prefix string
+		prev   ChangeSetID
+		index  uint
+		id     ResourceID
+	}{
+		{GatewayIDPrefix, goldenV1Head, 0, "gateway1yjq42vwasyur78qg7rwztstd6svc97sx"},
+		{GatewayIDPrefix, goldenV1Head, 300, "gateway18r32lpz3tjnskd5myghqhx49ssenyaaa"},
+	}
+
+	for _, test := range tests {
+		if id := generateResourceId(test.prefix, test.prev, test.index); id != test.id {
+			t.Errorf("expected %s for %s/%d, got %s", test.id, test.prev, test.index, id)
+		}
+	}
+
+	// the ids of the resources in the golden ledger were generated by an older
+	// release
+	l, err := DecodeLedger(readGolden(t, "v1.ledger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+
+	for _, cs := range l.Changes {
+		for i, a := range cs.Actions {
+			if _, ok := a.(AddGateway); ok {
+				id := generateResourceId(GatewayIDPrefix, cs.Prev, uint(i))
+
+				if _, ok := l.Snapshot.Gateways[id]; !ok {
+					t.Fatalf("gateway %s not found in golden ledger", id)
+				}
+
+				found = true
+			}
+		}
+	}
+
+	if !found {
+		t.Fatalf("golden ledger doesn't contain an AddGateway action")
+	}
+
+	seen := map[ResourceID]bool{}
+
+	for _, prefix := range []string{FunctionIDPrefix, GatewayIDPrefix} {
+		for i := uint(0); i < 1000; i++ {
+			id := generateResourceId(prefix, goldenV1Head, i)
+
+			if err := ValidateID(string(id), prefix); err != nil {
+				t.Fatal(err)
+			}
+
+			if seen[id] {
+				t.Fatalf("duplicate id %s", id)
+			}
+
+			seen[id] = true
+		}
+	}
+}
+
+func TestEncodeActionIndexLE(t *testing.T) {
+	tests := []struct {
+		index uint
+		bytes []byte
+	}{
+		{0, []byte{0}},
+		{1, []byte{1}},
+		{255, []byte{255}},
+		{256, []byte{0, 1}},
+		{258, []byte{2, 1}},
+		{65535, []byte{255, 255}},
+		{65536, []byte{0, 0, 1}},
+	}
+
+	for _, test := range tests {
+		if bs := encodeActionIndexLE(test.index); !bytes.Equal(bs, test.bytes) {
+			t.Errorf("expected %x for %d, got %x", test.bytes, test.index, bs)
+		}
+	}
+}
+
+// Assets are assigned to the closest nodes, so ids with different prefixes
+// must be comparable.
+func TestHammingDistance(t *testing.T) {
+	tests := []struct {
+		a        []byte
+		b        []byte
+		distance int
+	}{
+		{[]byte{0, 0}, []byte{0, 0}, 0},
+		{[]byte{0, 0}, []byte{1, 0}, 1},
+		{[]byte{0xff, 0}, []byte{0, 0x0f}, 12},
+	}
+
+	for _, test := range tests {
+		a := EncodeBech32(AssetIDPrefix, test.a)
+		b := EncodeBech32(NodeIDPrefix, test.b)
+
+		if d := HammingDistance(a, b); d != test.distance {
+			t.Errorf("expected distance %d between %s and %s, got %d", test.distance, a, b, d)
+		}
+	}
+
+	asset := string(GenerateAssetID([]byte("handler")))
+	node := string(goldenKeyPair(t, 1).Public.NodeID())
+
+	if HammingDistance(asset, node) != HammingDistance(node, asset) {
+		t.Fatalf("distance isn't symmetric")
+	}
+}
@@ -0,0 +1,190 @@
+package ledger
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The passphrase of an encrypted key file can be passed via an environment
+// variable with the following name:
+const KeyPassphraseEnvName = "OWS_KEY_PASSPHRASE"
+
+// scrypt parameters of newly encrypted key files (the parameters are stored in
+// the key file, so they can be increased later)
+const (
+	keyFileScryptLogN = 15
+	keyFileScryptR    = 8
+	keyFileScryptP    = 1
+)
+
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// Returns the passphrase of an encrypted key file. It is only called if the
+// key file is encrypted.
+type PassphraseFunc func() ([]byte, error)
+
+// The seed of the private key is encrypted using ChaCha20-Poly1305, with a key
+// derived from the passphrase using scrypt. The public key isn't encrypted, so
+// the user id can be shown without the passphrase, but it is authenticated.
+type EncryptedKeyPair struct {
+	Public     PublicKey `cbor:"1,keyasint"`
+	Salt       []byte    `cbor:"2,keyasint"`
+	ScryptLogN uint8     `cbor:"3,keyasint"`
+	ScryptR    int       `cbor:"4,keyasint"`
+	ScryptP    int       `cbor:"5,keyasint"`
+	Nonce      []byte    `cbor:"6,keyasint"`
+	Ciphertext []byte    `cbor:"7,keyasint"`
+}
+
+func (p *KeyPair) Encrypt(passphrase []byte) (*EncryptedKeyPair, error) {
+	e := &EncryptedKeyPair{
+		Public:     p.Public,
+		Salt:       make([]byte, 16),
+		ScryptLogN: keyFileScryptLogN,
+		ScryptR:    keyFileScryptR,
+		ScryptP:    keyFileScryptP,
+		Nonce:      make([]byte, chacha20poly1305.NonceSize),
+	}
+
+	if _, err := rand.Read(e.Salt); err != nil {
+		return nil, err
+	}
+
+	if _, err := rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+
+	aead, err := e.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	seed := ed25519.PrivateKey(p.Private).Seed()
+
+	e.Ciphertext = aead.Seal(nil, e.Nonce, seed, e.Public)
+
+	return e, nil
+}
+
+func (e *EncryptedKeyPair) Decrypt(passphrase []byte) (*KeyPair, error) {
+	aead, err := e.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := aead.Open(nil, e.Nonce, e.Ciphertext, e.Public)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("decrypted seed not exactly %d bytes long", ed25519.SeedSize)
+	}
+
+	kp := PrivateKey(ed25519.NewKeyFromSeed(seed)).KeyPair()
+
+	if !bytes.Equal(kp.Public, e.Public) {
+		return nil, errors.New("decrypted private key doesn't match public key")
+	}
+
+	return kp, nil
+}
+
+func (e *EncryptedKeyPair) Encode() ([]byte, error) {
+	return cbor.Marshal(*e)
+}
+
+func (e *EncryptedKeyPair) aead(passphrase []byte) (cipher.AEAD, error) {
+	if e.ScryptLogN == 0 || e.ScryptLogN > 30 {
+		return nil, fmt.Errorf("invalid scrypt cost 2^%d", e.ScryptLogN)
+	}
+
+	key, err := scrypt.Key(passphrase, e.Salt, 1<<e.ScryptLogN, e.ScryptR, e.ScryptP, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive key from passphrase (%v)", err)
+	}
+
+	return chacha20poly1305.New(key)
+}
+
+// Returns the encrypted key pair if `bs` is an encrypted key file.
+func decodeEncryptedKeyPair(bs []byte) (*EncryptedKeyPair, bool) {
+	var e EncryptedKeyPair
+
+	if err := cbor.Unmarshal(bs, &e); err != nil || len(e.Ciphertext) == 0 {
+		return nil, false
+	}
+
+	return &e, true
+}
+
+// Decodes a plain or an encrypted key file. `passphrase` is only called if the
+// key file is encrypted, and can be nil if encrypted key files aren't
+// supported.
+func DecodeKeyFile(bs []byte, passphrase PassphraseFunc) (*KeyPair, error) {
+	e, isEncrypted := decodeEncryptedKeyPair(bs)
+	if !isEncrypted {
+		return DecodeKeyPair(bs)
+	}
+
+	if passphrase == nil {
+		return nil, errors.New("key is encrypted, but no passphrase is available")
+	}
+
+	pp, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Decrypt(pp)
+}
+
+func IsEncryptedKeyFile(path string) (bool, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	_, isEncrypted := decodeEncryptedKeyPair(bs)
+
+	return isEncrypted, nil
+}
+
+// Returns the passphrase from the OWS_KEY_PASSPHRASE env variable.
+func EnvKeyPassphrase() ([]byte, bool) {
+	pp, exists := os.LookupEnv(KeyPassphraseEnvName)
+	if !exists {
+		return nil, false
+	}
+
+	return []byte(pp), true
+}
+
+// Writes the key pair encrypted using `passphrase`, or unencrypted if
+// `passphrase` is empty.
+func (p *KeyPair) WriteEncrypted(path string, passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return p.Write(path)
+	}
+
+	e, err := p.Encrypt(passphrase)
+	if err != nil {
+		return err
+	}
+
+	bs, err := e.Encode()
+	if err != nil {
+		return err
+	}
+
+	return OverwriteSafe(path, bs)
+}
@@ -0,0 +1,68 @@
+package ledger
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedKeyFile(t *testing.T) {
+	kp := goldenKeyPair(t, 1)
+	p := filepath.Join(t.TempDir(), "key")
+
+	if err := kp.WriteEncrypted(p, []byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+
+	if isEncrypted, err := IsEncryptedKeyFile(p); err != nil || !isEncrypted {
+		t.Fatalf("expected encrypted key file (%v)", err)
+	}
+
+	if _, err := ReadKeyPair(p, nil); err == nil {
+		t.Fatalf("expected encrypted key file to require a passphrase")
+	}
+
+	passphrase := func(pp string) PassphraseFunc {
+		return func() ([]byte, error) { return []byte(pp), nil }
+	}
+
+	if _, err := ReadKeyPair(p, passphrase("battery staple")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected wrong passphrase error, got %v", err)
+	}
+
+	decrypted, err := ReadKeyPair(p, passphrase("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(decrypted.Private, kp.Private) || !bytes.Equal(decrypted.Public, kp.Public) {
+		t.Fatalf("decrypted key differs")
+	}
+
+	// an empty passphrase writes the key unencrypted
+	if err := kp.WriteEncrypted(p, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if isEncrypted, err := IsEncryptedKeyFile(p); err != nil || isEncrypted {
+		t.Fatalf("expected unencrypted key file (%v)", err)
+	}
+
+	if _, err := ReadKeyPair(p, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedKeyPairAuthenticatesPublicKey(t *testing.T) {
+	e, err := goldenKeyPair(t, 1).Encrypt([]byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.Public = goldenKeyPair(t, 2).Public
+
+	if _, err := e.Decrypt([]byte("correct horse")); err == nil {
+		t.Fatalf("expected replaced public key to be detected")
+	}
+}
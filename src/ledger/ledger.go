@@ -18,9 +18,13 @@
 package ledger
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path"
+	"slices"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -38,10 +42,19 @@ const InitialConfigEnvName = "OWS_INITIAL_CONFIG"
 // The first entry in the Changes list is the initial configuration of a
 // project. The latter entries are actual configuration changes.
 //
+// If the ledger has a Checkpoint, the change sets it covers don't need to be
+// replayed when revalidating the ledger. Pruned ledgers (eg. of nodes that
+// were bootstrapped from a checkpoint) don't contain the change sets covered
+// by the Checkpoint, so Changes starts with the first change set after the
+// checkpoint. Use `Ledger.Height()` and `Ledger.ChangeAt()` to work with
+// change set indices that are independent of pruning.
+//
 // The snapshot field isn't exported because it might be nil. The snapshot is
 // generated on-demand by calling the `Ledger.Snapshot()` method.
 type Ledger struct {
 	InitialVersion LedgerVersion
+	Checkpoint     *Checkpoint // nil if there is no checkpoint
+	Pruned         bool
 	Changes        []ChangeSet
 	Snapshot       *Snapshot
 }
@@ -49,10 +62,17 @@ type Ledger struct {
 // Every new LedgerVersion introduces breaking changes, so a single major
 // version number is sufficient to describe it.
 //
-// The LedgerVersion starts at 1.
+// The LedgerVersion starts at 1. Version 2 adds a timestamp to change sets.
+// Version 3 validates the addresses and ports of nodes, and matches policy
+// actions by the category and name of the same entry.
+//
+// The version of an existing ledger is changed with the UpgradeLedgerVersion
+// action. The change sets are always decoded using the version of the
+// snapshot they are applied to (see `Ledger.VersionAt()`), so ledgers
+// created with older versions can still be decoded.
 type LedgerVersion uint
 
-const LatestLedgerVersion = LedgerVersion(1)
+const LatestLedgerVersion = LedgerVersion(3)
 
 // For convenience, the first change set (i.e. the initial configuration) and
 // latter change sets use the same structure. The `Prev“ ChangeSetID of the
@@ -62,8 +82,18 @@ const LatestLedgerVersion = LedgerVersion(1)
 // signatures field itself. Signatures are validated against previously defined
 // user permissions. The signers of the first change set are the root users,
 // and can submit any action without restriction perpetually.
+//
+// Version is the ledger version the change set is encoded with. It isn't part
+// of the encoding itself, it is set when decoding and when creating change
+// sets. The metadata (Timestamp, Message and ValidUntil) is only encoded from
+// version 2 onwards, and is covered by the signatures. Message and ValidUntil
+// are optional.
 type ChangeSet struct {
+	Version    LedgerVersion
 	Prev       ChangeSetID
+	Timestamp  time.Time
+	Message    string
+	ValidUntil time.Time
 	Actions    []Action
 	Signatures []Signature
 }
@@ -92,6 +122,7 @@ const ProjectIDPrefix = "project"
 // Valid action categories are:
 //   - functions
 //   - gateways
+//   - metrics
 //   - nodes
 //   - permissions
 //   - ...
@@ -104,13 +135,17 @@ const ProjectIDPrefix = "project"
 // configuration without inferring specific action types. The
 // `ResourceIDGenerator` creates unique resource ids.
 //
-// TODO: should an Unapply() method be added? (for easy rollbacks)
+// The Inverse() method returns the actions that undo the action, given the
+// snapshot before the action was applied, and the same ResourceIDGenerator as
+// Apply(). It returns an error if the action can't be undone (eg. removed
+// resources can't be recreated with the same id). See `Ledger.Revert()`.
 type Action interface {
 	Category() string
 	Name() string
 	Resources() []ResourceID
 
 	Apply(s *Snapshot, genID ResourceIDGenerator) error
+	Inverse(s *Snapshot, genID ResourceIDGenerator) ([]Action, error)
 }
 
 // Every newly created resource is given a deterministic id.
@@ -161,15 +196,146 @@ type FunctionConfig struct {
 	HandlerID AssetID
 }
 
+// A nil RateLimit means the gateway as a whole isn't rate limited (individual
+// endpoints can still be rate limited).
+//
+// A nil CORS means cross-origin requests aren't answered with any CORS headers,
+// so browsers will block them.
 type GatewayConfig struct {
-	Port      Port
-	Endpoints []GatewayEndpointConfig
+	Port         Port
+	Endpoints    []GatewayEndpointConfig
+	RateLimit    *RateLimitConfig
+	APIKeyQuotas []APIKeyQuotaConfig
+	CORS         *CORSConfig
 }
 
+// A nil Authorizer means the endpoint is public.
+//
+// A nil Transform means the request and the response are passed as-is.
 type GatewayEndpointConfig struct {
 	Method     string
 	Path       string
 	FunctionID FunctionID
+	Authorizer *GatewayAuthorizerConfig
+	RateLimit  *RateLimitConfig
+	Transform  *TransformConfig
+}
+
+// Cross-Origin Resource Sharing configuration of a gateway.
+//
+// AllowOrigins contains full origins (eg. "https://example.com"), or "*" to
+// allow any origin. "*" can't be combined with AllowCredentials.
+//
+// If AllowMethods is empty, the methods of the endpoints defined at the
+// requested path are allowed.
+//
+// MaxAge is the number of seconds browsers are allowed to cache preflight
+// responses. Zero means the header isn't sent.
+type CORSConfig struct {
+	AllowOrigins     []string
+	AllowMethods     []string
+	AllowHeaders     []string
+	ExposeHeaders    []string
+	MaxAge           uint
+	AllowCredentials bool
+}
+
+// Declarative modifications of the requests and responses of a gateway
+// endpoint.
+//
+// Header policies are applied after authorization, so authorization headers
+// can be stripped before they reach the function. Request headers are only
+// passed to the function through the RequestTemplate.
+//
+// RequestTemplate and ResponseTemplate are Go text/template templates (see
+// https://pkg.go.dev/text/template):
+//   - RequestTemplate must render JSON, which is used as the argument of the
+//     function. The template data has the Method, Path, Headers, Query and Body
+//     fields. Body is the decoded JSON body if the request has a JSON content
+//     type, otherwise it's the raw body string.
+//   - ResponseTemplate renders the response body. The template data has a
+//     single Result field, containing the value returned by the function.
+//
+// The `json` template function encodes any value as JSON. Templates are only
+// parsed by the gateways: requests to an endpoint whose template doesn't parse
+// fail.
+type TransformConfig struct {
+	SetRequestHeaders     []HeaderValue
+	RemoveRequestHeaders  []string
+	SetResponseHeaders    []HeaderValue
+	RemoveResponseHeaders []string
+	RequestTemplate       string
+	ResponseTemplate      string
+}
+
+// A list is used instead of a map so that the CBOR encoding is deterministic.
+type HeaderValue struct {
+	Name  string `cbor:"0,keyasint"`
+	Value string `cbor:"1,keyasint"`
+}
+
+// Token bucket rate limit. The bucket holds at most Burst tokens, and is
+// refilled with Rate tokens per second. Each request consumes one token.
+//
+// By default each node enforces the limit independently. If Cluster is true,
+// the nodes share their consumption over gossip, so that the limit applies to
+// the sum of the requests received by all nodes.
+type RateLimitConfig struct {
+	Rate    float64
+	Burst   uint
+	Cluster bool
+}
+
+// Limits the number of requests made with a given API key (identified by its
+// blake2b-128 digest, see `GatewayAuthorizerConfig`) to Limit per Period
+// seconds.
+type APIKeyQuotaConfig struct {
+	APIKeyDigest []byte
+	Limit        uint
+	Period       uint
+	Cluster      bool
+}
+
+// Valid gateway endpoint authorizer types.
+const (
+	APIKeyAuthorizerType   = "api-key"
+	FunctionAuthorizerType = "function"
+	JWTAuthorizerType      = "jwt"
+	OWSKeyAuthorizerType   = "ows-key"
+)
+
+// Only the fields relevant to the authorizer Type are set:
+//   - "api-key": APIKeyDigests
+//   - "jwt": JWKSURL and/or JWTKeys, optionally JWTIssuer and JWTAudience
+//   - "ows-key": no additional fields, signers are checked against the
+//     ledger users and policies
+//   - "function": FunctionID
+//
+// API keys are secrets and are never stored in the ledger. Only their
+// blake2b-128 digests are stored (see `DigestShort()`).
+//
+// JWTKeys are PEM encoded public keys (RSA, ECDSA or Ed25519). Symmetric JWT
+// algorithms aren't supported because the shared secret would have to be
+// stored in the ledger.
+type GatewayAuthorizerConfig struct {
+	Type          string
+	APIKeyDigests [][]byte
+	JWKSURL       string
+	JWTKeys       []string
+	JWTIssuer     string
+	JWTAudience   string
+	FunctionID    FunctionID
+}
+
+// Every node serves its metrics over HTTPS on Port.
+//
+// Requests originating from one of the AllowedNetworks (CIDR notation, eg.
+// "10.0.0.0/8") are always allowed. Other requests must present a client
+// certificate derived from the key of either a node, or a user with a policy
+// allowing "metrics:Read" on the node id.
+type MetricsConfig struct {
+	Port            Port
+	AllowedNetworks []string
 }
 
 type NodeConfig struct {
@@ -203,7 +369,10 @@ func EnvLedger() (*Ledger, bool) {
 }
 
 func NewLedger(v LedgerVersion, initialConfig *ChangeSet) (*Ledger, error) {
-	l := &Ledger{v, []ChangeSet{*initialConfig}, nil}
+	l := &Ledger{
+		InitialVersion: v,
+		Changes:        []ChangeSet{*initialConfig},
+	}
 
 	if err := l.Validate(); err != nil {
 		return nil, err
@@ -215,13 +384,60 @@ func NewLedger(v LedgerVersion, initialConfig *ChangeSet) (*Ledger, error) {
 // Reads, decodes and validates the ledger located at the path.
 // If there is no file is found at `path`, an os.ErrNotExist error is returned,
 // which can be used to write the ledger with only the initial config to disk.
+//
+// If a checkpoint is stored beside the ledger file, only the change sets after
+// the checkpoint are replayed.
 func ReadLedger(path string) (*Ledger, error) {
 	bs, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return DecodeLedger(bs)
+	entries, err := decodeLedgerEntries(bs)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeStoredLedger(path, entries)
+}
+
+// Decodes the entries of a ledger stored at the path, using the checkpoint
+// stored beside it if there is one.
+func decodeStoredLedger(path string, entries [][]byte) (*Ledger, error) {
+	cp, err := ReadCheckpoint(CheckpointPath(path))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("ignoring checkpoint of %s (%v)\n", path, err)
+		}
+
+		return decodeLedgerFromEntries(entries)
+	}
+
+	l, err := decodeLedgerFromEntriesAndCheckpoint(entries, cp)
+	if err != nil {
+		// full ledgers can still be replayed from the start
+		log.Printf("unable to load %s from checkpoint, replaying all change sets (%v)\n", path, err)
+
+		return decodeLedgerFromEntries(entries)
+	}
+
+	return l, nil
+}
+
+// Returns the path of the checkpoint file stored beside the ledger file.
+func CheckpointPath(ledgerPath string) string {
+	return path.Join(path.Dir(ledgerPath), CheckpointFileName)
+}
+
+// Returns a copy which can be modified (eg. using `Append()` or `Keep()`)
+// while the original ledger is being read. Checkpoints are never modified, so
+// they are shared.
+func (l *Ledger) Copy() *Ledger {
+	c := *l
+	c.Changes = slices.Clone(l.Changes)
+	c.Snapshot = l.Snapshot.Copy()
+
+	return &c
 }
 
 // Validates and appends a change set
@@ -246,22 +462,50 @@ func (l *Ledger) Head() ChangeSetID {
 	return l.Snapshot.Head
 }
 
-// Creates an unsigned change set.
+// Creates an unsigned change set, using the current ledger version.
 func (l *Ledger) NewChangeSet(actions ...Action) *ChangeSet {
+	return newChangeSet(l.Snapshot.Version, l.Head(), actions)
+}
+
+// Creates the unsigned initial config of a new ledger with version v.
+func NewInitialChangeSet(v LedgerVersion, actions ...Action) *ChangeSet {
+	return newChangeSet(v, "", actions)
+}
+
+func newChangeSet(v LedgerVersion, prev ChangeSetID, actions []Action) *ChangeSet {
 	cs := &ChangeSet{
-		Prev:       l.Head(),
+		Version:    v,
+		Prev:       prev,
 		Actions:    actions,
 		Signatures: []Signature{},
 	}
 
+	if v >= 2 {
+		// the timestamp is encoded with a precision of one second
+		cs.Timestamp = time.Now().Truncate(time.Second).UTC()
+	}
+
 	return cs
 }
 
 // Encodes and writes the ledger to disk.
+//
+// Checkpoints are written separately (see `Checkpoint.Write()`), but a stale
+// checkpoint file is removed if the ledger no longer has a checkpoint.
 func (l *Ledger) Write(path string) error {
 	bs := l.Encode()
 
-	return OverwriteSafe(path, bs)
+	if err := OverwriteSafe(path, bs); err != nil {
+		return err
+	}
+
+	if l.Checkpoint == nil {
+		if err := os.Remove(CheckpointPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // Creates any necessary parent directories, then writes a temporary file, and
@@ -276,7 +520,8 @@ func OverwriteSafe(p string, bs []byte) error {
 	tmpFileName := uuid.NewString()
 	tmpPath := path.Join(d, tmpFileName)
 
-	if err := os.WriteFile(tmpPath, bs, 0644); err != nil {
+	if err := writeFileSync(tmpPath, bs); err != nil {
+		os.Remove(tmpPath)
 		return fmt.Errorf("unable to write %s, tmp file creation failed (%v)", p, err)
 	}
 
@@ -284,9 +529,47 @@ func OverwriteSafe(p string, bs []byte) error {
 		return fmt.Errorf("unable to write %s, tmp file movement failed (%v)", p, err)
 	}
 
+	// make sure the rename itself survives a crash
+	if err := syncDir(d); err != nil {
+		return fmt.Errorf("unable to write %s, directory sync failed (%v)", p, err)
+	}
+
 	return nil
 }
 
+// Writes the file, and flushes it to disk before returning.
+func writeFileSync(p string, bs []byte) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(bs); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Flushes the directory entries (ie. created, renamed and removed files) to
+// disk.
+func syncDir(p string) error {
+	d, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+
+	return d.Sync()
+}
+
 func (cs *ChangeSet) apply(s *Snapshot) error {
 	for i, a := range cs.Actions {
 		if err := a.Apply(s, newResourceIDGenerator(cs.Prev, uint(i))); err != nil {
@@ -40,15 +40,16 @@ var RootPolicy = &Policy{
 	},
 }
 
-// If multiple resources are specified, all must be allowed.
-func (p *Policy) Allows(category string, action string, resources ...ResourceID) bool {
+// If multiple resources are specified, all must be allowed. Actions are matched
+// using the rules of ledger version v (see `PolicyStatement.matches()`).
+func (p *Policy) Allows(v LedgerVersion, category string, action string, resources ...ResourceID) bool {
 	if len(resources) == 0 {
 		panic(fmt.Sprintf("no resources specified"))
 	} else if len(resources) == 1 {
-		return p.allows(category, action, resources[0])
+		return p.allows(v, category, action, resources[0])
 	} else {
 		for _, r := range resources {
-			if !p.allows(category, action, r) {
+			if !p.allows(v, category, action, r) {
 				return false
 			}
 		}
@@ -57,15 +58,15 @@ func (p *Policy) Allows(category string, action string, resources ...ResourceID)
 	}
 }
 
-func (p *Policy) allows(category string, action string, resource ResourceID) bool {
+func (p *Policy) allows(v LedgerVersion, category string, action string, resource ResourceID) bool {
 	allowed := false
 
 	for _, s := range p.Statements {
-		if s.Allows(category, action, resource) {
+		if s.Allows(v, category, action, resource) {
 			allowed = true
 		}
 
-		if s.Denies(category, action, resource) {
+		if s.Denies(v, category, action, resource) {
 			return false
 		}
 	}
@@ -73,24 +74,50 @@ func (p *Policy) allows(category string, action string, resource ResourceID) boo
 	return allowed
 }
 
-func (s *PolicyStatement) Allows(category string, action string, resource ResourceID) bool {
+func (s *PolicyStatement) Allows(v LedgerVersion, category string, action string, resource ResourceID) bool {
 	if s.Effect == "Allow" {
-		return s.matches(category, action, resource)
+		return s.matches(v, category, action, resource)
 	} else {
 		return false
 	}
 }
 
-func (s *PolicyStatement) Denies(category string, action string, resource ResourceID) bool {
+func (s *PolicyStatement) Denies(v LedgerVersion, category string, action string, resource ResourceID) bool {
 	if s.Effect == "Deny" {
-		return s.matches(category, action, resource)
+		return s.matches(v, category, action, resource)
 	} else {
 		return false
 	}
 }
 
-func (s *PolicyStatement) matches(category string, action string, resource ResourceID) bool {
-	return s.matchesResource(resource) && s.matchesCategory(category) && s.matchesAction(action)
+// From ledger version 3 onwards, the category and the name must match the same
+// entry of `s.Actions` (eg. ["gateways:Add", "functions:Remove"] doesn't match
+// gateways:Remove). Older ledgers match them independently, so that they can
+// still be replayed.
+func (s *PolicyStatement) matches(v LedgerVersion, category string, action string, resource ResourceID) bool {
+	if !s.matchesResource(resource) {
+		return false
+	} else if v < 3 {
+		return s.matchesCategory(category) && s.matchesAction(action)
+	} else {
+		return s.matchesEntry(category, action)
+	}
+}
+
+func (s *PolicyStatement) matchesEntry(category string, name string) bool {
+	for _, a := range s.Actions {
+		if a == "*" {
+			return true
+		}
+
+		fields := strings.Split(a, ":")
+
+		if len(fields) == 2 && (fields[0] == "*" || fields[0] == category) && (fields[1] == "*" || fields[1] == name) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (s *PolicyStatement) matchesCategory(category string) bool {
@@ -137,9 +164,9 @@ func (s *PolicyStatement) matchesResource(resourceId ResourceID) bool {
 	return false
 }
 
-func actionAllowed(action Action, policies ...*Policy) bool {
+func actionAllowed(v LedgerVersion, action Action, policies ...*Policy) bool {
 	for _, policy := range policies {
-		if policy.Allows(action.Category(), action.Name(), action.Resources()...) {
+		if policy.Allows(v, action.Category(), action.Name(), action.Resources()...) {
 			return true
 		}
 	}
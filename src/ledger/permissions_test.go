@@ -0,0 +1,79 @@
+package ledger
+
+import (
+	"testing"
+)
+
+func TestPolicyAllows(t *testing.T) {
+	gatewayAdmin := &Policy{[]PolicyStatement{
+		{Actions: []string{"gateways:*"}, Resources: []string{"*"}, Effect: "Allow"},
+		{Actions: []string{"gateways:Remove"}, Resources: []string{"gateway1"}, Effect: "Deny"},
+	}}
+
+	mixed := &Policy{[]PolicyStatement{
+		{Actions: []string{"gateways:Add", "functions:Remove"}, Resources: []string{"*"}, Effect: "Allow"},
+	}}
+
+	anyCategory := &Policy{[]PolicyStatement{
+		{Actions: []string{"*:Remove"}, Resources: []string{"gateway1", "function1"}, Effect: "Allow"},
+	}}
+
+	denyAll := &Policy{[]PolicyStatement{
+		*RootPolicyStatement,
+		{Actions: []string{"*"}, Resources: []string{"*"}, Effect: "Deny"},
+	}}
+
+	tests := []struct {
+		name      string
+		policy    *Policy
+		category  string
+		action    string
+		resources []ResourceID
+		allowed   bool
+	}{
+		{"root", RootPolicy, NodesCategory, AddNodeName, []ResourceID{GlobalResourceID}, true},
+		{"empty policy", &Policy{}, GatewaysCategory, AddGatewayName, []ResourceID{GlobalResourceID}, false},
+		{"category wildcard", gatewayAdmin, GatewaysCategory, UpdateGatewayName, []ResourceID{"gateway1"}, true},
+		{"other category", gatewayAdmin, FunctionsCategory, AddFunctionName, []ResourceID{GlobalResourceID}, false},
+		{"deny overrides allow", gatewayAdmin, GatewaysCategory, RemoveGatewayName, []ResourceID{"gateway1"}, false},
+		{"deny of other resource", gatewayAdmin, GatewaysCategory, RemoveGatewayName, []ResourceID{"gateway2"}, true},
+		{"all resources must be allowed", gatewayAdmin, GatewaysCategory, RemoveGatewayName, []ResourceID{"gateway2", "gateway1"}, false},
+		{"first listed action", mixed, GatewaysCategory, AddGatewayName, []ResourceID{GlobalResourceID}, true},
+		{"second listed action", mixed, FunctionsCategory, RemoveFunctionName, []ResourceID{"function1"}, true},
+		{"category and name of different actions", mixed, GatewaysCategory, RemoveGatewayName, []ResourceID{"gateway1"}, false},
+		{"name wildcard of other category", mixed, FunctionsCategory, AddFunctionName, []ResourceID{GlobalResourceID}, false},
+		{"any category", anyCategory, FunctionsCategory, RemoveFunctionName, []ResourceID{"function1"}, true},
+		{"any category, other action", anyCategory, FunctionsCategory, AddFunctionName, []ResourceID{"function1"}, false},
+		{"any category, other resource", anyCategory, GatewaysCategory, RemoveGatewayName, []ResourceID{"gateway2"}, false},
+		{"resource list doesn't allow global resource", anyCategory, GatewaysCategory, RemoveGatewayName, []ResourceID{GlobalResourceID}, false},
+		{"deny all", denyAll, NodesCategory, AddNodeName, []ResourceID{GlobalResourceID}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if allowed := test.policy.Allows(LatestLedgerVersion, test.category, test.action, test.resources...); allowed != test.allowed {
+				t.Fatalf("expected allowed=%v, got %v", test.allowed, allowed)
+			}
+		})
+	}
+}
+
+// Before ledger version 3, the category and the name are matched independently,
+// so that older ledgers can still be replayed.
+func TestPolicyAllowsVersion(t *testing.T) {
+	mixed := &Policy{[]PolicyStatement{
+		{Actions: []string{"gateways:Add", "functions:Remove"}, Resources: []string{"*"}, Effect: "Allow"},
+	}}
+
+	if !mixed.Allows(2, GatewaysCategory, RemoveGatewayName, "gateway1") {
+		t.Fatalf("expected version 2 policy to match the category and the name of different actions")
+	}
+
+	if mixed.Allows(3, GatewaysCategory, RemoveGatewayName, "gateway1") {
+		t.Fatalf("expected version 3 policy to refuse the category and the name of different actions")
+	}
+
+	if !mixed.Allows(2, GatewaysCategory, AddGatewayName, GlobalResourceID) || !mixed.Allows(3, GatewaysCategory, AddGatewayName, GlobalResourceID) {
+		t.Fatalf("expected listed action to be allowed by all versions")
+	}
+}
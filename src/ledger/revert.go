@@ -0,0 +1,157 @@
+package ledger
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Returns the actions that undo the change set with the given id, so that they
+// can be submitted as a new change set.
+//
+// Reverting is refused if resources created, changed or removed by the change
+// set were changed again later, or if resources it created are referenced by
+// other resources (eg. a function used by a gateway endpoint).
+func (l *Ledger) Revert(id ChangeSetID) ([]Action, error) {
+	i := l.IndexOf(id)
+	if i < 0 {
+		return nil, fmt.Errorf("change set %s not found", id)
+	} else if i == 0 {
+		return nil, fmt.Errorf("the initial config can't be reverted")
+	}
+
+	cs, ok := l.ChangeAt(i)
+	if !ok {
+		return nil, fmt.Errorf("change set %s was pruned", id)
+	}
+
+	snapshots, err := l.snapshotsAt(i-1, i)
+	if err != nil {
+		return nil, err
+	}
+
+	before, after := snapshots[0], snapshots[1]
+
+	for _, d := range DiffSnapshots(before, after) {
+		current, _ := l.Snapshot.Resource(d.ID)
+
+		if !equalResources(current, d.After) {
+			return nil, fmt.Errorf("%s was changed by a later change set, revert that change set first", d.ID)
+		}
+
+		if d.Before == nil {
+			if other, ok := l.Snapshot.referrer(d.ID); ok {
+				return nil, fmt.Errorf("%s is used by %s", d.ID, other)
+			}
+		}
+	}
+
+	// each action is inverted using the snapshot right before it, and the
+	// inverses are applied in reverse order
+	s := before
+	inverse := []Action{}
+
+	for k, a := range cs.Actions {
+		genID := newResourceIDGenerator(cs.Prev, uint(k))
+
+		inv, err := a.Inverse(s, genID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to revert action %d (%v)", k, err)
+		}
+
+		inverse = append(slices.Clone(inv), inverse...)
+
+		if err := a.Apply(s, genID); err != nil {
+			return nil, fmt.Errorf("failed to replay action %d (%v)", k, err)
+		}
+	}
+
+	// make sure the inverse actions can be applied to the current state
+	check := l.Snapshot.Copy()
+	tmp := &ChangeSet{Prev: check.Head, Actions: inverse}
+
+	if err := tmp.apply(check); err != nil {
+		return nil, fmt.Errorf("inverse actions can't be applied to the current state (%v)", err)
+	}
+
+	return inverse, nil
+}
+
+// Returns the id of another resource that refers to the given resource.
+func (s *Snapshot) referrer(id ResourceID) (ResourceID, bool) {
+	for gatewayID, conf := range s.Gateways {
+		for _, ep := range conf.Endpoints {
+			if ep.FunctionID == id || ep.Authorizer != nil && ep.Authorizer.FunctionID == id {
+				return gatewayID, true
+			}
+		}
+	}
+
+	for userID, conf := range s.Users {
+		if slices.Contains(conf.Policies, id) {
+			return userID, true
+		}
+	}
+
+	return "", false
+}
+
+func (s *Snapshot) gatewayEndpoint(id GatewayID, method string, path string) (GatewayEndpointConfig, error) {
+	conf, ok := s.Gateways[id]
+	if !ok {
+		return GatewayEndpointConfig{}, fmt.Errorf("gateway %s doesn't exist", id)
+	}
+
+	for _, ep := range conf.Endpoints {
+		if ep.Method == method && ep.Path == path {
+			return ep, nil
+		}
+	}
+
+	return GatewayEndpointConfig{}, fmt.Errorf("gateway endpoint %s %s of %s doesn't exist", method, path, id)
+}
+
+// The following functions create the actions that restore a (possibly nil)
+// config.
+
+func newSetGatewayEndpointAuthorizer(id GatewayID, method string, path string, config *GatewayAuthorizerConfig) SetGatewayEndpointAuthorizer {
+	a := SetGatewayEndpointAuthorizer{GatewayID: id, Method: method, Path: path}
+
+	if config != nil {
+		a.Type = config.Type
+		a.APIKeyDigests = config.APIKeyDigests
+		a.JWKSURL = config.JWKSURL
+		a.JWTKeys = config.JWTKeys
+		a.JWTIssuer = config.JWTIssuer
+		a.JWTAudience = config.JWTAudience
+		a.FunctionID = config.FunctionID
+	}
+
+	return a
+}
+
+func newSetGatewayRateLimit(id GatewayID, method string, path string, config *RateLimitConfig) SetGatewayRateLimit {
+	a := SetGatewayRateLimit{GatewayID: id, Method: method, Path: path}
+
+	if config != nil {
+		a.Rate = config.Rate
+		a.Burst = config.Burst
+		a.Cluster = config.Cluster
+	}
+
+	return a
+}
+
+func newSetGatewayEndpointTransform(id GatewayID, method string, path string, config *TransformConfig) SetGatewayEndpointTransform {
+	a := SetGatewayEndpointTransform{GatewayID: id, Method: method, Path: path}
+
+	if config != nil {
+		a.SetRequestHeaders = config.SetRequestHeaders
+		a.RemoveRequestHeaders = config.RemoveRequestHeaders
+		a.SetResponseHeaders = config.SetResponseHeaders
+		a.RemoveResponseHeaders = config.RemoveResponseHeaders
+		a.RequestTemplate = config.RequestTemplate
+		a.ResponseTemplate = config.ResponseTemplate
+	}
+
+	return a
+}
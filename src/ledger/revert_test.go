@@ -0,0 +1,239 @@
+package ledger
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Returns a ledger containing a function, a gateway with a configured
+// endpoint, a second node and a user, along with the key of its root user.
+func newRevertTestLedger(t *testing.T) (*Ledger, *KeyPair) {
+	t.Helper()
+
+	l, kp := newStoreTestLedger(t, 1)
+
+	appendSigned(t, l, kp, l.NewChangeSet(
+		AddFunction{Runtime: "nodejs", HandlerID: GenerateAssetID([]byte("handler"))},
+		AddGateway{Port: 8080},
+		ConfigureMetrics{Port: 9100, AllowedNetworks: []string{"10.0.0.0/8"}},
+		AddNode{Key: goldenKeyPair(t, 2).Public, Address: "10.0.0.2", GossipPort: 9000, APIPort: 9001},
+	))
+
+	functionID := slices.Collect(maps.Keys(l.Snapshot.Functions))[0]
+	gatewayID := slices.Collect(maps.Keys(l.Snapshot.Gateways))[0]
+
+	appendSigned(t, l, kp, l.NewChangeSet(
+		AddGatewayEndpoint{GatewayID: gatewayID, Method: "GET", Path: "/a", FunctionID: functionID},
+		SetGatewayEndpointAuthorizer{GatewayID: gatewayID, Method: "GET", Path: "/a", Type: JWTAuthorizerType, JWKSURL: "https://example.com/jwks.json"},
+		SetGatewayRateLimit{GatewayID: gatewayID, Method: "GET", Path: "/a", Rate: 2.5, Burst: 10},
+		SetGatewayEndpointTransform{GatewayID: gatewayID, Method: "GET", Path: "/a", SetRequestHeaders: []HeaderValue{{"X-Api", "1"}}},
+		SetGatewayCORS{GatewayID: gatewayID, AllowOrigins: []string{"https://example.com"}},
+		SetGatewayAPIKeyQuota{GatewayID: gatewayID, APIKeyDigest: []byte("0123456789abcdef"), Limit: 1000, Period: 3600},
+	))
+
+	return l, kp
+}
+
+func revertTestIDs(l *Ledger) (FunctionID, GatewayID) {
+	return slices.Collect(maps.Keys(l.Snapshot.Functions))[0], slices.Collect(maps.Keys(l.Snapshot.Gateways))[0]
+}
+
+// Applying an action followed by its inverse must restore the state.
+func TestInverse(t *testing.T) {
+	l, kp := newRevertTestLedger(t)
+	functionID, gatewayID := revertTestIDs(l)
+	nodeID := kp.Public.NodeID()
+	otherNodeID := goldenKeyPair(t, 2).Public.NodeID()
+	user := goldenKeyPair(t, 10).Public
+
+	tests := []struct {
+		action Action
+		err    string
+	}{
+		{AddFunction{Runtime: "nodejs", HandlerID: GenerateAssetID([]byte("other"))}, ""},
+		{RemoveFunction{ID: functionID}, "can't be restored"},
+		{AddGateway{Port: 8081}, ""},
+		{AddGatewayEndpoint{GatewayID: gatewayID, Method: "POST", Path: "/b", FunctionID: functionID}, ""},
+		{RemoveGateway{ID: gatewayID}, "can't be restored"},
+		{RemoveGatewayEndpoint{GatewayID: gatewayID, Method: "GET", Path: "/a"}, ""},
+		{SetGatewayAPIKeyQuota{GatewayID: gatewayID, APIKeyDigest: []byte("0123456789abcdef"), Limit: 10, Period: 60}, ""},
+		{SetGatewayAPIKeyQuota{GatewayID: gatewayID, APIKeyDigest: []byte("fedcba9876543210"), Limit: 10, Period: 60}, ""},
+		{SetGatewayCORS{GatewayID: gatewayID, AllowOrigins: []string{"https://example.org"}, MaxAge: 600}, ""},
+		{SetGatewayCORS{GatewayID: gatewayID}, ""},
+		{SetGatewayEndpointAuthorizer{GatewayID: gatewayID, Method: "GET", Path: "/a", Type: JWTAuthorizerType, JWKSURL: "https://example.org/jwks.json"}, ""},
+		{SetGatewayEndpointAuthorizer{GatewayID: gatewayID, Method: "GET", Path: "/a"}, ""},
+		{SetGatewayEndpointTransform{GatewayID: gatewayID, Method: "GET", Path: "/a", RemoveResponseHeaders: []string{"Server"}}, ""},
+		{SetGatewayEndpointTransform{GatewayID: gatewayID, Method: "GET", Path: "/a"}, ""},
+		{SetGatewayRateLimit{GatewayID: gatewayID, Rate: 5, Burst: 20}, ""},
+		{SetGatewayRateLimit{GatewayID: gatewayID, Method: "GET", Path: "/a", Rate: 5, Burst: 20}, ""},
+		{SetGatewayRateLimit{GatewayID: gatewayID, Method: "GET", Path: "/a"}, ""},
+		{UpdateGateway{ID: gatewayID, Port: 8081}, ""},
+		{UpgradeLedgerVersion{Version: LatestLedgerVersion + 1}, "can't be downgraded"},
+		{ConfigureMetrics{Port: 9200}, ""},
+		{ConfigureMetrics{}, ""},
+		{AddNode{Key: goldenKeyPair(t, 3).Public, Address: "10.0.0.3", GossipPort: 9000, APIPort: 9001}, ""},
+		{ConfigureConsensus{Enabled: true}, ""},
+		{RemoveNode{ID: otherNodeID}, ""},
+		{RotateNodeKey{ID: nodeID, Key: goldenKeyPair(t, 12).Public}, ""},
+		{UpdateNodeAddress{ID: nodeID, Address: "node1.example.com"}, ""},
+		{UpdateNodePorts{ID: nodeID, GossipPort: 9002, APIPort: 9003}, ""},
+		{AddUser{Key: goldenKeyPair(t, 11).Public}, "can't be removed"},
+		{RotateUserKey{OldKey: user, NewKey: goldenKeyPair(t, 11).Public}, ""},
+	}
+
+	tested := map[string]bool{}
+
+	for _, test := range tests {
+		tested[actionKey(test.action)] = true
+
+		t.Run(actionKey(test.action), func(t *testing.T) {
+			before := l.Snapshot.Copy()
+			genID := newResourceIDGenerator(before.Head, 0)
+
+			inverse, err := test.action.Inverse(before, genID)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			after := before.Copy()
+
+			if err := test.action.Apply(after, genID); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(DiffSnapshots(before, after)) == 0 {
+				t.Fatalf("%+v didn't change the state", test.action)
+			}
+
+			tmp := &ChangeSet{Prev: after.Head, Actions: inverse}
+
+			if err := tmp.apply(after); err != nil {
+				t.Fatalf("unable to apply inverse %+v (%v)", inverse, err)
+			}
+
+			if diffs := DiffSnapshots(before, after); len(diffs) != 0 {
+				t.Fatalf("inverse %+v didn't restore the state, differs in %+v", inverse, diffs)
+			}
+		})
+	}
+
+	for _, a := range registeredActions(t) {
+		if !tested[actionKey(a)] {
+			t.Fatalf("no inverse test for %s", actionKey(a))
+		}
+	}
+}
+
+func TestRevert(t *testing.T) {
+	l, kp := newRevertTestLedger(t)
+	functionID, gatewayID := revertTestIDs(l)
+	before := l.Snapshot.Copy()
+
+	appendSigned(t, l, kp, l.NewChangeSet(
+		UpdateGateway{ID: gatewayID, Port: 8081},
+		RemoveGatewayEndpoint{GatewayID: gatewayID, Method: "GET", Path: "/a"},
+		ConfigureMetrics{},
+	))
+
+	inverse, err := l.Revert(l.Head())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appendSigned(t, l, kp, l.NewChangeSet(inverse...))
+
+	if diffs := DiffSnapshots(before, l.Snapshot); len(diffs) != 0 {
+		t.Fatalf("revert didn't restore the state, differs in %+v", diffs)
+	}
+
+	// the change sets used by the refusals below
+	changed := l.NewChangeSet(UpdateGateway{ID: gatewayID, Port: 8082})
+	appendSigned(t, l, kp, changed)
+	appendSigned(t, l, kp, l.NewChangeSet(UpdateGateway{ID: gatewayID, Port: 8083}))
+
+	added := l.NewChangeSet(AddFunction{Runtime: "nodejs", HandlerID: GenerateAssetID([]byte("other"))})
+	appendSigned(t, l, kp, added)
+
+	var addedID FunctionID
+
+	for id := range l.Snapshot.Functions {
+		if id != functionID {
+			addedID = id
+		}
+	}
+
+	appendSigned(t, l, kp, l.NewChangeSet(AddGatewayEndpoint{GatewayID: gatewayID, Method: "POST", Path: "/b", FunctionID: addedID}))
+
+	user := l.NewChangeSet(AddUser{Key: goldenKeyPair(t, 20).Public})
+	appendSigned(t, l, kp, user)
+
+	ids := l.IDChain().IDs
+
+	tests := []struct {
+		name string
+		id   ChangeSetID
+		err  string
+	}{
+		{"unknown", "changes1unknown", "not found"},
+		{"initial config", ids[0], "initial config can't be reverted"},
+		{"changed by a later change set", changed.ID(), "changed by a later change set"},
+		{"used by another resource", added.ID(), "is used by " + string(gatewayID)},
+		{"irreversible action", user.ID(), "unable to revert action 0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := l.Revert(test.id)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestRevertPrunedLedger(t *testing.T) {
+	full, kp := newRevertTestLedger(t)
+	_, gatewayID := revertTestIDs(full)
+
+	appendSigned(t, full, kp, full.NewChangeSet(UpdateGateway{ID: gatewayID, Port: 8081}))
+
+	ids := full.IDChain().IDs
+
+	// pruned after change set 3
+	c := full.Copy()
+
+	if err := c.Keep(3); err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewLedgerFromCheckpoint(LatestLedgerVersion, c.NewCheckpoint())
+
+	for _, cs := range full.Changes[4:] {
+		if err := l.Append(&cs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := l.Revert(ids[3]); err == nil || !strings.Contains(err.Error(), "pruned") {
+		t.Fatalf("expected pruned error, got %v", err)
+	}
+
+	// the state before the first change set after the checkpoint is the state
+	// of the checkpoint
+	inverse, err := l.Revert(ids[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inverse) != 1 || inverse[0].(UpdateGateway).Port != 8080 {
+		t.Fatalf("unexpected inverse %+v", inverse)
+	}
+}
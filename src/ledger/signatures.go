@@ -2,12 +2,16 @@ package ledger
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 
@@ -83,14 +87,15 @@ func RandomKeyPair() (*KeyPair, error) {
 	}, nil
 }
 
-func ReadKeyPair(path string) (*KeyPair, error) {
+// Reads a plain or an encrypted key file (see `DecodeKeyFile()`).
+func ReadKeyPair(path string, passphrase PassphraseFunc) (*KeyPair, error) {
 	// file exists
 	bytes, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return DecodeKeyPair(bytes)
+	return DecodeKeyFile(bytes, passphrase)
 }
 
 func RestoreKeyPair(phrase []string) (*KeyPair, error) {
@@ -126,26 +131,97 @@ func (p *KeyPair) Phrase() ([]string, error) {
 	return strings.Split(phrase, " "), nil
 }
 
+// Creates Ed25519 signatures on behalf of a public key. The private key isn't
+// necessarily available to the process (eg. keys stored in a hardware token or
+// held by ssh-agent).
+type Signer interface {
+	PublicKey() PublicKey
+	Sign(message []byte) (Signature, error)
+}
+
+func (p *KeyPair) PublicKey() PublicKey {
+	return p.Public
+}
+
 func (p *KeyPair) Sign(message []byte) (Signature, error) {
 	rawSigBytes := ed25519.Sign(ed25519.PrivateKey(p.Private), message)
 
-	if len(rawSigBytes) != 64 {
+	return NewSignature(p.Public, rawSigBytes)
+}
+
+func (p *KeyPair) SignChangeSet(cs *ChangeSet) (Signature, error) {
+	return SignChangeSet(p, cs)
+}
+
+func (p *KeyPair) SignCheckpoint(cp *Checkpoint) (Signature, error) {
+	return SignCheckpoint(p, cp)
+}
+
+func SignChangeSet(s Signer, cs *ChangeSet) (Signature, error) {
+	message := cs.withoutSignatures().Encode()
+
+	return signVerified(s, message)
+}
+
+func SignCheckpoint(s Signer, cp *Checkpoint) (Signature, error) {
+	message := cp.withoutSignatures().Encode()
+
+	return signVerified(s, message)
+}
+
+// External signers might use another key than expected, or another signature
+// scheme, so the signature is checked before it is used.
+func signVerified(s Signer, message []byte) (Signature, error) {
+	sig, err := s.Sign(message)
+	if err != nil {
+		return Signature{}, err
+	}
+
+	if !sig.Verify(message) {
+		return Signature{}, fmt.Errorf("invalid signature created by signer of %s", s.PublicKey().UserID())
+	}
+
+	return sig, nil
+}
+
+// Wraps raw Ed25519 signature bytes.
+func NewSignature(key PublicKey, raw []byte) (Signature, error) {
+	if len(raw) != 64 {
 		return Signature{}, errors.New("ed25519 signature not exactly 64 bytes long")
 	}
 
 	sigBytes := [64]byte{}
+	copy(sigBytes[:], raw)
 
-	for i, b := range rawSigBytes {
-		sigBytes[i] = b
-	}
+	return Signature{key, sigBytes}, nil
+}
 
-	return Signature{p.Public, sigBytes}, nil
+// Adapts a Signer to the standard library crypto.Signer interface (eg. for
+// TLS certificates). Only Ed25519 signatures of unhashed messages are
+// supported.
+func NewCryptoSigner(s Signer) crypto.Signer {
+	return cryptoSigner{s}
 }
 
-func (p *KeyPair) SignChangeSet(cs *ChangeSet) (Signature, error) {
-	message := cs.withoutSignatures().Encode()
+type cryptoSigner struct {
+	signer Signer
+}
 
-	return p.Sign(message)
+func (c cryptoSigner) Public() crypto.PublicKey {
+	return ed25519.PublicKey(c.signer.PublicKey())
+}
+
+func (c cryptoSigner) Sign(_ io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, fmt.Errorf("ed25519 signer can't sign prehashed messages")
+	}
+
+	sig, err := c.signer.Sign(message)
+	if err != nil {
+		return nil, err
+	}
+
+	return sig.Bytes[:], nil
 }
 
 func (p *KeyPair) Validate() error {
@@ -189,6 +265,21 @@ func ParsePublicKey(s string) (PublicKey, error) {
 	return bs, nil
 }
 
+// Parses a PEM encoded PKIX public key (e.g. an RSA, ECDSA or Ed25519 JWT
+// verification key).
+func ParsePEMPublicKey(s string) (any, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("expected PEM block type \"PUBLIC KEY\", got %q", block.Type)
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
 func parseKeyBytes(s string) ([]byte, error) {
 	s = strings.TrimSpace(s)
 
@@ -238,7 +329,13 @@ func (k PublicKey) String() string {
 	return hex.EncodeToString(bs)
 }
 
+// Signatures decoded from untrusted input can contain keys of any length,
+// which would make ed25519.Verify panic.
 func (s Signature) Verify(message []byte) bool {
+	if len(s.Key) != ed25519.PublicKeySize {
+		return false
+	}
+
 	return ed25519.Verify([]byte(s.Key)[:], message, s.Bytes[:])
 }
 
@@ -273,7 +370,11 @@ func (cs *ChangeSet) validateSignatures() ([]PublicKey, error) {
 // Creates a copy without signatures, which is
 func (cs *ChangeSet) withoutSignatures() *ChangeSet {
 	return &ChangeSet{
+		Version:    cs.Version,
 		Prev:       cs.Prev,
+		Timestamp:  cs.Timestamp,
+		Message:    cs.Message,
+		ValidUntil: cs.ValidUntil,
 		Actions:    cs.Actions,
 		Signatures: []Signature{},
 	}
@@ -1,15 +1,25 @@
 package ledger
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"unicode/utf8"
 )
 
 // Snapshot is used to validate a ledger.
 type Snapshot struct {
 	Version   LedgerVersion
 	Head      ChangeSetID
+	HeadTime  int64 `cbor:",omitempty"` // unix seconds of the head timestamp, zero before version 2
+	Consensus bool  // change sets must be accepted by a majority of the nodes
 	Functions map[FunctionID]FunctionConfig
 	Gateways  map[GatewayID]GatewayConfig
+	Metrics   *MetricsConfig // nil if metrics are disabled
 	Nodes     map[NodeID]NodeConfig
 	Policies  map[PolicyID]Policy
 	Users     map[UserID]UserConfig
@@ -94,6 +104,23 @@ func (s *Snapshot) RemoveGateway(id GatewayID) error {
 	return nil
 }
 
+func (s *Snapshot) UpdateGateway(id GatewayID, port Port) error {
+	conf, ok := s.Gateways[id]
+	if !ok {
+		return fmt.Errorf("gateway %s doesn't exist", id)
+	}
+
+	if other, ok := s.Ports()[port]; ok && other != id {
+		return fmt.Errorf("port %d already used by %s", port, other)
+	}
+
+	conf.Port = port
+
+	s.Gateways[id] = conf
+
+	return nil
+}
+
 func (s *Snapshot) RemoveGatewayEndpoint(id GatewayID, method string, path string) error {
 	conf, ok := s.Gateways[id]
 	if !ok {
@@ -122,16 +149,384 @@ func (s *Snapshot) RemoveGatewayEndpoint(id GatewayID, method string, path strin
 	return nil
 }
 
+// A nil config removes the authorizer of the endpoint.
+func (s *Snapshot) SetGatewayEndpointAuthorizer(id GatewayID, method string, path string, config *GatewayAuthorizerConfig) error {
+	conf, ok := s.Gateways[id]
+	if !ok {
+		return fmt.Errorf("gateway %s doesn't exist", id)
+	}
+
+	if config != nil {
+		if err := s.validateGatewayAuthorizer(config); err != nil {
+			return fmt.Errorf("invalid authorizer for gateway endpoint %s %s of %s (%v)", method, path, id, err)
+		}
+	}
+
+	endpoints := make([]GatewayEndpointConfig, len(conf.Endpoints))
+
+	found := false
+	for i, ep := range conf.Endpoints {
+		if ep.Method == method && ep.Path == path {
+			found = true
+			ep.Authorizer = config
+		}
+
+		endpoints[i] = ep
+	}
+
+	if !found {
+		return fmt.Errorf("gateway endpoint %s %s of %s doesn't exist", method, path, id)
+	}
+
+	conf.Endpoints = endpoints
+
+	s.Gateways[id] = conf
+
+	return nil
+}
+
+// Sets the rate limit of the whole gateway if method and path are empty,
+// otherwise sets the rate limit of a single endpoint. A nil config removes the
+// rate limit.
+func (s *Snapshot) SetGatewayRateLimit(id GatewayID, method string, path string, config *RateLimitConfig) error {
+	conf, ok := s.Gateways[id]
+	if !ok {
+		return fmt.Errorf("gateway %s doesn't exist", id)
+	}
+
+	if config != nil {
+		if config.Rate < 0 {
+			return fmt.Errorf("invalid negative rate limit %f for gateway %s", config.Rate, id)
+		}
+
+		if config.Burst == 0 {
+			return fmt.Errorf("invalid zero burst for gateway %s", id)
+		}
+	}
+
+	if method == "" && path == "" {
+		conf.RateLimit = config
+		s.Gateways[id] = conf
+
+		return nil
+	}
+
+	endpoints := make([]GatewayEndpointConfig, len(conf.Endpoints))
+
+	found := false
+	for i, ep := range conf.Endpoints {
+		if ep.Method == method && ep.Path == path {
+			found = true
+			ep.RateLimit = config
+		}
+
+		endpoints[i] = ep
+	}
+
+	if !found {
+		return fmt.Errorf("gateway endpoint %s %s of %s doesn't exist", method, path, id)
+	}
+
+	conf.Endpoints = endpoints
+
+	s.Gateways[id] = conf
+
+	return nil
+}
+
+// Adds or replaces the quota of an API key. A zero limit removes the quota.
+func (s *Snapshot) SetGatewayAPIKeyQuota(id GatewayID, config APIKeyQuotaConfig) error {
+	conf, ok := s.Gateways[id]
+	if !ok {
+		return fmt.Errorf("gateway %s doesn't exist", id)
+	}
+
+	if len(config.APIKeyDigest) != shortDigestSize {
+		return fmt.Errorf("API key digest isn't %d bytes long", shortDigestSize)
+	}
+
+	if config.Limit != 0 && config.Period == 0 {
+		return fmt.Errorf("invalid zero quota period for gateway %s", id)
+	}
+
+	quotas := make([]APIKeyQuotaConfig, 0, len(conf.APIKeyQuotas)+1)
+
+	for _, q := range conf.APIKeyQuotas {
+		if !bytes.Equal(q.APIKeyDigest, config.APIKeyDigest) {
+			quotas = append(quotas, q)
+		}
+	}
+
+	if config.Limit != 0 {
+		quotas = append(quotas, config)
+	} else if len(quotas) == len(conf.APIKeyQuotas) {
+		return fmt.Errorf("no quota found for API key digest %x of gateway %s", config.APIKeyDigest, id)
+	}
+
+	conf.APIKeyQuotas = quotas
+
+	s.Gateways[id] = conf
+
+	return nil
+}
+
+// A nil config removes the CORS configuration of the gateway.
+func (s *Snapshot) SetGatewayCORS(id GatewayID, config *CORSConfig) error {
+	conf, ok := s.Gateways[id]
+	if !ok {
+		return fmt.Errorf("gateway %s doesn't exist", id)
+	}
+
+	if config != nil {
+		if err := validateCORS(config); err != nil {
+			return fmt.Errorf("invalid CORS config for gateway %s (%v)", id, err)
+		}
+	}
+
+	conf.CORS = config
+
+	s.Gateways[id] = conf
+
+	return nil
+}
+
+// A nil config removes the transform of the endpoint.
+func (s *Snapshot) SetGatewayEndpointTransform(id GatewayID, method string, path string, config *TransformConfig) error {
+	conf, ok := s.Gateways[id]
+	if !ok {
+		return fmt.Errorf("gateway %s doesn't exist", id)
+	}
+
+	if config != nil {
+		if err := validateTransform(config); err != nil {
+			return fmt.Errorf("invalid transform for gateway endpoint %s %s of %s (%v)", method, path, id, err)
+		}
+	}
+
+	endpoints := make([]GatewayEndpointConfig, len(conf.Endpoints))
+
+	found := false
+	for i, ep := range conf.Endpoints {
+		if ep.Method == method && ep.Path == path {
+			found = true
+			ep.Transform = config
+		}
+
+		endpoints[i] = ep
+	}
+
+	if !found {
+		return fmt.Errorf("gateway endpoint %s %s of %s doesn't exist", method, path, id)
+	}
+
+	conf.Endpoints = endpoints
+
+	s.Gateways[id] = conf
+
+	return nil
+}
+
+func validateCORS(config *CORSConfig) error {
+	for _, o := range config.AllowOrigins {
+		if o == "*" {
+			if config.AllowCredentials {
+				return errors.New("wildcard origin can't be combined with credentials")
+			}
+
+			continue
+		}
+
+		u, err := url.Parse(o)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			return fmt.Errorf("invalid origin %q", o)
+		}
+	}
+
+	for _, m := range config.AllowMethods {
+		if m == "" || strings.ToUpper(m) != m {
+			return fmt.Errorf("invalid method %q", m)
+		}
+	}
+
+	for _, h := range slices.Concat(config.AllowHeaders, config.ExposeHeaders) {
+		if !isValidHeaderName(h) {
+			return fmt.Errorf("invalid header name %q", h)
+		}
+	}
+
+	return nil
+}
+
+func validateTransform(config *TransformConfig) error {
+	for _, h := range slices.Concat(config.SetRequestHeaders, config.SetResponseHeaders) {
+		if !isValidHeaderName(h.Name) {
+			return fmt.Errorf("invalid header name %q", h.Name)
+		}
+
+		if strings.ContainsAny(h.Value, "\r\n") {
+			return fmt.Errorf("invalid value of header %s", h.Name)
+		}
+	}
+
+	for _, h := range slices.Concat(config.RemoveRequestHeaders, config.RemoveResponseHeaders) {
+		if !isValidHeaderName(h) {
+			return fmt.Errorf("invalid header name %q", h)
+		}
+	}
+
+	// Templates are parsed by the gateways, so that the validity of the ledger
+	// doesn't depend on the template parser of a Go release
+	if !utf8.ValidString(config.RequestTemplate) {
+		return errors.New("request template isn't valid UTF-8")
+	}
+
+	if !utf8.ValidString(config.ResponseTemplate) {
+		return errors.New("response template isn't valid UTF-8")
+	}
+
+	return nil
+}
+
+// Header names are RFC 7230 tokens
+func isValidHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		if c > 127 || !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *Snapshot) validateGatewayAuthorizer(config *GatewayAuthorizerConfig) error {
+	switch config.Type {
+	case APIKeyAuthorizerType:
+		if len(config.APIKeyDigests) == 0 {
+			return errors.New("no API key digests specified")
+		}
+
+		for i, d := range config.APIKeyDigests {
+			if len(d) != shortDigestSize {
+				return fmt.Errorf("API key digest %d isn't %d bytes long", i, shortDigestSize)
+			}
+		}
+	case FunctionAuthorizerType:
+		if _, ok := s.Functions[config.FunctionID]; !ok {
+			return fmt.Errorf("authorizer function %s doesn't exist", config.FunctionID)
+		}
+	case JWTAuthorizerType:
+		if config.JWKSURL == "" && len(config.JWTKeys) == 0 {
+			return errors.New("neither a JWKS URL nor static JWT keys specified")
+		}
+
+		if config.JWKSURL != "" {
+			u, err := url.Parse(config.JWKSURL)
+			if err != nil {
+				return fmt.Errorf("invalid JWKS URL %s (%v)", config.JWKSURL, err)
+			}
+
+			if u.Scheme != "https" {
+				return fmt.Errorf("JWKS URL %s doesn't use https", config.JWKSURL)
+			}
+		}
+
+		for i, k := range config.JWTKeys {
+			if _, err := ParsePEMPublicKey(k); err != nil {
+				return fmt.Errorf("invalid JWT key %d (%v)", i, err)
+			}
+		}
+	case OWSKeyAuthorizerType:
+	default:
+		return fmt.Errorf("unknown authorizer type %q", config.Type)
+	}
+
+	return nil
+}
+
+// A nil config disables the metrics endpoint.
+func (s *Snapshot) ConfigureMetrics(config *MetricsConfig) error {
+	if config != nil {
+		if id, ok := s.Ports()[config.Port]; ok && id != GlobalResourceID {
+			return fmt.Errorf("port %d already used by %s", config.Port, id)
+		}
+
+		for _, n := range config.AllowedNetworks {
+			if _, _, err := net.ParseCIDR(n); err != nil {
+				return fmt.Errorf("invalid allowed network %s (%v)", n, err)
+			}
+		}
+	}
+
+	s.Metrics = config
+
+	return nil
+}
+
 func (s *Snapshot) AddNode(id NodeID, config NodeConfig) error {
 	if _, ok := s.Nodes[id]; ok {
 		return fmt.Errorf("node %s already exists", id)
 	}
 
+	if other, ok := s.FindNode(config.Key); ok {
+		return fmt.Errorf("key of node %s already used by node %s", id, other)
+	}
+
+	if err := s.checkNodeConfig(id, config); err != nil {
+		return err
+	}
+
 	s.Nodes[id] = config
 
 	return nil
 }
 
+// Modifies the config of an existing node. The config is only changed if fn
+// succeeds.
+func (s *Snapshot) UpdateNode(id NodeID, fn func(conf *NodeConfig) error) error {
+	conf, ok := s.Nodes[id]
+	if !ok {
+		return fmt.Errorf("node %s doesn't exist", id)
+	}
+
+	if err := fn(&conf); err != nil {
+		return err
+	}
+
+	if err := s.checkNodeConfig(id, conf); err != nil {
+		return err
+	}
+
+	s.Nodes[id] = conf
+
+	return nil
+}
+
+// Returns the id of the node with the given key. The id of a node is derived
+// from its original key, which differs from its current key once the key is
+// rotated.
+func (s *Snapshot) FindNode(key PublicKey) (NodeID, bool) {
+	return FindNode(s.Nodes, key)
+}
+
+// Like `Snapshot.FindNode()`, for any collection of node configs.
+func FindNode(nodes map[NodeID]NodeConfig, key PublicKey) (NodeID, bool) {
+	if conf, ok := nodes[key.NodeID()]; ok && bytes.Equal(conf.Key, key) {
+		return key.NodeID(), true
+	}
+
+	for id, conf := range nodes {
+		if bytes.Equal(conf.Key, key) {
+			return id, true
+		}
+	}
+
+	return "", false
+}
+
 func (s *Snapshot) RemoveNode(id NodeID) error {
 	if _, ok := s.Nodes[id]; !ok {
 		return fmt.Errorf("node %s doesn't exist", id)
@@ -167,6 +562,28 @@ func (s *Snapshot) RemoveUser(id UserID) error {
 	return nil
 }
 
+// Moves the config of the user with the old key to a user with the new key.
+func (s *Snapshot) RotateUserKey(oldKey PublicKey, newKey PublicKey) error {
+	oldID := oldKey.UserID()
+	newID := newKey.UserID()
+
+	conf, ok := s.Users[oldID]
+	if !ok {
+		return fmt.Errorf("user %s doesn't exist", oldID)
+	}
+
+	if _, ok := s.Users[newID]; ok {
+		return fmt.Errorf("user %s already exists", newID)
+	}
+
+	conf.Key = newKey
+
+	delete(s.Users, oldID)
+	s.Users[newID] = conf
+
+	return nil
+}
+
 func (s *Snapshot) addRootUsers(users ...PublicKey) {
 	for _, user := range users {
 		id := user.UserID()
@@ -202,6 +619,10 @@ func (s *Snapshot) Ports() map[Port]ResourceID {
 		ports[node.APIPort] = id
 	}
 
+	if s.Metrics != nil {
+		ports[s.Metrics.Port] = GlobalResourceID
+	}
+
 	return ports
 }
 
@@ -0,0 +1,532 @@
+package ledger
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Segments are closed once they reach this size, a new segment is then
+// started for the next entry.
+const MaxSegmentSize = 64 * 1024 * 1024
+
+// Each entry is preceded by its length and its CRC-32C checksum, both encoded
+// as little-endian uint32.
+const entryHeaderSize = 8
+
+const (
+	segmentExt         = ".seg"
+	storeTmpExt        = ".tmp"
+	storeOldExt        = ".old"
+	storeQuarantineExt = ".quarantine"
+	segmentFormat      = "%08d" + segmentExt
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// A Store keeps a ledger on disk as an append-only log, so that appending a
+// change set doesn't require rewriting the whole ledger.
+//
+// The log is a directory of numbered segment files. The entries are the same
+// as those of the encoded ledger (ie. the ledger version followed by the
+// change sets). Every append is flushed to disk before returning.
+//
+// A crash during an append can leave a partially written entry at the end of
+// the last segment. Such a torn tail is detected using the entry checksum, and
+// truncated when the store is opened.
+//
+// A Store can be used concurrently.
+type Store struct {
+	path     string
+	mutex    sync.Mutex
+	entries  []storeEntry
+	segments []int64 // size of each segment
+}
+
+// Location of an entry in the store.
+type storeEntry struct {
+	segment int
+	offset  int64
+}
+
+// Opens the store located at the path, recovering from interrupted writes.
+//
+// If the path contains a ledger using the single-file format (see
+// `Ledger.Write()`), it is migrated to a store. If the path doesn't exist an
+// empty store is created.
+func OpenStore(p string) (*Store, error) {
+	s := &Store{path: p}
+
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(p)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		if err := os.MkdirAll(p, 0755); err != nil {
+			return nil, err
+		}
+
+		if err := syncDir(path.Dir(p)); err != nil {
+			return nil, err
+		}
+	} else if !info.IsDir() {
+		if err := s.migrate(); err != nil {
+			return nil, fmt.Errorf("unable to migrate ledger %s (%v)", p, err)
+		}
+	}
+
+	if err := s.scan(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Returns true if the store doesn't contain any entries yet.
+func (s *Store) IsEmpty() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.entries) == 0
+}
+
+// Reads, decodes and validates the stored ledger. Like `ReadLedger()`, the
+// checkpoint stored beside the store is used if there is one.
+//
+// Change sets that fail to replay are moved to the quarantine file beside the
+// store (see `QuarantinePath()`), where they can still be inspected.
+func (s *Store) Ledger() (*Ledger, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries := make([][]byte, 0, len(s.entries))
+
+	for i := range s.segments {
+		bs, err := os.ReadFile(s.segmentPath(i))
+		if err != nil {
+			return nil, err
+		}
+
+		segEntries, _, err := decodeSegment(bs)
+		if err != nil {
+			return nil, fmt.Errorf("segment %d of %s is corrupt (%v)", i, s.path, err)
+		}
+
+		entries = append(entries, segEntries...)
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("ledger store %s is empty", s.path)
+	}
+
+	l, err := decodeStoredLedger(s.path, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	// invalid change sets are ignored while decoding, and mustn't remain in
+	// front of the change sets appended later
+	if n := len(l.Changes) + 1; n < len(entries) {
+		log.Printf("moving %d invalid change sets from %s to %s\n", len(entries)-n, s.path, s.QuarantinePath())
+
+		if err := s.quarantine(entries[n:]); err != nil {
+			return nil, fmt.Errorf("unable to quarantine invalid change sets of %s (%v)", s.path, err)
+		}
+
+		if err := s.truncateEntries(n); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// Appends the change set to the store, and flushes it to disk.
+func (s *Store) Append(cs *ChangeSet) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.appendEntry(cs.Encode())
+}
+
+// Removes the stored change sets that are no longer part of the ledger, after
+// the ledger has been rolled back (see `Ledger.Keep()`).
+func (s *Store) Truncate(l *Ledger) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.truncateEntries(len(l.Changes) + 1); err != nil {
+		return fmt.Errorf("unable to truncate ledger store %s (%v)", s.path, err)
+	}
+
+	return s.removeStaleCheckpoint(l)
+}
+
+// Replaces the content of the store by the ledger. The new segments are
+// written to a temporary directory first, which then atomically replaces the
+// old segments.
+//
+// This is used to compact the store, and to replace the ledger by a pruned
+// ledger.
+func (s *Store) Rewrite(l *Ledger) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.rewriteEntries(l.entries()); err != nil {
+		return fmt.Errorf("unable to rewrite ledger store %s (%v)", s.path, err)
+	}
+
+	if err := s.scan(); err != nil {
+		return err
+	}
+
+	return s.removeStaleCheckpoint(l)
+}
+
+func (s *Store) appendEntry(payload []byte) error {
+	bs := encodeEntry(payload)
+
+	i := len(s.segments) - 1
+	isNewSegment := i < 0 || (s.segments[i] > 0 && s.segments[i]+int64(len(bs)) > MaxSegmentSize)
+
+	if isNewSegment {
+		i++
+	}
+
+	f, err := os.OpenFile(s.segmentPath(i), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open ledger segment (%v)", err)
+	}
+
+	defer f.Close()
+
+	var offset int64
+	if !isNewSegment {
+		offset = s.segments[i]
+	}
+
+	if _, err := f.Write(bs); err != nil {
+		// remove the partially written entry, so that later entries aren't
+		// written after it
+		f.Truncate(offset)
+		return fmt.Errorf("unable to append to ledger segment (%v)", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("unable to flush ledger segment (%v)", err)
+	}
+
+	if isNewSegment {
+		if err := syncDir(s.path); err != nil {
+			return fmt.Errorf("unable to flush ledger store directory (%v)", err)
+		}
+
+		s.segments = append(s.segments, 0)
+	}
+
+	s.entries = append(s.entries, storeEntry{i, offset})
+	s.segments[i] = offset + int64(len(bs))
+
+	return nil
+}
+
+// Keeps the first n entries.
+func (s *Store) truncateEntries(n int) error {
+	if n >= len(s.entries) {
+		return nil
+	}
+
+	e := s.entries[n]
+
+	if err := truncateSync(s.segmentPath(e.segment), e.offset); err != nil {
+		return err
+	}
+
+	for i := len(s.segments) - 1; i > e.segment; i-- {
+		if err := os.Remove(s.segmentPath(i)); err != nil {
+			return err
+		}
+	}
+
+	if err := syncDir(s.path); err != nil {
+		return err
+	}
+
+	s.entries = s.entries[0:n]
+	s.segments = s.segments[0 : e.segment+1]
+	s.segments[e.segment] = e.offset
+
+	return nil
+}
+
+// Writes the entries to a temporary directory, and then replaces the store
+// directory by it. `Store.recover()` completes or undoes an interrupted
+// rewrite.
+func (s *Store) rewriteEntries(entries [][]byte) error {
+	tmpPath := s.path + storeTmpExt
+	oldPath := s.path + storeOldExt
+
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(tmpPath, 0755); err != nil {
+		return err
+	}
+
+	tmp := &Store{path: tmpPath}
+
+	for _, entry := range entries {
+		if err := tmp.appendEntry(entry); err != nil {
+			return err
+		}
+	}
+
+	if err := syncDir(tmpPath); err != nil {
+		return err
+	}
+
+	if err := os.Rename(s.path, oldPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+
+	if err := syncDir(path.Dir(s.path)); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(oldPath)
+}
+
+// Converts a ledger stored using the single-file format into a store. The
+// entries are copied as is, they are validated when the ledger is read.
+func (s *Store) migrate() error {
+	bs, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	entries, err := decodeLedgerEntries(bs)
+	if err != nil {
+		return err
+	}
+
+	if err := s.rewriteEntries(entries); err != nil {
+		return err
+	}
+
+	log.Printf("migrated ledger %s to append-only segments (%d entries)\n", s.path, len(entries))
+
+	return nil
+}
+
+// Cleans up after an interrupted `Store.rewriteEntries()`. If the old store
+// was moved but not yet replaced, it is restored. Otherwise the temporary
+// directory is incomplete and can be discarded.
+func (s *Store) recover() error {
+	oldPath := s.path + storeOldExt
+
+	if _, err := os.Stat(oldPath); err == nil {
+		if _, err := os.Stat(s.path); errors.Is(err, os.ErrNotExist) {
+			log.Printf("restoring %s after interrupted rewrite\n", s.path)
+
+			if err := os.Rename(oldPath, s.path); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := os.RemoveAll(s.path + storeTmpExt); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(oldPath)
+}
+
+// Indexes the entries of all segments. A torn or corrupt tail of the last
+// segment is truncated, corruption anywhere else results in an error.
+func (s *Store) scan() error {
+	dirEntries, err := os.ReadDir(s.path)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+
+	for _, de := range dirEntries {
+		if strings.HasSuffix(de.Name(), segmentExt) {
+			names = append(names, de.Name())
+		}
+	}
+
+	slices.Sort(names)
+
+	s.entries = []storeEntry{}
+	s.segments = []int64{}
+
+	for i, name := range names {
+		if name != fmt.Sprintf(segmentFormat, i) {
+			return fmt.Errorf("ledger store %s is missing segment %d", s.path, i)
+		}
+
+		bs, err := os.ReadFile(s.segmentPath(i))
+		if err != nil {
+			return err
+		}
+
+		entries, offsets, err := decodeSegment(bs)
+		if err != nil {
+			if i < len(names)-1 {
+				return fmt.Errorf("segment %d of %s is corrupt (%v)", i, s.path, err)
+			}
+
+			// keep everything up to the end of the last valid entry
+			var size int64
+			if n := len(entries); n > 0 {
+				size = offsets[n-1] + int64(entryHeaderSize+len(entries[n-1]))
+			}
+
+			log.Printf("truncating torn tail of %s at byte %d (%v)\n", s.segmentPath(i), size, err)
+
+			if err := truncateSync(s.segmentPath(i), size); err != nil {
+				return err
+			}
+
+			bs = bs[0:size]
+		}
+
+		for _, offset := range offsets {
+			s.entries = append(s.entries, storeEntry{i, offset})
+		}
+
+		s.segments = append(s.segments, int64(len(bs)))
+	}
+
+	return nil
+}
+
+// The quarantine file contains the change sets that failed to replay, using
+// the same entry format as the segments. Entries are only ever appended to it.
+func (s *Store) QuarantinePath() string {
+	return s.path + storeQuarantineExt
+}
+
+func (s *Store) quarantine(entries [][]byte) error {
+	f, err := os.OpenFile(s.QuarantinePath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	for _, entry := range entries {
+		if _, err := f.Write(encodeEntry(entry)); err != nil {
+			return err
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	return syncDir(path.Dir(s.path))
+}
+
+func (s *Store) removeStaleCheckpoint(l *Ledger) error {
+	if l.Checkpoint == nil {
+		if err := os.Remove(CheckpointPath(s.path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) segmentPath(i int) string {
+	return path.Join(s.path, fmt.Sprintf(segmentFormat, i))
+}
+
+func encodeEntry(payload []byte) []byte {
+	bs := make([]byte, entryHeaderSize, entryHeaderSize+len(payload))
+
+	binary.LittleEndian.PutUint32(bs[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(bs[4:8], crc32.Checksum(payload, crc32c))
+
+	return append(bs, payload...)
+}
+
+// Returns the entries of the segment and their offsets. If the segment has a
+// torn or corrupt tail, the valid entries before it are returned along with
+// an error.
+func decodeSegment(bs []byte) ([][]byte, []int64, error) {
+	entries := [][]byte{}
+	offsets := []int64{}
+
+	for offset := 0; offset < len(bs); {
+		if len(bs)-offset < entryHeaderSize {
+			return entries, offsets, io.ErrUnexpectedEOF
+		}
+
+		n := int(binary.LittleEndian.Uint32(bs[offset : offset+4]))
+		sum := binary.LittleEndian.Uint32(bs[offset+4 : offset+8])
+
+		if n > len(bs)-offset-entryHeaderSize {
+			return entries, offsets, io.ErrUnexpectedEOF
+		}
+
+		payload := bs[offset+entryHeaderSize : offset+entryHeaderSize+n]
+
+		if crc32.Checksum(payload, crc32c) != sum {
+			return entries, offsets, fmt.Errorf("checksum mismatch of entry at byte %d", offset)
+		}
+
+		// entries must be valid CBOR bytes, even if they aren't decoded yet
+		if err := cbor.Wellformed(payload); err != nil {
+			return entries, offsets, fmt.Errorf("malformed entry at byte %d (%v)", offset, err)
+		}
+
+		entries = append(entries, payload)
+		offsets = append(offsets, int64(offset))
+
+		offset += entryHeaderSize + n
+	}
+
+	return entries, offsets, nil
+}
+
+func truncateSync(p string, size int64) error {
+	f, err := os.OpenFile(p, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
@@ -0,0 +1,276 @@
+package ledger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns a ledger containing the initial config followed by n change sets,
+// along with the key of its root user.
+func newStoreTestLedger(t *testing.T, n int) (*Ledger, *KeyPair) {
+	t.Helper()
+
+	kp := goldenKeyPair(t, 1)
+
+	initial := NewInitialChangeSet(LatestLedgerVersion, AddNode{Key: kp.Public, Address: "10.0.0.1", GossipPort: 9000, APIPort: 9001})
+
+	sig, err := kp.SignChangeSet(initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initial.Signatures = []Signature{sig}
+
+	l, err := NewLedger(LatestLedgerVersion, initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range n {
+		appendSigned(t, l, kp, l.NewChangeSet(AddUser{Key: goldenKeyPair(t, byte(10+i)).Public}))
+	}
+
+	return l, kp
+}
+
+func openTestStore(t *testing.T, p string) *Store {
+	t.Helper()
+
+	s, err := OpenStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func assertStoredHead(t *testing.T, s *Store, head ChangeSetID, height int) {
+	t.Helper()
+
+	l, err := s.Ledger()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l.Head() != head || l.Height() != height {
+		t.Fatalf("expected head %s at height %d, got %s at height %d", head, height, l.Head(), l.Height())
+	}
+}
+
+func TestStoreAppend(t *testing.T) {
+	l, kp := newStoreTestLedger(t, 1)
+	p := filepath.Join(t.TempDir(), "ledger")
+
+	s := openTestStore(t, p)
+
+	if !s.IsEmpty() {
+		t.Fatalf("new store isn't empty")
+	}
+
+	if err := s.Rewrite(l); err != nil {
+		t.Fatal(err)
+	}
+
+	cs := l.NewChangeSet(AddUser{Key: goldenKeyPair(t, 20).Public})
+	appendSigned(t, l, kp, cs)
+
+	if err := s.Append(cs); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStoredHead(t, openTestStore(t, p), l.Head(), 3)
+}
+
+func TestStoreTornTail(t *testing.T) {
+	l, kp := newStoreTestLedger(t, 2)
+	p := filepath.Join(t.TempDir(), "ledger")
+
+	if err := openTestStore(t, p).Rewrite(l); err != nil {
+		t.Fatal(err)
+	}
+
+	// an entry that was partially written when the node crashed
+	cs := l.NewChangeSet(AddUser{Key: goldenKeyPair(t, 20).Public})
+	appendSigned(t, l, kp, cs)
+
+	seg := filepath.Join(p, "00000000.seg")
+	entry := encodeEntry(cs.Encode())
+
+	f, err := os.OpenFile(seg, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write(entry[0 : len(entry)/2]); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	s := openTestStore(t, p)
+	assertStoredHead(t, s, l.Changes[3].Prev, 3)
+
+	// the tail was truncated, so the change set can be appended again
+	if err := s.Append(cs); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStoredHead(t, openTestStore(t, p), l.Head(), 4)
+}
+
+func TestStoreChecksumMismatch(t *testing.T) {
+	l, _ := newStoreTestLedger(t, 2)
+	p := filepath.Join(t.TempDir(), "ledger")
+
+	if err := openTestStore(t, p).Rewrite(l); err != nil {
+		t.Fatal(err)
+	}
+
+	seg := filepath.Join(p, "00000000.seg")
+
+	bs, err := os.ReadFile(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the payload of the last entry
+	bs[len(bs)-1] ^= 0xff
+
+	if err := os.WriteFile(seg, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStoredHead(t, openTestStore(t, p), l.Changes[2].Prev, 2)
+
+	// corruption before the last segment can't be a torn tail
+	bs[len(bs)-1] ^= 0xff
+	bs[entryHeaderSize+1] ^= 0xff
+
+	if err := os.WriteFile(seg, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(p, "00000001.seg"), encodeEntry(l.Changes[2].Encode()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenStore(p); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("expected corrupt segment error, got %v", err)
+	}
+}
+
+func TestStoreRewrite(t *testing.T) {
+	l, _ := newStoreTestLedger(t, 3)
+	p := filepath.Join(t.TempDir(), "ledger")
+
+	s := openTestStore(t, p)
+
+	if err := s.Rewrite(l); err != nil {
+		t.Fatal(err)
+	}
+
+	// eg. after a rollback
+	if err := l.Keep(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Rewrite(l); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStoredHead(t, s, l.Head(), 2)
+	assertStoredHead(t, openTestStore(t, p), l.Head(), 2)
+
+	for _, ext := range []string{storeTmpExt, storeOldExt} {
+		if _, err := os.Stat(p + ext); !os.IsNotExist(err) {
+			t.Fatalf("%s wasn't removed (%v)", p+ext, err)
+		}
+	}
+
+	// interrupted after the old store was moved away
+	if err := os.Rename(p, p+storeOldExt); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(p+storeTmpExt, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStoredHead(t, openTestStore(t, p), l.Head(), 2)
+
+	if _, err := os.Stat(p + storeTmpExt); !os.IsNotExist(err) {
+		t.Fatalf("incomplete rewrite wasn't removed (%v)", err)
+	}
+}
+
+func TestStoreMigration(t *testing.T) {
+	l, _ := newStoreTestLedger(t, 2)
+	p := filepath.Join(t.TempDir(), "ledger")
+
+	if err := l.Write(p); err != nil {
+		t.Fatal(err)
+	}
+
+	s := openTestStore(t, p)
+
+	if info, err := os.Stat(p); err != nil || !info.IsDir() {
+		t.Fatalf("ledger wasn't migrated to a store (%v)", err)
+	}
+
+	assertStoredHead(t, s, l.Head(), 3)
+	assertStoredHead(t, openTestStore(t, p), l.Head(), 3)
+}
+
+func TestStoreQuarantine(t *testing.T) {
+	l, _ := newStoreTestLedger(t, 1)
+	p := filepath.Join(t.TempDir(), "ledger")
+
+	s := openTestStore(t, p)
+
+	if err := s.Rewrite(l); err != nil {
+		t.Fatal(err)
+	}
+
+	// signed by a key without any permissions, so it fails to replay
+	invalid := l.NewChangeSet(AddUser{Key: goldenKeyPair(t, 20).Public})
+
+	sig, err := goldenKeyPair(t, 30).SignChangeSet(invalid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid.Signatures = []Signature{sig}
+
+	if err := s.Append(invalid); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStoredHead(t, s, l.Head(), 2)
+
+	bs, err := os.ReadFile(s.QuarantinePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _, err := decodeSegment(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 quarantined change set, got %d", len(entries))
+	}
+
+	if cs, err := DecodeChangeSet(entries[0], l.Snapshot.Version); err != nil || cs.ID() != invalid.ID() {
+		t.Fatalf("quarantined entry isn't the invalid change set (%v)", err)
+	}
+
+	// the invalid change set was removed from the store
+	s = openTestStore(t, p)
+
+	if n := len(s.entries); n != 3 {
+		t.Fatalf("expected 3 entries, got %d", n)
+	}
+}
@@ -3,6 +3,7 @@ package ledger
 import (
 	"errors"
 	"fmt"
+	"slices"
 )
 
 // A helper class to detect forks and sync ledgers.
@@ -11,41 +12,48 @@ type ChangeSetIDChain struct {
 }
 
 // Find a change set with the given id. Searches from the end to the beginning
-// of `l.Changes`.
+// of `l.Changes`. The id of a change set is the Prev of the next change set,
+// so change sets don't need to be hashed again.
 func (l *Ledger) FindChange(id ChangeSetID) (*ChangeSet, bool) {
 	n := len(l.Changes)
 
-	for i := n; i >= 0; i-- {
-		if i > 0 && i == n {
-			if id == l.Head() {
-				return &(l.Changes[i-1]), true
-			}
-		} else if i < n {
-			if i > 1 && id == l.Changes[i].Prev {
-				return &(l.Changes[i-1]), true
-			}
-		} else if i > 0 {
-			if id == l.Changes[i].ID() {
-				return &(l.Changes[i]), true
-			}
+	if n == 0 {
+		return nil, false
+	}
+
+	if id == l.Head() {
+		return &(l.Changes[n-1]), true
+	}
+
+	// the Prev of the first change set of a pruned ledger is covered by the
+	// checkpoint, so it is skipped
+	for i := n - 1; i > 0; i-- {
+		if id == l.Changes[i].Prev {
+			return &(l.Changes[i-1]), true
 		}
 	}
 
 	return nil, false
 }
 
-// Returns all the change set ids.
+// Returns all the change set ids, including the ids of the change sets
+// covered by the checkpoint of a pruned ledger.
 func (l *Ledger) IDChain() *ChangeSetIDChain {
 	n := len(l.Changes)
-	ids := make([]ChangeSetID, n)
+	offset := l.offset()
+	ids := make([]ChangeSetID, offset+n)
+
+	if l.Pruned {
+		copy(ids, l.Checkpoint.IDs)
+	}
 
 	for i := 0; i < n; i++ {
 		if i+1 == n {
-			ids[i] = l.Head()
+			ids[offset+i] = l.Head()
 		} else if i+1 < n {
-			ids[i] = l.Changes[i+1].Prev
+			ids[offset+i] = l.Changes[i+1].Prev
 		} else {
-			ids[i] = l.Changes[i].ID()
+			ids[offset+i] = l.Changes[i].ID()
 		}
 	}
 
@@ -54,13 +62,87 @@ func (l *Ledger) IDChain() *ChangeSetIDChain {
 	}
 }
 
-// Removes [until+1:] changes, and revalidates from the beginning.
-func (l *Ledger) Keep(until int) {
-	l.Changes = l.Changes[0 : until+1]
+// Number of change sets, including the change sets covered by the checkpoint
+// of a pruned ledger.
+func (l *Ledger) Height() int {
+	return l.offset() + len(l.Changes)
+}
+
+// Returns the change set with index i, or false if i is out of range or if the
+// change set was pruned.
+func (l *Ledger) ChangeAt(i int) (*ChangeSet, bool) {
+	j := i - l.offset()
+
+	if j < 0 || j >= len(l.Changes) {
+		return nil, false
+	}
+
+	return &(l.Changes[j]), true
+}
+
+// Returns true if the change set with index i was pruned.
+func (l *Ledger) IsPruned(i int) bool {
+	return i < l.offset()
+}
+
+// Number of change sets missing at the start of Changes.
+func (l *Ledger) offset() int {
+	if l.Pruned {
+		return l.Checkpoint.Height()
+	}
+
+	return 0
+}
+
+// Returns the index of the change set with the given id, or -1 if it isn't
+// part of the ledger.
+func (l *Ledger) IndexOf(id ChangeSetID) int {
+	return slices.Index(l.IDChain().IDs, id)
+}
+
+// Returns the ledger version that must be used to decode change set i, which
+// is the version of the snapshot before applying that change set.
+func (l *Ledger) VersionAt(i int) LedgerVersion {
+	if cs, ok := l.ChangeAt(i); ok {
+		return cs.Version
+	}
+
+	return l.InitialVersion
+}
+
+// Returns the ledger version of the change set following cs, taking into
+// account a potential UpgradeLedgerVersion action.
+func (cs *ChangeSet) nextVersion() LedgerVersion {
+	v := cs.Version
+
+	for _, a := range cs.Actions {
+		if upgrade, ok := a.(UpgradeLedgerVersion); ok {
+			v = upgrade.Version
+		}
+	}
+
+	return v
+}
+
+// Removes [until+1:] changes, and revalidates from the checkpoint (or from the
+// beginning). If until precedes the checkpoint, the checkpoint is discarded,
+// unless the ledger is pruned, in which case an error is returned.
+func (l *Ledger) Keep(until int) error {
+	if l.Checkpoint != nil && until+1 < l.Checkpoint.Height() {
+		if l.Pruned {
+			return fmt.Errorf("unable to roll back to change set %d, the ledger is pruned until change set %d", until, l.Checkpoint.Height()-1)
+		}
+
+		l.Checkpoint = nil
+	}
+
+	l.Changes = l.Changes[0 : until+1-l.offset()]
 
 	if err := l.Validate(); err != nil {
 		panic(fmt.Errorf("old state of ledger is invalid (%v)", err))
 	}
+
+	return nil
 }
 
 // Returns the index of the latest common change set.
@@ -85,3 +167,50 @@ func (ca *ChangeSetIDChain) Intersect(cb *ChangeSetIDChain) (int, error) {
 
 	return n - 1, nil
 }
+
+// Acknowledgements of the change sets following the same change set, i.e. the
+// number of nodes whose ledger contains (or that voted for) each change set.
+// Used by consensus to find committed change sets.
+type ForkAcks struct {
+	Counts map[ChangeSetID]int
+	Nodes  int // number of nodes in the ledger
+}
+
+// Fork-choice rule, decides if the local chain (ca) should be replaced by a
+// remote chain (cb):
+//  1. If cb is a prefix of ca (or the same), ca is kept
+//  2. If ca is a prefix of cb, cb is adopted
+//  3. If the chains have forked, the longest chain wins
+//  4. If both forks have the same length, the chain whose first change set
+//     after the intersection has the lowest ID wins
+//
+// The decision only depends on the chains, so all nodes comparing the same
+// chains make the same decision, whichever peers they can reach, and
+// eventually converge on the same chain. Also returns the index of the latest
+// common change set.
+func (ca *ChangeSetIDChain) ShouldAdopt(cb *ChangeSetIDChain) (bool, int, error) {
+	p, err := ca.Intersect(cb)
+	if err != nil {
+		return false, 0, err
+	}
+
+	na := len(ca.IDs)
+	nb := len(cb.IDs)
+
+	switch {
+	case p+1 == nb:
+		return false, p, nil
+	case p+1 == na:
+		return true, p, nil
+	case na != nb:
+		return nb > na, p, nil
+	default:
+		return cb.IDs[p+1] < ca.IDs[p+1], p, nil
+	}
+}
+
+// Returns true if the chains have forked after the intersection p, i.e. if
+// neither is a prefix of the other.
+func (ca *ChangeSetIDChain) HasForked(cb *ChangeSetIDChain, p int) bool {
+	return p+1 < len(ca.IDs) && p+1 < len(cb.IDs)
+}
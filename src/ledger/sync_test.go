@@ -0,0 +1,129 @@
+package ledger
+
+import (
+	"testing"
+)
+
+func TestFindChange(t *testing.T) {
+	l, err := DecodeLedger(readGolden(t, "v1.ledger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range l.Changes {
+		id := l.Changes[i].ID()
+
+		cs, ok := l.FindChange(id)
+		if !ok {
+			t.Fatalf("change set %d (%s) not found", i, id)
+		}
+
+		if cs != &l.Changes[i] {
+			t.Fatalf("expected change set %d for %s, got %s", i, id, cs.ID())
+		}
+	}
+
+	if _, ok := l.FindChange(ChangeSetID("changes1qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqk5pfsn")); ok {
+		t.Fatalf("expected unknown change set not to be found")
+	}
+
+	if _, ok := (&Ledger{Snapshot: newSnapshot(1)}).FindChange(goldenV1Head); ok {
+		t.Fatalf("expected empty ledger not to contain change sets")
+	}
+}
+
+func TestIDChain(t *testing.T) {
+	l, err := DecodeLedger(readGolden(t, "v1.ledger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := l.IDChain().IDs
+
+	if len(ids) != l.Height() {
+		t.Fatalf("expected %d ids, got %d", l.Height(), len(ids))
+	}
+
+	for i, id := range ids {
+		if expected := l.Changes[i].ID(); id != expected {
+			t.Fatalf("expected id %s at %d, got %s", expected, i, id)
+		}
+
+		if l.IndexOf(id) != i {
+			t.Fatalf("expected index %d for %s, got %d", i, id, l.IndexOf(id))
+		}
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []ChangeSetID
+		b    []ChangeSetID
+		p    int
+		err  bool
+	}{
+		{"same chain", []ChangeSetID{"a", "b", "c"}, []ChangeSetID{"a", "b", "c"}, 2, false},
+		{"prefix", []ChangeSetID{"a", "b"}, []ChangeSetID{"a", "b", "c"}, 1, false},
+		{"extension", []ChangeSetID{"a", "b", "c"}, []ChangeSetID{"a"}, 0, false},
+		{"fork", []ChangeSetID{"a", "b", "c"}, []ChangeSetID{"a", "b", "d", "e"}, 1, false},
+		{"fork after initial config", []ChangeSetID{"a", "b"}, []ChangeSetID{"a", "c"}, 0, false},
+		{"different initial config", []ChangeSetID{"a", "b"}, []ChangeSetID{"x", "b"}, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := (&ChangeSetIDChain{test.a}).Intersect(&ChangeSetIDChain{test.b})
+
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected error, got intersection %d", p)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if p != test.p {
+				t.Fatalf("expected intersection %d, got %d", test.p, p)
+			}
+		})
+	}
+}
+
+func TestShouldAdopt(t *testing.T) {
+	tests := []struct {
+		name   string
+		local  []ChangeSetID
+		remote []ChangeSetID
+		adopt  bool
+	}{
+		{"same chain", []ChangeSetID{"a", "b"}, []ChangeSetID{"a", "b"}, false},
+		{"remote is prefix", []ChangeSetID{"a", "b", "c"}, []ChangeSetID{"a", "b"}, false},
+		{"local is prefix", []ChangeSetID{"a", "b"}, []ChangeSetID{"a", "b", "c"}, true},
+		{"longer remote fork", []ChangeSetID{"a", "b", "c"}, []ChangeSetID{"a", "d", "e", "f"}, true},
+		{"shorter remote fork", []ChangeSetID{"a", "b", "c", "d"}, []ChangeSetID{"a", "e", "f"}, false},
+		{"equal forks, lower remote id", []ChangeSetID{"a", "c", "d"}, []ChangeSetID{"a", "b", "e"}, true},
+		{"equal forks, higher remote id", []ChangeSetID{"a", "b", "e"}, []ChangeSetID{"a", "c", "d"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			local := &ChangeSetIDChain{test.local}
+			remote := &ChangeSetIDChain{test.remote}
+
+			adopt, _, err := local.ShouldAdopt(remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if adopt != test.adopt {
+				t.Fatalf("expected adopt=%v, got %v", test.adopt, adopt)
+			}
+
+			// the rule must be symmetric, otherwise nodes wouldn't converge
+			if test.adopt {
+				if reverse, _, _ := remote.ShouldAdopt(local); reverse {
+					t.Fatalf("both chains adopt each other")
+				}
+			}
+		})
+	}
+}
@@ -1,10 +1,17 @@
 package ledger
 
 import (
+	"bytes"
 	"fmt"
 	"log"
+	"slices"
+	"time"
 )
 
+// Maximum difference between the timestamp of a newly submitted change set and
+// the clock of the node receiving it.
+const MaxClockSkew = 5 * time.Minute
+
 // Instead of passing a plain list of change sets into validateAllChangeSets(),
 // we pass a generator, so that validation can be done whilst decoding.
 //
@@ -13,8 +20,14 @@ import (
 // changes.
 type changeSetGenerator = func(yield func(cs *ChangeSet, err error) bool)
 
-// (Re)validates the ledger from the beginning, and recreates the snapshot
+// (Re)validates the ledger from the beginning, or from the checkpoint if the
+// ledger has one, and recreates the snapshot
 func (l *Ledger) Validate() error {
+	if l.Checkpoint != nil {
+		l.Snapshot = l.validateFromCheckpoint()
+		return nil
+	}
+
 	snapshot := newSnapshot(l.InitialVersion)
 
 	genChanges := func(yield func(cs *ChangeSet, err error) bool) {
@@ -45,6 +58,21 @@ func (l *Ledger) Validate() error {
 	return nil
 }
 
+// Change sets covered by the checkpoint are trusted. Like in
+// `validateAllChangeSets()`, invalid change sets are ignored.
+func (l *Ledger) validateFromCheckpoint() *Snapshot {
+	snapshot := l.Checkpoint.Snapshot()
+
+	for i := l.Checkpoint.Height() - l.offset(); i < len(l.Changes); i++ {
+		if err := validateChangeSet(&(l.Changes[i]), snapshot); err != nil {
+			log.Printf("failed to validate change set, ignoring (%v)", err)
+			break
+		}
+	}
+
+	return snapshot
+}
+
 // Uses a generator function for the changes, so this function can be used in
 // different situations.
 func validateAllChangeSets(
@@ -77,6 +105,10 @@ func validateFirstChangeSet(cs *ChangeSet, snapshot *Snapshot) error {
 		return fmt.Errorf("invalid Prev ChangeSetID for first change set, expected empty string, got %s", cs.Prev)
 	}
 
+	if err := cs.checkVersion(snapshot.Version); err != nil {
+		return err
+	}
+
 	rootUsers, err := cs.validateSignatures()
 	if err != nil {
 		return fmt.Errorf("invalid root signature (%v)", err)
@@ -88,14 +120,63 @@ func validateFirstChangeSet(cs *ChangeSet, snapshot *Snapshot) error {
 		return fmt.Errorf("failed to validate first change set (%v)", err)
 	}
 
-	snapshot.Head = cs.ID()
+	snapshot.setHead(cs)
 
 	return nil
 }
 
 func validateChangeSet(cs *ChangeSet, snapshot *Snapshot) error {
-	if cs.Prev != snapshot.Head {
-		return fmt.Errorf("invalid Prev ChangeSetID, expected %s, got %s", snapshot.Head, cs.Prev)
+	if err := snapshot.CheckChangeSet(cs); err != nil {
+		return err
+	}
+
+	if err := cs.apply(snapshot); err != nil {
+		return err
+	}
+
+	snapshot.setHead(cs)
+
+	return nil
+}
+
+func (s *Snapshot) setHead(cs *ChangeSet) {
+	s.Head = cs.ID()
+
+	if !cs.Timestamp.IsZero() {
+		s.HeadTime = cs.Timestamp.Unix()
+	}
+}
+
+func validateResourceID(id ResourceID, expectedPrefix string) error {
+	prefix, bs, err := DecodeBech32(string(id))
+	if err != nil {
+		return fmt.Errorf("invalid resource id format %s (%v)", id, err)
+	}
+
+	if len(bs) != shortDigestSize {
+		return fmt.Errorf("invalid number of bytes in %s", id)
+	}
+
+	if prefix != expectedPrefix {
+		return fmt.Errorf("invalid resource id %s, expected prefix %s, got %s", id, expectedPrefix, prefix)
+	}
+
+	return nil
+}
+
+// Checks that the change set follows the head, and that its actions are
+// allowed for its signers, without applying it.
+func (s *Snapshot) CheckChangeSet(cs *ChangeSet) error {
+	if cs.Prev != s.Head {
+		return fmt.Errorf("invalid Prev ChangeSetID, expected %s, got %s", s.Head, cs.Prev)
+	}
+
+	if err := cs.checkVersion(s.Version); err != nil {
+		return err
+	}
+
+	if err := s.checkExpiry(cs); err != nil {
+		return err
 	}
 
 	signers, err := cs.validateSignatures()
@@ -103,39 +184,140 @@ func validateChangeSet(cs *ChangeSet, snapshot *Snapshot) error {
 		return err
 	}
 
+	if err := s.checkRequiredSigners(cs, signers); err != nil {
+		return err
+	}
+
 	// check that all the actions can actually be taken by the signers
-	policies, err := snapshot.UserPolicies(signers)
+	policies, err := s.UserPolicies(signers)
 	if err != nil {
 		return err
 	}
 
 	for _, a := range cs.Actions {
-		if !actionAllowed(a, policies...) {
+		// users can always rotate their own key, which requires the
+		// signature of the old key (see `checkRequiredSigners()`)
+		if _, ok := a.(RotateUserKey); ok {
+			continue
+		}
+
+		if !actionAllowed(s.Version, a, policies...) {
 			return fmt.Errorf("merged policy of all signers doesn't allow %s:%s", a.Category(), a.Name())
 		}
 	}
 
-	if err := cs.apply(snapshot); err != nil {
-		return err
+	return nil
+}
+
+// Change sets must be encoded with the current version of the ledger, which
+// determines whether they have a timestamp.
+func (cs *ChangeSet) checkVersion(v LedgerVersion) error {
+	if cs.Version != v {
+		return fmt.Errorf("invalid change set version, expected %d, got %d", v, cs.Version)
 	}
 
-	snapshot.Head = cs.ID()
+	if v >= 2 && cs.Timestamp.IsZero() {
+		return fmt.Errorf("missing change set timestamp")
+	} else if v < 2 && (!cs.Timestamp.IsZero() || cs.Message != "" || !cs.ValidUntil.IsZero()) {
+		return fmt.Errorf("unexpected change set metadata for ledger version %d", v)
+	}
+
+	if !cs.ValidUntil.IsZero() && !cs.ValidUntil.After(cs.Timestamp) {
+		return fmt.Errorf("change set expires before its timestamp")
+	}
 
 	return nil
 }
 
-func validateResourceID(id ResourceID, expectedPrefix string) error {
-	prefix, bs, err := DecodeBech32(string(id))
-	if err != nil {
-		return fmt.Errorf("invalid resource id format %s (%v)", id, err)
+// The head change set was accepted by a node whose clock was at most
+// MaxClockSkew behind its timestamp, so a change set that expired before that
+// can't have been appended in time. Unlike `CheckTime()` this only depends on
+// the ledger, so replaying the ledger later gives the same result.
+func (s *Snapshot) checkExpiry(cs *ChangeSet) error {
+	if cs.ValidUntil.IsZero() || s.HeadTime == 0 {
+		return nil
 	}
 
-	if len(bs) != shortDigestSize {
-		return fmt.Errorf("invalid number of bytes in %s", id)
+	if earliest := time.Unix(s.HeadTime, 0).Add(-MaxClockSkew); earliest.After(cs.ValidUntil) {
+		return fmt.Errorf("change set expired at %s, before change set %s was appended", cs.ValidUntil.Format(time.RFC3339), s.Head)
 	}
 
-	if prefix != expectedPrefix {
-		return fmt.Errorf("invalid resource id %s, expected prefix %s, got %s", id, expectedPrefix, prefix)
+	return nil
+}
+
+// Checks the change set timestamp and expiry against the clock of the node
+// that receives it. This isn't part of the ledger validation, because
+// replaying the ledger later must give the same result (see `checkExpiry()`
+// for the part of the expiry that is validated).
+func (cs *ChangeSet) CheckTime(now time.Time) error {
+	if !cs.Timestamp.IsZero() {
+		if skew := now.Sub(cs.Timestamp).Abs(); skew > MaxClockSkew {
+			return fmt.Errorf("change set timestamp %s is %s away from the node time", cs.Timestamp.Format(time.RFC3339), skew.Truncate(time.Second))
+		}
+	}
+
+	if !cs.ValidUntil.IsZero() && now.After(cs.ValidUntil) {
+		return fmt.Errorf("change set expired at %s", cs.ValidUntil.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// Some actions require specific signers, on top of the signers required by
+// the policies:
+//   - upgrading the ledger version requires a root user
+//   - rotating a node or user key requires both the old and the new key
+//
+// The actions are checked in order, so that the old key of a node that is
+// rotated twice in the same change set is the key set by the first rotation.
+func (s *Snapshot) checkRequiredSigners(cs *ChangeSet, signers []PublicKey) error {
+	signedBy := func(key PublicKey) bool {
+		return slices.ContainsFunc(signers, func(other PublicKey) bool {
+			return bytes.Equal(key, other)
+		})
+	}
+
+	// keys of the nodes added or rotated by the preceding actions
+	nodeKeys := map[NodeID]PublicKey{}
+
+	for _, a := range cs.Actions {
+		switch a := a.(type) {
+		case AddNode:
+			nodeKeys[a.Key.NodeID()] = a.Key
+		case UpgradeLedgerVersion:
+			isRoot := slices.ContainsFunc(signers, func(key PublicKey) bool {
+				conf, ok := s.Users[key.UserID()]
+				return ok && conf.IsRoot
+			})
+
+			if !isRoot {
+				return fmt.Errorf("%s:%s must be signed by a root user", a.Category(), a.Name())
+			}
+		case RotateNodeKey:
+			key, ok := nodeKeys[a.ID]
+			if !ok {
+				conf, ok := s.Nodes[a.ID]
+				if !ok {
+					return fmt.Errorf("node %s doesn't exist", a.ID)
+				}
+
+				key = conf.Key
+			}
+
+			if !signedBy(key) {
+				return fmt.Errorf("%s:%s must be signed by the old key of node %s", a.Category(), a.Name(), a.ID)
+			}
+
+			if !signedBy(a.Key) {
+				return fmt.Errorf("%s:%s must be signed by the new key of node %s", a.Category(), a.Name(), a.ID)
+			}
+
+			nodeKeys[a.ID] = a.Key
+		case RotateUserKey:
+			if !signedBy(a.OldKey) || !signedBy(a.NewKey) {
+				return fmt.Errorf("%s:%s must be signed by both the old and the new key of user %s", a.Category(), a.Name(), a.OldKey.UserID())
+			}
+		}
 	}
 
 	return nil
@@ -0,0 +1,310 @@
+package ledger
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckTime(t *testing.T) {
+	tests := []struct {
+		name       string
+		timestamp  time.Duration // relative to the node clock
+		validUntil time.Duration // relative to the node clock, 0 if not set
+		err        string
+	}{
+		{"in sync", 0, 0, ""},
+		{"within skew", -MaxClockSkew + time.Second, 0, ""},
+		{"behind", -MaxClockSkew - time.Second, 0, "away from the node time"},
+		{"ahead", MaxClockSkew + time.Second, 0, "away from the node time"},
+		{"not expired", -time.Minute, time.Second, ""},
+		{"expired", -time.Minute, -time.Second, "expired"},
+	}
+
+	now := goldenTimestamp
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cs := &ChangeSet{Version: 2, Timestamp: now.Add(test.timestamp)}
+
+			if test.validUntil != 0 {
+				cs.ValidUntil = now.Add(test.validUntil)
+			}
+
+			err := cs.CheckTime(now)
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+// Change sets that expired before the head was created are refused by the
+// ledger itself, so replaying gives the same result on every node.
+func TestExpiredChangeSet(t *testing.T) {
+	l, kp := newStoreTestLedger(t, 0)
+
+	head := l.NewChangeSet(AddUser{Key: goldenKeyPair(t, 10).Public})
+	head.Timestamp = goldenTimestamp
+	appendSigned(t, l, kp, head)
+
+	newChangeSet := func(validUntil time.Time) *ChangeSet {
+		cs := l.NewChangeSet(AddUser{Key: goldenKeyPair(t, 11).Public})
+		cs.Timestamp = goldenTimestamp.Add(-time.Hour)
+		cs.ValidUntil = validUntil
+
+		sig, err := kp.SignChangeSet(cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cs.Signatures = []Signature{sig}
+
+		return cs
+	}
+
+	expired := newChangeSet(goldenTimestamp.Add(-MaxClockSkew - time.Second))
+
+	if err := l.Append(expired); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("expected expired change set to be refused, got %v", err)
+	}
+
+	// the node that appended the head might have been behind by up to
+	// MaxClockSkew
+	valid := newChangeSet(goldenTimestamp.Add(-MaxClockSkew + time.Second))
+
+	if err := l.Append(valid); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeLedger(l.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Head() != valid.ID() || decoded.Snapshot.HeadTime != valid.Timestamp.Unix() {
+		t.Fatalf("unexpected head %s at %d", decoded.Head(), decoded.Snapshot.HeadTime)
+	}
+}
+
+// Returns a ledger with a second node (with golden key 2), along with the key
+// of its root user, which is also the key of the first node.
+func newRotationTestLedger(t *testing.T) (*Ledger, *KeyPair) {
+	t.Helper()
+
+	l, root := newStoreTestLedger(t, 0)
+
+	appendSigned(t, l, root, l.NewChangeSet(AddNode{Key: goldenKeyPair(t, 2).Public, Address: "10.0.0.2", GossipPort: 9000, APIPort: 9001}))
+
+	return l, root
+}
+
+func signWith(t *testing.T, cs *ChangeSet, signers ...*KeyPair) *ChangeSet {
+	t.Helper()
+
+	for _, kp := range signers {
+		sig, err := kp.SignChangeSet(cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cs.Signatures = append(cs.Signatures, sig)
+	}
+
+	return cs
+}
+
+func TestRotateNodeKey(t *testing.T) {
+	l, root := newRotationTestLedger(t)
+	node := goldenKeyPair(t, 2)
+	next := goldenKeyPair(t, 12)
+	last := goldenKeyPair(t, 13)
+	added := goldenKeyPair(t, 3)
+	id := node.Public.NodeID()
+
+	tests := []struct {
+		name    string
+		actions []Action
+		signers []*KeyPair
+		err     string
+	}{
+		{"missing old key", []Action{RotateNodeKey{ID: id, Key: next.Public}}, []*KeyPair{root, next}, "old key"},
+		{"missing new key", []Action{RotateNodeKey{ID: id, Key: next.Public}}, []*KeyPair{root, node}, "new key"},
+		{"key of another node", []Action{RotateNodeKey{ID: id, Key: root.Public}}, []*KeyPair{root, node}, "already used by node"},
+		{"unknown node", []Action{RotateNodeKey{ID: added.Public.NodeID(), Key: next.Public}}, []*KeyPair{root, next}, "doesn't exist"},
+		{"rotated twice", []Action{RotateNodeKey{ID: id, Key: next.Public}, RotateNodeKey{ID: id, Key: last.Public}}, []*KeyPair{root, node, next, last}, ""},
+		{"rotated twice without the intermediate key", []Action{RotateNodeKey{ID: id, Key: next.Public}, RotateNodeKey{ID: id, Key: last.Public}}, []*KeyPair{root, node, last}, "new key"},
+		// the old key is the key set by the preceding actions
+		{"added and rotated", []Action{AddNode{Key: added.Public, Address: "10.0.0.3", GossipPort: 9000, APIPort: 9001}, RotateNodeKey{ID: added.Public.NodeID(), Key: next.Public}}, []*KeyPair{root, added, next}, ""},
+		{"added and rotated without the added key", []Action{AddNode{Key: added.Public, Address: "10.0.0.3", GossipPort: 9000, APIPort: 9001}, RotateNodeKey{ID: added.Public.NodeID(), Key: next.Public}}, []*KeyPair{root, next}, "old key"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := l.Copy()
+
+			err := c.Append(signWith(t, c.NewChangeSet(test.actions...), test.signers...))
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	if err := l.Append(signWith(t, l.NewChangeSet(RotateNodeKey{ID: id, Key: next.Public}), root, node, next)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the node keeps its id, and can only be found using the new key
+	if found, ok := l.Snapshot.FindNode(next.Public); !ok || found != id {
+		t.Fatalf("expected node %s for the new key, got %s", id, found)
+	}
+
+	if found, ok := l.Snapshot.FindNode(node.Public); ok {
+		t.Fatalf("old key still belongs to node %s", found)
+	}
+
+	if conf := l.Snapshot.Nodes[id]; conf.Address != "10.0.0.2" || conf.GossipPort != 9000 || conf.APIPort != 9001 {
+		t.Fatalf("rotation changed the node config %+v", conf)
+	}
+
+	// the old key can't sign for the node anymore
+	back := RotateNodeKey{ID: id, Key: node.Public}
+
+	if err := l.Copy().Append(signWith(t, l.NewChangeSet(back), root, node)); err == nil || !strings.Contains(err.Error(), "old key") {
+		t.Fatalf("expected rotation signed by the replaced key to be refused, got %v", err)
+	}
+
+	if err := l.Append(signWith(t, l.NewChangeSet(back), root, next, node)); err != nil {
+		t.Fatal(err)
+	}
+
+	if found, ok := l.Snapshot.FindNode(node.Public); !ok || found != id {
+		t.Fatalf("expected node %s after rotating back, got %s", id, found)
+	}
+}
+
+func TestUpdateNode(t *testing.T) {
+	l, root := newRotationTestLedger(t)
+	node := goldenKeyPair(t, 2)
+	next := goldenKeyPair(t, 12)
+	id := node.Public.NodeID()
+
+	appendSigned(t, l, root, l.NewChangeSet(AddUser{Key: goldenKeyPair(t, 10).Public}))
+
+	if err := l.Append(signWith(t, l.NewChangeSet(RotateNodeKey{ID: id, Key: next.Public}), root, node, next)); err != nil {
+		t.Fatal(err)
+	}
+
+	// nodes are updated using their original id
+	appendSigned(t, l, root, l.NewChangeSet(
+		UpdateNodeAddress{ID: id, Address: "node2.example.com"},
+		UpdateNodePorts{ID: id, GossipPort: 9002, APIPort: 9003},
+	))
+
+	conf := l.Snapshot.Nodes[id]
+
+	if conf.Address != "node2.example.com" || conf.GossipPort != 9002 || conf.APIPort != 9003 || !bytes.Equal(conf.Key, next.Public) {
+		t.Fatalf("unexpected node config %+v", conf)
+	}
+
+	if found, ok := l.Snapshot.FindNode(next.Public); !ok || found != id {
+		t.Fatalf("expected node %s, got %s", id, found)
+	}
+
+	tests := []struct {
+		name   string
+		action Action
+		signer *KeyPair
+		err    string
+	}{
+		{"unknown node address", UpdateNodeAddress{ID: goldenKeyPair(t, 3).Public.NodeID(), Address: "node3.example.com"}, root, "doesn't exist"},
+		{"unknown node ports", UpdateNodePorts{ID: goldenKeyPair(t, 3).Public.NodeID(), GossipPort: 9004, APIPort: 9005}, root, "doesn't exist"},
+		{"invalid address", UpdateNodeAddress{ID: id, Address: "0.0.0.0"}, root, "address"},
+		{"without permission", UpdateNodeAddress{ID: id, Address: "node3.example.com"}, goldenKeyPair(t, 10), "doesn't allow"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := l.Copy().Append(signWith(t, l.NewChangeSet(test.action), test.signer))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestRotateUserKey(t *testing.T) {
+	l, root := newStoreTestLedger(t, 1)
+	user := goldenKeyPair(t, 10)
+	next := goldenKeyPair(t, 12)
+
+	tests := []struct {
+		name    string
+		action  Action
+		signers []*KeyPair
+		err     string
+	}{
+		{"missing old key", RotateUserKey{OldKey: user.Public, NewKey: next.Public}, []*KeyPair{root, next}, "both the old and the new key"},
+		{"missing new key", RotateUserKey{OldKey: user.Public, NewKey: next.Public}, []*KeyPair{root, user}, "both the old and the new key"},
+		{"key of another user", RotateUserKey{OldKey: user.Public, NewKey: root.Public}, []*KeyPair{user, root}, "already exists"},
+		{"unknown user", RotateUserKey{OldKey: goldenKeyPair(t, 11).Public, NewKey: next.Public}, []*KeyPair{goldenKeyPair(t, 11), next}, "doesn't exist"},
+		// users don't need any policy to rotate their own key
+		{"own key", RotateUserKey{OldKey: user.Public, NewKey: next.Public}, []*KeyPair{user, next}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := l.Copy()
+
+			err := c.Append(signWith(t, c.NewChangeSet(test.action), test.signers...))
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	// the root status is carried over, and the old key loses it
+	nextRoot := goldenKeyPair(t, 13)
+
+	if err := l.Append(signWith(t, l.NewChangeSet(RotateUserKey{OldKey: root.Public, NewKey: nextRoot.Public}), root, nextRoot)); err != nil {
+		t.Fatal(err)
+	}
+
+	if conf, ok := l.Snapshot.Users[nextRoot.Public.UserID()]; !ok || !conf.IsRoot || !bytes.Equal(conf.Key, nextRoot.Public) {
+		t.Fatalf("expected root user with the new key, got %+v", conf)
+	}
+
+	if _, ok := l.Snapshot.Users[root.Public.UserID()]; ok {
+		t.Fatalf("user with the old key still exists")
+	}
+
+	cs := l.NewChangeSet(AddUser{Key: goldenKeyPair(t, 20).Public})
+
+	if err := l.Copy().Append(signWith(t, cs, root)); err == nil {
+		t.Fatalf("old root key can still sign change sets")
+	}
+
+	appendSigned(t, l, nextRoot, l.NewChangeSet(AddUser{Key: goldenKeyPair(t, 20).Public}))
+
+	// there is no action to attach policies yet, so the snapshot is modified
+	// directly
+	s := newSnapshot(LatestLedgerVersion)
+	s.Policies["policy1"] = Policy{[]PolicyStatement{*RootPolicyStatement}}
+	s.Users[user.Public.UserID()] = UserConfig{Key: user.Public, Policies: []PolicyID{"policy1"}}
+
+	if err := (RotateUserKey{OldKey: user.Public, NewKey: next.Public}).Apply(s, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if conf, ok := s.Users[next.Public.UserID()]; !ok || !slices.Equal(conf.Policies, []PolicyID{"policy1"}) || conf.IsRoot {
+		t.Fatalf("expected policies to be carried over, got %+v", conf)
+	}
+}
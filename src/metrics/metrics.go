@@ -0,0 +1,382 @@
+// This package implements a minimal metrics registry, which can be exposed
+// using the Prometheus text format, or the OpenMetrics text format.
+//
+// Metrics are defined once, typically as package-level variables of the
+// package that updates them, and are registered in the `Default` registry:
+//
+//	var requests = metrics.Default.NewCounter("ows_requests_total", "Number of requests", "method")
+//
+//	requests.With("GET").Inc()
+//
+// Values that are cheaper to compute on demand (eg. memory stats) can be set
+// by a callback registered with `Registry.OnCollect()`.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+// Content types of the two supported exposition formats
+const (
+	PrometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Default histogram buckets, in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var Default = NewRegistry()
+
+type Registry struct {
+	mutex      sync.Mutex
+	families   map[string]*family
+	onCollect  []func()
+	collecting sync.Mutex // serializes the onCollect callbacks
+}
+
+type family struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	buckets    []float64 // only used by histograms
+
+	mutex  sync.Mutex
+	series map[string]*series // keyed by the joined label values
+}
+
+type series struct {
+	labelValues []string
+
+	mutex   sync.Mutex
+	value   float64
+	counts  []uint64 // histogram bucket counts (not cumulative), the last bucket is +Inf
+	sum     float64
+	samples uint64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		families: map[string]*family{},
+	}
+}
+
+// Registers a callback which is called before each collection, and can be
+// used to update gauges.
+func (r *Registry) OnCollect(f func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.onCollect = append(r.onCollect, f)
+}
+
+func (r *Registry) register(name string, help string, typ string, labelNames []string, buckets []float64) *family {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.families[name]; ok {
+		panic(fmt.Sprintf("metric %s already registered", name))
+	}
+
+	f := &family{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     map[string]*series{},
+	}
+
+	r.families[name] = f
+
+	return f
+}
+
+func (f *family) with(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\x00")
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{
+			labelValues: slices.Clone(labelValues),
+		}
+
+		if f.typ == histogramType {
+			s.counts = make([]uint64, len(f.buckets)+1)
+		}
+
+		f.series[key] = s
+	}
+
+	return s
+}
+
+// Removes all series of the family, eg. so that gauges of removed resources
+// are no longer reported.
+func (f *family) reset() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.series = map[string]*series{}
+}
+
+type CounterVec struct {
+	f *family
+}
+
+type Counter struct {
+	s *series
+}
+
+// Counter names should end with "_total".
+func (r *Registry) NewCounter(name string, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, counterType, labelNames, nil)}
+}
+
+func (v *CounterVec) With(labelValues ...string) Counter {
+	return Counter{v.f.with(labelValues)}
+}
+
+func (c Counter) Inc() {
+	c.Add(1)
+}
+
+// Negative values are ignored, counters can only increase.
+func (c Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+
+	c.s.mutex.Lock()
+	defer c.s.mutex.Unlock()
+
+	c.s.value += delta
+}
+
+type GaugeVec struct {
+	f *family
+}
+
+type Gauge struct {
+	s *series
+}
+
+func (r *Registry) NewGauge(name string, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{r.register(name, help, gaugeType, labelNames, nil)}
+}
+
+func (v *GaugeVec) With(labelValues ...string) Gauge {
+	return Gauge{v.f.with(labelValues)}
+}
+
+func (v *GaugeVec) Reset() {
+	v.f.reset()
+}
+
+func (g Gauge) Set(value float64) {
+	g.s.mutex.Lock()
+	defer g.s.mutex.Unlock()
+
+	g.s.value = value
+}
+
+func (g Gauge) Add(delta float64) {
+	g.s.mutex.Lock()
+	defer g.s.mutex.Unlock()
+
+	g.s.value += delta
+}
+
+type HistogramVec struct {
+	f *family
+}
+
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Buckets are the sorted upper bounds of the histogram buckets, excluding
+// +Inf.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if !slices.IsSorted(buckets) {
+		panic(fmt.Sprintf("buckets of metric %s aren't sorted", name))
+	}
+
+	return &HistogramVec{r.register(name, help, histogramType, labelNames, buckets)}
+}
+
+func (v *HistogramVec) With(labelValues ...string) Histogram {
+	return Histogram{v.f.with(labelValues), v.f.buckets}
+}
+
+func (h Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+
+	h.s.mutex.Lock()
+	defer h.s.mutex.Unlock()
+
+	h.s.counts[i] += 1
+	h.s.sum += value
+	h.s.samples += 1
+}
+
+// Writes all metrics using the Prometheus text format, or the OpenMetrics text
+// format if openMetrics is true.
+func (r *Registry) Write(w io.Writer, openMetrics bool) error {
+	r.collecting.Lock()
+
+	r.mutex.Lock()
+	callbacks := slices.Clone(r.onCollect)
+	r.mutex.Unlock()
+
+	for _, f := range callbacks {
+		f()
+	}
+
+	r.collecting.Unlock()
+
+	r.mutex.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mutex.Unlock()
+
+	slices.SortFunc(families, func(a, b *family) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	var sb strings.Builder
+
+	for _, f := range families {
+		f.write(&sb, openMetrics)
+	}
+
+	if openMetrics {
+		sb.WriteString("# EOF\n")
+	}
+
+	_, err := io.WriteString(w, sb.String())
+
+	return err
+}
+
+func (f *family) write(sb *strings.Builder, openMetrics bool) {
+	f.mutex.Lock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.mutex.Unlock()
+
+	slices.SortFunc(all, func(a, b *series) int {
+		return slices.Compare(a.labelValues, b.labelValues)
+	})
+
+	// OpenMetrics counter family names don't include the "_total" suffix
+	name := f.name
+	if openMetrics && f.typ == counterType {
+		name = strings.TrimSuffix(name, "_total")
+	}
+
+	fmt.Fprintf(sb, "# HELP %s %s\n", name, escapeHelp(f.help))
+	fmt.Fprintf(sb, "# TYPE %s %s\n", name, f.typ)
+
+	for _, s := range all {
+		s.mutex.Lock()
+
+		switch f.typ {
+		case histogramType:
+			cumulative := uint64(0)
+
+			for i, n := range s.counts {
+				cumulative += n
+
+				le := "+Inf"
+				if i < len(f.buckets) {
+					le = formatFloat(f.buckets[i])
+				}
+
+				writeSample(sb, f.name+"_bucket", f.labelNames, s.labelValues, "le", le, float64(cumulative))
+			}
+
+			writeSample(sb, f.name+"_sum", f.labelNames, s.labelValues, "", "", s.sum)
+			writeSample(sb, f.name+"_count", f.labelNames, s.labelValues, "", "", float64(s.samples))
+		default:
+			writeSample(sb, f.name, f.labelNames, s.labelValues, "", "", s.value)
+		}
+
+		s.mutex.Unlock()
+	}
+}
+
+func writeSample(sb *strings.Builder, name string, labelNames []string, labelValues []string, extraName string, extraValue string, value float64) {
+	sb.WriteString(name)
+
+	if len(labelNames) > 0 || extraName != "" {
+		pairs := make([]string, 0, len(labelNames)+1)
+
+		for i, n := range labelNames {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", n, escapeLabelValue(labelValues[i])))
+		}
+
+		if extraName != "" {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, extraValue))
+		}
+
+		sb.WriteString("{")
+		sb.WriteString(strings.Join(pairs, ","))
+		sb.WriteString("}")
+	}
+
+	sb.WriteString(" ")
+	sb.WriteString(formatFloat(value))
+	sb.WriteString("\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+// Returns true if the Accept header prefers the OpenMetrics format.
+func AcceptsOpenMetrics(accept string) bool {
+	return strings.Contains(accept, "application/openmetrics-text")
+}
@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func testRegistry() *Registry {
+	r := NewRegistry()
+
+	requests := r.NewCounter("test_requests_total", "Number of requests", "method", "path")
+	requests.With("GET", "/a").Inc()
+	requests.With("GET", "/a").Add(2)
+	requests.With("GET", "/a").Add(-5) // ignored
+	requests.With("POST", `/b"\`+"\n").Inc()
+
+	gauge := r.NewGauge("test_load", "Help with \\ and\nnewline")
+	gauge.With().Set(1.5)
+	gauge.With().Add(-0.25)
+
+	latency := r.NewHistogram("test_latency_seconds", "Latency", []float64{0.1, 1}, "gateway")
+	latency.With("gw1").Observe(0.05)
+	latency.With("gw1").Observe(0.1) // upper bounds are inclusive
+	latency.With("gw1").Observe(0.5)
+	latency.With("gw1").Observe(30)
+
+	return r
+}
+
+func TestWritePrometheus(t *testing.T) {
+	var sb strings.Builder
+
+	if err := testRegistry().Write(&sb, false); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_latency_seconds Latency
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{gateway="gw1",le="0.1"} 2
+test_latency_seconds_bucket{gateway="gw1",le="1"} 3
+test_latency_seconds_bucket{gateway="gw1",le="+Inf"} 4
+test_latency_seconds_sum{gateway="gw1"} 30.65
+test_latency_seconds_count{gateway="gw1"} 4
+# HELP test_load Help with \\ and\nnewline
+# TYPE test_load gauge
+test_load 1.25
+# HELP test_requests_total Number of requests
+# TYPE test_requests_total counter
+test_requests_total{method="GET",path="/a"} 3
+test_requests_total{method="POST",path="/b\"\\\n"} 1
+`
+
+	if sb.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, sb.String())
+	}
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	var sb strings.Builder
+
+	if err := testRegistry().Write(&sb, true); err != nil {
+		t.Fatal(err)
+	}
+
+	out := sb.String()
+
+	// counter families don't have the _total suffix, but their samples do
+	for _, line := range []string{
+		"# HELP test_requests Number of requests\n",
+		"# TYPE test_requests counter\n",
+		"test_requests_total{method=\"GET\",path=\"/a\"} 3\n",
+		"# TYPE test_latency_seconds histogram\n",
+		"test_latency_seconds_bucket{gateway=\"gw1\",le=\"+Inf\"} 4\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("expected %q in:\n%s", line, out)
+		}
+	}
+
+	if !strings.HasSuffix(out, "\n# EOF\n") || strings.Count(out, "# EOF") != 1 {
+		t.Fatalf("expected output to end with a single # EOF:\n%s", out)
+	}
+}
+
+func TestOnCollect(t *testing.T) {
+	r := NewRegistry()
+	gauge := r.NewGauge("test_items", "Items", "kind")
+
+	calls := 0
+	r.OnCollect(func() {
+		calls += 1
+
+		// series of removed resources aren't reported anymore
+		gauge.Reset()
+		gauge.With("a").Set(float64(calls))
+	})
+
+	var sb strings.Builder
+
+	for range 2 {
+		sb.Reset()
+
+		if err := r.Write(&sb, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := "# HELP test_items Items\n# TYPE test_items gauge\ntest_items{kind=\"a\"} 2\n"
+	if sb.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, sb.String())
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	cases := map[float64]string{
+		0:            "0",
+		1:            "1",
+		0.005:        "0.005",
+		1e21:         "1e+21",
+		-2.5:         "-2.5",
+		math.Inf(1):  "+Inf",
+		math.Inf(-1): "-Inf",
+		math.NaN():   "NaN",
+	}
+
+	for v, expected := range cases {
+		if got := formatFloat(v); got != expected {
+			t.Fatalf("expected %s, got %s", expected, got)
+		}
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	cases := map[string]func(r *Registry){
+		"duplicate name": func(r *Registry) {
+			r.NewCounter("test_total", "")
+			r.NewGauge("test_total", "")
+		},
+		"unsorted buckets": func(r *Registry) {
+			r.NewHistogram("test_seconds", "", []float64{1, 0.1})
+		},
+		"wrong label count": func(r *Registry) {
+			r.NewCounter("test_total", "", "a").With("x", "y")
+		},
+	}
+
+	for name, f := range cases {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected panic")
+				}
+			}()
+
+			f(NewRegistry())
+		})
+	}
+}
+
+func TestAcceptsOpenMetrics(t *testing.T) {
+	if !AcceptsOpenMetrics("application/openmetrics-text; version=1.0.0,text/plain;q=0.5") {
+		t.Fatalf("expected OpenMetrics to be accepted")
+	}
+
+	if AcceptsOpenMetrics("text/plain") || AcceptsOpenMetrics("") {
+		t.Fatalf("expected Prometheus format")
+	}
+}
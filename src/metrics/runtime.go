@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"runtime"
+	"time"
+)
+
+// Registers the goroutine, memory and GC metrics of the current process.
+func (r *Registry) RegisterRuntimeMetrics() {
+	var (
+		goroutines   = r.NewGauge("go_goroutines", "Number of goroutines that currently exist")
+		allocBytes   = r.NewGauge("go_memstats_alloc_bytes", "Number of bytes allocated and still in use")
+		heapInuse    = r.NewGauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use")
+		sysBytes     = r.NewGauge("go_memstats_sys_bytes", "Number of bytes obtained from the system")
+		gcCycles     = r.NewGauge("go_gc_cycles", "Number of completed GC cycles")
+		gcPauseTotal = r.NewGauge("go_gc_pause_seconds", "Cumulative GC stop-the-world pause duration")
+		uptime       = r.NewGauge("process_uptime_seconds", "Number of seconds since the process started")
+		start        = time.Now()
+	)
+
+	r.OnCollect(func() {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+
+		goroutines.With().Set(float64(runtime.NumGoroutine()))
+		allocBytes.With().Set(float64(ms.Alloc))
+		heapInuse.With().Set(float64(ms.HeapInuse))
+		sysBytes.With().Set(float64(ms.Sys))
+		gcCycles.With().Set(float64(ms.NumGC))
+		gcPauseTotal.With().Set(time.Duration(ms.PauseTotalNs).Seconds())
+		uptime.With().Set(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,65 @@
+package network
+
+import (
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// Default interval between anti-entropy rounds, and the maximum interval after
+// consecutive failures.
+const (
+	AntiEntropyInterval   = 30 * time.Second
+	MaxAntiEntropyBackoff = 10 * time.Minute
+)
+
+// Periodically compares the local head with the head of a random peer, and
+// pulls any missing change sets. This way nodes that missed a gossip catch up
+// eventually, and forks are resolved (see `PullFrom()`).
+//
+// Intervals are jittered so that nodes don't query each other in lockstep.
+// The interval is doubled after every failed round (up to maxBackoff), and
+// reset after a successful round.
+//
+// Never returns.
+func (c *APIClient) RunAntiEntropy(interval time.Duration, maxBackoff time.Duration) {
+	delay := interval
+
+	for {
+		time.Sleep(jitter(delay))
+
+		if err := c.antiEntropyRound(); err != nil {
+			delay = min(2*delay, maxBackoff)
+			log.Printf("anti-entropy round failed, next round in ~%s (%v)\n", delay, err)
+		} else {
+			delay = interval
+		}
+	}
+}
+
+func (c *APIClient) antiEntropyRound() error {
+	id, node := c.PickRandomNode()
+	if node == nil {
+		return nil
+	}
+
+	n, err := c.PullFrom(node)
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		log.Printf("anti-entropy: pulled %d change sets from node %s\n", n, id)
+	}
+
+	return nil
+}
+
+// Returns a random duration in [d/2, 3d/2).
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + rand.N(d)
+}
@@ -2,18 +2,33 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
 
 	"ows/ledger"
 )
 
+// Maximum duration of `NodeAPIClient.Acknowledged()`, so that unreachable
+// nodes don't block fork resolution.
+const AcknowledgedRequestTimeout = 5 * time.Second
+
 // General API client
 type APIClient struct {
-	kp        *ledger.KeyPair
+	signer    ledger.Signer
 	callbacks Callbacks
 }
 
@@ -25,31 +40,48 @@ type NodeAPIClient struct {
 }
 
 // Creates a new general API client
-func NewAPIClient(kp *ledger.KeyPair, callbacks Callbacks) *APIClient {
-	return &APIClient{kp, callbacks}
+func NewAPIClient(signer ledger.Signer, callbacks Callbacks) *APIClient {
+	return &APIClient{signer, callbacks}
 }
 
 // Returns a node-specific API client
 func (c *APIClient) PickNode() *NodeAPIClient {
 	m := c.callbacks.Ledger().Snapshot.Nodes
-	ownID := c.callbacks.OwnKeyPair().Public.NodeID()
+	ownID, _ := ledger.FindNode(m, c.callbacks.OwnSigner().PublicKey())
 
 	for id, conf := range m {
 		if id != ownID {
-			return NewNodeAPIClient(c.kp, conf.Address, conf.APIPort, m)
+			return NewNodeAPIClient(c.signer, conf.Address, conf.APIPort, m)
 		}
 	}
 
 	return nil
 }
 
-// Syncs the local ledger, by performing the following steps:
-//  1. Pick any node
-//  2. Request the head of that node's ledger
-//  3. If the head is the same exit
-//  4. If the head isn't the same, fetch all tx Ids
-//  5. Find the intersection (last common point)
-//  6. Download everything after the intersection
+// Returns a node-specific API client for a random node other than the
+// current one.
+func (c *APIClient) PickRandomNode() (ledger.NodeID, *NodeAPIClient) {
+	m := c.callbacks.Ledger().Snapshot.Nodes
+	ownID, _ := ledger.FindNode(m, c.callbacks.OwnSigner().PublicKey())
+
+	ids := make([]ledger.NodeID, 0, len(m))
+	for id := range m {
+		if id != ownID {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return "", nil
+	}
+
+	id := ids[rand.IntN(len(ids))]
+	conf := m[id]
+
+	return id, NewNodeAPIClient(c.signer, conf.Address, conf.APIPort, m)
+}
+
+// Syncs the local ledger with any node (see `SyncFrom()`).
 func (c *APIClient) Sync() error {
 	node := c.PickNode()
 
@@ -58,15 +90,64 @@ func (c *APIClient) Sync() error {
 		return nil
 	}
 
+	return c.SyncFrom(node)
+}
+
+// Pulls missing change sets from any node (see `PullFrom()`).
+func (c *APIClient) Pull() error {
+	node := c.PickNode()
+
+	// if no nodes are available to pull from, assume we are already in sync
+	if node == nil {
+		return nil
+	}
+
+	_, err := c.PullFrom(node)
+
+	return err
+}
+
+// Syncs the local ledger with the given node, by performing the following
+// steps:
+//  1. Request the head of that node's ledger
+//  2. If the head is the same exit
+//  3. If the node has the local head, download everything after it
+//  4. Otherwise fetch all tx Ids, and find the intersection (last common point)
+//  5. Download everything after the intersection
+//
+// Local change sets after the intersection are always discarded, so this is
+// only meant for clients, whose ledger is a copy of the ledger of the nodes.
+// Nodes use `PullFrom()` instead.
+//
+// Change sets are downloaded in batches and appended one by one, so an
+// interrupted sync resumes from the local head the next time.
+func (c *APIClient) SyncFrom(node *NodeAPIClient) (err error) {
+	start := time.Now()
+
+	defer func() {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+
+		syncDuration.With(result).Observe(time.Since(start).Seconds())
+	}()
+
 	head, err := node.Head()
 	if err != nil {
 		return err
 	}
 
-	if c.callbacks.Ledger().Head() == head {
+	localHead := c.callbacks.Ledger().Head()
+
+	if localHead == head {
 		return nil
 	}
 
+	if _, err := c.download(node, localHead); !errors.Is(err, ErrUnknownChangeSet) {
+		return err
+	}
+
 	remoteChangeSetIDs, err := node.ChangeSetIDChain()
 	if err != nil {
 		return err
@@ -84,48 +165,297 @@ func (c *APIClient) Sync() error {
 		return err
 	}
 
-	// download [p+1:] from remote ledger
-	if p+1 < len(remoteChangeSetIDs.IDs) {
-		for i := int(p) + 1; i < len(remoteChangeSetIDs.IDs); i++ {
-			h := remoteChangeSetIDs.IDs[i]
+	_, err = c.download(node, remoteChangeSetIDs.IDs[p])
+
+	return err
+}
+
+// Pulls the change sets of the node that are missing locally. Unlike
+// `SyncFrom()`, local change sets are only discarded if the ledgers have
+// forked and the fork-choice rule (see `ledger.ChangeSetIDChain.ShouldAdopt()`)
+// prefers the remote chain. Nothing is pulled if the local ledger is ahead of
+// the node, or if the local fork is preferred.
+//
+// Returns the number of change sets that were pulled.
+func (c *APIClient) PullFrom(node *NodeAPIClient) (n int, err error) {
+	start := time.Now()
+
+	defer func() {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+
+		syncDuration.With(result).Observe(time.Since(start).Seconds())
+	}()
+
+	head, err := node.Head()
+	if err != nil {
+		return 0, err
+	}
+
+	thisChangeSetIDs := c.callbacks.Ledger().IDChain()
+
+	// already in sync, or ahead
+	if slices.Contains(thisChangeSetIDs.IDs, head) {
+		return 0, nil
+	}
+
+	// the local ledger is a prefix of the node's ledger
+	n, err = c.download(node, c.callbacks.Ledger().Head())
+	if !errors.Is(err, ErrUnknownChangeSet) {
+		return n, err
+	}
+
+	remoteChangeSetIDs, err := node.ChangeSetIDChain()
+	if err != nil {
+		return 0, err
+	}
+
+	p, err := thisChangeSetIDs.Intersect(remoteChangeSetIDs)
+	if err != nil {
+		return 0, err
+	}
 
-			cs, err := node.ChangeSet(h)
+	if thisChangeSetIDs.HasForked(remoteChangeSetIDs, p) {
+		adopt, _, err := thisChangeSetIDs.ShouldAdopt(remoteChangeSetIDs)
+		if err != nil {
+			return 0, err
+		}
+
+		nLocal := len(thisChangeSetIDs.IDs) - p - 1
+		nRemote := len(remoteChangeSetIDs.IDs) - p - 1
+
+		if !adopt {
+			forksResolved.With(forkKept).Inc()
+			log.Printf("fork detected with node %s after change set %d, keeping local chain (%d local vs %d remote change sets)\n", node.address, p, nLocal, nRemote)
+			return 0, nil
+		}
+
+		forksResolved.With(forkAdopted).Inc()
+		log.Printf("fork detected with node %s after change set %d, adopting remote chain (%d local change sets orphaned, %d remote change sets)\n", node.address, p, nLocal, nRemote)
+
+		// remove [p+1:] from local ledger
+		if err := c.callbacks.Rollback(p); err != nil {
+			return 0, err
+		}
+	}
+
+	return c.download(node, remoteChangeSetIDs.IDs[p])
+}
+
+// Asks every other node which change set follows prev in its ledger (or which
+// change set it voted for). Unreachable nodes aren't counted.
+func (c *APIClient) Acknowledgements(prev ledger.ChangeSetID) ledger.ForkAcks {
+	m := c.callbacks.Ledger().Snapshot.Nodes
+	ownID, _ := ledger.FindNode(m, c.callbacks.OwnSigner().PublicKey())
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+	)
+
+	acks := ledger.ForkAcks{
+		Counts: map[ledger.ChangeSetID]int{},
+		Nodes:  len(m),
+	}
+
+	for id, conf := range m {
+		if id == ownID {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			ack, err := NewNodeAPIClient(c.signer, conf.Address, conf.APIPort, m).Acknowledged(prev)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if err == nil && ack != "" {
+				acks.Counts[ack] += 1
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return acks
+}
+
+// Downloads and appends the remote change sets following the change set with
+// id after, in batches. Change sets that have been appended concurrently (eg.
+// through gossip) are skipped. Returns the number of appended change sets.
+//
+// If the node has pruned the change sets, the local ledger is bootstrapped
+// from the node's checkpoint first.
+//
+// Returns ErrUnknownChangeSet if the node doesn't have the change set.
+func (c *APIClient) download(node *NodeAPIClient, after ledger.ChangeSetID) (int, error) {
+	n := 0
+
+	for {
+		changes, err := node.Changes(after, DefaultChangesLimit)
+		if errors.Is(err, ErrPrunedChangeSet) {
+			cp, err := c.bootstrapFrom(node)
 			if err != nil {
-				return err
+				return n, err
 			}
 
-			if err := c.callbacks.AppendChangeSet(cs); err != nil {
-				return err
+			after = cp.Head()
+			continue
+		} else if err != nil {
+			return n, err
+		}
+
+		for i := range changes {
+			cs := &changes[i]
+			id := cs.ID()
+
+			l := c.callbacks.Ledger()
+			if l.Head() != id && !slices.Contains(l.IDChain().IDs, id) {
+				if err := c.callbacks.AppendChangeSet(cs); err != nil {
+					return n, err
+				}
+
+				n++
 			}
+
+			after = id
+		}
+
+		if len(changes) < DefaultChangesLimit {
+			return n, nil
 		}
 	}
+}
 
-	return nil
+// Replaces the local ledger by the latest checkpoint of the node. The
+// checkpoint must be attested by a majority of the nodes, and must extend the
+// local ledger.
+func (c *APIClient) bootstrapFrom(node *NodeAPIClient) (*ledger.Checkpoint, error) {
+	cp, err := node.Checkpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	// the attestations are counted against the nodes of the local ledger,
+	// which is trusted, rather than against the nodes of the checkpoint
+	if err := c.callbacks.Ledger().CheckCheckpoint(cp); err != nil {
+		return nil, err
+	}
+
+	if err := c.callbacks.RestoreCheckpoint(cp); err != nil {
+		return nil, err
+	}
+
+	log.Printf("bootstrapped ledger from checkpoint %s (%d change sets)\n", cp.Head(), cp.Height())
+
+	return cp, nil
 }
 
-func NewNodeAPIClient[T any](
-	kp *ledger.KeyPair,
+// Fetches the stats of a gateway from every node, and aggregates them. The
+// nodes that couldn't be queried are returned along with their errors.
+func (c *APIClient) GatewayStats(id ledger.GatewayID) (*GatewayStats, map[ledger.NodeID]error) {
+	m := c.callbacks.Ledger().Snapshot.Nodes
+	ownID, _ := ledger.FindNode(m, c.callbacks.OwnSigner().PublicKey())
+
+	stats := &GatewayStats{
+		GatewayID: id,
+		Endpoints: []EndpointStats{},
+	}
+
+	errs := map[ledger.NodeID]error{}
+
+	for nodeID, conf := range m {
+		if nodeID == ownID {
+			continue
+		}
+
+		nodeStats, err := NewNodeAPIClient(c.signer, conf.Address, conf.APIPort, m).GatewayStats(id)
+		if err != nil {
+			errs[nodeID] = err
+			continue
+		}
+
+		stats.Merge(nodeStats)
+	}
+
+	return stats, errs
+}
+
+// Fetches the orphaned change sets from every node. Change sets orphaned by
+// several nodes are listed once for each node. The nodes that couldn't be
+// queried are returned along with their errors.
+func (c *APIClient) Orphans() ([]OrphanedChangeSet, map[ledger.NodeID]error) {
+	m := c.callbacks.Ledger().Snapshot.Nodes
+	ownID, _ := ledger.FindNode(m, c.callbacks.OwnSigner().PublicKey())
+
+	orphans := []OrphanedChangeSet{}
+	errs := map[ledger.NodeID]error{}
+
+	for nodeID, conf := range m {
+		if nodeID == ownID {
+			continue
+		}
+
+		nodeOrphans, err := NewNodeAPIClient(c.signer, conf.Address, conf.APIPort, m).Orphans()
+		if err != nil {
+			errs[nodeID] = err
+			continue
+		}
+
+		orphans = append(orphans, nodeOrphans...)
+	}
+
+	return orphans, errs
+}
+
+// Returns the status of all nodes, as seen by the first node that responds.
+func (c *APIClient) NodesStatus() ([]PeerStatus, error) {
+	m := c.callbacks.Ledger().Snapshot.Nodes
+	ownID, _ := ledger.FindNode(m, c.callbacks.OwnSigner().PublicKey())
+
+	var lastErr error = errors.New("no nodes available")
+
+	for id, conf := range m {
+		if id == ownID {
+			continue
+		}
+
+		status, err := NewNodeAPIClient(c.signer, conf.Address, conf.APIPort, m).NodesStatus()
+		if err != nil {
+			lastErr = fmt.Errorf("node %s unavailable (%v)", id, err)
+			continue
+		}
+
+		return status, nil
+	}
+
+	return nil, lastErr
+}
+
+func NewNodeAPIClient(
+	signer ledger.Signer,
 	address string,
 	port ledger.Port,
-	allNodes map[ledger.NodeID]T,
+	allNodes map[ledger.NodeID]ledger.NodeConfig,
 ) *NodeAPIClient {
-	cert, err := makeTLSCertificate(*kp)
+	cert, err := makeTLSCertificate(signer)
 	if err != nil {
 		panic(err)
 	}
 
 	tlsConf := makeClientTLSConfig(cert, func(peer ledger.PublicKey) bool {
-		if _, ok := allNodes[peer.NodeID()]; ok {
-			return true
-		} else {
-			return false
-		}
+		_, ok := ledger.FindNode(allNodes, peer)
+		return ok
 	})
 
 	httpClient := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConf,
-		},
+		Transport: makeClientTransport(signer.PublicKey(), tlsConf),
 	}
 
 	return &NodeAPIClient{httpClient, address, port}
@@ -188,8 +518,103 @@ func (c *NodeAPIClient) ChangeSet(id ledger.ChangeSetID) (*ledger.ChangeSet, err
 		return nil, err
 	}
 
-	// TODO: get version from another endpoint
-	return ledger.DecodeChangeSet(body, ledger.LatestLedgerVersion)
+	// older nodes don't specify the version, and only support version 1
+	v := ledger.LedgerVersion(1)
+
+	if h := resp.Header.Get(LedgerVersionHeader); h != "" {
+		n, err := strconv.ParseUint(h, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s header %s (%v)", LedgerVersionHeader, h, err)
+		}
+
+		v = ledger.LedgerVersion(n)
+	}
+
+	return ledger.DecodeChangeSet(body, v)
+}
+
+// Returns at most limit change sets following the change set with the given
+// id (or following the start of the ledger if after is empty). Returns
+// ErrUnknownChangeSet if the node doesn't have that change set, and
+// ErrPrunedChangeSet if the node has pruned the following change sets.
+func (c *NodeAPIClient) Changes(after ledger.ChangeSetID, limit int) ([]ledger.ChangeSet, error) {
+	q := url.Values{}
+	q.Set("limit", strconv.Itoa(limit))
+
+	if after != "" {
+		q.Set("from", string(after))
+	}
+
+	resp, err := c.httpClient.Get(c.url("changes?" + q.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrUnknownChangeSet
+	case http.StatusGone:
+		resp.Body.Close()
+		return nil, ErrPrunedChangeSet
+	}
+
+	resp, err = handleResponse(resp, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeChanges(body)
+}
+
+func (c *NodeAPIClient) Checkpoint() (*ledger.Checkpoint, error) {
+	resp, err := handleResponse(c.httpClient.Get(c.url("checkpoint")))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return ledger.DecodeCheckpoint(body)
+}
+
+// Returns the node's signature of its latest checkpoint, which must have the
+// given head.
+func (c *NodeAPIClient) CheckpointSignature(head ledger.ChangeSetID) (ledger.Signature, error) {
+	q := url.Values{}
+	q.Set("head", string(head))
+
+	resp, err := handleResponse(c.httpClient.Get(c.url("checkpoint/signature?" + q.Encode())))
+	if err != nil {
+		return ledger.Signature{}, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ledger.Signature{}, err
+	}
+
+	var sig ledger.Signature
+
+	if err := cbor.Unmarshal(body, &sig); err != nil {
+		return ledger.Signature{}, fmt.Errorf("invalid signature format (%v)", err)
+	}
+
+	return sig, nil
 }
 
 func (c *NodeAPIClient) ChangeSetIDChain() (*ledger.ChangeSetIDChain, error) {
@@ -222,7 +647,109 @@ func (c *NodeAPIClient) ChangeSetIDChain() (*ledger.ChangeSetIDChain, error) {
 		ids[i] = ledger.ChangeSetID(id)
 	}
 
-	return &ledger.ChangeSetIDChain{ids}, nil
+	return &ledger.ChangeSetIDChain{IDs: ids}, nil
+}
+
+func (c *NodeAPIClient) GatewayStats(id ledger.GatewayID) (*GatewayStats, error) {
+	resp, err := handleResponse(c.httpClient.Get(c.url(fmt.Sprintf("gateways/%s/stats", id))))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &GatewayStats{}
+
+	if err := json.Unmarshal(body, stats); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// Returns the status of all nodes, as seen by the remote node.
+func (c *NodeAPIClient) NodesStatus() ([]PeerStatus, error) {
+	resp, err := handleResponse(c.httpClient.Get(c.url("nodes/status")))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	status := []PeerStatus{}
+
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+func (c *NodeAPIClient) Orphans() ([]OrphanedChangeSet, error) {
+	resp, err := handleResponse(c.httpClient.Get(c.url("orphans")))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := []OrphanedChangeSet{}
+
+	if err := json.Unmarshal(body, &orphans); err != nil {
+		return nil, err
+	}
+
+	return orphans, nil
+}
+
+// Returns the change set following prev in the ledger of the node, or an empty
+// id if prev is the head of the node or is unknown to the node.
+func (c *NodeAPIClient) Acknowledged(prev ledger.ChangeSetID) (ledger.ChangeSetID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), AcknowledgedRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url("acknowledged?prev="+url.QueryEscape(string(prev))), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := handleResponse(c.httpClient.Do(req))
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	id := string(body)
+	if id == "" {
+		return "", nil
+	}
+
+	if err := ledger.ValidateID(id, ledger.ChangeSetIDPrefix); err != nil {
+		return "", err
+	}
+
+	return ledger.ChangeSetID(id), nil
 }
 
 func (c *NodeAPIClient) Head() (ledger.ChangeSetID, error) {
@@ -247,15 +774,30 @@ func (c *NodeAPIClient) Head() (ledger.ChangeSetID, error) {
 	return ledger.ChangeSetID(id), nil
 }
 
-// Not responsible for appending locally via c.callbacks.AppendChangeSet()
-func (c *NodeAPIClient) AppendChangeSet(cs *ledger.ChangeSet) error {
+// Not responsible for appending locally via c.callbacks.AppendChangeSet().
+// Returns the acknowledgement of the node (ChangeSetAppended or
+// ChangeSetCommitted).
+func (c *NodeAPIClient) AppendChangeSet(cs *ledger.ChangeSet) (string, error) {
 	bs := cs.Encode()
 
-	if _, err := handleResponse(c.httpClient.Post(c.url(""), "application/cbor", bytes.NewBuffer(bs))); err != nil {
-		return err
+	resp, err := handleResponse(c.httpClient.Post(c.url(""), "application/cbor", bytes.NewBuffer(bs)))
+	if err != nil {
+		return "", err
 	}
 
-	return nil
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	// older nodes don't return an acknowledgement
+	if len(body) == 0 {
+		return ChangeSetAppended, nil
+	}
+
+	return string(body), nil
 }
 
 func (c *NodeAPIClient) UploadAsset(bs []byte) (ledger.AssetID, error) {
@@ -288,7 +830,7 @@ func (c *NodeAPIClient) UploadAsset(bs []byte) (ledger.AssetID, error) {
 }
 
 func (c *NodeAPIClient) url(relPath string) string {
-	return fmt.Sprintf("https://%s:%d/%s", c.address, c.port, relPath)
+	return fmt.Sprintf("https://%s/%s", ledger.JoinHostPort(c.address, c.port), relPath)
 }
 
 func handleResponse(resp *http.Response, err error) (*http.Response, error) {
@@ -1,34 +1,41 @@
 package network
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/fxamacker/cbor/v2"
+
 	"ows/ledger"
 )
 
 // API server handler
 type apiHandler struct {
-	callbacks Callbacks
+	callbacks NodeCallbacks
 }
 
-func ServeAPI(port ledger.Port, kp *ledger.KeyPair, callbacks Callbacks) {
-	cert, err := makeTLSCertificate(*kp)
+// Starts serving the node API in the background. The listener is created
+// synchronously, so that errors can be returned.
+func ServeAPI(port ledger.Port, kp *ledger.KeyPair, callbacks NodeCallbacks) (*http.Server, error) {
+	cert, err := makeTLSCertificate(kp)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	tlsConf := makeServerTLSConfig(cert, func(k ledger.PublicKey) bool {
 		l := callbacks.Ledger()
 
-		if _, ok := l.Snapshot.Nodes[k.NodeID()]; ok {
+		if _, ok := l.Snapshot.FindNode(k); ok {
 			return true
 		} else if _, ok := l.Snapshot.Users[k.UserID()]; ok {
 			return true
@@ -46,9 +53,18 @@ func ServeAPI(port ledger.Port, kp *ledger.KeyPair, callbacks Callbacks) {
 		MaxHeaderBytes: 1 << 20,
 	}
 
-	if err := s.ListenAndServeTLS("", ""); err != nil {
-		panic(err)
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on port %d (%v)", port, err)
 	}
+
+	go func() {
+		if err := s.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+			log.Printf("API server on port %d stopped (%v)\n", port, err)
+		}
+	}()
+
+	return s, nil
 }
 
 func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -60,13 +76,27 @@ func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
 		case "/":
 			h.serveChangeSetIDChain(w, r)
+		case "/acknowledged":
+			h.serveAcknowledged(w, r)
 		case "/assets":
 			h.serveGetAssetList(w, r)
+		case "/changes":
+			h.serveChanges(w, r)
+		case "/checkpoint":
+			h.serveCheckpoint(w, r)
+		case "/checkpoint/signature":
+			h.serveCheckpointSignature(w, r)
 		case "/head":
 			h.serveHead(w, r)
+		case "/nodes/status":
+			h.serveNodesStatus(w, r)
+		case "/orphans":
+			h.serveOrphans(w, r)
 		default:
 			if strings.HasPrefix(r.URL.Path, "/assets/") {
 				h.serveGetAsset(w, r)
+			} else if strings.HasPrefix(r.URL.Path, "/gateways/") && strings.HasSuffix(r.URL.Path, "/stats") {
+				h.serveGatewayStats(w, r)
 			} else {
 				h.serveChangeSet(w, r)
 			}
@@ -127,6 +157,30 @@ func (h *apiHandler) serveGetAssetList(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s", string(bs))
 }
 
+func (h *apiHandler) serveGatewayStats(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimSuffix(r.URL.Path[len("/gateways/"):], "/stats"), "/")
+
+	if err := ledger.ValidateID(id, ledger.GatewayIDPrefix); err != nil {
+		http.Error(w, fmt.Sprintf("invalid gateway id %s (%v)", id, err), 400)
+		return
+	}
+
+	stats, err := h.callbacks.GatewayStats(ledger.GatewayID(id))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), 404)
+		return
+	}
+
+	bs, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create gateway stats json (%v)", err), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
+
 func (h *apiHandler) serveChangeSet(w http.ResponseWriter, r *http.Request) {
 	id := strings.Trim(r.URL.Path, "/")
 
@@ -135,18 +189,126 @@ func (h *apiHandler) serveChangeSet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cs, ok := h.callbacks.Ledger().FindChange(ledger.ChangeSetID(id))
-	if !ok {
+	l := h.callbacks.Ledger()
+
+	i := l.IndexOf(ledger.ChangeSetID(id))
+	if i < 0 {
 		http.Error(w, fmt.Sprintf("invalid path %s", r.URL.Path), 404)
 		return
 	}
 
+	cs, ok := l.ChangeAt(i)
+	if !ok {
+		http.Error(w, fmt.Sprintf("change set %s was pruned", id), 410)
+		return
+	}
+
 	bs := cs.Encode()
 
 	w.Header().Set("Content-Type", "application/cbor")
+	w.Header().Set(LedgerVersionHeader, strconv.Itoa(int(l.VersionAt(i))))
 	w.Write(bs)
 }
 
+// Serves the id of the change set following `prev` (see
+// `NodeCallbacks.Acknowledged()`), or an empty body.
+func (h *apiHandler) serveAcknowledged(w http.ResponseWriter, r *http.Request) {
+	prev := r.URL.Query().Get("prev")
+
+	if err := ledger.ValidateID(prev, ledger.ChangeSetIDPrefix); err != nil {
+		http.Error(w, fmt.Sprintf("invalid change set id %s (%v)", prev, err), 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "%s", h.callbacks.Acknowledged(ledger.ChangeSetID(prev)))
+}
+
+// Serves at most `limit` change sets following the change set with id `from`
+// (or following the start of the ledger if `from` isn't specified).
+func (h *apiHandler) serveChanges(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	limit := DefaultChangesLimit
+
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %s", s), 400)
+			return
+		}
+
+		limit = min(n, MaxChangesLimit)
+	}
+
+	l := h.callbacks.Ledger()
+	start := 0
+
+	if from := q.Get("from"); from != "" {
+		if err := ledger.ValidateID(from, ledger.ChangeSetIDPrefix); err != nil {
+			http.Error(w, fmt.Sprintf("invalid change set id %s (%v)", from, err), 400)
+			return
+		}
+
+		i := l.IndexOf(ledger.ChangeSetID(from))
+		if i < 0 {
+			http.Error(w, fmt.Sprintf("change set %s not found", from), 404)
+			return
+		}
+
+		start = i + 1
+	}
+
+	if l.IsPruned(start) {
+		http.Error(w, fmt.Sprintf("change sets following %s were pruned", q.Get("from")), 410)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/cbor")
+	w.Write(encodeChanges(l, start, limit))
+}
+
+func (h *apiHandler) serveCheckpoint(w http.ResponseWriter, r *http.Request) {
+	cp := h.callbacks.Ledger().Checkpoint
+	if cp == nil {
+		http.Error(w, "no checkpoint available", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/cbor")
+	w.Write(cp.Encode())
+}
+
+// Serves the own signature of the latest checkpoint, if its head corresponds
+// to the requested head.
+func (h *apiHandler) serveCheckpointSignature(w http.ResponseWriter, r *http.Request) {
+	head := r.URL.Query().Get("head")
+
+	cp := h.callbacks.Ledger().Checkpoint
+	if cp == nil || string(cp.Head()) != head {
+		http.Error(w, fmt.Sprintf("no checkpoint with head %s", head), 404)
+		return
+	}
+
+	ownKey := h.callbacks.OwnSigner().PublicKey()
+
+	for _, sig := range cp.Signatures {
+		if bytes.Equal(sig.Key, ownKey) {
+			bs, err := cbor.Marshal(sig)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to encode signature (%v)", err), 500)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/cbor")
+			w.Write(bs)
+			return
+		}
+	}
+
+	http.Error(w, fmt.Sprintf("checkpoint %s not signed", head), 404)
+}
+
 func (h *apiHandler) serveChangeSetIDChain(w http.ResponseWriter, r *http.Request) {
 	chain := h.callbacks.Ledger().IDChain()
 
@@ -167,6 +329,28 @@ func (h *apiHandler) serveHead(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s", head)
 }
 
+func (h *apiHandler) serveNodesStatus(w http.ResponseWriter, r *http.Request) {
+	bs, err := json.Marshal(h.callbacks.NodesStatus())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create nodes status json (%v)", err), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
+
+func (h *apiHandler) serveOrphans(w http.ResponseWriter, r *http.Request) {
+	bs, err := json.Marshal(h.callbacks.Orphans())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create orphans json (%v)", err), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
+
 func (h *apiHandler) servePostChangeSet(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
@@ -182,12 +366,27 @@ func (h *apiHandler) servePostChangeSet(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if err := h.callbacks.AppendChangeSet(cs); err != nil {
+	if err := cs.CheckTime(h.callbacks.Now()); err != nil {
+		http.Error(w, fmt.Sprintf("change set refused (%v)", err), 400)
+		return
+	}
+
+	ack := ChangeSetAppended
+
+	if h.callbacks.Ledger().Snapshot.Consensus {
+		if err := h.callbacks.CommitChangeSet(cs); err != nil {
+			http.Error(w, fmt.Sprintf("change set not committed (%v)", err), 409)
+			return
+		}
+
+		ack = ChangeSetCommitted
+	} else if err := h.callbacks.AppendChangeSet(cs); err != nil {
 		http.Error(w, fmt.Sprintf("failure while appending change set (%v)", err), 400)
 		return
 	}
 
-	fmt.Fprintf(w, "")
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "%s", ack)
 }
 
 func (h *apiHandler) servePutAsset(w http.ResponseWriter, r *http.Request) {
@@ -230,7 +429,7 @@ func (h *apiHandler) hasNodeCertificate(r *http.Request) bool {
 			continue
 		}
 
-		if _, ok := h.callbacks.Ledger().Snapshot.Nodes[key.NodeID()]; ok {
+		if _, ok := h.callbacks.Ledger().Snapshot.FindNode(key); ok {
 			return true
 		}
 	}
@@ -1,6 +1,8 @@
 package network
 
 import (
+	"time"
+
 	"ows/ledger"
 )
 
@@ -12,5 +14,33 @@ type Callbacks interface {
 	Ledger() *ledger.Ledger
 	ListAssets() []ledger.AssetID
 	Rollback(p int) error
-	OwnKeyPair() *ledger.KeyPair
+	RestoreCheckpoint(cp *ledger.Checkpoint) error
+	OwnSigner() ledger.Signer
+}
+
+// Implemented by nodeState, contains callbacks that are only needed by the
+// node services (and not by the client).
+type NodeCallbacks interface {
+	Callbacks
+
+	// The clock of the node, which is used to check the timestamps of
+	// submitted change sets (it is replaced in tests).
+	Now() time.Time
+
+	// Returns the change set following prev in the ledger, or the change set
+	// following prev that the node voted for. This is used by consensus to
+	// find committed change sets (see `ledger.ForkAcks`). Returns an empty id
+	// if there is none.
+	Acknowledged(prev ledger.ChangeSetID) ledger.ChangeSetID
+
+	AddHeartbeat(from ledger.NodeID, head ledger.ChangeSetID, hb *Heartbeat)
+	AddRateLimitUsage(from ledger.NodeID, usage []RateLimitUsage)
+	NodesStatus() []PeerStatus
+	GatewayStats(id ledger.GatewayID) (*GatewayStats, error)
+	Orphans() []OrphanedChangeSet
+
+	// Only used if consensus is enabled in the ledger
+	CommitChangeSet(cs *ledger.ChangeSet) error
+	Vote(cs *ledger.ChangeSet, proposer ledger.NodeID) error
+	ReleaseVote(cs *ledger.ChangeSet, proposer ledger.NodeID)
 }
@@ -1,6 +1,7 @@
 package network
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/tls"
@@ -8,12 +9,18 @@ import (
 	"crypto/x509/pkix"
 	"fmt"
 	"math/big"
+	"net"
+	"net/http"
 	"time"
 
 	"ows/ledger"
 )
 
-func makeTLSCertificate(keyPair ledger.KeyPair) (*tls.Certificate, error) {
+// The private key of the signer isn't necessarily available (see
+// `ledger.Signer`), so the certificate is signed through `crypto.Signer`.
+func makeTLSCertificate(signer ledger.Signer) (*tls.Certificate, error) {
+	priv := ledger.NewCryptoSigner(signer)
+
 	// Create an X.509 certificate template
 	certTemplate := &x509.Certificate{
 		SerialNumber: big.NewInt(1),
@@ -28,14 +35,14 @@ func makeTLSCertificate(keyPair ledger.KeyPair) (*tls.Certificate, error) {
 		BasicConstraintsValid: true,
 	}
 
-	certDER, err := x509.CreateCertificate(rand.Reader, certTemplate, certTemplate, ed25519.PublicKey(keyPair.Public), ed25519.PrivateKey(keyPair.Private))
+	certDER, err := x509.CreateCertificate(rand.Reader, certTemplate, certTemplate, ed25519.PublicKey(signer.PublicKey()), priv)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create certificate (%v)", err)
 	}
 
 	return &tls.Certificate{
 		Certificate: [][]byte{certDER},
-		PrivateKey:  ed25519.PrivateKey(keyPair.Private),
+		PrivateKey:  priv,
 	}, nil
 }
 
@@ -47,6 +54,22 @@ func makeClientTLSConfig(cert *tls.Certificate, isValidPeer func(k ledger.Public
 	}
 }
 
+// Opens the connections of the node and user clients, on behalf of the given
+// key. Replaced by the node tests to simulate network partitions.
+var DialNode = func(ctx context.Context, from ledger.PublicKey, network string, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func makeClientTransport(from ledger.PublicKey, tlsConf *tls.Config) *http.Transport {
+	return &http.Transport{
+		TLSClientConfig: tlsConf,
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return DialNode(ctx, from, network, address)
+		},
+	}
+}
+
 func makeServerTLSConfig(cert *tls.Certificate, isValidPeer func(k ledger.PublicKey) bool) *tls.Config {
 	return &tls.Config{
 		Certificates:          []tls.Certificate{*cert},
@@ -0,0 +1,85 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"ows/ledger"
+)
+
+// Number of change sets returned by `GET /changes` if no limit is specified,
+// and the maximum limit.
+const (
+	DefaultChangesLimit = 100
+	MaxChangesLimit     = 1000
+)
+
+// Response header of `GET /<change-set-id>` containing the ledger version
+// needed to decode the change set.
+const LedgerVersionHeader = "Ows-Ledger-Version"
+
+// Returned by `NodeAPIClient.Changes()` if the node doesn't have the change
+// set after which the changes were requested.
+var ErrUnknownChangeSet = errors.New("change set unknown to node")
+
+// Returned by `NodeAPIClient.Changes()` if the node has pruned the change sets
+// after which the changes were requested. The ledger must be bootstrapped from
+// a checkpoint instead.
+var ErrPrunedChangeSet = errors.New("change set pruned by node")
+
+// A single change set in the response of `GET /changes`, along with the ledger
+// version needed to decode it.
+type changeSetEntry struct {
+	Version   ledger.LedgerVersion `cbor:"0,keyasint"`
+	ChangeSet []byte               `cbor:"1,keyasint"`
+}
+
+// Encodes change sets [from:from+limit] of the ledger, none of which can be
+// pruned.
+func encodeChanges(l *ledger.Ledger, from int, limit int) []byte {
+	to := min(from+limit, l.Height())
+
+	entries := make([]changeSetEntry, 0, max(to-from, 0))
+
+	for i := from; i < to; i++ {
+		cs, ok := l.ChangeAt(i)
+		if !ok {
+			panic(fmt.Sprintf("change set %d was pruned", i))
+		}
+
+		entries = append(entries, changeSetEntry{
+			Version:   l.VersionAt(i),
+			ChangeSet: cs.Encode(),
+		})
+	}
+
+	bs, err := cbor.Marshal(entries)
+	if err != nil {
+		panic(fmt.Sprintf("unable to encode change sets (%v)", err))
+	}
+
+	return bs
+}
+
+func decodeChanges(bs []byte) ([]ledger.ChangeSet, error) {
+	entries := []changeSetEntry{}
+
+	if err := cbor.Unmarshal(bs, &entries); err != nil {
+		return nil, fmt.Errorf("invalid change sets format (%v)", err)
+	}
+
+	changes := make([]ledger.ChangeSet, len(entries))
+
+	for i, e := range entries {
+		cs, err := ledger.DecodeChangeSet(e.ChangeSet, e.Version)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode change set %d (%v)", i, err)
+		}
+
+		changes[i] = *cs
+	}
+
+	return changes, nil
+}
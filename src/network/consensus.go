@@ -0,0 +1,292 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"ows/ledger"
+)
+
+// Votes that haven't been decided after VoteTimeout are resolved by asking
+// the other nodes (see `Votes.Stale()`). VoteRequestTimeout must be shorter,
+// so that a proposal is over by then.
+const (
+	VoteTimeout        = 10 * time.Second
+	VoteRequestTimeout = 5 * time.Second
+)
+
+// Acknowledgements returned by the node API when posting a change set
+const (
+	ChangeSetAppended  = "appended"  // appended by the node, without consensus
+	ChangeSetCommitted = "committed" // accepted by a majority of the nodes
+)
+
+// Keeps track of the change sets accepted by the current node, so that at
+// most one change set per Prev is accepted.
+//
+// Votes are persisted, and kept until the ledger of the node no longer ends
+// with their Prev (see `Decide()`), or until they are released. Otherwise a
+// node that restarted could accept a change set that conflicts with a
+// committed one.
+type Votes struct {
+	path  string
+	mutex sync.Mutex
+	votes map[ledger.ChangeSetID]Ballot // keyed by Prev
+}
+
+// A vote for a change set
+type Ballot struct {
+	ID       ledger.ChangeSetID
+	Proposer ledger.NodeID // node that requested the vote
+	Encoded  []byte        // the change set, so that it can be appended later
+	Time     time.Time
+}
+
+// Reads the votes persisted at the path, if any.
+func OpenVotes(p string) (*Votes, error) {
+	v := &Votes{
+		path:  p,
+		votes: map[ledger.ChangeSetID]Ballot{},
+	}
+
+	bs, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return v, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := cbor.Unmarshal(bs, &v.votes); err != nil {
+		return nil, fmt.Errorf("invalid votes file %s (%v)", p, err)
+	}
+
+	return v, nil
+}
+
+// Accepts the change set if it follows the head of s, if its signers are
+// allowed to take its actions, if it isn't expired, and if no other change set
+// with the same Prev was accepted. Accepting the same change set twice is
+// allowed.
+//
+// The vote is persisted before returning.
+func (v *Votes) Vote(s *ledger.Snapshot, cs *ledger.ChangeSet, proposer ledger.NodeID, now time.Time) error {
+	if err := s.CheckChangeSet(cs); err != nil {
+		return err
+	}
+
+	if err := cs.CheckTime(now); err != nil {
+		return err
+	}
+
+	id := cs.ID()
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if other, ok := v.votes[cs.Prev]; ok {
+		if other.ID != id {
+			return fmt.Errorf("change set %s already accepted after %s", other.ID, cs.Prev)
+		}
+
+		return nil
+	}
+
+	v.votes[cs.Prev] = Ballot{
+		ID:       id,
+		Proposer: proposer,
+		Encoded:  cs.Encode(),
+		Time:     now,
+	}
+
+	if err := v.write(); err != nil {
+		delete(v.votes, cs.Prev)
+		return fmt.Errorf("unable to persist vote (%v)", err)
+	}
+
+	return nil
+}
+
+// Returns the vote for a change set following prev, if any.
+func (v *Votes) Get(prev ledger.ChangeSetID) (Ballot, bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	b, ok := v.votes[prev]
+
+	return b, ok
+}
+
+// Withdraws the vote for the change set, so that other change sets with the
+// same Prev can be accepted.
+func (v *Votes) Release(prev ledger.ChangeSetID, id ledger.ChangeSetID) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if other, ok := v.votes[prev]; ok && other.ID == id {
+		delete(v.votes, prev)
+		v.writeOrLog()
+	}
+}
+
+// Drops the votes that no longer follow the head of the ledger, ie. the votes
+// for change sets that were appended, or that lost to another change set.
+func (v *Votes) Decide(head ledger.ChangeSetID) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	n := len(v.votes)
+
+	maps.DeleteFunc(v.votes, func(prev ledger.ChangeSetID, _ Ballot) bool {
+		return prev != head
+	})
+
+	if len(v.votes) != n {
+		v.writeOrLog()
+	}
+}
+
+// Returns the votes older than VoteTimeout, keyed by Prev.
+func (v *Votes) Stale(now time.Time) map[ledger.ChangeSetID]Ballot {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	stale := map[ledger.ChangeSetID]Ballot{}
+
+	for prev, b := range v.votes {
+		if now.Sub(b.Time) > VoteTimeout {
+			stale[prev] = b
+		}
+	}
+
+	return stale
+}
+
+// Must be called while holding the mutex.
+func (v *Votes) write() error {
+	bs, err := cbor.Marshal(v.votes)
+	if err != nil {
+		return err
+	}
+
+	return ledger.OverwriteSafe(v.path, bs)
+}
+
+// A released vote that isn't persisted is only kept longer than necessary,
+// which is safe.
+func (v *Votes) writeOrLog() {
+	if err := v.write(); err != nil {
+		log.Printf("unable to persist votes (%v)\n", err)
+	}
+}
+
+// Returns true if n votes form a majority of the given number of nodes.
+func IsMajority(n int, nNodes int) bool {
+	return 2*n > nNodes
+}
+
+// Asks all other nodes to accept the change set, and returns the number of
+// nodes that accepted it.
+func (c *GossipClient) RequestVotes(cs *ledger.ChangeSet) int {
+	l := c.callbacks.Ledger()
+	ownID, _ := l.Snapshot.FindNode(c.kp.Public)
+
+	bs := cs.Encode()
+
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		accepted int
+	)
+
+	for id, conf := range l.Snapshot.Nodes {
+		if id == ownID {
+			continue
+		}
+
+		url := fmt.Sprintf("https://%s/vote", ledger.JoinHostPort(conf.Address, conf.GossipPort))
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if err := c.sendVoteRequest("POST", url, bs); err != nil {
+				consensusVotes.With(voteRejected).Inc()
+				return
+			}
+
+			consensusVotes.With(voteAccepted).Inc()
+
+			mutex.Lock()
+			accepted += 1
+			mutex.Unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	return accepted
+}
+
+// Asks all other nodes to withdraw their vote for the change set, after it
+// failed to reach a majority. Nodes only accept this from the proposer of the
+// change set. Nodes that aren't reached release their vote once it is stale.
+func (c *GossipClient) ReleaseVotes(cs *ledger.ChangeSet) {
+	l := c.callbacks.Ledger()
+	ownID, _ := l.Snapshot.FindNode(c.kp.Public)
+
+	bs := cs.Encode()
+
+	var wg sync.WaitGroup
+
+	for id, conf := range l.Snapshot.Nodes {
+		if id == ownID {
+			continue
+		}
+
+		url := fmt.Sprintf("https://%s/vote", ledger.JoinHostPort(conf.Address, conf.GossipPort))
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if err := c.sendVoteRequest("DELETE", url, bs); err != nil {
+				log.Printf("failed to release vote on node %s (%v)\n", id, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (c *GossipClient) sendVoteRequest(method string, url string, bs []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), VoteRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(bs))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/cbor")
+
+	resp, err := handleResponse(c.httpClient.Do(req))
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package network
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"ows/ledger"
+)
+
+func TestVotes(t *testing.T) {
+	kp, err := ledger.RandomKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initial := ledger.NewInitialChangeSet(ledger.LatestLedgerVersion, ledger.AddNode{Key: kp.Public, Address: "127.0.0.1", GossipPort: 9000, APIPort: 9001})
+
+	sign := func(cs *ledger.ChangeSet) *ledger.ChangeSet {
+		sig, err := kp.SignChangeSet(cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cs.Signatures = append(cs.Signatures, sig)
+
+		return cs
+	}
+
+	l, err := ledger.NewLedger(ledger.LatestLedgerVersion, sign(initial))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newChangeSet := func() *ledger.ChangeSet {
+		other, err := ledger.RandomKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return sign(l.NewChangeSet(ledger.AddUser{Key: other.Public}))
+	}
+
+	a := newChangeSet()
+	b := newChangeSet()
+	prev := l.Head()
+	now := time.Now()
+
+	p := path.Join(t.TempDir(), "votes")
+
+	v, err := OpenVotes(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Vote(l.Snapshot, a, "proposer", now); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Vote(l.Snapshot, a, "proposer", now); err != nil {
+		t.Fatalf("voting twice for the same change set failed (%v)", err)
+	}
+
+	if err := v.Vote(l.Snapshot, b, "proposer", now); err == nil {
+		t.Fatalf("accepted conflicting change set")
+	}
+
+	// votes survive restarts, and don't expire
+	v, err = OpenVotes(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Vote(l.Snapshot, b, "proposer", now.Add(10*VoteTimeout)); err == nil {
+		t.Fatalf("accepted conflicting change set after reopening")
+	}
+
+	ballot, ok := v.Get(prev)
+	if !ok || ballot.ID != a.ID() || ballot.Proposer != "proposer" {
+		t.Fatalf("unexpected vote %v", ballot)
+	}
+
+	if cs, err := ledger.DecodeChangeSet(ballot.Encoded, l.Snapshot.Version); err != nil || cs.ID() != a.ID() {
+		t.Fatalf("vote doesn't contain the change set (%v)", err)
+	}
+
+	if stale := v.Stale(now); len(stale) != 0 {
+		t.Fatalf("expected no stale votes, got %v", stale)
+	}
+
+	if stale := v.Stale(now.Add(2 * VoteTimeout)); len(stale) != 1 || stale[prev].ID != a.ID() {
+		t.Fatalf("expected stale vote for %s, got %v", a.ID(), stale)
+	}
+
+	// the head hasn't changed
+	v.Decide(prev)
+
+	if _, ok := v.Get(prev); !ok {
+		t.Fatalf("vote decided before the head changed")
+	}
+
+	// only the vote for the same change set is released
+	v.Release(prev, b.ID())
+
+	if _, ok := v.Get(prev); !ok {
+		t.Fatalf("vote released by another change set")
+	}
+
+	v.Release(prev, a.ID())
+
+	v, err = OpenVotes(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Vote(l.Snapshot, b, "proposer", now); err != nil {
+		t.Fatalf("released vote still blocks other change sets (%v)", err)
+	}
+
+	// appending the change set decides the vote
+	if err := l.Append(b); err != nil {
+		t.Fatal(err)
+	}
+
+	v.Decide(l.Head())
+
+	v, err = OpenVotes(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := v.Get(prev); ok {
+		t.Fatalf("vote not decided after appending")
+	}
+}
@@ -0,0 +1,127 @@
+package network
+
+import (
+	"math"
+
+	"ows/ledger"
+)
+
+// Upper bounds, in milliseconds, of the gateway endpoint latency histogram
+// buckets. The last bucket of each histogram counts all latencies above the
+// last bound.
+var LatencyBucketBounds = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// Request statistics of a gateway on a single node, or aggregated across
+// nodes.
+type GatewayStats struct {
+	GatewayID ledger.GatewayID `json:"gatewayId"`
+	Endpoints []EndpointStats  `json:"endpoints"`
+}
+
+// Counters of an endpoint. Requests that don't match any endpoint are counted
+// with an empty Method and Path.
+//
+// Statuses is keyed by status class ("2xx", "3xx", "4xx", "5xx").
+type EndpointStats struct {
+	Method         string            `json:"method"`
+	Path           string            `json:"path"`
+	Requests       uint64            `json:"requests"`
+	Statuses       map[string]uint64 `json:"statuses"`
+	Bytes          uint64            `json:"bytes"`
+	LatencySum     float64           `json:"latencySumMs"`
+	LatencyBuckets []uint64          `json:"latencyBuckets"`
+}
+
+func NewEndpointStats(method string, path string) EndpointStats {
+	return EndpointStats{
+		Method:         method,
+		Path:           path,
+		Statuses:       map[string]uint64{},
+		LatencyBuckets: make([]uint64, len(LatencyBucketBounds)+1),
+	}
+}
+
+// Adds the counters of other to s.
+func (s *GatewayStats) Merge(other *GatewayStats) {
+	for _, o := range other.Endpoints {
+		found := false
+
+		for i, e := range s.Endpoints {
+			if e.Method == o.Method && e.Path == o.Path {
+				s.Endpoints[i].Merge(o)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			e := NewEndpointStats(o.Method, o.Path)
+			e.Merge(o)
+			s.Endpoints = append(s.Endpoints, e)
+		}
+	}
+}
+
+// Adds the counters of other to s.
+func (s *EndpointStats) Merge(other EndpointStats) {
+	s.Requests += other.Requests
+	s.Bytes += other.Bytes
+	s.LatencySum += other.LatencySum
+
+	for class, n := range other.Statuses {
+		s.Statuses[class] += n
+	}
+
+	// histograms with a different number of buckets (eg. from nodes running
+	// another version) are merged bucket by bucket, the excess is added to the
+	// last bucket
+	for i, n := range other.LatencyBuckets {
+		s.LatencyBuckets[min(i, len(s.LatencyBuckets)-1)] += n
+	}
+}
+
+// Records a single request.
+func (s *EndpointStats) Add(status int, bytes int, latencyMs float64) {
+	s.Requests += 1
+	s.Bytes += uint64(bytes)
+	s.LatencySum += latencyMs
+	s.Statuses[StatusClass(status)] += 1
+
+	i := 0
+	for i < len(LatencyBucketBounds) && latencyMs > LatencyBucketBounds[i] {
+		i++
+	}
+
+	s.LatencyBuckets[i] += 1
+}
+
+// Returns an upper bound of the latency percentile (0 < p <= 1), derived from
+// the histogram. Returns -1 if the percentile falls in the unbounded bucket,
+// and 0 if no requests were recorded.
+func (s *EndpointStats) LatencyPercentile(p float64) float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+
+	// nearest rank
+	target := max(uint64(math.Ceil(p*float64(s.Requests))), 1)
+
+	count := uint64(0)
+	for i, n := range s.LatencyBuckets {
+		count += n
+
+		if count >= target {
+			if i < len(LatencyBucketBounds) {
+				return LatencyBucketBounds[i]
+			}
+
+			break
+		}
+	}
+
+	return -1
+}
+
+func StatusClass(status int) string {
+	return string(rune('0'+status/100)) + "xx"
+}
@@ -0,0 +1,158 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEndpointStatsAdd(t *testing.T) {
+	s := NewEndpointStats("GET", "/hello")
+
+	s.Add(200, 10, 5)
+	s.Add(204, 0, 5.5)
+	s.Add(404, 20, 250)
+	s.Add(502, 30, 20000)
+
+	if s.Requests != 4 || s.Bytes != 60 || s.LatencySum != 20260.5 {
+		t.Fatalf("unexpected counters %+v", s)
+	}
+
+	if expected := map[string]uint64{"2xx": 2, "4xx": 1, "5xx": 1}; !reflect.DeepEqual(s.Statuses, expected) {
+		t.Fatalf("expected statuses %v, got %v", expected, s.Statuses)
+	}
+
+	// bounds are inclusive, latencies above the last bound go to the last
+	// bucket
+	expected := make([]uint64, len(LatencyBucketBounds)+1)
+	expected[0] = 1
+	expected[1] = 1
+	expected[5] = 1
+	expected[len(LatencyBucketBounds)] = 1
+
+	if !reflect.DeepEqual(s.LatencyBuckets, expected) {
+		t.Fatalf("expected buckets %v, got %v", expected, s.LatencyBuckets)
+	}
+}
+
+func TestEndpointStatsMerge(t *testing.T) {
+	a := NewEndpointStats("GET", "/hello")
+	a.Add(200, 10, 1)
+
+	b := NewEndpointStats("GET", "/hello")
+	b.Add(200, 10, 1)
+	b.Add(500, 5, 100)
+
+	a.Merge(b)
+
+	if a.Requests != 3 || a.Bytes != 25 || a.LatencySum != 102 || a.Statuses["2xx"] != 2 || a.Statuses["5xx"] != 1 {
+		t.Fatalf("unexpected merged counters %+v", a)
+	}
+
+	if a.LatencyBuckets[0] != 2 || a.LatencyBuckets[4] != 1 {
+		t.Fatalf("unexpected merged buckets %v", a.LatencyBuckets)
+	}
+
+	// eg. from a node with more buckets, the excess goes to the last bucket
+	other := NewEndpointStats("GET", "/hello")
+	other.LatencyBuckets = make([]uint64, len(LatencyBucketBounds)+3)
+	other.LatencyBuckets[len(LatencyBucketBounds)+2] = 7
+
+	a.Merge(other)
+
+	if n := a.LatencyBuckets[len(LatencyBucketBounds)]; n != 7 {
+		t.Fatalf("expected 7 latencies in the last bucket, got %d", n)
+	}
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	empty := NewEndpointStats("GET", "/hello")
+
+	single := NewEndpointStats("GET", "/hello")
+	single.Add(200, 0, 7)
+
+	many := NewEndpointStats("GET", "/hello")
+	for i := range 100 {
+		if i < 90 {
+			many.Add(200, 0, 3)
+		} else if i < 99 {
+			many.Add(200, 0, 80)
+		} else {
+			many.Add(200, 0, 60000)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		stats    EndpointStats
+		p        float64
+		expected float64
+	}{
+		{"empty", empty, 0.5, 0},
+		{"empty p99", empty, 0.99, 0},
+		{"single p50", single, 0.5, 10},
+		{"single p99", single, 0.99, 10},
+		{"p50", many, 0.5, 5},
+		{"p90", many, 0.9, 5},
+		{"p95", many, 0.95, 100},
+		{"p99", many, 0.99, 100},
+		{"unbounded", many, 1, -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ms := test.stats.LatencyPercentile(test.p); ms != test.expected {
+				t.Fatalf("expected %g, got %g", test.expected, ms)
+			}
+		})
+	}
+}
+
+// Stats of the same gateway are merged across nodes by endpoint.
+func TestGatewayStatsMerge(t *testing.T) {
+	node := func(endpoints ...EndpointStats) *GatewayStats {
+		return &GatewayStats{GatewayID: "gateway1", Endpoints: endpoints}
+	}
+
+	endpoint := func(method string, path string, n int) EndpointStats {
+		e := NewEndpointStats(method, path)
+
+		for range n {
+			e.Add(200, 1, 1)
+		}
+
+		return e
+	}
+
+	total := node()
+	total.Merge(node(endpoint("GET", "/a", 1), endpoint("POST", "/a", 2)))
+	total.Merge(node(endpoint("GET", "/a", 3), endpoint("", "", 4)))
+	total.Merge(node())
+
+	expected := map[string]uint64{"GET /a": 4, "POST /a": 2, " ": 4}
+	actual := map[string]uint64{}
+
+	for _, e := range total.Endpoints {
+		actual[e.Method+" "+e.Path] = e.Requests
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected requests %v, got %v", expected, actual)
+	}
+
+	// merging doesn't modify the stats of the nodes
+	n := node(endpoint("GET", "/b", 1))
+	total.Merge(n)
+	total.Merge(n)
+
+	if n.Endpoints[0].Requests != 1 {
+		t.Fatalf("merged stats were modified")
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	for status, class := range map[int]string{200: "2xx", 301: "3xx", 404: "4xx", 503: "5xx"} {
+		if c := StatusClass(status); c != class {
+			t.Errorf("expected %s for %d, got %s", class, status, c)
+		}
+	}
+}
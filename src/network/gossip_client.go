@@ -16,7 +16,7 @@ type GossipClient struct {
 }
 
 func NewGossipClient(kp *ledger.KeyPair, callbacks Callbacks) *GossipClient {
-	cert, err := makeTLSCertificate(*kp)
+	cert, err := makeTLSCertificate(kp)
 	if err != nil {
 		panic(err)
 	}
@@ -24,28 +24,37 @@ func NewGossipClient(kp *ledger.KeyPair, callbacks Callbacks) *GossipClient {
 	tlsConf := makeClientTLSConfig(cert, func(peer ledger.PublicKey) bool {
 		l := callbacks.Ledger()
 
-		if _, ok := l.Snapshot.Nodes[peer.NodeID()]; ok {
-			return true
-		} else {
-			return false
-		}
+		_, ok := l.Snapshot.FindNode(peer)
+		return ok
 	})
 
 	httpClient := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConf,
-		},
+		Transport: makeClientTransport(kp.Public, tlsConf),
 	}
 
 	return &GossipClient{kp, httpClient, callbacks}
 }
 
+// Sends the gossip to the closest nodes, which relay it further (see
+// `OneToClosest()`).
 func (c *GossipClient) Notify(g *Gossip) {
 	l := c.callbacks.Ledger()
-	s := l.Snapshot
+	ownID, _ := l.Snapshot.FindNode(c.kp.Public)
+
+	c.notify(g, OneToClosest(l, ownID, g.NodeID))
+}
+
+// Sends the gossip directly to all other nodes, for information that other
+// nodes only accept from the node it concerns.
+func (c *GossipClient) NotifyAll(g *Gossip) {
+	l := c.callbacks.Ledger()
+	ownID, _ := l.Snapshot.FindNode(c.kp.Public)
 
-	initiator := g.NodeID
-	dst := OneToClosest(l, c.kp.Public.NodeID(), initiator)
+	c.notify(g, OneToAll(l, ownID, g.NodeID))
+}
+
+func (c *GossipClient) notify(g *Gossip, dst []ledger.NodeID) {
+	s := c.callbacks.Ledger().Snapshot
 
 	bs := g.Encode()
 
@@ -59,17 +68,22 @@ func (c *GossipClient) Notify(g *Gossip) {
 		address := conf.Address
 		port := conf.GossipPort
 
-		url := fmt.Sprintf("https://%s:%d/", address, port)
+		url := fmt.Sprintf("https://%s/", ledger.JoinHostPort(address, port))
 
 		req, err := http.NewRequest("PUT", url, bytes.NewBuffer(bs))
 		if err != nil {
 			panic("failed to create PUT request")
 		}
 
-		if _, err := c.httpClient.Do(req); err != nil {
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			gossipDropped.With(gossipSendFailed).Inc()
 			log.Printf("failed to gossip to %s (%v)", url, err)
+			continue
 		}
-	}
 
-	return
+		resp.Body.Close()
+
+		gossipSent.With().Inc()
+	}
 }
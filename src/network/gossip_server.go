@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -15,41 +17,55 @@ import (
 
 const MaxRecentGossips = 100
 
-// TODO: include events and health status
+// TODO: include events
 type Gossip struct {
-	NodeID  ledger.NodeID
-	Head    ledger.ChangeSetID
-	Changes []ledger.ChangeSet
+	NodeID    ledger.NodeID
+	Head      ledger.ChangeSetID
+	Changes   []ledger.ChangeSet
+	Usage     []RateLimitUsage
+	Heartbeat *Heartbeat
+}
+
+// Number of requests consumed by cluster-wide rate limits (or quotas) on the
+// sending node since its previous usage gossip.
+//
+// Window is the index of the quota period (unix time divided by the period).
+// For token bucket rate limits Window is the unix time of the consumption, so
+// that consecutive usage gossips aren't mistaken for duplicates.
+type RateLimitUsage struct {
+	Key    string `cbor:"0,keyasint"`
+	Window int64  `cbor:"1,keyasint,omitempty"`
+	Count  uint   `cbor:"2,keyasint"`
 }
 
 type encodeableGossip struct {
-	NodeID  []byte                       `cbor:"0,keyasint"`
-	Head    []byte                       `cbor:"1,keyasint"`
-	Changes []ledger.EncodeableChangeSet `cbor:"2,keyasint,omitempty"`
+	NodeID    []byte                       `cbor:"0,keyasint"`
+	Head      []byte                       `cbor:"1,keyasint"`
+	Changes   []ledger.EncodeableChangeSet `cbor:"2,keyasint,omitempty"`
+	Usage     []RateLimitUsage             `cbor:"3,keyasint,omitempty"`
+	Heartbeat *Heartbeat                   `cbor:"4,keyasint,omitempty"`
 }
 
 type gossipHandler struct {
 	kp        *ledger.KeyPair
-	callbacks Callbacks
+	callbacks NodeCallbacks
 
 	mutex  sync.Mutex
 	recent [][]byte // list of hashes of recent gossips
 }
 
-func ServeGossip(port ledger.Port, kp *ledger.KeyPair, callbacks Callbacks) {
-	cert, err := makeTLSCertificate(*kp)
+// Starts serving the gossip service in the background, see `ServeAPI()`.
+func ServeGossip(port ledger.Port, kp *ledger.KeyPair, callbacks NodeCallbacks) (*http.Server, error) {
+	cert, err := makeTLSCertificate(kp)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	tlsConf := makeServerTLSConfig(cert, func(k ledger.PublicKey) bool {
 		l := callbacks.Ledger()
 
-		if _, ok := l.Snapshot.Nodes[k.NodeID()]; ok {
-			return true
-		} else {
-			return false
-		}
+		_, ok := l.Snapshot.FindNode(k)
+		return ok
 	})
 
 	s := &http.Server{
@@ -64,9 +80,18 @@ func ServeGossip(port ledger.Port, kp *ledger.KeyPair, callbacks Callbacks) {
 		MaxHeaderBytes: 1 << 20,
 	}
 
-	if err := s.ListenAndServeTLS("", ""); err != nil {
-		panic(err)
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on port %d (%v)", port, err)
 	}
+
+	go func() {
+		if err := s.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+			log.Printf("gossip server on port %d stopped (%v)\n", port, err)
+		}
+	}()
+
+	return s, nil
 }
 
 func (h *gossipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -78,6 +103,20 @@ func (h *gossipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		default:
 			http.Error(w, fmt.Sprintf("invalid gossip PUT path %s", r.URL.Path), 404)
 		}
+	case "POST":
+		switch r.URL.Path {
+		case "/vote":
+			h.serveVote(w, r)
+		default:
+			http.Error(w, fmt.Sprintf("invalid gossip POST path %s", r.URL.Path), 404)
+		}
+	case "DELETE":
+		switch r.URL.Path {
+		case "/vote":
+			h.serveReleaseVote(w, r)
+		default:
+			http.Error(w, fmt.Sprintf("invalid gossip DELETE path %s", r.URL.Path), 404)
+		}
 	default:
 		http.Error(w, fmt.Sprintf("invalid gossip HTTP method %s", r.Method), 404)
 	}
@@ -120,7 +159,10 @@ func (h *gossipHandler) servePut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	gossipReceived.With().Inc()
+
 	if h.isRecentDuplicate(body) {
+		gossipDropped.With(gossipDuplicate).Inc()
 		fmt.Fprintf(w, "")
 		return
 	}
@@ -130,12 +172,33 @@ func (h *gossipHandler) servePut(w http.ResponseWriter, r *http.Request) {
 
 	g, err := DecodeGossip(body, v)
 	if err != nil {
+		gossipDropped.With(gossipInvalid).Inc()
 		http.Error(w, fmt.Sprintf("invalid gossip format (%v)", err), 400)
+		return
+	}
+
+	// Usage isn't signed, so it is only accepted from the node that consumed
+	// it, and isn't relayed (see `GossipClient.NotifyAll()`)
+	if len(g.Usage) > 0 {
+		if peer, ok := h.peerNodeID(r); ok && peer == g.NodeID {
+			h.callbacks.AddRateLimitUsage(g.NodeID, g.Usage)
+		} else {
+			gossipDropped.With(gossipUnauthenticated).Inc()
+			log.Printf("ignoring rate limit usage of node %s sent by another node\n", g.NodeID)
+		}
+
+		g.Usage = nil
+	}
+
+	if g.Heartbeat != nil {
+		h.callbacks.AddHeartbeat(g.NodeID, g.Head, g.Heartbeat)
 	}
 
-	if g.Head != l.Head() {
+	// Gossips without changes only carry information about the sending node
+	if len(g.Changes) > 0 && g.Head != l.Head() {
 		if len(g.Changes) == 0 || g.Changes[len(g.Changes)-1].ID() != g.Head {
 			// TODO: fetch changes from API instead
+			gossipDropped.With(gossipInvalid).Inc()
 			http.Error(w, fmt.Sprintf("gossip doesn't include necessary changes, aboting"), 400)
 			return
 		}
@@ -144,6 +207,7 @@ func (h *gossipHandler) servePut(w http.ResponseWriter, r *http.Request) {
 			if cs.Prev == l.Head() {
 				for j := i; j < len(g.Changes); j++ {
 					if err := h.callbacks.AppendChangeSet(&(g.Changes[j])); err != nil {
+						gossipDropped.With(gossipRejected).Inc()
 						http.Error(w, fmt.Sprintf("unable to apply new change set %d (%v)", j, err), 400)
 						return
 					}
@@ -155,12 +219,82 @@ func (h *gossipHandler) servePut(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// spread gossip to other nodes
-	gc := NewGossipClient(h.kp, h.callbacks)
-	gc.Notify(g)
+	if len(g.Changes) > 0 || g.Heartbeat != nil {
+		gc := NewGossipClient(h.kp, h.callbacks)
+		gc.Notify(g)
+	}
+
+	fmt.Fprintf(w, "")
+}
+
+// Returns the id of the node whose certificate was used to connect.
+func (h *gossipHandler) peerNodeID(r *http.Request) (ledger.NodeID, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", false
+	}
+
+	key, err := extractPeerPublicKey(r.TLS.PeerCertificates[0])
+	if err != nil {
+		return "", false
+	}
+
+	return h.callbacks.Ledger().Snapshot.FindNode(key)
+}
+
+// Change sets are proposed by the node that received them from a client, see
+// `GossipClient.RequestVotes()`.
+func (h *gossipHandler) serveVote(w http.ResponseWriter, r *http.Request) {
+	proposer, cs, ok := h.readVoteRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.callbacks.Vote(cs, proposer); err != nil {
+		http.Error(w, fmt.Sprintf("change set rejected (%v)", err), 409)
+		return
+	}
 
 	fmt.Fprintf(w, "")
 }
 
+// See `GossipClient.ReleaseVotes()`.
+func (h *gossipHandler) serveReleaseVote(w http.ResponseWriter, r *http.Request) {
+	proposer, cs, ok := h.readVoteRequest(w, r)
+	if !ok {
+		return
+	}
+
+	h.callbacks.ReleaseVote(cs, proposer)
+
+	fmt.Fprintf(w, "")
+}
+
+// Returns the requesting node and the change set. Writes the error response
+// and returns false if the request is invalid.
+func (h *gossipHandler) readVoteRequest(w http.ResponseWriter, r *http.Request) (ledger.NodeID, *ledger.ChangeSet, bool) {
+	defer r.Body.Close()
+
+	proposer, ok := h.peerNodeID(r)
+	if !ok {
+		http.Error(w, "vote requests must be sent by a node", 403)
+		return "", nil, false
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body (%v)", err), 400)
+		return "", nil, false
+	}
+
+	cs, err := ledger.DecodeChangeSet(body, h.callbacks.Ledger().Snapshot.Version)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid change set format (%v)", err), 400)
+		return "", nil, false
+	}
+
+	return proposer, cs, true
+}
+
 func (g *Gossip) Encode() []byte {
 	_, nodeIDBytes, err := ledger.DecodeBech32(string(g.NodeID))
 	if err != nil {
@@ -179,9 +313,11 @@ func (g *Gossip) Encode() []byte {
 	}
 
 	eg := encodeableGossip{
-		NodeID:  nodeIDBytes,
-		Head:    headBytes,
-		Changes: ecs,
+		NodeID:    nodeIDBytes,
+		Head:      headBytes,
+		Changes:   ecs,
+		Usage:     g.Usage,
+		Heartbeat: g.Heartbeat,
 	}
 
 	bs, err := cbor.Marshal(eg)
@@ -200,8 +336,15 @@ func DecodeGossip(bs []byte, v ledger.LedgerVersion) (*Gossip, error) {
 		return nil, err
 	}
 
-	nodeID := ledger.EncodeBech32(ledger.NodeIDPrefix, eg.NodeID)
-	head := ledger.EncodeBech32(ledger.ChangeSetIDPrefix, eg.Head)
+	nodeID, err := ledger.DecodeShortID(ledger.NodeIDPrefix, eg.NodeID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gossip node id (%v)", err)
+	}
+
+	head, err := ledger.DecodeShortID(ledger.ChangeSetIDPrefix, eg.Head)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gossip head (%v)", err)
+	}
 
 	changes := make([]ledger.ChangeSet, len(eg.Changes))
 
@@ -215,8 +358,10 @@ func DecodeGossip(bs []byte, v ledger.LedgerVersion) (*Gossip, error) {
 	}
 
 	return &Gossip{
-		NodeID:  ledger.NodeID(nodeID),
-		Head:    ledger.ChangeSetID(head),
-		Changes: changes,
+		NodeID:    ledger.NodeID(nodeID),
+		Head:      ledger.ChangeSetID(head),
+		Changes:   changes,
+		Usage:     eg.Usage,
+		Heartbeat: eg.Heartbeat,
 	}, nil
 }
@@ -0,0 +1,124 @@
+package network
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"testing"
+
+	"ows/ledger"
+)
+
+// Only implements what is needed to receive usage gossips.
+type usageCallbacks struct {
+	NodeCallbacks
+
+	l     *ledger.Ledger
+	usage map[ledger.NodeID][]RateLimitUsage
+}
+
+func (c *usageCallbacks) Ledger() *ledger.Ledger {
+	return c.l
+}
+
+func (c *usageCallbacks) AddRateLimitUsage(from ledger.NodeID, usage []RateLimitUsage) {
+	c.usage[from] = append(c.usage[from], usage...)
+}
+
+func TestUsageGossipBoundToPeer(t *testing.T) {
+	keyPairs := make([]*ledger.KeyPair, 3)
+	actions := make([]ledger.Action, 3)
+
+	for i := range keyPairs {
+		kp, err := ledger.RandomKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keyPairs[i] = kp
+		actions[i] = ledger.AddNode{Key: kp.Public, Address: "127.0.0.1", GossipPort: ledger.Port(9000 + 2*i), APIPort: ledger.Port(9001 + 2*i)}
+	}
+
+	cs := ledger.NewInitialChangeSet(ledger.LatestLedgerVersion, actions...)
+
+	sig, err := keyPairs[0].SignChangeSet(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs.Signatures = []ledger.Signature{sig}
+
+	l, err := ledger.NewLedger(ledger.LatestLedgerVersion, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callbacks := &usageCallbacks{l: l, usage: map[ledger.NodeID][]RateLimitUsage{}}
+	h := &gossipHandler{kp: keyPairs[0], callbacks: callbacks}
+
+	peerCert := func(kp *ledger.KeyPair) *x509.Certificate {
+		cert, err := makeTLSCertificate(kp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return parsed
+	}
+
+	owner := keyPairs[1].Public.NodeID()
+
+	stranger, err := ledger.RandomKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		sender *ledger.KeyPair
+		nodeID ledger.NodeID
+		window int64
+		accept bool
+	}{
+		{"own usage", keyPairs[1], owner, 1, true},
+		{"spoofed usage", keyPairs[2], owner, 2, false},
+		{"no certificate", nil, owner, 3, false},
+		{"unknown node", stranger, stranger.Public.NodeID(), 4, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			g := &Gossip{
+				NodeID: c.nodeID,
+				Head:   l.Head(),
+				Usage:  []RateLimitUsage{{Key: "gateway1", Window: c.window, Count: 1}},
+			}
+
+			r := httptest.NewRequest("PUT", "/", bytes.NewReader(g.Encode()))
+			if c.sender != nil {
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{peerCert(c.sender)}}
+			}
+
+			w := httptest.NewRecorder()
+			h.servePut(w, r)
+
+			if w.Code != 200 {
+				t.Fatalf("unexpected status %d (%s)", w.Code, w.Body.String())
+			}
+
+			received := false
+			for _, u := range callbacks.usage[c.nodeID] {
+				received = received || u.Window == c.window
+			}
+
+			if received != c.accept {
+				t.Fatalf("expected usage accepted=%v, got %v", c.accept, received)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+
+	"ows/ledger"
+)
+
+func testGossip(t testing.TB) *Gossip {
+	kp, err := ledger.RandomKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs := ledger.NewInitialChangeSet(ledger.LatestLedgerVersion, ledger.AddNode{Key: kp.Public, Address: "127.0.0.1", GossipPort: 9000, APIPort: 9001})
+
+	sig, err := kp.SignChangeSet(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs.Signatures = []ledger.Signature{sig}
+
+	return &Gossip{
+		NodeID:    kp.Public.NodeID(),
+		Head:      cs.ID(),
+		Changes:   []ledger.ChangeSet{*cs},
+		Usage:     []RateLimitUsage{{Key: "gateway1/GET/hello", Window: 12, Count: 3}},
+		Heartbeat: &Heartbeat{Timestamp: 1700000000, Height: 1, Uptime: 60, Version: "dev", Load: 0.5},
+	}
+}
+
+func TestGossipRoundTrip(t *testing.T) {
+	g := testGossip(t)
+	bs := g.Encode()
+
+	decoded, err := DecodeGossip(bs, ledger.LatestLedgerVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.NodeID != g.NodeID || decoded.Head != g.Head || len(decoded.Changes) != 1 || decoded.Changes[0].ID() != g.Head {
+		t.Fatalf("decoded gossip differs: %+v", decoded)
+	}
+
+	if !bytes.Equal(decoded.Encode(), bs) {
+		t.Fatalf("reencoded gossip differs")
+	}
+}
+
+func FuzzDecodeGossip(f *testing.F) {
+	g := testGossip(f)
+
+	f.Add(g.Encode())
+
+	g.Changes = nil
+	g.Heartbeat = nil
+	f.Add(g.Encode())
+
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		g, err := DecodeGossip(bs, ledger.LatestLedgerVersion)
+		if err != nil {
+			return
+		}
+
+		// gossips are decoded before any validation, so decodable gossips
+		// must at least be reencodable
+		if _, err := DecodeGossip(g.Encode(), ledger.LatestLedgerVersion); err != nil {
+			t.Fatalf("unable to decode reencoded gossip (%v)", err)
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package network
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"ows/ledger"
+)
+
+// Interval at which nodes gossip their heartbeat.
+const HeartbeatInterval = 5 * time.Second
+
+// Peers that haven't sent a heartbeat for longer than these durations are
+// considered suspect, respectively dead.
+const (
+	SuspectAfter = 3 * HeartbeatInterval
+	DeadAfter    = 12 * HeartbeatInterval
+)
+
+// Valid peer states
+const (
+	PeerAlive   = "alive"
+	PeerSuspect = "suspect"
+	PeerDead    = "dead"
+)
+
+// Health information periodically gossiped by each node. The head of the
+// node's ledger is carried by the enclosing Gossip.
+//
+// Timestamp is the unix time (in milliseconds) at which the heartbeat was
+// created, according to the clock of the sender. It is only used to order the
+// heartbeats of a node, and makes sure consecutive heartbeats aren't mistaken
+// for duplicates. Load is the 1-minute system load average.
+type Heartbeat struct {
+	Timestamp     int64   `cbor:"0,keyasint"`
+	Height        uint    `cbor:"1,keyasint"`
+	Uptime        uint64  `cbor:"2,keyasint"`
+	Version       string  `cbor:"3,keyasint"`
+	Load          float64 `cbor:"4,keyasint"`
+	LastError     string  `cbor:"5,keyasint,omitempty"`
+	LastErrorTime int64   `cbor:"6,keyasint,omitempty"`
+}
+
+// Status of a node, as seen by the node reporting it. LastSeen is zero if no
+// heartbeat has been received yet.
+type PeerStatus struct {
+	NodeID        ledger.NodeID      `json:"nodeId"`
+	State         string             `json:"state"`
+	LastSeen      time.Time          `json:"lastSeen"`
+	Head          ledger.ChangeSetID `json:"head,omitempty"`
+	Height        uint               `json:"height"`
+	Uptime        uint64             `json:"uptime"`
+	Version       string             `json:"version,omitempty"`
+	Load          float64            `json:"load"`
+	LastError     string             `json:"lastError,omitempty"`
+	LastErrorTime time.Time          `json:"lastErrorTime,omitempty"`
+
+	timestamp int64 // Heartbeat.Timestamp of the latest heartbeat
+}
+
+// Cluster membership table, built from received heartbeats.
+type Membership struct {
+	mutex sync.Mutex
+	peers map[ledger.NodeID]*PeerStatus
+}
+
+func NewMembership() *Membership {
+	return &Membership{
+		peers: map[ledger.NodeID]*PeerStatus{},
+	}
+}
+
+// Older heartbeats (eg. received out of order) are ignored. Liveness is based
+// on the local time at which heartbeats are received, so that peers whose
+// clock is off aren't considered dead.
+func (m *Membership) Update(id ledger.NodeID, head ledger.ChangeSetID, hb *Heartbeat, now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	p, ok := m.peers[id]
+	if !ok {
+		p = &PeerStatus{NodeID: id}
+		m.peers[id] = p
+	}
+
+	if ok && p.Head != "" && hb.Timestamp < p.timestamp {
+		return
+	}
+
+	p.LastSeen = now
+	p.timestamp = hb.Timestamp
+
+	p.Head = head
+	p.Height = hb.Height
+	p.Uptime = hb.Uptime
+	p.Version = hb.Version
+	p.Load = hb.Load
+	p.LastError = hb.LastError
+
+	if hb.LastErrorTime != 0 {
+		p.LastErrorTime = time.UnixMilli(hb.LastErrorTime)
+	} else {
+		p.LastErrorTime = time.Time{}
+	}
+}
+
+// Returns the status of the given nodes, sorted by node id. Peers that are no
+// longer part of the ledger are forgotten.
+func (m *Membership) Status(nodes []ledger.NodeID, now time.Time) []PeerStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	isMember := map[ledger.NodeID]bool{}
+	for _, id := range nodes {
+		isMember[id] = true
+	}
+
+	for id := range m.peers {
+		if !isMember[id] {
+			delete(m.peers, id)
+		}
+	}
+
+	status := make([]PeerStatus, 0, len(nodes))
+
+	for _, id := range nodes {
+		p, ok := m.peers[id]
+		if !ok {
+			status = append(status, PeerStatus{NodeID: id, State: PeerDead})
+			continue
+		}
+
+		s := *p
+		s.State = peerState(now.Sub(p.LastSeen))
+
+		status = append(status, s)
+	}
+
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].NodeID < status[j].NodeID
+	})
+
+	return status
+}
+
+func peerState(silence time.Duration) string {
+	switch {
+	case silence > DeadAfter:
+		return PeerDead
+	case silence > SuspectAfter:
+		return PeerSuspect
+	default:
+		return PeerAlive
+	}
+}
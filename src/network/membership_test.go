@@ -0,0 +1,78 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"ows/ledger"
+)
+
+func TestMembership(t *testing.T) {
+	m := NewMembership()
+	start := time.Unix(1700000000, 0)
+	nodes := []ledger.NodeID{"node1", "node2", "node3"}
+
+	// the clock of node1 is a minute behind, the clock of node2 is ahead
+	hb := func(id ledger.NodeID, now time.Time, height uint) {
+		offset := map[ledger.NodeID]time.Duration{"node1": -time.Minute, "node2": time.Hour}[id]
+
+		m.Update(id, ledger.ChangeSetID("head"), &Heartbeat{Timestamp: now.Add(offset).UnixMilli(), Height: height}, now)
+	}
+
+	state := func(now time.Time) map[ledger.NodeID]string {
+		states := map[ledger.NodeID]string{}
+
+		for _, s := range m.Status(nodes, now) {
+			states[s.NodeID] = s.State
+		}
+
+		return states
+	}
+
+	hb("node1", start, 1)
+	hb("node2", start, 1)
+
+	steps := []struct {
+		elapsed  time.Duration
+		expected map[ledger.NodeID]string
+	}{
+		{0, map[ledger.NodeID]string{"node1": PeerAlive, "node2": PeerAlive, "node3": PeerDead}},
+		{SuspectAfter, map[ledger.NodeID]string{"node1": PeerAlive, "node2": PeerAlive, "node3": PeerDead}},
+		{SuspectAfter + time.Second, map[ledger.NodeID]string{"node1": PeerSuspect, "node2": PeerSuspect, "node3": PeerDead}},
+		{DeadAfter + time.Second, map[ledger.NodeID]string{"node1": PeerDead, "node2": PeerDead, "node3": PeerDead}},
+	}
+
+	for _, s := range steps {
+		states := state(start.Add(s.elapsed))
+
+		for id, expected := range s.expected {
+			if states[id] != expected {
+				t.Fatalf("after %s: expected %s to be %s, got %s", s.elapsed, id, expected, states[id])
+			}
+		}
+	}
+
+	// a heartbeat received late is still proof of life
+	now := start.Add(DeadAfter + time.Second)
+	hb("node1", now, 2)
+
+	if s := state(now)["node1"]; s != PeerAlive {
+		t.Fatalf("expected node1 to be alive again, got %s", s)
+	}
+
+	// heartbeats received out of order are ignored
+	m.Update("node1", "old", &Heartbeat{Timestamp: start.UnixMilli(), Height: 1}, now.Add(time.Second))
+
+	for _, s := range m.Status(nodes, now) {
+		if s.NodeID == "node1" && (s.Height != 2 || !s.LastSeen.Equal(now)) {
+			t.Fatalf("expected older heartbeat to be ignored, got %+v", s)
+		}
+	}
+
+	// peers that leave the ledger are forgotten
+	m.Status([]ledger.NodeID{"node2"}, now)
+
+	if s := m.Status(nodes, now); s[0].State != PeerDead || !s[0].LastSeen.IsZero() {
+		t.Fatalf("expected node1 to be forgotten, got %+v", s[0])
+	}
+}
@@ -0,0 +1,164 @@
+package network
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"ows/ledger"
+	"ows/metrics"
+)
+
+var (
+	gossipSent     = metrics.Default.NewCounter("ows_gossip_messages_sent_total", "Number of gossip messages sent to other nodes")
+	gossipReceived = metrics.Default.NewCounter("ows_gossip_messages_received_total", "Number of gossip messages received from other nodes")
+	gossipDropped  = metrics.Default.NewCounter("ows_gossip_messages_dropped_total", "Number of gossip messages that were dropped", "reason")
+	syncDuration   = metrics.Default.NewHistogram("ows_ledger_sync_duration_seconds", "Duration of ledger syncs with other nodes", metrics.DefaultBuckets, "result")
+	forksResolved  = metrics.Default.NewCounter("ows_ledger_forks_resolved_total", "Number of ledger forks detected with other nodes", "outcome")
+	consensusVotes = metrics.Default.NewCounter("ows_consensus_votes_total", "Number of votes requested from other nodes", "result")
+)
+
+// Results of vote requests
+const (
+	voteAccepted = "accepted"
+	voteRejected = "rejected"
+)
+
+// Outcomes of fork resolution
+const (
+	forkAdopted = "adopted"
+	forkKept    = "kept"
+)
+
+// Reasons for dropping gossip messages
+const (
+	gossipDuplicate       = "duplicate"
+	gossipInvalid         = "invalid"
+	gossipRejected        = "rejected"
+	gossipSendFailed      = "send_failed"
+	gossipUnauthenticated = "unauthenticated"
+)
+
+type metricsHandler struct {
+	callbacks Callbacks
+	registry  *metrics.Registry
+}
+
+// Starts serving the metrics of the registry over HTTPS in the background.
+// The listener is created synchronously, so that errors can be returned.
+//
+// Unlike the API and gossip services, client certificates are optional,
+// because scrapers within the allowed networks don't need one.
+func ServeMetrics(port ledger.Port, kp *ledger.KeyPair, callbacks Callbacks, registry *metrics.Registry) (*http.Server, error) {
+	cert, err := makeTLSCertificate(kp)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: &metricsHandler{callbacks, registry},
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{*cert},
+			ClientAuth:   tls.RequestClientCert,
+		},
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on port %d (%v)", port, err)
+	}
+
+	go func() {
+		if err := s.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+			log.Printf("metrics server on port %d stopped (%v)\n", port, err)
+		}
+	}()
+
+	return s, nil
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" || r.URL.Path != "/metrics" {
+		http.Error(w, fmt.Sprintf("invalid metrics path %s %s", r.Method, r.URL.Path), 404)
+		return
+	}
+
+	if !h.isAllowed(r) {
+		http.Error(w, "metrics access denied", 403)
+		return
+	}
+
+	openMetrics := metrics.AcceptsOpenMetrics(r.Header.Get("Accept"))
+
+	if openMetrics {
+		w.Header().Set("Content-Type", metrics.OpenMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", metrics.PrometheusContentType)
+	}
+
+	if err := h.registry.Write(w, openMetrics); err != nil {
+		log.Printf("failed to write metrics (%v)\n", err)
+	}
+}
+
+func (h *metricsHandler) isAllowed(r *http.Request) bool {
+	s := h.callbacks.Ledger().Snapshot
+
+	if s.Metrics == nil {
+		return false
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			for _, n := range s.Metrics.AllowedNetworks {
+				if _, ipNet, err := net.ParseCIDR(n); err == nil && ipNet.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+
+	// the TLS handshake proves that the client owns the certificate key
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+
+	key, err := extractPeerPublicKey(r.TLS.PeerCertificates[0])
+	if err != nil {
+		return false
+	}
+
+	if _, ok := s.FindNode(key); ok {
+		return true
+	}
+
+	if _, ok := s.Users[key.UserID()]; !ok {
+		return false
+	}
+
+	policies, err := s.UserPolicies([]ledger.PublicKey{key})
+	if err != nil {
+		return false
+	}
+
+	// policies can't be checked against an empty resource id
+	ownID, ok := s.FindNode(h.callbacks.OwnSigner().PublicKey())
+	if !ok {
+		return false
+	}
+
+	for _, p := range policies {
+		if p.Allows(s.Version, ledger.MetricsCategory, ledger.ReadMetricsName, ownID) {
+			return true
+		}
+	}
+
+	return false
+}
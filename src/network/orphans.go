@@ -0,0 +1,75 @@
+package network
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"ows/ledger"
+)
+
+// Maximum number of orphaned change sets remembered by a node
+const MaxOrphans = 1000
+
+// A change set that was discarded when the local ledger adopted another fork.
+// Its actions are no longer part of the ledger, and must be resubmitted by
+// one of the signers if they are still needed.
+type OrphanedChangeSet struct {
+	ID      ledger.ChangeSetID `json:"id"`
+	Index   int                `json:"index"`
+	Signers []ledger.UserID    `json:"signers"`
+	NodeID  ledger.NodeID      `json:"nodeId"` // node that discarded the change set
+	Time    time.Time          `json:"time"`
+}
+
+// Lists the change sets [p+1:] of l, which are about to be rolled back.
+func NewOrphanedChangeSets(l *ledger.Ledger, p int, nodeID ledger.NodeID, now time.Time) []OrphanedChangeSet {
+	ids := l.IDChain().IDs
+	orphans := []OrphanedChangeSet{}
+
+	for i := p + 1; i < l.Height(); i++ {
+		cs, ok := l.ChangeAt(i)
+		if !ok {
+			continue
+		}
+
+		orphans = append(orphans, OrphanedChangeSet{
+			ID:      ids[i],
+			Index:   i,
+			Signers: cs.Signers(),
+			NodeID:  nodeID,
+			Time:    now,
+		})
+	}
+
+	return orphans
+}
+
+// Returns true if the change set was signed by the given user.
+func (o OrphanedChangeSet) SignedBy(id ledger.UserID) bool {
+	return slices.Contains(o.Signers, id)
+}
+
+// Thread-safe list of the latest orphaned change sets.
+type Orphans struct {
+	mutex sync.Mutex
+	list  []OrphanedChangeSet
+}
+
+func (o *Orphans) Add(orphans []OrphanedChangeSet) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.list = append(o.list, orphans...)
+
+	if n := len(o.list); n > MaxOrphans {
+		o.list = slices.Clone(o.list[n-MaxOrphans:])
+	}
+}
+
+func (o *Orphans) List() []OrphanedChangeSet {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return slices.Clone(o.list)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"ows/ledger"
+)
+
+// Interval at which missing checkpoint attestations are requested from other
+// nodes.
+const CheckpointAttestationInterval = 30 * time.Second
+
+// Replaces the ledger by a pruned ledger starting from the checkpoint.
+func (s *nodeState) RestoreCheckpoint(cp *ledger.Checkpoint) error {
+	s.updateMutex.Lock()
+	defer s.updateMutex.Unlock()
+
+	l := ledger.NewLedgerFromCheckpoint(s.ledger().InitialVersion, cp)
+	p := s.ledgerPath()
+
+	if err := cp.Write(ledger.CheckpointPath(p)); err != nil {
+		return err
+	}
+
+	if err := s.store.Rewrite(l); err != nil {
+		return err
+	}
+
+	s.setLedger(l)
+
+	if err := s.resources.Sync(l.Snapshot); err != nil {
+		s.health.recordError(err)
+		return err
+	}
+
+	s.syncMetrics()
+
+	return nil
+}
+
+// Creates and signs a checkpoint of the updated ledger (before it replaces the
+// current ledger) if its height is a multiple of `ledger.CheckpointInterval`.
+// Signatures of the other nodes are collected later by
+// `collectAttestations()`.
+func (s *nodeState) createCheckpoint(l *ledger.Ledger) error {
+	if l.Height()%ledger.CheckpointInterval != 0 {
+		return nil
+	}
+
+	if l.Checkpoint != nil && l.Checkpoint.Head() == l.Head() {
+		return nil
+	}
+
+	cp := l.NewCheckpoint()
+
+	sig, err := s.keyPair().SignCheckpoint(cp)
+	if err != nil {
+		return err
+	}
+
+	cp.AddSignature(sig)
+
+	if err := cp.Write(ledger.CheckpointPath(s.ledgerPath())); err != nil {
+		return fmt.Errorf("unable to write checkpoint (%v)", err)
+	}
+
+	l.Checkpoint = cp
+
+	log.Printf("created checkpoint %s (%d change sets)\n", cp.Head(), cp.Height())
+
+	return nil
+}
+
+// Periodically requests the signatures of the latest checkpoint from the
+// nodes that haven't attested it yet, until a majority of the nodes has
+// attested it.
+func (s *nodeState) collectAttestations(interval time.Duration) {
+	for range time.Tick(interval) {
+		l := s.ledger()
+
+		// the checkpoint was created by the current node, so its nodes can
+		// be trusted
+		cp := l.Checkpoint
+		if cp == nil || cp.Attested(cp.Snapshot().Nodes) == nil {
+			continue
+		}
+
+		// signatures are added to a copy, so that the checkpoint that is
+		// being served isn't modified
+		next := *cp
+		next.Signatures = slices.Clone(cp.Signatures)
+
+		attesters := next.Attesters(cp.Snapshot().Nodes)
+		added := 0
+
+		for _, id := range cp.Snapshot().NodeIDs() {
+			if slices.Contains(attesters, id) {
+				continue
+			}
+
+			c, err := s.newNodeAPIClient(id)
+			if err != nil {
+				continue
+			}
+
+			sig, err := c.CheckpointSignature(cp.Head())
+			if err != nil {
+				continue
+			}
+
+			if signer, ok := cp.Snapshot().FindNode(sig.Key); ok && signer == id && next.AddSignature(sig) {
+				added++
+			}
+		}
+
+		if added > 0 {
+			s.updateCheckpoint(cp, &next)
+		}
+	}
+}
+
+// Replaces the checkpoint of the ledger by a checkpoint with more signatures,
+// unless the checkpoint has changed in the meantime.
+func (s *nodeState) updateCheckpoint(prev *ledger.Checkpoint, next *ledger.Checkpoint) {
+	s.updateMutex.Lock()
+	defer s.updateMutex.Unlock()
+
+	l := s.ledger()
+	if l.Checkpoint != prev {
+		return
+	}
+
+	if err := next.Write(ledger.CheckpointPath(s.ledgerPath())); err != nil {
+		log.Printf("unable to write checkpoint (%v)\n", err)
+		return
+	}
+
+	// only the checkpoint changes, so the rest of the ledger can be shared
+	updated := *l
+	updated.Checkpoint = next
+	s.setLedger(&updated)
+
+	if err := next.Attested(next.Snapshot().Nodes); err == nil {
+		log.Printf("checkpoint %s attested by a majority of the nodes\n", next.Head())
+	}
+}
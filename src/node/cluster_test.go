@@ -0,0 +1,317 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"ows/ledger"
+	"ows/network"
+)
+
+func TestClusterGossip(t *testing.T) {
+	c := newTestCluster(t, 3)
+
+	id := c.commit(0, ledger.AddUser{Key: randomKeyPair(t).Public})
+
+	if head := c.assertConverged(); head != id {
+		t.Fatalf("expected head %s, got %s", id, head)
+	}
+
+	// change sets can be sent to any node
+	id = c.commit(2, ledger.AddUser{Key: randomKeyPair(t).Public})
+
+	if head := c.assertConverged(); head != id {
+		t.Fatalf("expected head %s, got %s", id, head)
+	}
+
+	for i, s := range c.nodes {
+		if h := s.Ledger().Height(); h != 3 {
+			t.Fatalf("expected height 3 on node %d, got %d", i, h)
+		}
+	}
+}
+
+func TestClusterPartition(t *testing.T) {
+	c := newTestCluster(t, 3)
+
+	c.partition([]int{0, 1}, []int{2})
+
+	c.commit(0, ledger.AddUser{Key: randomKeyPair(t).Public})
+	majorityHead := c.commit(1, ledger.AddUser{Key: randomKeyPair(t).Public})
+	minorityHead := c.commit(2, ledger.AddUser{Key: randomKeyPair(t).Public})
+
+	c.assertConverged(0, 1)
+
+	// anti-entropy can't reach the other side either
+	c.antiEntropy()
+
+	if heads := c.heads(); heads[0] != majorityHead || heads[2] != minorityHead {
+		t.Fatalf("expected forked heads %s and %s, got %v", majorityHead, minorityHead, heads)
+	}
+
+	c.clock.advance(time.Hour)
+	c.heal()
+	c.antiEntropy()
+
+	// the longest chain wins
+	if head := c.assertConverged(); head != majorityHead {
+		t.Fatalf("expected head %s, got %s", majorityHead, head)
+	}
+
+	orphans := c.nodes[2].Orphans()
+
+	if len(orphans) != 1 || orphans[0].ID != minorityHead {
+		t.Fatalf("expected %s to be orphaned, got %v", minorityHead, orphans)
+	}
+
+	if !orphans[0].Time.Equal(c.clock.Now()) {
+		t.Fatalf("expected orphan time %s, got %s", c.clock.Now(), orphans[0].Time)
+	}
+
+	if orphans := c.nodes[0].Orphans(); len(orphans) != 0 {
+		t.Fatalf("expected no orphans on majority node, got %v", orphans)
+	}
+}
+
+func TestClusterForkLength(t *testing.T) {
+	c := newTestCluster(t, 3)
+
+	c.partition([]int{0, 1}, []int{2})
+
+	shorter := c.commit(0, ledger.AddUser{Key: randomKeyPair(t).Public})
+	c.assertConverged(0, 1)
+
+	var longer ledger.ChangeSetID
+
+	for range 4 {
+		longer = c.commit(2, ledger.AddUser{Key: randomKeyPair(t).Public})
+	}
+
+	c.heal()
+	c.antiEntropy()
+
+	if head := c.assertConverged(); head != longer {
+		t.Fatalf("expected head %s, got %s", longer, head)
+	}
+
+	for _, i := range []int{0, 1} {
+		if orphans := c.nodes[i].Orphans(); len(orphans) != 1 || orphans[0].ID != shorter {
+			t.Fatalf("expected %s to be orphaned on node %d, got %v", shorter, i, orphans)
+		}
+	}
+}
+
+// The fork-choice rule only depends on the ledgers, so nodes that can reach
+// different peers still make the same decision.
+func TestClusterForkPeerSets(t *testing.T) {
+	c := newTestCluster(t, 4)
+
+	c.partition([]int{0, 1}, []int{2, 3})
+
+	a := c.commit(0, ledger.AddUser{Key: randomKeyPair(t).Public})
+	b := c.commit(2, ledger.AddUser{Key: randomKeyPair(t).Public})
+
+	c.assertConverged(0, 1)
+	c.assertConverged(2, 3)
+
+	// every node only reaches a single node of the other fork
+	c.partition([]int{0, 2}, []int{1, 3})
+	c.antiEntropy()
+
+	// forks of the same length, so the lowest id wins
+	if head := c.assertConverged(); head != min(a, b) {
+		t.Fatalf("expected head %s, got %s", min(a, b), head)
+	}
+}
+
+func TestClusterIsolatedNode(t *testing.T) {
+	c := newTestCluster(t, 3)
+
+	c.partition([]int{0, 1})
+
+	id := c.commit(0, ledger.AddUser{Key: randomKeyPair(t).Public})
+	c.assertConverged(0, 1)
+
+	if head := c.nodes[2].Ledger().Head(); head == id {
+		t.Fatalf("isolated node received change set %s", id)
+	}
+
+	// the isolated node catches up without any forks
+	c.heal()
+	c.antiEntropy()
+
+	if head := c.assertConverged(); head != id {
+		t.Fatalf("expected head %s, got %s", id, head)
+	}
+
+	if orphans := c.nodes[2].Orphans(); len(orphans) != 0 {
+		t.Fatalf("expected no orphans, got %v", orphans)
+	}
+}
+
+// Timestamps and expiries of submitted change sets are checked against the
+// node clock.
+func TestClusterChangeSetTime(t *testing.T) {
+	c := newTestCluster(t, 1)
+
+	submit := func(timestamp time.Time, validUntil time.Time) error {
+		cs := c.nodes[0].Ledger().NewChangeSet(ledger.AddUser{Key: randomKeyPair(t).Public})
+		cs.Timestamp = timestamp
+		cs.ValidUntil = validUntil
+		c.sign(cs)
+
+		_, err := c.apiClient(c.root, 0).AppendChangeSet(cs)
+
+		return err
+	}
+
+	created := c.clock.Now()
+	c.clock.advance(time.Hour)
+
+	if err := submit(created, time.Time{}); err == nil || !strings.Contains(err.Error(), "away from the node time") {
+		t.Fatalf("expected skewed change set to be refused, got %v", err)
+	}
+
+	now := c.clock.Now()
+
+	if err := submit(now.Add(-time.Minute), now.Add(-time.Second)); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("expected expired change set to be refused, got %v", err)
+	}
+
+	if err := submit(now, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusterFunctions(t *testing.T) {
+	c := newTestCluster(t, 3)
+
+	handler, err := c.apiClient(c.root, 0).UploadAsset([]byte("export function handler(arg) { return arg }"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.commit(1, ledger.AddFunction{Runtime: "nodejs", HandlerID: handler})
+	c.assertConverged()
+
+	for i, s := range c.nodes {
+		if !c.runtimes[i].isInitialized() {
+			t.Fatalf("function runtime of node %d not initialized", i)
+		}
+
+		for id := range s.Ledger().Snapshot.Functions {
+			res, err := s.resources.RunFunction(id, "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if m, ok := res.(map[string]any); !ok || m["handler"] != string(handler) || m["arg"] != "hello" {
+				t.Fatalf("unexpected function result %v on node %d", res, i)
+			}
+		}
+	}
+}
+
+func enableConsensus(c *testCluster) {
+	c.commit(0, ledger.ConfigureConsensus{Enabled: true})
+	c.assertConverged()
+}
+
+func TestClusterConsensus(t *testing.T) {
+	c := newTestCluster(t, 3)
+	enableConsensus(c)
+
+	cs := c.newChangeSet(1, ledger.AddUser{Key: randomKeyPair(t).Public})
+
+	ack, err := c.apiClient(c.root, 1).AppendChangeSet(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ack != network.ChangeSetCommitted {
+		t.Fatalf("expected ack %s, got %s", network.ChangeSetCommitted, ack)
+	}
+
+	if head := c.assertConverged(); head != cs.ID() {
+		t.Fatalf("expected head %s, got %s", cs.ID(), head)
+	}
+}
+
+func TestClusterConsensusRelease(t *testing.T) {
+	c := newTestCluster(t, 4)
+	enableConsensus(c)
+
+	prev := c.nodes[0].Ledger().Head()
+
+	// 2 of 4 nodes isn't a majority
+	c.partition([]int{0, 1}, []int{2, 3})
+
+	cs := c.newChangeSet(0, ledger.AddUser{Key: randomKeyPair(t).Public})
+
+	if _, err := c.apiClient(c.root, 0).AppendChangeSet(cs); err == nil {
+		t.Fatalf("change set committed without a majority")
+	}
+
+	// the proposer released the votes, so other change sets can be committed
+	for i, s := range c.nodes {
+		if b, ok := s.votes.Get(prev); ok {
+			t.Fatalf("node %d still votes for %s", i, b.ID)
+		}
+	}
+
+	c.heal()
+
+	id := c.commit(2, ledger.AddUser{Key: randomKeyPair(t).Public})
+
+	if head := c.assertConverged(); head != id {
+		t.Fatalf("expected head %s, got %s", id, head)
+	}
+}
+
+// A change set accepted by a majority is committed, even if the proposer never
+// appended it. Until then the voters refuse conflicting change sets, however
+// long it takes.
+func TestClusterConsensusLostCommit(t *testing.T) {
+	c := newTestCluster(t, 3)
+	enableConsensus(c)
+
+	committed := c.newChangeSet(0, ledger.AddUser{Key: randomKeyPair(t).Public})
+
+	for _, i := range []int{0, 1} {
+		if err := c.nodes[i].Vote(committed, c.nodes[0].ID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.clock.advance(time.Hour)
+
+	// appended without consensus, and gossiped to the voters
+	conflicting := c.newChangeSet(2, ledger.AddUser{Key: randomKeyPair(t).Public})
+
+	if err := c.nodes[2].AppendChangeSet(conflicting); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []int{0, 1} {
+		if head := c.nodes[i].Ledger().Head(); head == conflicting.ID() {
+			t.Fatalf("node %d appended change set conflicting with its vote", i)
+		}
+	}
+
+	c.nodes[0].resolveStaleVotes()
+
+	if head := c.assertConverged(0, 1); head != committed.ID() {
+		t.Fatalf("expected head %s, got %s", committed.ID(), head)
+	}
+
+	// node 2 appended its change set without consensus, which nodes following
+	// the protocol never do, so the fork is resolved like any other fork
+	c.antiEntropy()
+
+	winner := min(committed.ID(), conflicting.ID())
+
+	if head := c.assertConverged(); head != winner {
+		t.Fatalf("expected head %s, got %s", winner, head)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"ows/ledger"
+	"ows/network"
+)
+
+func (s *nodeState) Vote(cs *ledger.ChangeSet, proposer ledger.NodeID) error {
+	return s.votes.Vote(s.ledger().Snapshot, cs, proposer, s.clock())
+}
+
+// Only the proposer of a change set can release the votes for it.
+func (s *nodeState) ReleaseVote(cs *ledger.ChangeSet, proposer ledger.NodeID) {
+	if b, ok := s.votes.Get(cs.Prev); ok && b.ID == cs.ID() && b.Proposer == proposer {
+		s.votes.Release(cs.Prev, b.ID)
+	}
+}
+
+// Proposes the change set to all other nodes, and appends it once a majority
+// of the nodes (including the current one) has accepted it. Appending gossips
+// the change set, which commits it on the other nodes.
+func (s *nodeState) CommitChangeSet(cs *ledger.ChangeSet) error {
+	if err := s.Vote(cs, s.ID()); err != nil {
+		return err
+	}
+
+	gc := network.NewGossipClient(s.keyPair(), s)
+
+	accepted := 1 + gc.RequestVotes(cs)
+	nNodes := len(s.ledger().Snapshot.Nodes)
+
+	if !network.IsMajority(accepted, nNodes) {
+		s.votes.Release(cs.Prev, cs.ID())
+		gc.ReleaseVotes(cs)
+
+		return fmt.Errorf("only %d of %d nodes accepted the change set", accepted, nNodes)
+	}
+
+	if err := s.AppendChangeSet(cs); err != nil {
+		return err
+	}
+
+	log.Printf("committed change set %s (accepted by %d of %d nodes)\n", cs.ID(), accepted, nNodes)
+
+	return nil
+}
+
+// A change set received from another node (eg. by gossip) that conflicts with
+// the vote of the current node is only appended if a majority of the nodes
+// acknowledged it, ie. if it was committed. The vote is then released.
+func (s *nodeState) checkVote(cs *ledger.ChangeSet) error {
+	id := cs.ID()
+
+	b, ok := s.votes.Get(cs.Prev)
+	if !ok || b.ID == id {
+		return nil
+	}
+
+	acks := network.NewAPIClient(s.keyPair(), s).Acknowledgements(cs.Prev)
+
+	if !network.IsMajority(acks.Counts[id], acks.Nodes) {
+		return fmt.Errorf("change set %s conflicts with the vote for change set %s, and wasn't accepted by a majority of the nodes", id, b.ID)
+	}
+
+	s.votes.Release(cs.Prev, b.ID)
+
+	return nil
+}
+
+// Periodically resolves the votes that weren't decided in time, eg. because
+// the proposer stopped before appending the change set, or because its
+// release request was lost.
+func (s *nodeState) resolveVotes(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.resolveStaleVotes()
+	}
+}
+
+// A stale vote is appended if a majority of the nodes acknowledged its change
+// set, and released if its change set can no longer reach a majority (ie. if
+// enough nodes acknowledged other change sets). Otherwise it is kept, as the
+// change set might have been committed by nodes that are unreachable.
+func (s *nodeState) resolveStaleVotes() {
+	l := s.ledger()
+	s.votes.Decide(l.Head())
+
+	client := network.NewAPIClient(s.keyPair(), s)
+
+	for prev, b := range s.votes.Stale(s.clock()) {
+		acks := client.Acknowledgements(prev)
+		acks.Counts[b.ID] += 1
+
+		if network.IsMajority(acks.Counts[b.ID], acks.Nodes) {
+			cs, err := ledger.DecodeChangeSet(b.Encoded, l.Snapshot.Version)
+			if err != nil {
+				log.Printf("invalid change set %s in vote (%v)\n", b.ID, err)
+				continue
+			}
+
+			if err := s.AppendChangeSet(cs); err != nil {
+				log.Printf("failed to append committed change set %s (%v)\n", b.ID, err)
+				continue
+			}
+
+			log.Printf("appended change set %s, which was committed without this node\n", b.ID)
+			continue
+		}
+
+		against := 0
+
+		for id, n := range acks.Counts {
+			if id != b.ID {
+				against += n
+			}
+		}
+
+		if !network.IsMajority(acks.Nodes-against, acks.Nodes) {
+			log.Printf("released vote for change set %s, which can't reach a majority\n", b.ID)
+			s.votes.Release(prev, b.ID)
+		}
+	}
+}
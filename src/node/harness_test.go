@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"ows/ledger"
+	"ows/network"
+	"ows/resources"
+)
+
+// Time only advances when `advance()` is called. It starts far from the real
+// time, so that anything that still uses the real time fails the tests.
+type testClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// Replaces Docker. Handlers return their id and argument.
+type fakeRuntime struct {
+	mutex       sync.Mutex
+	initialized bool
+	calls       []ledger.AssetID
+}
+
+func (r *fakeRuntime) Initialize() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.initialized = true
+
+	return nil
+}
+
+func (r *fakeRuntime) isInitialized() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.initialized
+}
+
+func (r *fakeRuntime) Run(handler ledger.AssetID, arg any) (any, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.calls = append(r.calls, handler)
+
+	return map[string]any{"handler": string(handler), "arg": arg}, nil
+}
+
+// Refuses connections between partitioned nodes, see `testCluster.partition()`.
+// Connections are identified by the key of the dialing node and the address
+// of the dialed node, so that clusters of different tests don't interfere.
+type partitions struct {
+	mutex   sync.Mutex
+	refused map[string]bool
+}
+
+var testPartitions = &partitions{refused: map[string]bool{}}
+
+func init() {
+	network.DialNode = testPartitions.dial
+}
+
+func (p *partitions) dial(ctx context.Context, from ledger.PublicKey, network string, address string) (net.Conn, error) {
+	p.mutex.Lock()
+	refused := p.refused[from.String()+" "+address]
+	p.mutex.Unlock()
+
+	if refused {
+		return nil, fmt.Errorf("connection to %s refused by partition", address)
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func (p *partitions) set(from ledger.PublicKey, address string, refused bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if refused {
+		p.refused[from.String()+" "+address] = true
+	} else {
+		delete(p.refused, from.String()+" "+address)
+	}
+}
+
+// N nodes running in the test process on loopback ports. The initial config
+// is signed by the root user, and contains all the nodes.
+//
+// All nodes use the cluster clock, and change sets are timestamped with it (see
+// `newChangeSet()`). Background loops (heartbeats, anti-entropy, etc.) aren't
+// started, see `antiEntropy()`.
+type testCluster struct {
+	t        *testing.T
+	clock    *testClock
+	root     *ledger.KeyPair
+	nodes    []*nodeState
+	runtimes []*fakeRuntime
+}
+
+func newTestCluster(t *testing.T, n int) *testCluster {
+	t.Helper()
+
+	c := &testCluster{
+		t:     t,
+		clock: newTestClock(),
+		root:  randomKeyPair(t),
+	}
+
+	keyPairs := make([]*ledger.KeyPair, n)
+	actions := make([]ledger.Action, n)
+	ports := freePorts(t, 2*n)
+
+	for i := range n {
+		keyPairs[i] = randomKeyPair(t)
+
+		actions[i] = ledger.AddNode{
+			Key:        keyPairs[i].Public,
+			Address:    "127.0.0.1",
+			GossipPort: ports[2*i],
+			APIPort:    ports[2*i+1],
+		}
+	}
+
+	cs := ledger.NewInitialChangeSet(ledger.LatestLedgerVersion, actions...)
+	cs.Timestamp = c.clock.Now()
+	c.sign(cs)
+
+	l, err := ledger.NewLedger(ledger.LatestLedgerVersion, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+
+	for _, kp := range keyPairs {
+		s := newNodeState(c.clock.Now)
+		s.testDir = dir
+		s.cachedKeyPair = kp
+
+		// each node starts with its own copy of the initial ledger on disk
+		store, err := ledger.OpenStore(s.ledgerPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.Rewrite(l); err != nil {
+			t.Fatal(err)
+		}
+
+		s.openVotes()
+
+		runtime := &fakeRuntime{}
+
+		s.resources = resources.NewManager(kp, s.assetsPath(), "", 0)
+		s.resources.Runtime = runtime
+
+		c.nodes = append(c.nodes, s)
+		c.runtimes = append(c.runtimes, runtime)
+	}
+
+	for _, s := range c.nodes {
+		if err := s.resources.Sync(s.Ledger().Snapshot); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.serve(); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(s.stop)
+	}
+
+	return c
+}
+
+func randomKeyPair(t *testing.T) *ledger.KeyPair {
+	kp, err := ledger.RandomKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return kp
+}
+
+// The ports are released before they are returned, so they could be reused by
+// another process in the meantime, but that is unlikely. The listeners are
+// kept open until all the ports are known, so the ports are distinct.
+func freePorts(t *testing.T, n int) []ledger.Port {
+	ports := make([]ledger.Port, n)
+
+	for i := range n {
+		ln, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer ln.Close()
+
+		ports[i] = ledger.Port(ln.Addr().(*net.TCPAddr).Port)
+	}
+
+	return ports
+}
+
+func (c *testCluster) sign(cs *ledger.ChangeSet) {
+	sig, err := c.root.SignChangeSet(cs)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	cs.Signatures = append(cs.Signatures, sig)
+}
+
+// Returns a client for the API of node i, which authenticates using the key of
+// the signer.
+func (c *testCluster) apiClient(signer ledger.Signer, i int) *network.NodeAPIClient {
+	l := c.nodes[i].Ledger()
+	conf := l.Snapshot.Nodes[c.nodes[i].ID()]
+
+	return network.NewNodeAPIClient(signer, conf.Address, conf.APIPort, l.Snapshot.Nodes)
+}
+
+// Returns a change set on top of the head of node i, timestamped with the
+// cluster clock and signed by the root user.
+func (c *testCluster) newChangeSet(i int, actions ...ledger.Action) *ledger.ChangeSet {
+	cs := c.nodes[i].Ledger().NewChangeSet(actions...)
+	cs.Timestamp = c.clock.Now()
+	c.sign(cs)
+
+	return cs
+}
+
+// Sends a change set containing the actions to node i, like `ows` does, and
+// returns its id.
+func (c *testCluster) commit(i int, actions ...ledger.Action) ledger.ChangeSetID {
+	c.t.Helper()
+
+	cs := c.newChangeSet(i, actions...)
+
+	if _, err := c.apiClient(c.root, i).AppendChangeSet(cs); err != nil {
+		c.t.Fatalf("node %d refused change set (%v)", i, err)
+	}
+
+	return cs.ID()
+}
+
+// Nodes in different groups can no longer connect to each other. Nodes that
+// aren't part of any group are isolated.
+func (c *testCluster) partition(groups ...[]int) {
+	for i, s := range c.nodes {
+		for j, other := range c.nodes {
+			refused := i != j && !slices.ContainsFunc(groups, func(g []int) bool {
+				return slices.Contains(g, i) && slices.Contains(g, j)
+			})
+
+			conf := other.Ledger().Snapshot.Nodes[other.ID()]
+
+			for _, port := range []ledger.Port{conf.GossipPort, conf.APIPort} {
+				testPartitions.set(s.keyPair().Public, net.JoinHostPort(conf.Address, fmt.Sprint(port)), refused)
+			}
+		}
+	}
+}
+
+func (c *testCluster) heal() {
+	all := []int{}
+
+	for i := range c.nodes {
+		all = append(all, i)
+	}
+
+	c.partition(all)
+}
+
+// Runs a deterministic anti-entropy round: every node pulls from every other
+// node. Pulls between partitioned nodes fail.
+func (c *testCluster) antiEntropy() {
+	for i, s := range c.nodes {
+		client := network.NewAPIClient(s.keyPair(), s)
+
+		for j := range c.nodes {
+			if i != j {
+				client.PullFrom(c.apiClient(s.keyPair(), j))
+			}
+		}
+	}
+}
+
+func (c *testCluster) heads() []ledger.ChangeSetID {
+	heads := make([]ledger.ChangeSetID, len(c.nodes))
+
+	for i, s := range c.nodes {
+		heads[i] = s.Ledger().Head()
+	}
+
+	return heads
+}
+
+// Waits until the given nodes (or all nodes if none are given) have the same
+// head and have synced their resources with it, and returns that head.
+func (c *testCluster) assertConverged(nodes ...int) ledger.ChangeSetID {
+	c.t.Helper()
+
+	if len(nodes) == 0 {
+		for i := range c.nodes {
+			nodes = append(nodes, i)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		heads := c.heads()
+		converged := true
+
+		// the ledger is replaced before the resources are synced
+		for _, i := range nodes {
+			converged = converged && heads[i] == heads[nodes[0]] && c.nodes[i].resources.SyncedHead() == heads[i]
+		}
+
+		if converged {
+			return heads[nodes[0]]
+		}
+
+		if time.Now().After(deadline) {
+			c.t.Fatalf("nodes %v didn't converge (heads %v)", nodes, heads)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ows/ledger"
+	"ows/network"
+)
+
+// Keeps track of the node's own health, and of the health of its peers.
+type health struct {
+	clock      func() time.Time
+	start      time.Time
+	membership *network.Membership
+
+	mutex         sync.Mutex
+	lastError     string
+	lastErrorTime time.Time
+}
+
+func newHealth(clock func() time.Time) *health {
+	return &health{
+		clock:      clock,
+		start:      clock(),
+		membership: network.NewMembership(),
+	}
+}
+
+// The last error is included in the heartbeats, so that operators can see it
+// using `ows nodes status`.
+func (h *health) recordError(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.lastError = err.Error()
+	h.lastErrorTime = h.clock()
+}
+
+func (s *nodeState) AddHeartbeat(from ledger.NodeID, head ledger.ChangeSetID, hb *network.Heartbeat) {
+	s.health.membership.Update(from, head, hb, s.clock())
+}
+
+func (s *nodeState) NodesStatus() []network.PeerStatus {
+	// make sure the own status is always fresh
+	s.health.membership.Update(s.ID(), s.ledger().Head(), s.heartbeat(), s.clock())
+
+	return s.health.membership.Status(s.ledger().Snapshot.NodeIDs(), s.clock())
+}
+
+func (s *nodeState) heartbeat() *network.Heartbeat {
+	h := s.health
+	now := s.clock()
+
+	hb := &network.Heartbeat{
+		Timestamp: now.UnixMilli(),
+		Height:    uint(s.ledger().Height()),
+		Uptime:    uint64(now.Sub(h.start).Seconds()),
+		Version:   Version,
+		Load:      loadAverage(),
+	}
+
+	h.mutex.Lock()
+	if h.lastError != "" {
+		hb.LastError = h.lastError
+		hb.LastErrorTime = h.lastErrorTime.UnixMilli()
+	}
+	h.mutex.Unlock()
+
+	return hb
+}
+
+// Periodically gossips the heartbeat of this node.
+func (s *nodeState) sendHeartbeats(interval time.Duration) {
+	for range time.Tick(interval) {
+		hb := s.heartbeat()
+		l := s.ledger()
+
+		s.health.membership.Update(s.ID(), l.Head(), hb, s.clock())
+
+		kp := s.keyPair()
+		gc := network.NewGossipClient(kp, s)
+		gc.Notify(&network.Gossip{
+			NodeID:    s.ID(),
+			Head:      l.Head(),
+			Heartbeat: hb,
+		})
+	}
+}
+
+// Returns the 1-minute system load average, or 0 if it isn't available (eg.
+// on non-Linux systems).
+func loadAverage() float64 {
+	bs, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+
+	fields := strings.Fields(string(bs))
+	if len(fields) == 0 {
+		return 0
+	}
+
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		log.Printf("invalid /proc/loadavg content (%v)\n", err)
+		return 0
+	}
+
+	return load
+}
@@ -6,10 +6,11 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 
-	"ows/ledger"
+	"ows/metrics"
 	"ows/network"
 	"ows/resources"
 )
@@ -18,7 +19,7 @@ const keyPath = "/etc/ows/key"
 
 var (
 	Version        = "dev" // set externally
-	state          = &nodeState{}
+	state          = newNodeState(time.Now)
 	testPortOffset = 0
 )
 
@@ -56,42 +57,41 @@ func handleStartNode(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	// Get own node config
 	kp := state.keyPair()
 	l := state.ledger()
-	id := kp.Public.NodeID()
+	state.openVotes()
 
-	// Set resource object
 	log.Printf("starting OWS node for %s\n", l.ProjectID())
-	state.resources = resources.NewManager(kp, state.assetsPath(), testPortOffset)
-	state.resources.Sync(l.Snapshot)
-
-	// Sync from other nodes (if other nodes are available)
-	otherNodes := make([]ledger.NodeID, 0)
-
-	for otherID, _ := range l.Snapshot.Nodes {
-		if otherID != id {
-			otherNodes = append(otherNodes, otherID)
-		}
+	state.resources = resources.NewManager(kp, state.assetsPath(), state.appLogPath(), testPortOffset)
+	if err := state.resources.Sync(l.Snapshot); err != nil {
+		log.Printf("failed to sync resources (%v)\n", err)
+		state.health.recordError(err)
 	}
 
-	if len(otherNodes) >= 1 {
+	// Sync from other nodes (if other nodes are available). Syncing might
+	// replace the ledger (see `nodeState.RestoreCheckpoint()`), or rotate the
+	// node key.
+	if len(l.Snapshot.Nodes) > 1 {
 		c := network.NewAPIClient(kp, state)
-		if err := c.Sync(); err != nil {
+		if err := c.Pull(); err != nil {
 			panic(fmt.Sprintf("failed to sync upon startup (%v)", err))
 		}
 	}
 
-	conf, ok := l.Snapshot.Nodes[id]
-	if !ok {
-		panic(fmt.Sprintf("own node id %s not found in synced ledger", id))
+	if err := state.serve(); err != nil {
+		panic(err)
 	}
 
-	go network.ServeAPI(conf.APIPort, kp, state)
-	log.Printf("hosting node API at https://%s:%d\n", conf.Address, conf.APIPort)
+	go state.shareRateLimitUsage(resources.RateLimitUsageInterval)
+
+	go state.collectAttestations(CheckpointAttestationInterval)
+
+	go state.sendHeartbeats(network.HeartbeatInterval)
+	go state.resolveVotes(network.VoteTimeout)
+	go network.NewAPIClient(kp, state).RunAntiEntropy(network.AntiEntropyInterval, network.MaxAntiEntropyBackoff)
 
-	go network.ServeGossip(conf.GossipPort, kp, state)
-	log.Printf("hosting gossip service at https://%s:%d\n", conf.Address, conf.GossipPort)
+	state.registerMetrics(metrics.Default)
+	state.syncMetrics()
 
 	quitChannel := make(chan os.Signal, 1)
 	signal.Notify(quitChannel, syscall.SIGINT, syscall.SIGTERM)
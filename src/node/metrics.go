@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"ows/ledger"
+	"ows/metrics"
+	"ows/network"
+)
+
+// Registers the node-level metrics, which are computed on each scrape.
+func (s *nodeState) registerMetrics(r *metrics.Registry) {
+	var (
+		ledgerHeight = r.NewGauge("ows_ledger_height", "Number of change sets in the ledger, including the initial configuration")
+		ledgerHead   = r.NewGauge("ows_ledger_head_info", "Id of the latest change set in the ledger", "head")
+		assets       = r.NewGauge("ows_assets", "Number of assets stored by this node")
+		assetsBytes  = r.NewGauge("ows_assets_bytes", "Total size of the assets stored by this node")
+	)
+
+	r.RegisterRuntimeMetrics()
+
+	r.OnCollect(func() {
+		l := s.ledger()
+
+		ledgerHeight.With().Set(float64(l.Height()))
+
+		ledgerHead.Reset()
+		ledgerHead.With(string(l.Head())).Set(1)
+
+		ids := s.resources.ListAssets()
+		size := int64(0)
+
+		for _, id := range ids {
+			if info, err := os.Stat(path.Join(s.assetsPath(), string(id))); err == nil {
+				size += info.Size()
+			}
+		}
+
+		assets.With().Set(float64(len(ids)))
+		assetsBytes.With().Set(float64(size))
+	})
+}
+
+// Starts, moves or stops the metrics server according to the ledger.
+func (s *nodeState) syncMetrics() {
+	s.metricsMutex.Lock()
+	defer s.metricsMutex.Unlock()
+
+	port := ledger.Port(0)
+	if conf := s.ledger().Snapshot.Metrics; conf != nil {
+		port = conf.Port
+	}
+
+	if port == s.metricsPort {
+		return
+	}
+
+	if s.metricsServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := s.metricsServer.Shutdown(ctx); err != nil {
+			log.Printf("failed to stop metrics server on port %d (%v)\n", s.metricsPort, err)
+		}
+
+		log.Printf("stopped metrics server on port %d\n", s.metricsPort)
+
+		s.metricsServer = nil
+		s.metricsPort = 0
+	}
+
+	if port == 0 {
+		return
+	}
+
+	server, err := network.ServeMetrics(port, s.keyPair(), s, metrics.Default)
+	if err != nil {
+		log.Printf("failed to start metrics server (%v)\n", err)
+		s.health.recordError(err)
+		return
+	}
+
+	s.metricsServer = server
+	s.metricsPort = port
+
+	log.Printf("hosting metrics at https://:%d/metrics\n", port)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"ows/network"
+)
+
+func (s *nodeState) Orphans() []network.OrphanedChangeSet {
+	return s.orphans.List()
+}
+
+// Logs and remembers change sets that were rolled back.
+func (s *nodeState) recordOrphans(orphans []network.OrphanedChangeSet) {
+	for _, o := range orphans {
+		signers := make([]string, len(o.Signers))
+		for i, id := range o.Signers {
+			signers[i] = string(id)
+		}
+
+		log.Printf("orphaned change set %s (index %d, signed by %s)\n", o.ID, o.Index, strings.Join(signers, ", "))
+	}
+
+	s.orphans.Add(orphans)
+}
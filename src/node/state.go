@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"path"
+	"slices"
+	"sync"
+	"time"
 
 	"ows/ledger"
 	"ows/network"
@@ -13,26 +18,134 @@ import (
 )
 
 const (
-	AppDirName           = "ows"
-	AssetsDirName        = "assets"
-	DefaultConfigDirName = "/etc"
-	DefaultDataDirName   = "/var/lib"
-	DefaultLogDirName    = "/var/log"
-	KeyPairFileName      = "key"
-	LedgerFileName       = "ledger"
-	TestLogDirName       = "log"
+	AppDirName                  = "ows"
+	AssetsDirName               = "assets"
+	CredentialsDirEnvName       = "CREDENTIALS_DIRECTORY"
+	DefaultConfigDirName        = "/etc"
+	DefaultDataDirName          = "/var/lib"
+	DefaultLogDirName           = "/var/log"
+	KeyPairFileName             = "key"
+	KeyPassphraseCredentialName = "ows-key-passphrase"
+	LedgerFileName              = "ledger"
+	TestLogDirName              = "log"
+	VotesFileName               = "votes"
 )
 
 type nodeState struct {
 	testDir string
+	clock   func() time.Time
 
 	cachedKeyPair *ledger.KeyPair
-	cachedLedger  *ledger.Ledger
+
+	// The ledger is read by the API and gossip handlers without locking, so
+	// it is never modified in place: updates are applied to a copy, which
+	// then replaces cachedLedger (see `setLedger()`). Updates of the ledger
+	// and of the store are serialized by updateMutex.
+	ledgerMutex  sync.RWMutex
+	updateMutex  sync.Mutex
+	cachedLedger *ledger.Ledger
+	store        *ledger.Store
 
 	resources *resources.Manager
+	health    *health
+	orphans   network.Orphans
+	votes     *network.Votes // see `openVotes()`
+
+	metricsMutex  sync.Mutex
+	metricsServer *http.Server
+	metricsPort   ledger.Port
+
+	apiServer    *http.Server
+	gossipServer *http.Server
+}
+
+// The clock is injectable so that time-dependent behavior (eg. heartbeats and
+// votes) can be tested.
+func newNodeState(clock func() time.Time) *nodeState {
+	return &nodeState{
+		clock:  clock,
+		health: newHealth(clock),
+	}
+}
+
+// Starts serving the node API and the gossip service, using the ports of the
+// node in the ledger.
+func (s *nodeState) serve() error {
+	kp := s.keyPair()
+	id := s.ID()
+
+	conf, ok := s.ledger().Snapshot.Nodes[id]
+	if !ok {
+		return fmt.Errorf("own node id %s not found in ledger", id)
+	}
+
+	apiServer, err := network.ServeAPI(conf.APIPort, kp, s)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("hosting node API at https://%s\n", ledger.JoinHostPort(conf.Address, conf.APIPort))
+
+	gossipServer, err := network.ServeGossip(conf.GossipPort, kp, s)
+	if err != nil {
+		apiServer.Close()
+		return err
+	}
+
+	log.Printf("hosting gossip service at https://%s\n", ledger.JoinHostPort(conf.Address, conf.GossipPort))
+
+	s.apiServer = apiServer
+	s.gossipServer = gossipServer
+
+	return nil
 }
 
+// Stops the node API and the gossip service.
+func (s *nodeState) stop() {
+	for _, server := range []*http.Server{s.apiServer, s.gossipServer} {
+		if server != nil {
+			server.Close()
+		}
+	}
+
+	s.apiServer = nil
+	s.gossipServer = nil
+}
+
+func (s *nodeState) Now() time.Time {
+	return s.clock()
+}
+
+func (s *nodeState) Acknowledged(prev ledger.ChangeSetID) ledger.ChangeSetID {
+	ids := s.ledger().IDChain().IDs
+
+	if i := slices.Index(ids, prev); i >= 0 && i+1 < len(ids) {
+		return ids[i+1]
+	}
+
+	if b, ok := s.votes.Get(prev); ok {
+		return b.ID
+	}
+
+	return ""
+}
+
+func (s *nodeState) GatewayStats(id ledger.GatewayID) (*network.GatewayStats, error) {
+	return s.resources.GatewayStats(id)
+}
+
+func (s *nodeState) AddRateLimitUsage(_ ledger.NodeID, usage []network.RateLimitUsage) {
+	s.resources.AddRateLimitUsage(usage)
+}
+
+// Assets uploaded by clients are stored on the nodes closest to the asset id.
+// Assets uploaded by other nodes are only stored locally, otherwise they would
+// be forwarded back and forth.
 func (s *nodeState) AddAsset(bs []byte, isFromNode bool) (ledger.AssetID, error) {
+	if isFromNode {
+		return s.resources.AddAsset(bs)
+	}
+
 	assetID := ledger.GenerateAssetID(bs)
 
 	closestNodes := network.ClosestNodes(s.Ledger().Snapshot.NodeIDs(), string(assetID), 3)
@@ -40,7 +153,7 @@ func (s *nodeState) AddAsset(bs []byte, isFromNode bool) (ledger.AssetID, error)
 	for _, nodeID := range closestNodes {
 		if nodeID == s.ID() {
 			if _, err := s.resources.AddAsset(bs); err != nil {
-				log.Println("failed to add asset localy (%v)", err)
+				log.Printf("failed to add asset localy (%v)\n", err)
 			}
 		} else {
 			c, err := s.newNodeAPIClient(nodeID)
@@ -61,27 +174,26 @@ func (s *nodeState) GetAsset(id ledger.AssetID) ([]byte, error) {
 	return s.resources.GetAsset(id)
 }
 
-// Append the change set to the ledger, then write the ledger to disk, and
-// finally sync the resources.
+// Append the change set to the ledger, then append it to the store on disk,
+// sync the resources, and finally gossip the change set.
 func (s *nodeState) AppendChangeSet(cs *ledger.ChangeSet) error {
-	l := s.ledger()
-
-	if err := l.Append(cs); err != nil {
-		return err
-	}
-
-	if err := l.Write(s.ledgerPath()); err != nil {
+	// acknowledgements are requested from the other nodes, so the update lock
+	// can't be held
+	if err := s.checkVote(cs); err != nil {
 		return err
 	}
 
-	if err := s.resources.Sync(l.Snapshot); err != nil {
+	l, err := s.appendChangeSet(cs)
+	if err != nil {
 		return err
 	}
 
+	// gossiping can take a while, and the other nodes can gossip back, so
+	// the update lock isn't held
 	kp := s.keyPair()
 	gc := network.NewGossipClient(kp, s)
 	gc.Notify(&network.Gossip{
-		NodeID:  kp.Public.NodeID(),
+		NodeID:  s.ID(),
 		Head:    l.Head(),
 		Changes: []ledger.ChangeSet{*cs},
 	})
@@ -89,8 +201,47 @@ func (s *nodeState) AppendChangeSet(cs *ledger.ChangeSet) error {
 	return nil
 }
 
+func (s *nodeState) appendChangeSet(cs *ledger.ChangeSet) (*ledger.Ledger, error) {
+	s.updateMutex.Lock()
+	defer s.updateMutex.Unlock()
+
+	l := s.ledger().Copy()
+
+	if err := l.Append(cs); err != nil {
+		return nil, err
+	}
+
+	// the in-memory ledger mustn't get ahead of the ledger on disk
+	if err := s.store.Append(cs); err != nil {
+		return nil, err
+	}
+
+	if err := s.createCheckpoint(l); err != nil {
+		log.Printf("failed to create checkpoint (%v)\n", err)
+	}
+
+	s.setLedger(l)
+
+	if err := s.resources.Sync(l.Snapshot); err != nil {
+		s.health.recordError(err)
+		return nil, err
+	}
+
+	s.syncMetrics()
+
+	return l, nil
+}
+
+// The id of a node is derived from its original key, so it can't be derived
+// from the current key once the key has been rotated.
 func (s *nodeState) ID() ledger.NodeID {
-	return s.keyPair().Public.NodeID()
+	key := s.keyPair().Public
+
+	if id, ok := s.ledger().Snapshot.FindNode(key); ok {
+		return id
+	}
+
+	return key.NodeID()
 }
 
 func (s *nodeState) Ledger() *ledger.Ledger {
@@ -101,16 +252,49 @@ func (s *nodeState) ListAssets() []ledger.AssetID {
 	return s.resources.ListAssets()
 }
 
-func (s *nodeState) OwnKeyPair() *ledger.KeyPair {
+func (s *nodeState) OwnSigner() ledger.Signer {
 	return s.keyPair()
 }
 
 func (s *nodeState) Rollback(p int) error {
-	l := s.ledger()
+	s.updateMutex.Lock()
+	defer s.updateMutex.Unlock()
+
+	l := s.ledger().Copy()
+
+	orphans := network.NewOrphanedChangeSets(l, p, s.ID(), s.clock())
+
+	if err := l.Keep(p); err != nil {
+		return err
+	}
+
+	if err := s.store.Truncate(l); err != nil {
+		return err
+	}
 
-	l.Keep(p)
+	s.setLedger(l)
+	s.recordOrphans(orphans)
 
-	return l.Write(s.ledgerPath())
+	return nil
+}
+
+// Periodically gossips the local consumption of cluster-wide rate limits and
+// quotas directly to the other nodes, so they can take it into account.
+func (s *nodeState) shareRateLimitUsage(interval time.Duration) {
+	for range time.Tick(interval) {
+		usage := s.resources.TakeRateLimitUsage()
+		if len(usage) == 0 {
+			continue
+		}
+
+		kp := s.keyPair()
+		gc := network.NewGossipClient(kp, s)
+		gc.NotifyAll(&network.Gossip{
+			NodeID: s.ID(),
+			Head:   s.ledger().Head(),
+			Usage:  usage,
+		})
+	}
 }
 
 func (s *nodeState) appConfigPath() string {
@@ -145,14 +329,13 @@ func (s *nodeState) ledgerPath() string {
 	return path.Join(s.appDataPath(), LedgerFileName)
 }
 
+func (s *nodeState) votesPath() string {
+	return path.Join(s.appDataPath(), VotesFileName)
+}
+
 func (s *nodeState) systemConfigPath() string {
 	if s.testDir != "" {
-		kp, exists := ledger.EnvKeyPair()
-		if !exists {
-			panic(fmt.Sprintf("%s not set (must be set when --test-dir is set)", ledger.PrivateKeyEnvName))
-		}
-
-		nodeID := kp.Public.NodeID()
+		nodeID := s.keyPair().Public.NodeID()
 
 		return path.Join(s.testDir, string(nodeID))
 	} else {
@@ -183,19 +366,28 @@ func (s *nodeState) keyPair() *ledger.KeyPair {
 		return s.cachedKeyPair
 	}
 
-	p := s.keyPairPath()
 	kp, existsInEnv := ledger.EnvKeyPair()
 
 	if s.testDir != "" {
 		if !existsInEnv {
 			panic(fmt.Sprintf("%s not set (must be set when --test-dir is set)", ledger.PrivateKeyEnvName))
 		}
-	} else if !existsInEnv {
+
+		// the key path depends on the key in test mode, so the key isn't
+		// written to disk
+		s.cachedKeyPair = kp
+
+		return kp
+	}
+
+	p := s.keyPairPath()
+
+	if !existsInEnv {
 		var err error
-		kp, err = ledger.ReadKeyPair(p)
+		kp, err = ledger.ReadKeyPair(p, keyPassphrase)
 		if err != nil {
 			if errors.Is(err, os.ErrNotExist) {
-				panic(fmt.Sprintf("node key not found at %s"))
+				panic(fmt.Sprintf("node key not found at %s", p))
 			} else {
 				panic(err)
 			}
@@ -204,7 +396,10 @@ func (s *nodeState) keyPair() *ledger.KeyPair {
 		// write key to disk if it isn't available
 		if _, err := os.Stat(p); err != nil {
 			if errors.Is(err, os.ErrNotExist) {
-				if err := kp.Write(p); err != nil {
+				// encrypt the key if a passphrase is configured
+				pp, _ := keyPassphrase()
+
+				if err := kp.WriteEncrypted(p, pp); err != nil {
 					panic(fmt.Sprintf("unable to write key to %s (%v)", p, err))
 				}
 			} else {
@@ -218,44 +413,104 @@ func (s *nodeState) keyPair() *ledger.KeyPair {
 	return kp
 }
 
+// The passphrase of an encrypted node key is read from OWS_KEY_PASSPHRASE, or
+// from the ows-key-passphrase systemd credential (eg. set using
+// `LoadCredentialEncrypted=ows-key-passphrase:<path>` in the unit file).
+func keyPassphrase() ([]byte, error) {
+	if pp, exists := ledger.EnvKeyPassphrase(); exists {
+		return pp, nil
+	}
+
+	if d, exists := os.LookupEnv(CredentialsDirEnvName); exists {
+		bs, err := os.ReadFile(path.Join(d, KeyPassphraseCredentialName))
+		if err == nil {
+			return bytes.TrimRight(bs, "\r\n"), nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("unable to read %s credential (%v)", KeyPassphraseCredentialName, err)
+		}
+	}
+
+	return nil, fmt.Errorf("node key is encrypted, but neither %s nor the %s credential is set", ledger.KeyPassphraseEnvName, KeyPassphraseCredentialName)
+}
+
+// Opens the ledger store, which migrates a ledger written using the older
+// single-file format. The store is initialized using the env ledger if it is
+// empty.
+//
+// The returned ledger mustn't be modified, see `nodeState.cachedLedger`.
 func (s *nodeState) ledger() *ledger.Ledger {
+	s.ledgerMutex.RLock()
+	l := s.cachedLedger
+	s.ledgerMutex.RUnlock()
+
+	if l != nil {
+		return l
+	}
+
+	s.ledgerMutex.Lock()
+	defer s.ledgerMutex.Unlock()
+
 	if s.cachedLedger != nil {
 		return s.cachedLedger
 	}
 
+	p := s.ledgerPath()
+
+	store, err := ledger.OpenStore(p)
+	if err != nil {
+		panic(fmt.Sprintf("unable to open ledger store (%v)", err))
+	}
+
 	l, existsInEnv := ledger.EnvLedger()
 
-	if !existsInEnv {
-		lDisk, err := ledger.ReadLedger(s.ledgerPath())
+	if store.IsEmpty() {
+		if !existsInEnv {
+			panic(fmt.Sprintf("unable to read ledger, %s is empty", p))
+		}
+
+		if err := store.Rewrite(l); err != nil {
+			panic(err)
+		}
+	} else {
+		lDisk, err := store.Ledger()
 		if err != nil {
 			panic(fmt.Sprintf("unable to read ledger (%v)", err))
-		} else {
-			l = lDisk
 		}
-	} else {
-		p := s.ledgerPath()
 
-		lDisk, err := ledger.ReadLedger(p)
-		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				if err := l.Write(p); err != nil {
-					panic(err)
-				}
-			} else {
-				panic(err)
-			}
-		} else if lDisk.ProjectID() != l.ProjectID() {
+		if existsInEnv && lDisk.ProjectID() != l.ProjectID() {
 			panic(fmt.Sprintf("project id of ledger at %s (%s) doesn't correspond to env (%s)", p, lDisk.ProjectID(), l.ProjectID()))
-		} else {
-			l = lDisk
 		}
+
+		l = lDisk
 	}
 
+	s.store = store
 	s.cachedLedger = l
 
 	return l
 }
 
+// Must be called while holding updateMutex. Votes that no longer follow the
+// head are decided.
+func (s *nodeState) setLedger(l *ledger.Ledger) {
+	s.ledgerMutex.Lock()
+	s.cachedLedger = l
+	s.ledgerMutex.Unlock()
+
+	s.votes.Decide(l.Head())
+}
+
+// Reads the votes persisted by a previous run of the node, see
+// `network.Votes`.
+func (s *nodeState) openVotes() {
+	votes, err := network.OpenVotes(s.votesPath())
+	if err != nil {
+		panic(fmt.Sprintf("unable to read votes (%v)", err))
+	}
+
+	s.votes = votes
+}
+
 func (s *nodeState) newNodeAPIClient(nodeID ledger.NodeID) (*network.NodeAPIClient, error) {
 	allNodes := s.ledger().Snapshot.Nodes
 
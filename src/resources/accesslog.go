@@ -0,0 +1,324 @@
+package resources
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"ows/ledger"
+	"ows/network"
+)
+
+const (
+	AccessLogFileName = "access.log"
+	StatsFileName     = "stats.json"
+
+	// The access log is rotated once it exceeds this size. Only a single
+	// rotated file is kept.
+	maxAccessLogSize = 64 << 20
+
+	// Interval at which the gateway stats are written to disk
+	statsFlushInterval = 10 * time.Second
+)
+
+// A single line of a gateway access log
+type accessLogEntry struct {
+	Time       time.Time         `json:"time"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Status     int               `json:"status"`
+	LatencyMs  float64           `json:"latencyMs"`
+	Bytes      int               `json:"bytes"`
+	FunctionID ledger.FunctionID `json:"functionId,omitempty"`
+	RemoteIP   string            `json:"remoteIp"`
+}
+
+// Writes the access log and keeps the per-endpoint stats of a gateway. Both
+// are stored in the log directory of the gateway:
+//   - <logs-dir>/<gateway-id>/access.log
+//   - <logs-dir>/<gateway-id>/stats.json
+type gatewayLogs struct {
+	dir     string
+	maxSize int64 // see `maxAccessLogSize`
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+	stats map[string]*network.EndpointStats // keyed by "<method> <path>"
+	dirty bool
+
+	done chan struct{}
+}
+
+func newGatewayLogs(logsDir string, id ledger.GatewayID) (*gatewayLogs, error) {
+	dir := path.Join(logsDir, string(id))
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create gateway log directory %s (%v)", dir, err)
+	}
+
+	l := &gatewayLogs{
+		dir:     dir,
+		maxSize: maxAccessLogSize,
+		stats:   map[string]*network.EndpointStats{},
+		done:    make(chan struct{}),
+	}
+
+	if err := l.openAccessLog(); err != nil {
+		return nil, err
+	}
+
+	// stats survive restarts
+	if bs, err := os.ReadFile(path.Join(dir, StatsFileName)); err == nil {
+		stats := &network.GatewayStats{}
+
+		if err := json.Unmarshal(bs, stats); err != nil {
+			log.Printf("ignoring invalid gateway stats in %s (%v)\n", dir, err)
+		} else {
+			for _, e := range stats.Endpoints {
+				l.endpointStats(e.Method, e.Path).Merge(e)
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read gateway stats (%v)", err)
+	}
+
+	go l.flushPeriodically()
+
+	return l, nil
+}
+
+func (l *gatewayLogs) openAccessLog() error {
+	p := path.Join(l.dir, AccessLogFileName)
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open access log %s (%v)", p, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to open access log %s (%v)", p, err)
+	}
+
+	l.file = f
+	l.size = info.Size()
+
+	return nil
+}
+
+// Must be called while holding the mutex
+func (l *gatewayLogs) rotate() error {
+	p := path.Join(l.dir, AccessLogFileName)
+
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(p, p+".1"); err != nil {
+		return err
+	}
+
+	return l.openAccessLog()
+}
+
+// Must be called while holding the mutex
+func (l *gatewayLogs) endpointStats(method string, path string) *network.EndpointStats {
+	key := method + " " + path
+
+	s, ok := l.stats[key]
+	if !ok {
+		e := network.NewEndpointStats(method, path)
+		s = &e
+		l.stats[key] = s
+	}
+
+	return s
+}
+
+// Endpoint is nil if the request didn't match any endpoint.
+func (l *gatewayLogs) record(r *http.Request, w *responseRecorder, endpoint *GatewayEndpoint, start time.Time) {
+	latencyMs := float64(time.Since(start).Microseconds()) / 1000
+
+	entry := accessLogEntry{
+		Time:      start.UTC(),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    w.status,
+		LatencyMs: latencyMs,
+		Bytes:     w.bytes,
+		RemoteIP:  remoteIP(r),
+	}
+
+	method, path := "", ""
+	if endpoint != nil {
+		entry.FunctionID = endpoint.Config.FunctionID
+		method, path = endpoint.Config.Method, endpoint.Config.Path
+	}
+
+	bs, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("failed to encode access log entry (%v)\n", err)
+		return
+	}
+
+	bs = append(bs, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.endpointStats(method, path).Add(w.status, w.bytes, latencyMs)
+	l.dirty = true
+
+	if l.file == nil {
+		return
+	}
+
+	if l.size > 0 && l.size+int64(len(bs)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Printf("failed to rotate access log in %s (%v)\n", l.dir, err)
+		}
+	}
+
+	n, err := l.file.Write(bs)
+	l.size += int64(n)
+
+	if err != nil {
+		log.Printf("failed to write access log in %s (%v)\n", l.dir, err)
+	}
+}
+
+func (l *gatewayLogs) Stats(id ledger.GatewayID) *network.GatewayStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.snapshot(id)
+}
+
+// Must be called while holding the mutex
+func (l *gatewayLogs) snapshot(id ledger.GatewayID) *network.GatewayStats {
+	stats := &network.GatewayStats{
+		GatewayID: id,
+		Endpoints: make([]network.EndpointStats, 0, len(l.stats)),
+	}
+
+	for _, s := range l.stats {
+		e := network.NewEndpointStats(s.Method, s.Path)
+		e.Merge(*s)
+		stats.Endpoints = append(stats.Endpoints, e)
+	}
+
+	return stats
+}
+
+func (l *gatewayLogs) flush() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.dirty {
+		return nil
+	}
+
+	bs, err := json.Marshal(l.snapshot(""))
+	if err != nil {
+		return err
+	}
+
+	if err := ledger.OverwriteSafe(path.Join(l.dir, StatsFileName), bs); err != nil {
+		return err
+	}
+
+	l.dirty = false
+
+	return nil
+}
+
+func (l *gatewayLogs) flushPeriodically() {
+	ticker := time.NewTicker(statsFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.flush(); err != nil {
+				log.Printf("failed to write gateway stats in %s (%v)\n", l.dir, err)
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *gatewayLogs) close() error {
+	close(l.done)
+
+	err := l.flush()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file != nil {
+		if closeErr := l.file.Close(); err == nil {
+			err = closeErr
+		}
+
+		l.file = nil
+	}
+
+	return err
+}
+
+// Captures the status and the size of the response, for the access log
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(bs []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(bs)
+	w.bytes += n
+
+	return n, err
+}
+
+// The direct peer address is used. X-Forwarded-For headers are ignored
+// because they can be set by any caller.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// Returns the stats of a gateway on this node.
+func (m *Manager) GatewayStats(id ledger.GatewayID) (*network.GatewayStats, error) {
+	m.mutex.RLock()
+	g, ok := m.Gateways[id]
+	m.mutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("gateway %s not found", id)
+	}
+
+	if g.Handler.logs == nil {
+		return &network.GatewayStats{GatewayID: id, Endpoints: []network.EndpointStats{}}, nil
+	}
+
+	return g.Handler.logs.Stats(id), nil
+}
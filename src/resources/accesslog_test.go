@@ -0,0 +1,197 @@
+package resources
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"ows/ledger"
+)
+
+func newTestGatewayLogs(t *testing.T, dir string) *gatewayLogs {
+	t.Helper()
+
+	l, err := newGatewayLogs(dir, "gateway1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return l
+}
+
+func recordTestRequest(l *gatewayLogs, method string, target string, status int, body string, endpoint *GatewayEndpoint) {
+	r := httptest.NewRequest(method, target, nil)
+	r.RemoteAddr = "192.0.2.1:51234"
+
+	w := &responseRecorder{ResponseWriter: httptest.NewRecorder(), status: 200}
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+
+	l.record(r, w, endpoint, time.Now())
+}
+
+func readAccessLog(t *testing.T, p string) []map[string]any {
+	t.Helper()
+
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	lines := []map[string]any{}
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := map[string]any{}
+
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid access log line %q (%v)", scanner.Text(), err)
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	dir := t.TempDir()
+	l := newTestGatewayLogs(t, dir)
+	defer l.close()
+
+	endpoint := &GatewayEndpoint{Config: ledger.GatewayEndpointConfig{Method: "GET", Path: "/hello", FunctionID: "function1"}}
+
+	recordTestRequest(l, "GET", "/hello?name=x", 201, "hello", endpoint)
+	recordTestRequest(l, "POST", "/unknown", 404, "", nil)
+
+	lines := readAccessLog(t, path.Join(dir, "gateway1", AccessLogFileName))
+
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 access log lines, got %d", len(lines))
+	}
+
+	keys := []string{"time", "method", "path", "status", "latencyMs", "bytes", "functionId", "remoteIp"}
+
+	for _, k := range keys {
+		if _, ok := lines[0][k]; !ok {
+			t.Fatalf("access log line %v doesn't contain %s", lines[0], k)
+		}
+	}
+
+	if len(lines[0]) != len(keys) {
+		t.Fatalf("unexpected access log keys %v", lines[0])
+	}
+
+	// the query isn't logged
+	if lines[0]["method"] != "GET" || lines[0]["path"] != "/hello" || lines[0]["status"] != 201.0 || lines[0]["bytes"] != 5.0 || lines[0]["functionId"] != "function1" || lines[0]["remoteIp"] != "192.0.2.1" {
+		t.Fatalf("unexpected access log line %v", lines[0])
+	}
+
+	if _, err := time.Parse(time.RFC3339Nano, lines[0]["time"].(string)); err != nil {
+		t.Fatalf("invalid time in access log (%v)", err)
+	}
+
+	if _, ok := lines[1]["functionId"]; ok || lines[1]["status"] != 404.0 {
+		t.Fatalf("unexpected access log line of unmatched request %v", lines[1])
+	}
+
+	// unmatched requests are counted with an empty method and path
+	counts := map[string]uint64{}
+
+	for _, e := range l.Stats("gateway1").Endpoints {
+		counts[e.Method+" "+e.Path] = e.Requests
+	}
+
+	if expected := map[string]uint64{"GET /hello": 1, " ": 1}; !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("expected requests %v, got %v", expected, counts)
+	}
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	l := newTestGatewayLogs(t, dir)
+	defer l.close()
+
+	p := path.Join(dir, "gateway1", AccessLogFileName)
+
+	recordTestRequest(l, "GET", "/a", 200, "", nil)
+
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// room for two lines, lines differ in length by a few bytes (eg. the
+	// latency)
+	l.mutex.Lock()
+	l.maxSize = info.Size() * 5 / 2
+	l.mutex.Unlock()
+
+	recordTestRequest(l, "GET", "/b", 200, "", nil)
+	recordTestRequest(l, "GET", "/c", 200, "", nil)
+	recordTestRequest(l, "GET", "/d", 200, "", nil)
+	recordTestRequest(l, "GET", "/e", 200, "", nil)
+
+	paths := func(lines []map[string]any) []any {
+		ps := []any{}
+
+		for _, line := range lines {
+			ps = append(ps, line["path"])
+		}
+
+		return ps
+	}
+
+	// only a single rotated file is kept
+	if ps := paths(readAccessLog(t, p+".1")); !reflect.DeepEqual(ps, []any{"/c", "/d"}) {
+		t.Fatalf("unexpected rotated access log %v", ps)
+	}
+
+	if ps := paths(readAccessLog(t, p)); !reflect.DeepEqual(ps, []any{"/e"}) {
+		t.Fatalf("unexpected access log %v", ps)
+	}
+
+	if _, err := os.Stat(p + ".2"); !os.IsNotExist(err) {
+		t.Fatalf("more than one rotated access log (%v)", err)
+	}
+}
+
+// Closing writes the stats, which are restored when the gateway is added
+// again.
+func TestAccessLogClose(t *testing.T) {
+	dir := t.TempDir()
+	l := newTestGatewayLogs(t, dir)
+
+	recordTestRequest(l, "GET", "/a", 200, "abc", nil)
+
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "gateway1", StatsFileName)); err != nil {
+		t.Fatalf("stats weren't written (%v)", err)
+	}
+
+	// requests that are still being served after closing are only counted
+	recordTestRequest(l, "GET", "/a", 200, "", nil)
+
+	if lines := readAccessLog(t, path.Join(dir, "gateway1", AccessLogFileName)); len(lines) != 1 {
+		t.Fatalf("expected 1 access log line, got %d", len(lines))
+	}
+
+	reopened := newTestGatewayLogs(t, dir)
+	defer reopened.close()
+
+	stats := reopened.Stats("gateway1")
+
+	if len(stats.Endpoints) != 1 || stats.Endpoints[0].Requests != 1 || stats.Endpoints[0].Bytes != 3 {
+		t.Fatalf("stats weren't restored %+v", stats)
+	}
+}
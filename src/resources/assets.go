@@ -49,7 +49,7 @@ func GetAsset(assetsDir string, id ledger.AssetID) ([]byte, error) {
 	bs, err := os.ReadFile(p)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			log.Printf("asset %s not found locally at %p\n", id, p)
+			log.Printf("asset %s not found locally at %s\n", id, p)
 		}
 		return nil, err
 	}
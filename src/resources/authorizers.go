@@ -0,0 +1,619 @@
+package resources
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ows/ledger"
+)
+
+// Request headers used by the gateway endpoint authorizers.
+const (
+	APIKeyHeader       = "X-Api-Key"
+	OWSKeyHeader       = "X-Ows-Key"
+	OWSNonceHeader     = "X-Ows-Nonce"
+	OWSSignatureHeader = "X-Ows-Signature"
+	OWSTimestampHeader = "X-Ows-Timestamp"
+)
+
+const (
+	// Requests signed with an OWS key are rejected if their timestamp differs
+	// more than this from the node clock (limits replay attacks).
+	MaxRequestSignatureAge = 5 * time.Minute
+
+	// Length limits of the X-Ows-Nonce header.
+	MinRequestNonceLength = 16
+	MaxRequestNonceLength = 64
+
+	jwksCacheTTL       = 10 * time.Minute
+	jwksRetryInterval  = 30 * time.Second
+	jwksFetchTimeout   = 5 * time.Second
+	maxSignedBodySize  = 10 << 20
+	nonceSweepInterval = time.Minute
+)
+
+// Returned by the authorizers, so that the gateway handler can respond with the
+// correct status code.
+type authError struct {
+	status  int
+	message string
+}
+
+func (e *authError) Error() string {
+	return e.message
+}
+
+func unauthorized(format string, args ...any) error {
+	return &authError{http.StatusUnauthorized, fmt.Sprintf(format, args...)}
+}
+
+func forbidden(format string, args ...any) error {
+	return &authError{http.StatusForbidden, fmt.Sprintf(format, args...)}
+}
+
+// The message signed by a client that invokes an endpoint protected by an
+// "ows-key" authorizer. The request URI is the escaped path followed by the
+// query (if any), and the body is included as its blake2b-128 digest.
+//
+// The resulting signature is sent base64 encoded in the X-Ows-Signature
+// header, the unix timestamp (in seconds) in the X-Ows-Timestamp header, the
+// random nonce in the X-Ows-Nonce header, and the hex encoded public key in
+// the X-Ows-Key header. Each nonce can only be used once per node.
+func GatewayRequestMessage(gatewayID ledger.GatewayID, method string, requestURI string, timestamp int64, nonce string, body []byte) []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n%s\n%d\n%s\n%x", gatewayID, method, requestURI, timestamp, nonce, ledger.DigestShort(body)))
+}
+
+// Returns nil if the request is allowed to invoke the endpoint. Returns an
+// *authError otherwise.
+func (h *GatewayHandler) authorize(r *http.Request, config ledger.GatewayEndpointConfig) error {
+	a := config.Authorizer
+
+	if a == nil {
+		return nil
+	}
+
+	switch a.Type {
+	case ledger.APIKeyAuthorizerType:
+		return authorizeAPIKey(r, a)
+	case ledger.FunctionAuthorizerType:
+		return h.Manager.authorizeWithFunction(r, a)
+	case ledger.JWTAuthorizerType:
+		return h.Manager.authorizeJWT(r, a)
+	case ledger.OWSKeyAuthorizerType:
+		return h.Manager.authorizeOWSKey(r, h.GatewayID)
+	default:
+		return forbidden("unsupported authorizer type %s", a.Type)
+	}
+}
+
+func authorizeAPIKey(r *http.Request, a *ledger.GatewayAuthorizerConfig) error {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return unauthorized("missing %s header", APIKeyHeader)
+	}
+
+	digest := ledger.DigestShort([]byte(key))
+
+	for _, d := range a.APIKeyDigests {
+		if subtle.ConstantTimeCompare(digest, d) == 1 {
+			return nil
+		}
+	}
+
+	return forbidden("invalid API key")
+}
+
+// The authorizer function receives a description of the request, and must
+// return either `true` or an object with an `allow` field set to `true`.
+func (m *Manager) authorizeWithFunction(r *http.Request, a *ledger.GatewayAuthorizerConfig) error {
+	resp, err := m.RunFunction(a.FunctionID, map[string]any{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"headers": flattenValues(r.Header),
+		"query":   flattenValues(r.URL.Query()),
+	})
+	if err != nil {
+		return forbidden("authorizer function %s failed (%v)", a.FunctionID, err)
+	}
+
+	switch v := resp.(type) {
+	case bool:
+		if v {
+			return nil
+		}
+	case map[string]any:
+		if allow, ok := v["allow"].(bool); ok && allow {
+			return nil
+		}
+	}
+
+	return forbidden("rejected by authorizer function")
+}
+
+func (m *Manager) authorizeOWSKey(r *http.Request, gatewayID ledger.GatewayID) error {
+	rawKey := r.Header.Get(OWSKeyHeader)
+	rawTimestamp := r.Header.Get(OWSTimestampHeader)
+	rawSignature := r.Header.Get(OWSSignatureHeader)
+	nonce := r.Header.Get(OWSNonceHeader)
+
+	if rawKey == "" || rawTimestamp == "" || rawSignature == "" || nonce == "" {
+		return unauthorized("missing %s, %s, %s or %s header", OWSKeyHeader, OWSTimestampHeader, OWSNonceHeader, OWSSignatureHeader)
+	}
+
+	if len(nonce) < MinRequestNonceLength || len(nonce) > MaxRequestNonceLength {
+		return unauthorized("invalid %s header (expected %d to %d characters)", OWSNonceHeader, MinRequestNonceLength, MaxRequestNonceLength)
+	}
+
+	key, err := ledger.ParsePublicKey(rawKey)
+	if err != nil {
+		return unauthorized("invalid %s header (%v)", OWSKeyHeader, err)
+	}
+
+	timestamp, err := strconv.ParseInt(rawTimestamp, 10, 64)
+	if err != nil {
+		return unauthorized("invalid %s header (%v)", OWSTimestampHeader, err)
+	}
+
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > MaxRequestSignatureAge || age < -MaxRequestSignatureAge {
+		return unauthorized("request timestamp too far from node time")
+	}
+
+	sigBytes, err := base64.URLEncoding.WithPadding(base64.NoPadding).DecodeString(rawSignature)
+	if err != nil || len(sigBytes) != ed25519.SignatureSize {
+		return unauthorized("invalid %s header", OWSSignatureHeader)
+	}
+
+	// The body is needed for the signature, and must be restored afterwards
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxSignedBodySize))
+	if err != nil {
+		return unauthorized("unable to read request body (%v)", err)
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	message := GatewayRequestMessage(gatewayID, r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+
+	if !ed25519.Verify(ed25519.PublicKey(key), message, sigBytes) {
+		return unauthorized("invalid request signature")
+	}
+
+	snapshot := m.currentSnapshot()
+	if snapshot == nil {
+		return forbidden("ledger not yet available")
+	}
+
+	if _, ok := snapshot.Users[key.UserID()]; !ok {
+		return forbidden("user %s not found", key.UserID())
+	}
+
+	policies, err := snapshot.UserPolicies([]ledger.PublicKey{key})
+	if err != nil {
+		return forbidden("%v", err)
+	}
+
+	allowed := false
+
+	for _, p := range policies {
+		if p.Allows(snapshot.Version, ledger.GatewaysCategory, ledger.InvokeGatewayName, gatewayID) {
+			allowed = true
+			break
+		}
+	}
+
+	if !allowed {
+		return forbidden("user %s isn't allowed to invoke %s", key.UserID(), gatewayID)
+	}
+
+	// Only checked for allowed users, so that others can't fill the cache
+	if !m.nonces.use(key.UserID(), nonce, time.Now()) {
+		return unauthorized("request nonce already used")
+	}
+
+	return nil
+}
+
+// Remembers the nonces of the requests signed with OWS keys, until their
+// timestamps are no longer accepted, so that a captured request can't be
+// replayed. The nonces are kept by each node separately.
+type nonceCache struct {
+	mutex     sync.Mutex
+	expires   map[string]time.Time
+	lastSweep time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{
+		expires: map[string]time.Time{},
+	}
+}
+
+// Returns false if the nonce was already used by the user.
+func (c *nonceCache) use(userID ledger.UserID, nonce string, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if now.Sub(c.lastSweep) > nonceSweepInterval {
+		for k, exp := range c.expires {
+			if now.After(exp) {
+				delete(c.expires, k)
+			}
+		}
+
+		c.lastSweep = now
+	}
+
+	k := string(userID) + " " + nonce
+
+	if exp, ok := c.expires[k]; ok && !now.After(exp) {
+		return false
+	}
+
+	// the timestamp can be up to MaxRequestSignatureAge in the future
+	c.expires[k] = now.Add(2 * MaxRequestSignatureAge)
+
+	return true
+}
+
+func (m *Manager) authorizeJWT(r *http.Request, a *ledger.GatewayAuthorizerConfig) error {
+	authHeader := r.Header.Get("Authorization")
+
+	token, ok := strings.CutPrefix(authHeader, "Bearer ")
+	if !ok || token == "" {
+		return unauthorized("missing bearer token")
+	}
+
+	keys := []jwtKey{}
+
+	for _, k := range a.JWTKeys {
+		pub, err := ledger.ParsePEMPublicKey(k)
+		if err != nil {
+			// already validated by the ledger
+			continue
+		}
+
+		keys = append(keys, jwtKey{"", pub})
+	}
+
+	if a.JWKSURL != "" {
+		jwksKeys, err := m.jwks.get(a.JWKSURL)
+		if err != nil && len(keys) == 0 {
+			return forbidden("unable to fetch JWKS (%v)", err)
+		}
+
+		keys = append(keys, jwksKeys...)
+	}
+
+	claims, err := verifyJWT(token, keys)
+	if err != nil {
+		return forbidden("invalid token (%v)", err)
+	}
+
+	if err := validateJWTClaims(claims, a.JWTIssuer, a.JWTAudience, time.Now()); err != nil {
+		return forbidden("invalid token (%v)", err)
+	}
+
+	return nil
+}
+
+// kid is empty for static keys.
+type jwtKey struct {
+	kid string
+	pub any
+}
+
+func verifyJWT(token string, keys []jwtKey) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("expected three dot-separated parts")
+	}
+
+	b64 := base64.RawURLEncoding
+
+	headerBytes, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid header encoding (%v)", err)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, fmt.Errorf("invalid header (%v)", err)
+	}
+
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding (%v)", err)
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+
+	verified := false
+
+	for _, k := range keys {
+		if header.Kid != "" && k.kid != "" && header.Kid != k.kid {
+			continue
+		}
+
+		if verifyJWTSignature(header.Alg, k.pub, signingInput, sig) {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, fmt.Errorf("no key found that verifies the %s signature", header.Alg)
+	}
+
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload encoding (%v)", err)
+	}
+
+	claims := map[string]any{}
+
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("invalid payload (%v)", err)
+	}
+
+	return claims, nil
+}
+
+func verifyJWTSignature(alg string, pub any, input []byte, sig []byte) bool {
+	var h crypto.Hash
+
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		h = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		h = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		h = crypto.SHA512
+	case "EdDSA":
+		k, ok := pub.(ed25519.PublicKey)
+		return ok && ed25519.Verify(k, input, sig)
+	default:
+		return false
+	}
+
+	hasher := h.New()
+	hasher.Write(input)
+	digest := hasher.Sum(nil)
+
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.VerifyPKCS1v15(k, h, digest, sig) == nil
+		} else if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(k, h, digest, sig, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		if strings.HasPrefix(alg, "ES") {
+			n := (k.Curve.Params().BitSize + 7) / 8
+			if len(sig) != 2*n {
+				return false
+			}
+
+			r := new(big.Int).SetBytes(sig[:n])
+			s := new(big.Int).SetBytes(sig[n:])
+
+			return ecdsa.Verify(k, digest, r, s)
+		}
+	}
+
+	return false
+}
+
+// Tokens without an exp claim are refused, as they would remain valid forever.
+func validateJWTClaims(claims map[string]any, issuer string, audience string, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("missing exp claim")
+	}
+
+	if now.Unix() >= int64(exp) {
+		return errors.New("expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Unix() < int64(nbf) {
+			return errors.New("not yet valid")
+		}
+	}
+
+	if issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != issuer {
+			return fmt.Errorf("unexpected issuer %q", iss)
+		}
+	}
+
+	if audience != "" {
+		found := false
+
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == audience
+		case []any:
+			for _, item := range aud {
+				if s, ok := item.(string); ok && s == audience {
+					found = true
+				}
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("audience %q not found", audience)
+		}
+	}
+
+	return nil
+}
+
+// Caches the keys of JSON Web Key Sets, to avoid fetching them for every
+// request.
+type jwksCache struct {
+	mutex   sync.Mutex
+	entries map[string]jwksCacheEntry
+}
+
+// failed and err are those of the latest failed fetch.
+type jwksCacheEntry struct {
+	keys    []jwtKey
+	fetched time.Time
+	failed  time.Time
+	err     error
+}
+
+func newJWKSCache() *jwksCache {
+	return &jwksCache{
+		entries: map[string]jwksCacheEntry{},
+	}
+}
+
+func (c *jwksCache) get(url string) ([]jwtKey, error) {
+	c.mutex.Lock()
+	entry, ok := c.entries[url]
+	c.mutex.Unlock()
+
+	now := time.Now()
+
+	if ok && now.Sub(entry.fetched) < jwksCacheTTL {
+		return entry.keys, nil
+	}
+
+	// failed fetches are retried after an interval, instead of for every
+	// request
+	if ok && now.Sub(entry.failed) < jwksRetryInterval {
+		return entry.result()
+	}
+
+	keys, err := fetchJWKS(url)
+	if err != nil {
+		entry.failed = now
+		entry.err = err
+	} else {
+		entry = jwksCacheEntry{keys: keys, fetched: now}
+	}
+
+	c.mutex.Lock()
+	c.entries[url] = entry
+	c.mutex.Unlock()
+
+	return entry.result()
+}
+
+// The stale keys keep being used if the JWKS endpoint is temporarily
+// unavailable.
+func (e jwksCacheEntry) result() ([]jwtKey, error) {
+	if e.fetched.IsZero() {
+		return nil, e.err
+	}
+
+	return e.keys, nil
+}
+
+func fetchJWKS(url string) ([]jwtKey, error) {
+	client := &http.Client{Timeout: jwksFetchTimeout}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS (%v)", err)
+	}
+
+	b64 := base64.RawURLEncoding
+	keys := []jwtKey{}
+
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, errN := b64.DecodeString(k.N)
+			e, errE := b64.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+
+			keys = append(keys, jwtKey{k.Kid, &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}})
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+
+			x, errX := b64.DecodeString(k.X)
+			y, errY := b64.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+
+			keys = append(keys, jwtKey{k.Kid, &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}})
+		case "OKP":
+			if k.Crv != "Ed25519" {
+				continue
+			}
+
+			x, err := b64.DecodeString(k.X)
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				continue
+			}
+
+			keys = append(keys, jwtKey{k.Kid, ed25519.PublicKey(x)})
+		}
+	}
+
+	return keys, nil
+}
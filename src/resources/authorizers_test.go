@@ -0,0 +1,553 @@
+package resources
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ows/ledger"
+)
+
+// Returns the status of the *authError, or 0 if err is nil.
+func authStatus(t *testing.T, err error) int {
+	t.Helper()
+
+	if err == nil {
+		return 0
+	}
+
+	var authErr *authError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expected *authError, got %T (%v)", err, err)
+	}
+
+	return authErr.status
+}
+
+func TestAuthorizeAPIKey(t *testing.T) {
+	a := &ledger.GatewayAuthorizerConfig{
+		Type:          ledger.APIKeyAuthorizerType,
+		APIKeyDigests: [][]byte{ledger.DigestShort([]byte("key1")), ledger.DigestShort([]byte("key2"))},
+	}
+
+	tests := []struct {
+		key    string
+		status int
+	}{
+		{"key1", 0},
+		{"key2", 0},
+		{"", http.StatusUnauthorized},
+		{"key3", http.StatusForbidden},
+		{"KEY1", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.key != "" {
+			r.Header.Set(APIKeyHeader, test.key)
+		}
+
+		if status := authStatus(t, authorizeAPIKey(r, a)); status != test.status {
+			t.Errorf("expected status %d for key %q, got %d", test.status, test.key, status)
+		}
+	}
+}
+
+type jwtSigner struct {
+	alg  string
+	kid  string
+	pub  any
+	sign func(digest []byte) []byte
+}
+
+func newJWTSigners(t *testing.T) []jwtSigner {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sha := func(input []byte) []byte {
+		h := sha256.Sum256(input)
+		return h[:]
+	}
+
+	return []jwtSigner{
+		{"RS256", "rsa", &rsaKey.PublicKey, func(input []byte) []byte {
+			sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sha(input))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return sig
+		}},
+		{"PS256", "rsa", &rsaKey.PublicKey, func(input []byte) []byte {
+			sig, err := rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA256, sha(input), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return sig
+		}},
+		{"ES256", "ec", &ecKey.PublicKey, func(input []byte) []byte {
+			r, s, err := ecdsa.Sign(rand.Reader, ecKey, sha(input))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sig := make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+
+			return sig
+		}},
+		{"EdDSA", "ed", edPub, func(input []byte) []byte {
+			return ed25519.Sign(edKey, input)
+		}},
+	}
+}
+
+func (s jwtSigner) token(t *testing.T, claims map[string]any) string {
+	b64 := base64.RawURLEncoding
+
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+
+	return input + "." + b64.EncodeToString(s.sign([]byte(input)))
+}
+
+func (s jwtSigner) pem(t *testing.T) string {
+	bs, err := x509.MarshalPKIXPublicKey(s.pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: bs}))
+}
+
+func (s jwtSigner) jwk() map[string]string {
+	b64 := base64.RawURLEncoding
+
+	switch k := s.pub.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": s.kid, "n": b64.EncodeToString(k.N.Bytes()), "e": b64.EncodeToString(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": s.kid, "crv": "P-256", "x": b64.EncodeToString(k.X.FillBytes(make([]byte, 32))), "y": b64.EncodeToString(k.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": s.kid, "crv": "Ed25519", "x": b64.EncodeToString(k)}
+	default:
+		panic("unsupported key type")
+	}
+}
+
+func bearer(token string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	return r
+}
+
+func TestAuthorizeJWT(t *testing.T) {
+	m := NewManager(nil, t.TempDir(), "", 0)
+	now := time.Now().Unix()
+
+	for _, s := range newJWTSigners(t) {
+		t.Run(s.alg, func(t *testing.T) {
+			a := &ledger.GatewayAuthorizerConfig{
+				Type:        ledger.JWTAuthorizerType,
+				JWTKeys:     []string{s.pem(t)},
+				JWTIssuer:   "issuer",
+				JWTAudience: "audience",
+			}
+
+			valid := map[string]any{"iss": "issuer", "aud": "audience", "exp": now + 60}
+
+			tests := []struct {
+				name   string
+				token  string
+				status int
+			}{
+				{"valid", s.token(t, valid), 0},
+				{"audience list", s.token(t, map[string]any{"iss": "issuer", "aud": []string{"other", "audience"}, "exp": now + 60}), 0},
+				{"expired", s.token(t, map[string]any{"iss": "issuer", "aud": "audience", "exp": now - 1}), http.StatusForbidden},
+				{"without expiration", s.token(t, map[string]any{"iss": "issuer", "aud": "audience"}), http.StatusForbidden},
+				{"not yet valid", s.token(t, map[string]any{"iss": "issuer", "aud": "audience", "exp": now + 60, "nbf": now + 60}), http.StatusForbidden},
+				{"other issuer", s.token(t, map[string]any{"iss": "other", "aud": "audience", "exp": now + 60}), http.StatusForbidden},
+				{"other audience", s.token(t, map[string]any{"iss": "issuer", "aud": "other", "exp": now + 60}), http.StatusForbidden},
+				{"tampered payload", tamper(s.token(t, valid)), http.StatusForbidden},
+				{"malformed", "abc.def", http.StatusForbidden},
+			}
+
+			for _, test := range tests {
+				if status := authStatus(t, m.authorizeJWT(bearer(test.token), a)); status != test.status {
+					t.Errorf("%s: expected status %d, got %d", test.name, test.status, status)
+				}
+			}
+
+			if status := authStatus(t, m.authorizeJWT(httptest.NewRequest("GET", "/", nil), a)); status != http.StatusUnauthorized {
+				t.Errorf("expected status 401 without token, got %d", status)
+			}
+		})
+	}
+}
+
+// Replaces the payload by a payload with other claims, keeping the signature.
+func tamper(token string) string {
+	b64 := base64.RawURLEncoding
+	payload := b64.EncodeToString([]byte(`{"iss":"issuer","aud":"audience","admin":true}`))
+
+	parts := bytes.Split([]byte(token), []byte("."))
+
+	return string(parts[0]) + "." + payload + "." + string(parts[2])
+}
+
+func TestAuthorizeJWTWrongKey(t *testing.T) {
+	m := NewManager(nil, t.TempDir(), "", 0)
+	signers := newJWTSigners(t)
+	claims := map[string]any{"exp": time.Now().Unix() + 60}
+
+	// the token of each signer is checked against the key of another signer
+	// (the RS256 and PS256 signers share a key)
+	for i, s := range signers {
+		other := signers[(i+2)%len(signers)]
+
+		a := &ledger.GatewayAuthorizerConfig{Type: ledger.JWTAuthorizerType, JWTKeys: []string{other.pem(t)}}
+
+		if status := authStatus(t, m.authorizeJWT(bearer(s.token(t, claims)), a)); status != http.StatusForbidden {
+			t.Errorf("expected %s token to be refused by %s key, got status %d", s.alg, other.alg, status)
+		}
+	}
+
+	// the algorithm of the header must match the key type
+	s := signers[3]
+	s.alg = "RS256"
+
+	a := &ledger.GatewayAuthorizerConfig{Type: ledger.JWTAuthorizerType, JWTKeys: []string{signers[3].pem(t)}}
+
+	if status := authStatus(t, m.authorizeJWT(bearer(s.token(t, claims)), a)); status != http.StatusForbidden {
+		t.Errorf("expected token with mismatching algorithm to be refused, got status %d", status)
+	}
+}
+
+func TestAuthorizeJWKS(t *testing.T) {
+	signers := newJWTSigners(t)
+
+	var (
+		fetches     atomic.Int32
+		unavailable atomic.Bool
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+
+		if unavailable.Load() {
+			http.Error(w, "unavailable", 503)
+			return
+		}
+
+		keys := []map[string]string{}
+		for _, s := range signers {
+			keys = append(keys, s.jwk())
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+
+	defer server.Close()
+
+	m := NewManager(nil, t.TempDir(), "", 0)
+	a := &ledger.GatewayAuthorizerConfig{Type: ledger.JWTAuthorizerType, JWKSURL: server.URL}
+	claims := map[string]any{"exp": time.Now().Unix() + 60}
+
+	for _, s := range signers {
+		if err := m.authorizeJWT(bearer(s.token(t, claims)), a); err != nil {
+			t.Errorf("expected %s token to be allowed by JWKS, got %v", s.alg, err)
+		}
+	}
+
+	// keys are cached
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("expected JWKS to be fetched once, got %d fetches", n)
+	}
+
+	// a kid that doesn't match any key is refused
+	s := signers[0]
+	s.kid = "unknown"
+
+	if status := authStatus(t, m.authorizeJWT(bearer(s.token(t, claims)), a)); status != http.StatusForbidden {
+		t.Errorf("expected token with unknown kid to be refused, got status %d", status)
+	}
+
+	// stale keys keep being used while the endpoint is unavailable
+	m.jwks.mutex.Lock()
+	entry := m.jwks.entries[server.URL]
+	entry.fetched = time.Now().Add(-2 * jwksCacheTTL)
+	m.jwks.entries[server.URL] = entry
+	m.jwks.mutex.Unlock()
+
+	unavailable.Store(true)
+
+	if err := m.authorizeJWT(bearer(signers[0].token(t, claims)), a); err != nil {
+		t.Errorf("expected stale JWKS keys to be used, got %v", err)
+	}
+
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("expected JWKS to be refetched once, got %d fetches", n)
+	}
+
+	// the failed fetch isn't retried for every request
+	if err := m.authorizeJWT(bearer(signers[0].token(t, claims)), a); err != nil {
+		t.Errorf("expected stale JWKS keys to be used, got %v", err)
+	}
+
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("expected failed JWKS fetch not to be retried, got %d fetches", n)
+	}
+
+	// without any cached keys an unavailable endpoint refuses all tokens
+	fresh := NewManager(nil, t.TempDir(), "", 0)
+
+	for range 2 {
+		if status := authStatus(t, fresh.authorizeJWT(bearer(signers[0].token(t, claims)), a)); status != http.StatusForbidden {
+			t.Errorf("expected status 403 with unavailable JWKS, got %d", status)
+		}
+	}
+
+	if n := fetches.Load(); n != 3 {
+		t.Fatalf("expected failed JWKS fetch not to be retried, got %d fetches", n)
+	}
+
+	// the fetch is retried after the interval
+	unavailable.Store(false)
+
+	fresh.jwks.mutex.Lock()
+	entry = fresh.jwks.entries[server.URL]
+	entry.failed = time.Now().Add(-jwksRetryInterval)
+	fresh.jwks.entries[server.URL] = entry
+	fresh.jwks.mutex.Unlock()
+
+	if err := fresh.authorizeJWT(bearer(signers[0].token(t, claims)), a); err != nil {
+		t.Errorf("expected token to be allowed after the JWKS fetch is retried, got %v", err)
+	}
+
+	if n := fetches.Load(); n != 4 {
+		t.Fatalf("expected JWKS fetch to be retried, got %d fetches", n)
+	}
+}
+
+func TestAuthorizeOWSKey(t *testing.T) {
+	allowed, err := ledger.RandomKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	denied, err := ledger.RandomKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknown, err := ledger.RandomKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gateway := ledger.GatewayID("gateway1test")
+
+	snapshot := &ledger.Snapshot{
+		Policies: map[ledger.PolicyID]ledger.Policy{
+			"invoke": {Statements: []ledger.PolicyStatement{
+				{Actions: []string{"gateways:Invoke"}, Resources: []string{string(gateway)}, Effect: "Allow"},
+			}},
+		},
+		Users: map[ledger.UserID]ledger.UserConfig{
+			allowed.Public.UserID(): {Key: allowed.Public, Policies: []ledger.PolicyID{"invoke"}},
+			denied.Public.UserID():  {Key: denied.Public},
+		},
+	}
+
+	m := NewManager(nil, t.TempDir(), "", 0)
+
+	nonces := 0
+
+	signedRequest := func(kp *ledger.KeyPair, gatewayID ledger.GatewayID, timestamp time.Time, target string, signedTarget string, body string, signedBody string) *http.Request {
+		r := httptest.NewRequest("POST", target, bytes.NewBufferString(body))
+
+		nonces++
+		nonce := fmt.Sprintf("nonce%016d", nonces)
+
+		sig := ed25519.Sign(ed25519.PrivateKey(kp.Private), GatewayRequestMessage(gatewayID, "POST", signedTarget, timestamp.Unix(), nonce, []byte(signedBody)))
+
+		r.Header.Set(OWSKeyHeader, kp.Public.String())
+		r.Header.Set(OWSTimestampHeader, strconv.FormatInt(timestamp.Unix(), 10))
+		r.Header.Set(OWSNonceHeader, nonce)
+		r.Header.Set(OWSSignatureHeader, base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(sig))
+
+		return r
+	}
+
+	request := func(kp *ledger.KeyPair, timestamp time.Time, body string, signedBody string) *http.Request {
+		return signedRequest(kp, gateway, timestamp, "/hello?a=1", "/hello?a=1", body, signedBody)
+	}
+
+	withNonce := func(r *http.Request, nonce string) *http.Request {
+		r.Header.Set(OWSNonceHeader, nonce)
+		return r
+	}
+
+	now := time.Now()
+
+	// the ledger isn't available before the first sync
+	if status := authStatus(t, m.authorizeOWSKey(request(allowed, now, "", ""), gateway)); status != http.StatusForbidden {
+		t.Fatalf("expected status 403 before sync, got %d", status)
+	}
+
+	m.mutex.Lock()
+	m.snapshot = snapshot
+	m.mutex.Unlock()
+
+	tests := []struct {
+		name    string
+		r       *http.Request
+		gateway ledger.GatewayID
+		status  int
+	}{
+		{"allowed", request(allowed, now, "body", "body"), gateway, 0},
+		{"not allowed gateway", signedRequest(allowed, "gateway1other", now, "/hello?a=1", "/hello?a=1", "body", "body"), "gateway1other", http.StatusForbidden},
+		{"signed for other gateway", request(allowed, now, "body", "body"), "gateway1other", http.StatusUnauthorized},
+		{"no policy", request(denied, now, "body", "body"), gateway, http.StatusForbidden},
+		{"unknown user", request(unknown, now, "body", "body"), gateway, http.StatusForbidden},
+		{"modified body", request(allowed, now, "other body", "body"), gateway, http.StatusUnauthorized},
+		{"modified query", signedRequest(allowed, gateway, now, "/hello?a=2", "/hello?a=1", "body", "body"), gateway, http.StatusUnauthorized},
+		{"modified path", signedRequest(allowed, gateway, now, "/other?a=1", "/hello?a=1", "body", "body"), gateway, http.StatusUnauthorized},
+		{"modified nonce", withNonce(request(allowed, now, "body", "body"), "nonce9999999999999999"), gateway, http.StatusUnauthorized},
+		{"short nonce", withNonce(request(allowed, now, "body", "body"), "nonce"), gateway, http.StatusUnauthorized},
+		{"old timestamp", request(allowed, now.Add(-MaxRequestSignatureAge-time.Minute), "body", "body"), gateway, http.StatusUnauthorized},
+		{"future timestamp", request(allowed, now.Add(MaxRequestSignatureAge+time.Minute), "body", "body"), gateway, http.StatusUnauthorized},
+		{"missing headers", httptest.NewRequest("POST", "/hello", nil), gateway, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		if status := authStatus(t, m.authorizeOWSKey(test.r, test.gateway)); status != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, status)
+		}
+	}
+
+	// the body must still be readable by the endpoint
+	r := request(allowed, now, "body", "body")
+
+	if err := m.authorizeOWSKey(r, gateway); err != nil {
+		t.Fatal(err)
+	}
+
+	if bs, _ := io.ReadAll(r.Body); string(bs) != "body" {
+		t.Fatalf("expected body to be restored, got %q", bs)
+	}
+
+	// a replayed request is refused
+	replayed := httptest.NewRequest("POST", "/hello?a=1", bytes.NewBufferString("body"))
+	replayed.Header = r.Header.Clone()
+
+	if status := authStatus(t, m.authorizeOWSKey(replayed, gateway)); status != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 for replayed request, got %d", status)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	c := newNonceCache()
+	now := time.Now()
+
+	if !c.use("user1", "nonce1", now) || !c.use("user2", "nonce1", now) {
+		t.Fatalf("expected nonces to be accepted once per user")
+	}
+
+	if c.use("user1", "nonce1", now.Add(MaxRequestSignatureAge)) {
+		t.Fatalf("expected reused nonce to be refused")
+	}
+
+	// nonces are forgotten once their requests would be too old anyway
+	later := now.Add(2*MaxRequestSignatureAge + time.Second)
+
+	if !c.use("user1", "nonce2", later) {
+		t.Fatalf("expected new nonce to be accepted")
+	}
+
+	if _, ok := c.expires["user1 nonce1"]; ok {
+		t.Fatalf("expected expired nonces to be removed")
+	}
+
+	if !c.use("user1", "nonce1", later) {
+		t.Fatalf("expected expired nonce to be accepted again")
+	}
+}
+
+func TestSyncCopiesSnapshot(t *testing.T) {
+	kp, err := ledger.RandomKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs := ledger.NewInitialChangeSet(ledger.LatestLedgerVersion, ledger.AddNode{Key: kp.Public, Address: "127.0.0.1", GossipPort: 9000, APIPort: 9001})
+
+	sig, err := kp.SignChangeSet(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs.Signatures = []ledger.Signature{sig}
+
+	l, err := ledger.NewLedger(ledger.LatestLedgerVersion, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager(kp, t.TempDir(), "", 0)
+
+	if err := m.Sync(l.Snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// modifications of the ledger aren't visible to the authorizers until the
+	// next sync
+	delete(l.Snapshot.Users, kp.Public.UserID())
+
+	if _, ok := m.currentSnapshot().Users[kp.Public.UserID()]; !ok {
+		t.Fatalf("expected synced snapshot not to be modified by the ledger")
+	}
+}
@@ -27,6 +27,28 @@ const NODEJS_INPUT_NAME = "input.json"
 const NODEJS_OUTPUT_NAME = "output.json"
 const IPC_SOCKET_NAME = "socket.sock"
 
+// Runs the handlers of functions.
+type FunctionRuntime interface {
+	// Called before the first function is added.
+	Initialize() error
+
+	// The handler is the id of an asset that exists locally.
+	Run(handler ledger.AssetID, arg any) (any, error)
+}
+
+// Runs nodejs handlers in a Docker container, see `initializeDocker()`.
+type dockerRuntime struct {
+	m *Manager
+}
+
+func (r *dockerRuntime) Initialize() error {
+	return r.m.initializeDocker()
+}
+
+func (r *dockerRuntime) Run(handler ledger.AssetID, arg any) (any, error) {
+	return r.m.runNodeScriptInDocker(string(handler), arg)
+}
+
 func (m *Manager) SyncFunctions(functions map[ledger.FunctionID]ledger.FunctionConfig) error {
 	for id, conf := range functions {
 		if _, ok := m.Functions[id]; ok {
@@ -58,22 +80,24 @@ func (m *Manager) addFunction(id ledger.FunctionID, config ledger.FunctionConfig
 		return errors.New("function added before")
 	}
 
-	if !m.dockerInitialized {
-		if err := m.initializeDocker(); err != nil {
-			log.Println("failed to initialize docker", err)
+	if !m.runtimeInitialized {
+		if err := m.Runtime.Initialize(); err != nil {
+			log.Println("failed to initialize function runtime", err)
 			return err
 		}
 
-		m.dockerInitialized = true
+		m.runtimeInitialized = true
 	}
 
 	if err := m.AssertAssetExists(config.HandlerID); err != nil {
 		return err
 	}
 
+	m.mutex.Lock()
 	m.Functions[id] = &Function{
 		Config: config,
 	}
+	m.mutex.Unlock()
 
 	return nil
 }
@@ -85,24 +109,33 @@ func (m *Manager) removeFunction(id ledger.FunctionID) error {
 
 	// TODO: what if task is still being referenced elsewhere?
 
+	m.mutex.Lock()
 	delete(m.Functions, id)
+	m.mutex.Unlock()
 
 	return nil
 }
 
 func (m *Manager) updateFunction(id ledger.FunctionID, config ledger.FunctionConfig) error {
-	fn, ok := m.Functions[id]
-	if !ok {
+	if _, ok := m.Functions[id]; !ok {
 		return fmt.Errorf("function %s not found", id)
 	}
 
-	fn.Config = config
+	// replaced instead of modified, because RunFunction may be using it
+	m.mutex.Lock()
+	m.Functions[id] = &Function{
+		Config: config,
+	}
+	m.mutex.Unlock()
 
 	return nil
 }
 
 func (m *Manager) RunFunction(id ledger.FunctionID, arg any) (any, error) {
+	m.mutex.RLock()
 	fn, ok := m.Functions[id]
+	m.mutex.RUnlock()
+
 	if !ok {
 		return nil, fmt.Errorf("task %s not found", id)
 	}
@@ -113,7 +146,18 @@ func (m *Manager) RunFunction(id ledger.FunctionID, arg any) (any, error) {
 		return nil, fmt.Errorf("unsupported runtime %s", conf.Runtime)
 	}
 
-	return m.runNodeScriptInDocker(string(conf.HandlerID), arg)
+	start := time.Now()
+
+	res, err := m.Runtime.Run(conf.HandlerID, arg)
+
+	functionInvocations.With(string(id)).Inc()
+	functionDuration.With(string(id)).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		functionErrors.With(string(id)).Inc()
+	}
+
+	return res, err
 }
 
 func makeTmpDir() (string, error) {
@@ -1,13 +1,15 @@
 package resources
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
-	"slices"
+	"strconv"
 	"time"
 
 	"ows/ledger"
@@ -24,28 +26,126 @@ func (g *Gateway) shutdown() error {
 }
 
 func (h *GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if endpoints, ok := h.Endpoints[r.Method]; ok {
-		if endpoint, ok := endpoints[r.URL.Path]; ok {
-			// now run the task
-			resp, err := h.Manager.RunFunction(endpoint.Config.FunctionID, "hello world")
-			if err != nil {
-				http.Error(w, fmt.Sprintf("failed to run task (%v)", err), 500)
-				return
-			}
+	start := time.Now()
+	rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
 
-			str, err := json.Marshal(resp)
-			if err != nil {
-				http.Error(w, "bad response", 500)
-				return
-			}
+	endpoint := h.serve(rec, r, start)
 
-			fmt.Fprintf(w, string(str))
-		} else {
+	recordGatewayRequest(h, endpoint, rec.status)
+
+	if h.logs != nil {
+		h.logs.record(r, rec, endpoint, start)
+	}
+}
+
+// Returns the matched endpoint, or nil if the request didn't match any
+// endpoint.
+func (h *GatewayHandler) serve(w http.ResponseWriter, r *http.Request, now time.Time) *GatewayEndpoint {
+	// the handler config can be replaced while the request is being served,
+	// but never modified in-place
+	h.mutex.RLock()
+	allEndpoints := h.Endpoints
+	rateLimit := h.RateLimit
+	quotas := h.APIKeyQuotas
+	cors := h.CORS
+	h.mutex.RUnlock()
+
+	endpoint := allEndpoints[r.Method][r.URL.Path]
+
+	if cors != nil && r.Header.Get("Origin") != "" {
+		if isPreflight := serveCORS(w, r, cors, allEndpoints); isPreflight {
+			return endpoint
+		}
+	}
+
+	if rateLimit != nil {
+		if ok, retryAfter := h.Manager.limits.allow(gatewayRateLimitKey(h.GatewayID), *rateLimit, now); !ok {
+			tooManyRequests(w, retryAfter)
+			return endpoint
+		}
+	}
+
+	if endpoint == nil {
+		if _, ok := allEndpoints[r.Method]; ok {
 			http.Error(w, "invalid path", 404)
+		} else {
+			http.Error(w, "unsupported method", 404)
 		}
-	} else {
-		http.Error(w, "unsupported method", 404)
+
+		return nil
 	}
+
+	if rl := endpoint.Config.RateLimit; rl != nil {
+		key := endpointRateLimitKey(h.GatewayID, r.Method, r.URL.Path)
+
+		if ok, retryAfter := h.Manager.limits.allow(key, *rl, now); !ok {
+			tooManyRequests(w, retryAfter)
+			return endpoint
+		}
+	}
+
+	if err := h.authorize(r, endpoint.Config); err != nil {
+		status := http.StatusForbidden
+
+		var authErr *authError
+		if errors.As(err, &authErr) {
+			status = authErr.status
+		}
+
+		http.Error(w, err.Error(), status)
+		return endpoint
+	}
+
+	if ok, retryAfter := h.allowAPIKeyQuota(r, quotas, now); !ok {
+		tooManyRequests(w, retryAfter)
+		return endpoint
+	}
+
+	if endpoint.templateErr != nil {
+		http.Error(w, endpoint.templateErr.Error(), http.StatusInternalServerError)
+		return endpoint
+	}
+
+	arg, err := endpoint.functionArg(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return endpoint
+	}
+
+	// now run the task
+	resp, err := h.Manager.RunFunction(endpoint.Config.FunctionID, arg)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to run task (%v)", err), 500)
+		return endpoint
+	}
+
+	endpoint.writeResponse(w, resp)
+
+	return endpoint
+}
+
+// Requests made with an API key that has a quota count towards that quota,
+// regardless of the endpoint authorizer type.
+func (h *GatewayHandler) allowAPIKeyQuota(r *http.Request, quotas []ledger.APIKeyQuotaConfig, now time.Time) (bool, time.Duration) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" || len(quotas) == 0 {
+		return true, 0
+	}
+
+	digest := ledger.DigestShort([]byte(key))
+
+	for _, q := range quotas {
+		if bytes.Equal(q.APIKeyDigest, digest) {
+			return h.Manager.limits.allowQuota(apiKeyQuotaKey(h.GatewayID, digest), q, now)
+		}
+	}
+
+	return true, 0
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
 }
 
 func (m *Manager) SyncGateways(gateways map[ledger.GatewayID]ledger.GatewayConfig) error {
@@ -77,39 +177,75 @@ func (m *Manager) addGateway(id ledger.GatewayID, config ledger.GatewayConfig) e
 		return fmt.Errorf("gateway %s already exists", id)
 	}
 
+	endpoints, err := newGatewayEndpoints(config.Endpoints)
+	if err != nil {
+		return err
+	}
+
 	h := &GatewayHandler{
-		Manager:   m,
-		Endpoints: map[string]map[string]*GatewayEndpoint{},
+		GatewayID:    id,
+		Manager:      m,
+		Endpoints:    endpoints,
+		RateLimit:    config.RateLimit,
+		APIKeyQuotas: config.APIKeyQuotas,
+		CORS:         config.CORS,
 	}
 
-	s := &http.Server{
-		Addr:           fmt.Sprintf(":%d", int(config.Port)+m.portOffset),
-		Handler:        h,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
+	if m.LogsDir != "" {
+		h.logs, err = newGatewayLogs(m.LogsDir, id)
+		if err != nil {
+			return err
+		}
 	}
 
+	// TODO: flexible TLS, using DomainManager + LetsEncrypt
+	s, err := m.listenGateway(config.Port, h)
+	if err != nil {
+		if h.logs != nil {
+			h.logs.close()
+		}
+
+		return err
+	}
+
+	m.mutex.Lock()
 	m.Gateways[id] = &Gateway{
 		Port:    config.Port,
 		Handler: h,
 		Server:  s,
 	}
-
-	// TODO: flexible TLS, using DomainManager + LetsEncrypt
-	go s.ListenAndServe()
+	m.mutex.Unlock()
 
 	log.Printf("added gateway %s on port %d\n", id, config.Port)
 
 	for _, ep := range config.Endpoints {
-		if err := m.addGatewayEndpoint(id, ep); err != nil {
-			return err
-		}
+		log.Printf("added endpoint %s %s to gateway %s (port %d)\n", ep.Method, ep.Path, id, config.Port)
 	}
 
 	return nil
 }
 
+// Starts serving the handler on the given port. The listener is created
+// synchronously so that errors (eg. port already in use) can be returned.
+func (m *Manager) listenGateway(port ledger.Port, h *GatewayHandler) (*http.Server, error) {
+	s := &http.Server{
+		Addr:           fmt.Sprintf(":%d", int(port)+m.portOffset),
+		Handler:        h,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on port %d (%v)", port, err)
+	}
+
+	go s.Serve(ln)
+
+	return s, nil
+}
+
 func (m *Manager) removeGateway(id ledger.GatewayID) error {
 	gateway, ok := m.Gateways[id]
 	if !ok {
@@ -121,126 +257,108 @@ func (m *Manager) removeGateway(id ledger.GatewayID) error {
 		return err
 	}
 
+	if logs := gateway.Handler.logs; logs != nil {
+		if err := logs.close(); err != nil {
+			log.Printf("failed to close logs of gateway %s (%v)\n", id, err)
+		}
+	}
+
+	m.mutex.Lock()
 	delete(m.Gateways, id)
+	m.mutex.Unlock()
 
 	log.Printf("removed gateway %s on port %d\n", id, gateway.Port)
 
 	return nil
 }
 
+// Reconciles the running gateway with its config.
+//
+// The new endpoints are prepared in full before replacing the old ones, so
+// requests are either served by the previous or by the new config, never by a
+// mix of both.
+//
+// If the port changes, the new listener is started before the old one is
+// drained, so that no requests are dropped.
 func (m *Manager) updateGateway(id ledger.GatewayID, config ledger.GatewayConfig) error {
 	prev, ok := m.Gateways[id]
 	if !ok {
 		return fmt.Errorf("gateway %s not found", id)
 	}
 
-	// make sure the endpoints correspond
-
-	// TODO: support port changes
-
-	for _, ep := range config.Endpoints {
-		if methodEndpoints, ok := prev.Handler.Endpoints[ep.Method]; ok {
-			if _, ok := methodEndpoints[ep.Path]; ok {
-				return m.updateGatewayEndpoint(id, ep)
-			} else {
-				return m.addGatewayEndpoint(id, ep)
-			}
-		} else {
-			return m.addGatewayEndpoint(id, ep)
-		}
+	endpoints, err := newGatewayEndpoints(config.Endpoints)
+	if err != nil {
+		return err
 	}
 
-	for method, methodEndpoints := range prev.Handler.Endpoints {
-		methodEndpointConfigs := slices.DeleteFunc(config.Endpoints, func(ep ledger.GatewayEndpointConfig) bool {
-			return ep.Method != method
-		})
+	h := prev.Handler
 
-		if len(methodEndpointConfigs) == 0 {
-			for path, _ := range methodEndpoints {
-				return m.removeGatewayEndpoint(id, method, path)
-			}
+	if config.Port != prev.Port {
+		s, err := m.listenGateway(config.Port, h)
+		if err != nil {
+			return err
 		}
 
-		for path, _ := range methodEndpoints {
-			pathEndpointConfigs := slices.DeleteFunc(methodEndpointConfigs, func(ep ledger.GatewayEndpointConfig) bool {
-				return ep.Path != path
-			})
+		m.mutex.Lock()
+		old := *prev
+		prev.Port = config.Port
+		prev.Server = s
+		m.mutex.Unlock()
 
-			if len(pathEndpointConfigs) == 0 {
-				return m.removeGatewayEndpoint(id, method, path)
+		// in-flight requests on the old port are allowed to finish
+		go func() {
+			if err := old.shutdown(); err != nil {
+				log.Printf("failed to drain gateway %s on port %d (%v)\n", id, old.Port, err)
 			}
-		}
-	}
-
-	return nil
-}
-
-func (m *Manager) addGatewayEndpoint(gatewayID ledger.GatewayID, config ledger.GatewayEndpointConfig) error {
-	gateway, ok := m.Gateways[gatewayID]
-	if !ok {
-		return fmt.Errorf("invalid gateway id %s", gatewayID)
-	}
-
-	method := config.Method
-	relPath := config.Path
-
-	endpoints, ok := gateway.Handler.Endpoints[method]
-	if !ok {
-		endpoints = map[string]*GatewayEndpoint{}
-		gateway.Handler.Endpoints[method] = endpoints
-	}
-
-	if _, ok := endpoints[relPath]; ok {
-		return errors.New("endpoint already exists")
-	}
-
-	endpoints[relPath] = &GatewayEndpoint{
-		Config: config,
-	}
-
-	log.Printf("added endpoint %s %s to gateway %s (port %d)\n", config.Method, config.Path, gatewayID, gateway.Port)
-
-	return nil
-}
+		}()
 
-func (m *Manager) removeGatewayEndpoint(gatewayID ledger.GatewayID, method string, path string) error {
-	gateway, ok := m.Gateways[gatewayID]
-	if !ok {
-		return fmt.Errorf("invalid gateway id %s", gatewayID)
+		log.Printf("moved gateway %s from port %d to port %d\n", id, old.Port, config.Port)
 	}
 
-	endpoints, ok := gateway.Handler.Endpoints[method]
-	if !ok {
-		return fmt.Errorf("no endpoints with method %s found", method)
+	h.mutex.Lock()
+	prevEndpoints := h.Endpoints
+	h.Endpoints = endpoints
+	h.RateLimit = config.RateLimit
+	h.APIKeyQuotas = config.APIKeyQuotas
+	h.CORS = config.CORS
+	h.mutex.Unlock()
+
+	for method, paths := range endpoints {
+		for path := range paths {
+			if _, ok := prevEndpoints[method][path]; !ok {
+				log.Printf("added endpoint %s %s to gateway %s (port %d)\n", method, path, id, prev.Port)
+			}
+		}
 	}
 
-	if _, ok := endpoints[path]; !ok {
-		return fmt.Errorf("no endpoint with method %s and path %s found", method, path)
+	for method, paths := range prevEndpoints {
+		for path := range paths {
+			if _, ok := endpoints[method][path]; !ok {
+				log.Printf("removed endpoint %s %s from gateway %s (port %d)\n", method, path, id, prev.Port)
+			}
+		}
 	}
 
-	delete(endpoints, path)
-
 	return nil
 }
 
-func (m *Manager) updateGatewayEndpoint(gatewayID ledger.GatewayID, config ledger.GatewayEndpointConfig) error {
-	gateway, ok := m.Gateways[gatewayID]
-	if !ok {
-		return fmt.Errorf("invalid gateway id %s", gatewayID)
-	}
+// Builds the endpoints lookup table of a gateway handler.
+func newGatewayEndpoints(configs []ledger.GatewayEndpointConfig) (map[string]map[string]*GatewayEndpoint, error) {
+	endpoints := map[string]map[string]*GatewayEndpoint{}
 
-	endpoints, ok := gateway.Handler.Endpoints[config.Method]
-	if !ok {
-		return fmt.Errorf("no endpoints with method %s found", config.Method)
-	}
+	for _, config := range configs {
+		methodEndpoints, ok := endpoints[config.Method]
+		if !ok {
+			methodEndpoints = map[string]*GatewayEndpoint{}
+			endpoints[config.Method] = methodEndpoints
+		}
 
-	if _, ok := endpoints[config.Path]; !ok {
-		return fmt.Errorf("no endpoint with method %s and path %s found", config.Method, config.Path)
-	}
+		if _, ok := methodEndpoints[config.Path]; ok {
+			return nil, fmt.Errorf("duplicate endpoint %s %s", config.Method, config.Path)
+		}
 
-	endpoints[config.Path] = &GatewayEndpoint{
-		Config: config,
+		methodEndpoints[config.Path] = newGatewayEndpoint(config)
 	}
 
-	return nil
+	return endpoints, nil
 }
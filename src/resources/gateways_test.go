@@ -0,0 +1,238 @@
+package resources
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"ows/ledger"
+)
+
+func TestUpdateGatewayEndpoints(t *testing.T) {
+	ep := func(method string, path string, fn ledger.FunctionID) ledger.GatewayEndpointConfig {
+		return ledger.GatewayEndpointConfig{
+			Method:     method,
+			Path:       path,
+			FunctionID: fn,
+		}
+	}
+
+	steps := []struct {
+		name      string
+		endpoints []ledger.GatewayEndpointConfig
+	}{
+		{"initial", []ledger.GatewayEndpointConfig{
+			ep("GET", "/a", "fn1"),
+			ep("GET", "/b", "fn1"),
+			ep("POST", "/a", "fn2"),
+		}},
+		{"add several", []ledger.GatewayEndpointConfig{
+			ep("GET", "/a", "fn1"),
+			ep("GET", "/b", "fn1"),
+			ep("GET", "/c", "fn1"),
+			ep("POST", "/a", "fn2"),
+			ep("PUT", "/a", "fn2"),
+			ep("DELETE", "/a", "fn2"),
+		}},
+		{"remove several", []ledger.GatewayEndpointConfig{
+			ep("GET", "/b", "fn1"),
+			ep("PUT", "/a", "fn2"),
+		}},
+		{"add, remove and change at once", []ledger.GatewayEndpointConfig{
+			ep("GET", "/b", "fn3"),
+			ep("GET", "/d", "fn1"),
+			ep("PATCH", "/a", "fn2"),
+			ep("PATCH", "/b", "fn2"),
+		}},
+		{"remove all", []ledger.GatewayEndpointConfig{}},
+		{"add again", []ledger.GatewayEndpointConfig{
+			ep("GET", "/a", "fn1"),
+			ep("POST", "/a", "fn1"),
+		}},
+	}
+
+	m := NewManager(nil, t.TempDir(), t.TempDir(), 0)
+	port := freePort(t)
+	id := ledger.GatewayID("gateway1test")
+
+	defer m.removeGateway(id)
+
+	for i, step := range steps {
+		conf := ledger.GatewayConfig{
+			Port:      port,
+			Endpoints: step.endpoints,
+		}
+
+		if err := m.SyncGateways(map[ledger.GatewayID]ledger.GatewayConfig{id: conf}); err != nil {
+			t.Fatalf("step %d (%s): sync failed (%v)", i, step.name, err)
+		}
+
+		h := m.Gateways[id].Handler
+
+		got := []string{}
+		for method, paths := range h.Endpoints {
+			for path, e := range paths {
+				got = append(got, fmt.Sprintf("%s %s %s", method, path, e.Config.FunctionID))
+			}
+		}
+
+		expected := []string{}
+		for _, e := range step.endpoints {
+			expected = append(expected, fmt.Sprintf("%s %s %s", e.Method, e.Path, e.FunctionID))
+		}
+
+		slices.Sort(got)
+		slices.Sort(expected)
+
+		if !slices.Equal(got, expected) {
+			t.Fatalf("step %d (%s): expected endpoints %v, got %v", i, step.name, expected, got)
+		}
+	}
+}
+
+func TestUpdateGatewayEndpointsRemovedAreNotServed(t *testing.T) {
+	m := NewManager(nil, t.TempDir(), t.TempDir(), 0)
+	port := freePort(t)
+	id := ledger.GatewayID("gateway1test")
+
+	defer m.removeGateway(id)
+
+	if err := m.addGateway(id, ledger.GatewayConfig{
+		Port: port,
+		Endpoints: []ledger.GatewayEndpointConfig{
+			{Method: "GET", Path: "/a", FunctionID: "fn1"},
+			{Method: "GET", Path: "/b", FunctionID: "fn1"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.updateGateway(id, ledger.GatewayConfig{
+		Port: port,
+		Endpoints: []ledger.GatewayEndpointConfig{
+			{Method: "POST", Path: "/c", FunctionID: "fn1"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/a", "/b"} {
+		if status := get(t, port, path); status != http.StatusNotFound {
+			t.Errorf("expected status 404 for removed endpoint GET %s, got %d", path, status)
+		}
+	}
+}
+
+func TestUpdateGatewayPort(t *testing.T) {
+	m := NewManager(nil, t.TempDir(), t.TempDir(), 0)
+	oldPort := freePort(t)
+	newPort := freePort(t)
+	id := ledger.GatewayID("gateway1test")
+
+	defer m.removeGateway(id)
+
+	endpoints := []ledger.GatewayEndpointConfig{
+		{Method: "GET", Path: "/a", FunctionID: "fn1"},
+	}
+
+	if err := m.addGateway(id, ledger.GatewayConfig{Port: oldPort, Endpoints: endpoints}); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := get(t, oldPort, "/unknown"); status != http.StatusNotFound {
+		t.Fatalf("expected status 404 on old port, got %d", status)
+	}
+
+	if err := m.updateGateway(id, ledger.GatewayConfig{Port: newPort, Endpoints: endpoints}); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Gateways[id].Port != newPort {
+		t.Fatalf("expected gateway port %d, got %d", newPort, m.Gateways[id].Port)
+	}
+
+	// the new listener is ready as soon as updateGateway returns
+	if status := get(t, newPort, "/unknown"); status != http.StatusNotFound {
+		t.Fatalf("expected status 404 on new port, got %d", status)
+	}
+
+	// the old listener is drained in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", oldPort))
+		if err != nil {
+			break
+		}
+
+		conn.Close()
+
+		if time.Now().After(deadline) {
+			t.Fatalf("old port %d still accepting connections", oldPort)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpdateGatewayPortInUse(t *testing.T) {
+	m := NewManager(nil, t.TempDir(), t.TempDir(), 0)
+	port := freePort(t)
+	id := ledger.GatewayID("gateway1test")
+
+	defer m.removeGateway(id)
+
+	if err := m.addGateway(id, ledger.GatewayConfig{Port: port}); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	usedPort := ledger.Port(ln.Addr().(*net.TCPAddr).Port)
+
+	if err := m.updateGateway(id, ledger.GatewayConfig{Port: usedPort}); err == nil {
+		t.Fatalf("expected error when moving to port %d which is in use", usedPort)
+	}
+
+	// the gateway keeps serving on its previous port
+	if m.Gateways[id].Port != port {
+		t.Fatalf("expected gateway to remain on port %d, got %d", port, m.Gateways[id].Port)
+	}
+
+	if status := get(t, port, "/unknown"); status != http.StatusNotFound {
+		t.Fatalf("expected status 404 on previous port, got %d", status)
+	}
+}
+
+func freePort(t *testing.T) ledger.Port {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	return ledger.Port(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func get(t *testing.T, port ledger.Port, path string) int {
+	t.Helper()
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	return resp.StatusCode
+}
@@ -2,6 +2,8 @@ package resources
 
 import (
 	"net/http"
+	"sync"
+	"text/template"
 
 	"ows/ledger"
 )
@@ -9,12 +11,25 @@ import (
 type Manager struct {
 	Current   *ledger.KeyPair
 	AssetsDir string
+	LogsDir   string // gateway access logs and stats are written here, disabled if empty
 	Functions map[ledger.FunctionID]*Function
 	Gateways  map[ledger.GatewayID]*Gateway
 	Nodes     map[ledger.NodeID]*Node
+	Runtime   FunctionRuntime
 
-	portOffset        int
-	dockerInitialized bool // TODO: this should be moved into an Images or Containers field
+	portOffset         int
+	runtimeInitialized bool
+	jwks               *jwksCache
+	nonces             *nonceCache
+	limits             *rateLimiters
+
+	// Sync calls are serialized by syncMutex. The fields below are read by the
+	// gateway and API goroutines, so Sync only changes them while holding
+	// mutex: the snapshot, the Functions and Gateways maps, and the Port and
+	// Server of each Gateway.
+	syncMutex sync.Mutex
+	mutex     sync.RWMutex
+	snapshot  *ledger.Snapshot // copy of the latest synced ledger state, used by authorizers
 }
 
 type Function struct {
@@ -27,34 +42,73 @@ type Gateway struct {
 	Server  *http.Server
 }
 
+// The fields below mutex are replaced as a whole when the gateway is updated,
+// and must only be accessed while holding the mutex.
 type GatewayHandler struct {
-	Manager *Manager // need access to manager to be able to run functions and fetch assets
+	GatewayID ledger.GatewayID
+	Manager   *Manager // need access to manager to be able to run functions and fetch assets
+
+	mutex sync.RWMutex
 	// first key is method: "GET", "POST", "DELETE", "PUT", "PATCH"
 	// second key is relative path, including initial slash (eg. "/assets")
 	Endpoints map[string]map[string]*GatewayEndpoint
+
+	RateLimit    *ledger.RateLimitConfig
+	APIKeyQuotas []ledger.APIKeyQuotaConfig
+	CORS         *ledger.CORSConfig
+
+	logs *gatewayLogs // nil if the manager has no LogsDir
 }
 
 type GatewayEndpoint struct {
 	Config ledger.GatewayEndpointConfig
+
+	// parsed Config.Transform templates, nil if not set
+	requestTemplate  *template.Template
+	responseTemplate *template.Template
+
+	// set if one of the templates couldn't be parsed
+	templateErr error
 }
 
 type Node struct {
 	Config ledger.NodeConfig
 }
 
-func NewManager(current *ledger.KeyPair, assetsDir string, portOffset int) *Manager {
-	return &Manager{
-		Current:           current,
-		AssetsDir:         assetsDir,
-		Functions:         map[ledger.FunctionID]*Function{},
-		Gateways:          map[ledger.GatewayID]*Gateway{},
-		Nodes:             map[ledger.NodeID]*Node{},
-		portOffset:        portOffset,
-		dockerInitialized: false,
+// Functions are run in Docker, unless the Runtime field is replaced before the
+// first sync.
+func NewManager(current *ledger.KeyPair, assetsDir string, logsDir string, portOffset int) *Manager {
+	m := &Manager{
+		Current:            current,
+		AssetsDir:          assetsDir,
+		LogsDir:            logsDir,
+		Functions:          map[ledger.FunctionID]*Function{},
+		Gateways:           map[ledger.GatewayID]*Gateway{},
+		Nodes:              map[ledger.NodeID]*Node{},
+		portOffset:         portOffset,
+		runtimeInitialized: false,
+		jwks:               newJWKSCache(),
+		nonces:             newNonceCache(),
+		limits:             newRateLimiters(),
 	}
+
+	m.Runtime = &dockerRuntime{m}
+
+	return m
 }
 
+// The snapshot is copied, because the ledger keeps modifying it while the
+// gateways are serving requests.
 func (m *Manager) Sync(snapshot *ledger.Snapshot) error {
+	m.syncMutex.Lock()
+	defer m.syncMutex.Unlock()
+
+	snapshot = snapshot.Copy()
+
+	m.mutex.Lock()
+	m.snapshot = snapshot
+	m.mutex.Unlock()
+
 	if err := m.SyncFunctions(snapshot.Functions); err != nil {
 		return err
 	}
@@ -69,3 +123,22 @@ func (m *Manager) Sync(snapshot *ledger.Snapshot) error {
 
 	return nil
 }
+
+// Returns the head of the snapshot of the latest sync, so that callers can
+// wait for the resources to catch up with the ledger.
+func (m *Manager) SyncedHead() ledger.ChangeSetID {
+	if s := m.currentSnapshot(); s != nil {
+		return s.Head
+	}
+
+	return ""
+}
+
+// Returns the snapshot of the latest sync, which mustn't be modified. Returns
+// nil before the first sync.
+func (m *Manager) currentSnapshot() *ledger.Snapshot {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.snapshot
+}
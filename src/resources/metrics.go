@@ -0,0 +1,22 @@
+package resources
+
+import (
+	"ows/metrics"
+	"ows/network"
+)
+
+var (
+	functionInvocations = metrics.Default.NewCounter("ows_function_invocations_total", "Number of function invocations", "function")
+	functionErrors      = metrics.Default.NewCounter("ows_function_errors_total", "Number of failed function invocations", "function")
+	functionDuration    = metrics.Default.NewHistogram("ows_function_duration_seconds", "Duration of function invocations", metrics.DefaultBuckets, "function")
+	gatewayRequests     = metrics.Default.NewCounter("ows_gateway_requests_total", "Number of gateway requests, unmatched requests have an empty method and path", "gateway", "method", "path", "status")
+)
+
+func recordGatewayRequest(h *GatewayHandler, endpoint *GatewayEndpoint, status int) {
+	method, path := "", ""
+	if endpoint != nil {
+		method, path = endpoint.Config.Method, endpoint.Config.Path
+	}
+
+	gatewayRequests.With(string(h.GatewayID), method, path, network.StatusClass(status)).Inc()
+}
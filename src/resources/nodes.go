@@ -10,9 +10,23 @@ import (
 )
 
 func (m *Manager) CurrentNodeID() ledger.NodeID {
+	if id, ok := ledger.FindNode(m.nodeConfigs(), m.Current.Public); ok {
+		return id
+	}
+
 	return m.Current.Public.NodeID()
 }
 
+func (m *Manager) nodeConfigs() map[ledger.NodeID]ledger.NodeConfig {
+	configs := make(map[ledger.NodeID]ledger.NodeConfig, len(m.Nodes))
+
+	for id, n := range m.Nodes {
+		configs[id] = n.Config
+	}
+
+	return configs
+}
+
 func (m *Manager) OtherNodeIDs() []ledger.NodeID {
 	nodeIDs := make([]ledger.NodeID, 0)
 	currentID := m.CurrentNodeID()
@@ -36,7 +50,7 @@ func (m *Manager) NewNodeAPIClient(id ledger.NodeID) (*network.NodeAPIClient, er
 		return nil, fmt.Errorf("node %s not found", id)
 	}
 
-	return network.NewNodeAPIClient(m.Current, n.Config.Address, n.Config.APIPort, m.Nodes), nil
+	return network.NewNodeAPIClient(m.Current, n.Config.Address, n.Config.APIPort, m.nodeConfigs()), nil
 }
 
 func (m *Manager) SyncNodes(nodes map[ledger.NodeID]ledger.NodeConfig) error {
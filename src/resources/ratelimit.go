@@ -0,0 +1,202 @@
+package resources
+
+import (
+	"encoding/hex"
+	"math"
+	"sync"
+	"time"
+
+	"ows/ledger"
+	"ows/network"
+)
+
+// Interval at which the node gossips the consumption of cluster-wide rate
+// limits and quotas.
+const RateLimitUsageInterval = 2 * time.Second
+
+// Keeps the state of all the rate limits and quotas of all the gateways.
+//
+// The limiters are keyed by:
+//   - "<gateway-id>" for gateway-wide rate limits
+//   - "<gateway-id> <method> <path>" for endpoint rate limits
+//   - "<gateway-id> <api-key-digest-hex>" for API key quotas
+type rateLimiters struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	quotas  map[string]*quotaCounter
+
+	// local consumption of cluster-wide limits since the last call to
+	// `takeUsage()`
+	usage map[rateLimitUsageKey]uint
+}
+
+type rateLimitUsageKey struct {
+	key    string
+	window int64
+}
+
+type tokenBucket struct {
+	config ledger.RateLimitConfig
+	tokens float64
+	last   time.Time
+}
+
+// Fixed window counter
+type quotaCounter struct {
+	config ledger.APIKeyQuotaConfig
+	window int64
+	count  uint
+}
+
+func newRateLimiters() *rateLimiters {
+	return &rateLimiters{
+		buckets: map[string]*tokenBucket{},
+		quotas:  map[string]*quotaCounter{},
+		usage:   map[rateLimitUsageKey]uint{},
+	}
+}
+
+func gatewayRateLimitKey(id ledger.GatewayID) string {
+	return string(id)
+}
+
+func endpointRateLimitKey(id ledger.GatewayID, method string, path string) string {
+	return string(id) + " " + method + " " + path
+}
+
+func apiKeyQuotaKey(id ledger.GatewayID, digest []byte) string {
+	return string(id) + " " + hex.EncodeToString(digest)
+}
+
+// Consumes a token from the bucket. If no token is available, the duration
+// after which a token will be available is returned.
+func (l *rateLimiters) allow(key string, config ledger.RateLimitConfig, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{config, float64(config.Burst), now}
+		l.buckets[key] = b
+	} else if b.config != config {
+		b.config = config
+		b.tokens = math.Min(b.tokens, float64(config.Burst))
+	}
+
+	b.refill(now)
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / config.Rate * float64(time.Second))
+	}
+
+	b.tokens -= 1
+
+	if config.Cluster {
+		l.usage[rateLimitUsageKey{key, now.Unix()}] += 1
+	}
+
+	return true, 0
+}
+
+// Counts a request made with the API key. If the quota of the current period
+// has been exhausted, the duration until the next period is returned.
+func (l *rateLimiters) allowQuota(key string, config ledger.APIKeyQuotaConfig, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	period := int64(config.Period)
+	window := now.Unix() / period
+
+	q, ok := l.quotas[key]
+	if !ok {
+		q = &quotaCounter{config: config, window: window}
+		l.quotas[key] = q
+	}
+
+	q.config = config
+
+	if q.window != window {
+		q.window = window
+		q.count = 0
+	}
+
+	if q.count >= config.Limit {
+		next := time.Unix((window+1)*period, 0)
+		return false, next.Sub(now)
+	}
+
+	q.count += 1
+
+	if config.Cluster {
+		l.usage[rateLimitUsageKey{key, window}] += 1
+	}
+
+	return true, 0
+}
+
+// Returns the local consumption of cluster-wide limits since the previous
+// call, and resets it.
+func (l *rateLimiters) takeUsage() []network.RateLimitUsage {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	usage := make([]network.RateLimitUsage, 0, len(l.usage))
+
+	for k, count := range l.usage {
+		usage = append(usage, network.RateLimitUsage{
+			Key:    k.key,
+			Window: k.window,
+			Count:  count,
+		})
+	}
+
+	l.usage = map[rateLimitUsageKey]uint{}
+
+	return usage
+}
+
+// Applies the consumption of other nodes to the local buckets and quota
+// counters.
+func (l *rateLimiters) addUsage(usage []network.RateLimitUsage, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, u := range usage {
+		if b, ok := l.buckets[u.Key]; ok && b.config.Cluster {
+			b.refill(now)
+
+			// a large remote burst can't block the bucket for longer than it
+			// takes to refill it once
+			b.tokens = math.Max(b.tokens-float64(u.Count), -float64(b.config.Burst))
+		}
+
+		if q, ok := l.quotas[u.Key]; ok && q.config.Cluster {
+			if q.window == u.Window {
+				q.count += u.Count
+			} else if q.window < u.Window {
+				q.window = u.Window
+				q.count = u.Count
+			}
+		}
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(b.config.Burst), b.tokens+elapsed*b.config.Rate)
+		b.last = now
+	}
+}
+
+// Returns the local consumption of cluster-wide rate limits and quotas since
+// the previous call. The node is responsible for gossiping it to the other
+// nodes.
+func (m *Manager) TakeRateLimitUsage() []network.RateLimitUsage {
+	return m.limits.takeUsage()
+}
+
+// Applies the cluster-wide rate limit consumption received from another node.
+func (m *Manager) AddRateLimitUsage(usage []network.RateLimitUsage) {
+	m.limits.addUsage(usage, time.Now())
+}
@@ -0,0 +1,196 @@
+package resources
+
+import (
+	"testing"
+	"time"
+
+	"ows/ledger"
+	"ows/network"
+)
+
+func TestTokenBucket(t *testing.T) {
+	l := newRateLimiters()
+	config := ledger.RateLimitConfig{Rate: 2, Burst: 3}
+	now := time.Unix(1700000000, 0)
+
+	steps := []struct {
+		name    string
+		elapsed time.Duration
+		allowed bool
+		retry   time.Duration
+	}{
+		{"burst 1", 0, true, 0},
+		{"burst 2", 0, true, 0},
+		{"burst 3", 0, true, 0},
+		{"exhausted", 0, false, 500 * time.Millisecond},
+		{"partially refilled", 250 * time.Millisecond, false, 250 * time.Millisecond},
+		{"refilled", 250 * time.Millisecond, true, 0},
+		{"exhausted again", 0, false, 500 * time.Millisecond},
+		{"capped at burst 1", time.Hour, true, 0},
+		{"capped at burst 2", 0, true, 0},
+		{"capped at burst 3", 0, true, 0},
+		{"capped at burst 4", 0, false, 500 * time.Millisecond},
+	}
+
+	for _, s := range steps {
+		now = now.Add(s.elapsed)
+
+		allowed, retry := l.allow("gateway1", config, now)
+		if allowed != s.allowed || retry != s.retry {
+			t.Fatalf("%s: expected (%v, %s), got (%v, %s)", s.name, s.allowed, s.retry, allowed, retry)
+		}
+	}
+
+	// lowering the burst drops the excess tokens
+	now = now.Add(time.Hour)
+	config.Burst = 1
+
+	if allowed, _ := l.allow("gateway1", config, now); !allowed {
+		t.Fatalf("expected request to be allowed")
+	}
+
+	if allowed, _ := l.allow("gateway1", config, now); allowed {
+		t.Fatalf("expected request to be refused after lowering the burst")
+	}
+
+	// buckets are independent
+	if allowed, _ := l.allow("gateway2", config, now); !allowed {
+		t.Fatalf("expected request to other bucket to be allowed")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	l := newRateLimiters()
+	config := ledger.APIKeyQuotaConfig{Limit: 2, Period: 60}
+	start := time.Unix(1700000040, 0) // 1700000040 is a multiple of 60
+
+	steps := []struct {
+		name    string
+		elapsed time.Duration
+		allowed bool
+		retry   time.Duration
+	}{
+		{"first", 0, true, 0},
+		{"second", 10 * time.Second, true, 0},
+		{"exhausted", 10 * time.Second, false, 40 * time.Second},
+		{"next window", 40 * time.Second, true, 0},
+		{"next window second", 0, true, 0},
+		{"next window exhausted", 59 * time.Second, false, time.Second},
+	}
+
+	now := start
+
+	for _, s := range steps {
+		now = now.Add(s.elapsed)
+
+		allowed, retry := l.allowQuota("gateway1 00", config, now)
+		if allowed != s.allowed || retry != s.retry {
+			t.Fatalf("%s: expected (%v, %s), got (%v, %s)", s.name, s.allowed, s.retry, allowed, retry)
+		}
+	}
+
+	// raising the limit applies to the current window
+	config.Limit = 3
+
+	if allowed, _ := l.allowQuota("gateway1 00", config, now); !allowed {
+		t.Fatalf("expected request to be allowed after raising the limit")
+	}
+}
+
+func TestTakeUsage(t *testing.T) {
+	l := newRateLimiters()
+	now := time.Unix(1700000040, 0)
+
+	local := ledger.RateLimitConfig{Rate: 1, Burst: 10}
+	cluster := ledger.RateLimitConfig{Rate: 1, Burst: 10, Cluster: true}
+	quota := ledger.APIKeyQuotaConfig{Limit: 10, Period: 60, Cluster: true}
+
+	l.allow("local", local, now)
+	l.allow("cluster", cluster, now)
+	l.allow("cluster", cluster, now)
+	l.allow("cluster", cluster, now.Add(time.Second))
+	l.allowQuota("quota", quota, now)
+
+	expected := map[network.RateLimitUsage]bool{
+		{Key: "cluster", Window: now.Unix(), Count: 2}:     true,
+		{Key: "cluster", Window: now.Unix() + 1, Count: 1}: true,
+		{Key: "quota", Window: now.Unix() / 60, Count: 1}:  true,
+	}
+
+	usage := l.takeUsage()
+	if len(usage) != len(expected) {
+		t.Fatalf("expected %d usage entries, got %v", len(expected), usage)
+	}
+
+	for _, u := range usage {
+		if !expected[u] {
+			t.Fatalf("unexpected usage %v", u)
+		}
+	}
+
+	if usage := l.takeUsage(); len(usage) != 0 {
+		t.Fatalf("expected usage to be reset, got %v", usage)
+	}
+}
+
+// Two nodes share a cluster-wide rate limit and quota through their usage.
+func TestAddUsage(t *testing.T) {
+	a := newRateLimiters()
+	b := newRateLimiters()
+	now := time.Unix(1700000040, 0)
+
+	bucket := ledger.RateLimitConfig{Rate: 1, Burst: 4, Cluster: true}
+	quota := ledger.APIKeyQuotaConfig{Limit: 4, Period: 60, Cluster: true}
+	local := ledger.RateLimitConfig{Rate: 1, Burst: 4}
+
+	// b must know the limits before it can apply remote usage
+	b.allow("bucket", bucket, now)
+	b.allowQuota("quota", quota, now)
+	b.allow("local", local, now)
+	b.takeUsage()
+
+	for range 3 {
+		a.allow("bucket", bucket, now)
+		a.allowQuota("quota", quota, now)
+		a.allow("local", local, now)
+	}
+
+	usage := a.takeUsage()
+
+	// gossiping the same usage under a local key has no effect
+	usage = append(usage, network.RateLimitUsage{Key: "local", Window: now.Unix(), Count: 3})
+
+	b.addUsage(usage, now)
+
+	if allowed, _ := b.allow("bucket", bucket, now); allowed {
+		t.Fatalf("expected cluster bucket to be exhausted")
+	}
+
+	if allowed, _ := b.allowQuota("quota", quota, now); allowed {
+		t.Fatalf("expected cluster quota to be exhausted")
+	}
+
+	if allowed, _ := b.allow("local", local, now); !allowed {
+		t.Fatalf("expected local bucket to be unaffected by remote usage")
+	}
+
+	// a large remote burst only blocks the bucket until it is refilled once
+	b.addUsage([]network.RateLimitUsage{{Key: "bucket", Window: now.Unix(), Count: 1000}}, now)
+
+	if allowed, _ := b.allow("bucket", bucket, now.Add(8*time.Second)); !allowed {
+		t.Fatalf("expected bucket to be refilled")
+	}
+
+	// usage of a later window replaces the count, earlier windows are ignored
+	later := now.Add(time.Minute)
+	b.addUsage([]network.RateLimitUsage{{Key: "quota", Window: later.Unix() / 60, Count: 3}}, later)
+	b.addUsage([]network.RateLimitUsage{{Key: "quota", Window: now.Unix() / 60, Count: 3}}, later)
+
+	if allowed, _ := b.allowQuota("quota", quota, later); !allowed {
+		t.Fatalf("expected quota to be allowed in the next window")
+	}
+
+	if allowed, _ := b.allowQuota("quota", quota, later); allowed {
+		t.Fatalf("expected quota of the next window to be exhausted")
+	}
+}
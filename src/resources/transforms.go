@@ -0,0 +1,276 @@
+package resources
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"ows/ledger"
+)
+
+// Default argument passed to functions invoked by endpoints without a request
+// template.
+const defaultFunctionArg = "hello world"
+
+// Request bodies larger than this are rejected by endpoints with a request
+// template.
+const maxTransformBodySize = 1 << 20
+
+// Templates are only checked structurally by the ledger, so they can still
+// fail to parse here. In that case the endpoint is kept, but its requests fail.
+func newGatewayEndpoint(config ledger.GatewayEndpointConfig) *GatewayEndpoint {
+	ep := &GatewayEndpoint{
+		Config: config,
+	}
+
+	if t := config.Transform; t != nil {
+		var err error
+
+		if t.RequestTemplate != "" {
+			ep.requestTemplate, err = parseTransformTemplate("request", t.RequestTemplate)
+			if err != nil {
+				ep.templateErr = fmt.Errorf("invalid request template of %s %s (%v)", config.Method, config.Path, err)
+			}
+		}
+
+		if t.ResponseTemplate != "" && ep.templateErr == nil {
+			ep.responseTemplate, err = parseTransformTemplate("response", t.ResponseTemplate)
+			if err != nil {
+				ep.templateErr = fmt.Errorf("invalid response template of %s %s (%v)", config.Method, config.Path, err)
+			}
+		}
+
+		if ep.templateErr != nil {
+			log.Printf("%v\n", ep.templateErr)
+		}
+	}
+
+	return ep
+}
+
+// Parses a gateway endpoint request or response template (see
+// `ledger.TransformConfig`).
+func parseTransformTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			bs, err := json.Marshal(v)
+			if err != nil {
+				return "", err
+			}
+
+			return string(bs), nil
+		},
+	}).Option("missingkey=zero").Parse(text)
+}
+
+// Applies the request header policy, and renders the request template into the
+// function argument.
+func (ep *GatewayEndpoint) functionArg(r *http.Request) (any, error) {
+	if t := ep.Config.Transform; t != nil {
+		applyHeaderPolicy(r.Header, t.SetRequestHeaders, t.RemoveRequestHeaders)
+	}
+
+	if ep.requestTemplate == nil {
+		return defaultFunctionArg, nil
+	}
+
+	body, err := readRequestBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := ep.requestTemplate.Execute(&buf, map[string]any{
+		"Method":  r.Method,
+		"Path":    r.URL.Path,
+		"Headers": flattenValues(r.Header),
+		"Query":   flattenValues(r.URL.Query()),
+		"Body":    body,
+	}); err != nil {
+		return nil, fmt.Errorf("request template failed (%v)", err)
+	}
+
+	var arg any
+	if err := json.Unmarshal(buf.Bytes(), &arg); err != nil {
+		return nil, fmt.Errorf("request template didn't render valid JSON (%v)", err)
+	}
+
+	return arg, nil
+}
+
+// Applies the response header policy, and writes the function result, either
+// rendered using the response template or encoded as JSON.
+func (ep *GatewayEndpoint) writeResponse(w http.ResponseWriter, result any) {
+	var body []byte
+
+	if ep.responseTemplate != nil {
+		var buf bytes.Buffer
+		if err := ep.responseTemplate.Execute(&buf, map[string]any{
+			"Result": result,
+		}); err != nil {
+			http.Error(w, fmt.Sprintf("response template failed (%v)", err), 500)
+			return
+		}
+
+		body = buf.Bytes()
+	} else {
+		var err error
+		body, err = json.Marshal(result)
+		if err != nil {
+			http.Error(w, "bad response", 500)
+			return
+		}
+	}
+
+	if t := ep.Config.Transform; t != nil {
+		applyHeaderPolicy(w.Header(), t.SetResponseHeaders, t.RemoveResponseHeaders)
+	}
+
+	w.Write(body)
+}
+
+// JSON bodies are decoded, other bodies are returned as a string.
+func readRequestBody(r *http.Request) (any, error) {
+	bs, err := io.ReadAll(io.LimitReader(r.Body, maxTransformBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read request body (%v)", err)
+	}
+
+	if len(bs) > maxTransformBodySize {
+		return nil, fmt.Errorf("request body larger than %d bytes", maxTransformBodySize)
+	}
+
+	if len(bs) == 0 {
+		return nil, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		var body any
+		if err := json.Unmarshal(bs, &body); err != nil {
+			return nil, fmt.Errorf("invalid JSON body (%v)", err)
+		}
+
+		return body, nil
+	}
+
+	return string(bs), nil
+}
+
+func applyHeaderPolicy(h http.Header, set []ledger.HeaderValue, remove []string) {
+	for _, name := range remove {
+		h.Del(name)
+	}
+
+	for _, hv := range set {
+		h.Set(hv.Name, hv.Value)
+	}
+}
+
+// Only the first value of each key is kept.
+func flattenValues(values map[string][]string) map[string]string {
+	flat := map[string]string{}
+
+	for k, vs := range values {
+		if len(vs) > 0 {
+			flat[k] = vs[0]
+		}
+	}
+
+	return flat
+}
+
+// Sets the CORS response headers if the request origin is allowed. Returns
+// true if the request was a preflight request, in which case the response has
+// been fully written.
+func serveCORS(w http.ResponseWriter, r *http.Request, c *ledger.CORSConfig, endpoints map[string]map[string]*GatewayEndpoint) bool {
+	origin := r.Header.Get("Origin")
+	requestedMethod := r.Header.Get("Access-Control-Request-Method")
+	isPreflight := r.Method == http.MethodOptions && requestedMethod != ""
+
+	w.Header().Add("Vary", "Origin")
+
+	if !slices.Contains(c.AllowOrigins, "*") && !slices.Contains(c.AllowOrigins, origin) {
+		if isPreflight {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+		}
+
+		return isPreflight
+	}
+
+	if slices.Contains(c.AllowOrigins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if c.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !isPreflight {
+		if len(c.ExposeHeaders) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+		}
+
+		return false
+	}
+
+	methods := c.AllowMethods
+	if len(methods) == 0 {
+		methods = pathMethods(endpoints, r.URL.Path)
+	}
+
+	if !slices.Contains(methods, requestedMethod) {
+		http.Error(w, "method not allowed", http.StatusForbidden)
+		return true
+	}
+
+	for _, name := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		name = strings.TrimSpace(name)
+
+		if name != "" && !slices.ContainsFunc(c.AllowHeaders, func(allowed string) bool {
+			return strings.EqualFold(allowed, name)
+		}) {
+			http.Error(w, fmt.Sprintf("header %s not allowed", name), http.StatusForbidden)
+			return true
+		}
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+
+	if len(c.AllowHeaders) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.AllowHeaders, ", "))
+	}
+
+	if c.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge)))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return true
+}
+
+// Sorted methods of the endpoints defined at the given path
+func pathMethods(allEndpoints map[string]map[string]*GatewayEndpoint, path string) []string {
+	methods := []string{}
+
+	for method, endpoints := range allEndpoints {
+		if _, ok := endpoints[path]; ok {
+			methods = append(methods, method)
+		}
+	}
+
+	slices.Sort(methods)
+
+	return methods
+}
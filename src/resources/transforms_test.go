@@ -0,0 +1,299 @@
+package resources
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"ows/ledger"
+)
+
+func TestTransformRequest(t *testing.T) {
+	ep := newGatewayEndpoint(ledger.GatewayEndpointConfig{
+		Method: "POST",
+		Path:   "/hello",
+		Transform: &ledger.TransformConfig{
+			RemoveRequestHeaders: []string{"Authorization"},
+			SetRequestHeaders:    []ledger.HeaderValue{{Name: "X-Env", Value: "test"}},
+			RequestTemplate:      `{"method": {{json .Method}}, "name": {{json .Query.name}}, "env": {{json (index .Headers "X-Env")}}, "auth": {{json (index .Headers "Authorization")}}, "body": {{json .Body}}}`,
+		},
+	})
+
+	if ep.templateErr != nil {
+		t.Fatal(ep.templateErr)
+	}
+
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		expected    any
+	}{
+		{"json body", "application/json", `{"a": [1, 2]}`, map[string]any{"a": []any{1.0, 2.0}}},
+		{"json suffix", "application/ld+json; charset=utf-8", `"x"`, "x"},
+		{"text body", "text/plain", `{"a": 1}`, `{"a": 1}`},
+		{"empty body", "", "", nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/hello?name=world", strings.NewReader(c.body))
+			r.Header.Set("Content-Type", c.contentType)
+			r.Header.Set("Authorization", "Bearer secret")
+
+			arg, err := ep.functionArg(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := map[string]any{
+				"method": "POST",
+				"name":   "world",
+				"env":    "test",
+				"auth":   "",
+				"body":   c.expected,
+			}
+
+			// the header policy is applied before the template is rendered
+			if !reflect.DeepEqual(arg, expected) {
+				t.Fatalf("expected %v, got %v", expected, arg)
+			}
+
+			if r.Header.Get("Authorization") != "" || r.Header.Get("X-Env") != "test" {
+				t.Fatalf("header policy not applied (%v)", r.Header)
+			}
+		})
+	}
+}
+
+func TestTransformRequestErrors(t *testing.T) {
+	ep := newGatewayEndpoint(ledger.GatewayEndpointConfig{
+		Method:    "POST",
+		Path:      "/hello",
+		Transform: &ledger.TransformConfig{RequestTemplate: `{{.Body}}`},
+	})
+
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"invalid json body", "application/json", `{`},
+		{"template renders invalid json", "text/plain", `not json`},
+		{"body too large", "text/plain", strings.Repeat("1", maxTransformBodySize+1)},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/hello", strings.NewReader(c.body))
+			r.Header.Set("Content-Type", c.contentType)
+
+			if _, err := ep.functionArg(r); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+
+	// without a request template the default argument is used
+	ep = newGatewayEndpoint(ledger.GatewayEndpointConfig{Method: "GET", Path: "/hello"})
+
+	arg, err := ep.functionArg(httptest.NewRequest("GET", "/hello", nil))
+	if err != nil || arg != defaultFunctionArg {
+		t.Fatalf("expected default argument, got %v (%v)", arg, err)
+	}
+}
+
+func TestTransformResponse(t *testing.T) {
+	cases := []struct {
+		name      string
+		transform *ledger.TransformConfig
+		body      string
+		headers   map[string]string
+	}{
+		{"json", nil, `{"n":1}`, map[string]string{}},
+		{
+			"template",
+			&ledger.TransformConfig{
+				ResponseTemplate:      `n={{.Result.n}} missing={{.Result.missing}}`,
+				SetResponseHeaders:    []ledger.HeaderValue{{Name: "Content-Type", Value: "text/plain"}},
+				RemoveResponseHeaders: []string{"X-Internal"},
+			},
+			`n=1 missing=<no value>`,
+			map[string]string{"Content-Type": "text/plain", "X-Internal": ""},
+		},
+		{
+			"failing template",
+			&ledger.TransformConfig{ResponseTemplate: `{{.Result.n.x}}`},
+			"response template failed",
+			map[string]string{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ep := newGatewayEndpoint(ledger.GatewayEndpointConfig{Method: "GET", Path: "/", Transform: c.transform})
+
+			w := httptest.NewRecorder()
+			w.Header().Set("X-Internal", "1")
+
+			ep.writeResponse(w, map[string]any{"n": 1})
+
+			if body := strings.TrimSpace(w.Body.String()); !strings.HasPrefix(body, c.body) {
+				t.Fatalf("expected body %q, got %q", c.body, body)
+			}
+
+			for name, value := range c.headers {
+				if got := w.Header().Get(name); got != value {
+					t.Fatalf("expected header %s %q, got %q", name, value, got)
+				}
+			}
+		})
+	}
+}
+
+func TestTransformInvalidTemplate(t *testing.T) {
+	ep := newGatewayEndpoint(ledger.GatewayEndpointConfig{
+		Method:    "GET",
+		Path:      "/hello",
+		Transform: &ledger.TransformConfig{RequestTemplate: `{{.Body`},
+	})
+
+	if ep.templateErr == nil {
+		t.Fatalf("expected template error")
+	}
+
+	h := &GatewayHandler{
+		Endpoints: map[string]map[string]*GatewayEndpoint{"GET": {"/hello": ep}},
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", w.Code)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	endpoints := map[string]map[string]*GatewayEndpoint{
+		"GET":  {"/a": {}},
+		"POST": {"/a": {}, "/b": {}},
+	}
+
+	strict := &ledger.CORSConfig{
+		AllowOrigins:     []string{"https://example.com"},
+		AllowHeaders:     []string{"Content-Type"},
+		ExposeHeaders:    []string{"X-Request-Id", "X-Other"},
+		MaxAge:           600,
+		AllowCredentials: true,
+	}
+
+	wildcard := &ledger.CORSConfig{
+		AllowOrigins: []string{"*"},
+		AllowMethods: []string{"GET"},
+	}
+
+	cases := []struct {
+		name      string
+		config    *ledger.CORSConfig
+		method    string
+		path      string
+		headers   map[string]string
+		preflight bool
+		status    int
+		expected  map[string]string
+	}{
+		{
+			"simple request", strict, "GET", "/a",
+			map[string]string{"Origin": "https://example.com"},
+			false, 200,
+			map[string]string{
+				"Access-Control-Allow-Origin":      "https://example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Expose-Headers":    "X-Request-Id, X-Other",
+				"Access-Control-Allow-Methods":     "",
+				"Vary":                             "Origin",
+			},
+		},
+		{
+			"simple request from other origin", strict, "GET", "/a",
+			map[string]string{"Origin": "https://evil.com"},
+			false, 200,
+			map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			"preflight", strict, "OPTIONS", "/a",
+			map[string]string{"Origin": "https://example.com", "Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "content-type"},
+			true, 204,
+			map[string]string{
+				"Access-Control-Allow-Origin":   "https://example.com",
+				"Access-Control-Allow-Methods":  "GET, POST",
+				"Access-Control-Allow-Headers":  "Content-Type",
+				"Access-Control-Max-Age":        "600",
+				"Access-Control-Expose-Headers": "",
+			},
+		},
+		{
+			"preflight methods of path", strict, "OPTIONS", "/b",
+			map[string]string{"Origin": "https://example.com", "Access-Control-Request-Method": "GET"},
+			true, 403,
+			map[string]string{},
+		},
+		{
+			"preflight from other origin", strict, "OPTIONS", "/a",
+			map[string]string{"Origin": "https://evil.com", "Access-Control-Request-Method": "GET"},
+			true, 403,
+			map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			"preflight with header not allowed", strict, "OPTIONS", "/a",
+			map[string]string{"Origin": "https://example.com", "Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "Content-Type, X-Custom"},
+			true, 403,
+			map[string]string{},
+		},
+		{
+			"wildcard", wildcard, "OPTIONS", "/b",
+			map[string]string{"Origin": "https://any.com", "Access-Control-Request-Method": "GET"},
+			true, 204,
+			map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Methods":     "GET",
+				"Access-Control-Allow-Credentials": "",
+				"Access-Control-Max-Age":           "",
+			},
+		},
+		{
+			"options without requested method isn't a preflight", wildcard, "OPTIONS", "/a",
+			map[string]string{"Origin": "https://any.com"},
+			false, 200,
+			map[string]string{"Access-Control-Allow-Origin": "*"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(c.method, c.path, nil)
+			for name, value := range c.headers {
+				r.Header.Set(name, value)
+			}
+
+			w := httptest.NewRecorder()
+
+			if preflight := serveCORS(w, r, c.config, endpoints); preflight != c.preflight {
+				t.Fatalf("expected preflight %v, got %v", c.preflight, preflight)
+			}
+
+			if w.Code != c.status {
+				t.Fatalf("expected status %d, got %d", c.status, w.Code)
+			}
+
+			for name, value := range c.expected {
+				if got := w.Header().Get(name); got != value {
+					t.Fatalf("expected header %s %q, got %q", name, value, got)
+				}
+			}
+		})
+	}
+}
@@ -2,6 +2,10 @@
 
 TEST_DIR="./tests"
 
+echo "Running unit tests"
+
+(cd ./src && go test -race ./...) || exit $?
+
 echo "Running integration tests in $TEST_DIR"
 
 cd $TEST_DIR
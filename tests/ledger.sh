@@ -5,6 +5,6 @@ ledger_summary() {
     OWS_PRIVATE_KEY=$client_private_key \
     OWS_INITIAL_CONFIG=$initial_config \
     ../dist/ows \
-        ledger list \
+        ledger list --only-ids \
         --test-dir $TEST_DIR
 }
\ No newline at end of file